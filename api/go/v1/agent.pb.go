@@ -498,11 +498,16 @@ func (x *GetConfigResponse) GetConfig() *AgentConfig {
 }
 
 type HISessionRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
-	ListenerId    string                 `protobuf:"bytes,2,opt,name=listener_id,json=listenerId,proto3" json:"listener_id,omitempty"`
-	SourceIp      string                 `protobuf:"bytes,3,opt,name=source_ip,json=sourceIp,proto3" json:"source_ip,omitempty"`
-	SourcePort    uint32                 `protobuf:"varint,4,opt,name=source_port,json=sourcePort,proto3" json:"source_port,omitempty"`
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	AgentId    string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	ListenerId string                 `protobuf:"bytes,2,opt,name=listener_id,json=listenerId,proto3" json:"listener_id,omitempty"`
+	SourceIp   string                 `protobuf:"bytes,3,opt,name=source_ip,json=sourceIp,proto3" json:"source_ip,omitempty"`
+	SourcePort uint32                 `protobuf:"varint,4,opt,name=source_port,json=sourcePort,proto3" json:"source_port,omitempty"`
+	// Module that escalated the connection mid-session; empty when the
+	// listener is high-interaction from the start.
+	EscalatedBy string `protobuf:"bytes,5,opt,name=escalated_by,json=escalatedBy,proto3" json:"escalated_by,omitempty"`
+	// Sandbox image the listener asks for; empty for the master's default.
+	SandboxImage  string `protobuf:"bytes,6,opt,name=sandbox_image,json=sandboxImage,proto3" json:"sandbox_image,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -565,6 +570,20 @@ func (x *HISessionRequest) GetSourcePort() uint32 {
 	return 0
 }
 
+func (x *HISessionRequest) GetEscalatedBy() string {
+	if x != nil {
+		return x.EscalatedBy
+	}
+	return ""
+}
+
+func (x *HISessionRequest) GetSandboxImage() string {
+	if x != nil {
+		return x.SandboxImage
+	}
+	return ""
+}
+
 type HISessionResponse struct {
 	state           protoimpl.MessageState `protogen:"open.v1"`
 	SessionId       string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
@@ -625,6 +644,120 @@ func (x *HISessionResponse) GetTunnelKey() []byte {
 	return nil
 }
 
+// Sent when a tunnel opened for RequestHISession closes. The master stops
+// the session once it has had no open tunnels for its idle timeout.
+type HISessionClosedRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	SessionId     string                 `protobuf:"bytes,2,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	SourcePort    uint32                 `protobuf:"varint,3,opt,name=source_port,json=sourcePort,proto3" json:"source_port,omitempty"`
+	Reason        string                 `protobuf:"bytes,4,opt,name=reason,proto3" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HISessionClosedRequest) Reset() {
+	*x = HISessionClosedRequest{}
+	mi := &file_v1_agent_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HISessionClosedRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HISessionClosedRequest) ProtoMessage() {}
+
+func (x *HISessionClosedRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v1_agent_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HISessionClosedRequest.ProtoReflect.Descriptor instead.
+func (*HISessionClosedRequest) Descriptor() ([]byte, []int) {
+	return file_v1_agent_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *HISessionClosedRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *HISessionClosedRequest) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *HISessionClosedRequest) GetSourcePort() uint32 {
+	if x != nil {
+		return x.SourcePort
+	}
+	return 0
+}
+
+func (x *HISessionClosedRequest) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+type HISessionClosedResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ok            bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HISessionClosedResponse) Reset() {
+	*x = HISessionClosedResponse{}
+	mi := &file_v1_agent_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HISessionClosedResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HISessionClosedResponse) ProtoMessage() {}
+
+func (x *HISessionClosedResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_v1_agent_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HISessionClosedResponse.ProtoReflect.Descriptor instead.
+func (*HISessionClosedResponse) Descriptor() ([]byte, []int) {
+	return file_v1_agent_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *HISessionClosedResponse) GetOk() bool {
+	if x != nil {
+		return x.Ok
+	}
+	return false
+}
+
 var File_v1_agent_proto protoreflect.FileDescriptor
 
 const file_v1_agent_proto_rawDesc = "" +
@@ -670,25 +803,37 @@ const file_v1_agent_proto_rawDesc = "" +
 	"\x0fcurrent_version\x18\x02 \x01(\tR\x0ecurrentVersion\"]\n" +
 	"\x11GetConfigResponse\x12\x18\n" +
 	"\aupdated\x18\x01 \x01(\bR\aupdated\x12.\n" +
-	"\x06config\x18\x02 \x01(\v2\x16.gimpel.v1.AgentConfigR\x06config\"\x8c\x01\n" +
+	"\x06config\x18\x02 \x01(\v2\x16.gimpel.v1.AgentConfigR\x06config\"\xd4\x01\n" +
 	"\x10HISessionRequest\x12\x19\n" +
 	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1f\n" +
 	"\vlistener_id\x18\x02 \x01(\tR\n" +
 	"listenerId\x12\x1b\n" +
 	"\tsource_ip\x18\x03 \x01(\tR\bsourceIp\x12\x1f\n" +
 	"\vsource_port\x18\x04 \x01(\rR\n" +
-	"sourcePort\"|\n" +
+	"sourcePort\x12!\n" +
+	"\fescalated_by\x18\x05 \x01(\tR\vescalatedBy\x12#\n" +
+	"\rsandbox_image\x18\x06 \x01(\tR\fsandboxImage\"|\n" +
 	"\x11HISessionResponse\x12\x1d\n" +
 	"\n" +
 	"session_id\x18\x01 \x01(\tR\tsessionId\x12)\n" +
 	"\x10sandbox_endpoint\x18\x02 \x01(\tR\x0fsandboxEndpoint\x12\x1d\n" +
 	"\n" +
-	"tunnel_key\x18\x03 \x01(\fR\ttunnelKey2\xb2\x02\n" +
+	"tunnel_key\x18\x03 \x01(\fR\ttunnelKey\"\x8b\x01\n" +
+	"\x16HISessionClosedRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x02 \x01(\tR\tsessionId\x12\x1f\n" +
+	"\vsource_port\x18\x03 \x01(\rR\n" +
+	"sourcePort\x12\x16\n" +
+	"\x06reason\x18\x04 \x01(\tR\x06reason\")\n" +
+	"\x17HISessionClosedResponse\x12\x0e\n" +
+	"\x02ok\x18\x01 \x01(\bR\x02ok2\x92\x03\n" +
 	"\fAgentControl\x12C\n" +
 	"\bRegister\x12\x1a.gimpel.v1.RegisterRequest\x1a\x1b.gimpel.v1.RegisterResponse\x12F\n" +
 	"\tGetConfig\x12\x1b.gimpel.v1.GetConfigRequest\x1a\x1c.gimpel.v1.GetConfigResponse\x12F\n" +
 	"\tHeartbeat\x12\x1b.gimpel.v1.HeartbeatRequest\x1a\x1c.gimpel.v1.HeartbeatResponse\x12M\n" +
-	"\x10RequestHISession\x12\x1b.gimpel.v1.HISessionRequest\x1a\x1c.gimpel.v1.HISessionResponseB5Z3github.com/nohaxxjustlags/gimpel/api/go/v1;gimpelv1b\x06proto3"
+	"\x10RequestHISession\x12\x1b.gimpel.v1.HISessionRequest\x1a\x1c.gimpel.v1.HISessionResponse\x12^\n" +
+	"\x15ReportHISessionClosed\x12!.gimpel.v1.HISessionClosedRequest\x1a\".gimpel.v1.HISessionClosedResponseB5Z3github.com/nohaxxjustlags/gimpel/api/go/v1;gimpelv1b\x06proto3"
 
 var (
 	file_v1_agent_proto_rawDescOnce sync.Once
@@ -702,36 +847,40 @@ func file_v1_agent_proto_rawDescGZIP() []byte {
 	return file_v1_agent_proto_rawDescData
 }
 
-var file_v1_agent_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_v1_agent_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
 var file_v1_agent_proto_goTypes = []any{
-	(*ListenerSpec)(nil),      // 0: gimpel.v1.ListenerSpec
-	(*ModuleSpec)(nil),        // 1: gimpel.v1.ModuleSpec
-	(*AgentConfig)(nil),       // 2: gimpel.v1.AgentConfig
-	(*RegisterRequest)(nil),   // 3: gimpel.v1.RegisterRequest
-	(*RegisterResponse)(nil),  // 4: gimpel.v1.RegisterResponse
-	(*GetConfigRequest)(nil),  // 5: gimpel.v1.GetConfigRequest
-	(*GetConfigResponse)(nil), // 6: gimpel.v1.GetConfigResponse
-	(*HISessionRequest)(nil),  // 7: gimpel.v1.HISessionRequest
-	(*HISessionResponse)(nil), // 8: gimpel.v1.HISessionResponse
-	nil,                       // 9: gimpel.v1.ModuleSpec.EnvEntry
-	(*HeartbeatRequest)(nil),  // 10: gimpel.v1.HeartbeatRequest
-	(*HeartbeatResponse)(nil), // 11: gimpel.v1.HeartbeatResponse
+	(*ListenerSpec)(nil),            // 0: gimpel.v1.ListenerSpec
+	(*ModuleSpec)(nil),              // 1: gimpel.v1.ModuleSpec
+	(*AgentConfig)(nil),             // 2: gimpel.v1.AgentConfig
+	(*RegisterRequest)(nil),         // 3: gimpel.v1.RegisterRequest
+	(*RegisterResponse)(nil),        // 4: gimpel.v1.RegisterResponse
+	(*GetConfigRequest)(nil),        // 5: gimpel.v1.GetConfigRequest
+	(*GetConfigResponse)(nil),       // 6: gimpel.v1.GetConfigResponse
+	(*HISessionRequest)(nil),        // 7: gimpel.v1.HISessionRequest
+	(*HISessionResponse)(nil),       // 8: gimpel.v1.HISessionResponse
+	(*HISessionClosedRequest)(nil),  // 9: gimpel.v1.HISessionClosedRequest
+	(*HISessionClosedResponse)(nil), // 10: gimpel.v1.HISessionClosedResponse
+	nil,                             // 11: gimpel.v1.ModuleSpec.EnvEntry
+	(*HeartbeatRequest)(nil),        // 12: gimpel.v1.HeartbeatRequest
+	(*HeartbeatResponse)(nil),       // 13: gimpel.v1.HeartbeatResponse
 }
 var file_v1_agent_proto_depIdxs = []int32{
-	9,  // 0: gimpel.v1.ModuleSpec.env:type_name -> gimpel.v1.ModuleSpec.EnvEntry
+	11, // 0: gimpel.v1.ModuleSpec.env:type_name -> gimpel.v1.ModuleSpec.EnvEntry
 	0,  // 1: gimpel.v1.ModuleSpec.listeners:type_name -> gimpel.v1.ListenerSpec
 	1,  // 2: gimpel.v1.AgentConfig.modules:type_name -> gimpel.v1.ModuleSpec
 	2,  // 3: gimpel.v1.GetConfigResponse.config:type_name -> gimpel.v1.AgentConfig
 	3,  // 4: gimpel.v1.AgentControl.Register:input_type -> gimpel.v1.RegisterRequest
 	5,  // 5: gimpel.v1.AgentControl.GetConfig:input_type -> gimpel.v1.GetConfigRequest
-	10, // 6: gimpel.v1.AgentControl.Heartbeat:input_type -> gimpel.v1.HeartbeatRequest
+	12, // 6: gimpel.v1.AgentControl.Heartbeat:input_type -> gimpel.v1.HeartbeatRequest
 	7,  // 7: gimpel.v1.AgentControl.RequestHISession:input_type -> gimpel.v1.HISessionRequest
-	4,  // 8: gimpel.v1.AgentControl.Register:output_type -> gimpel.v1.RegisterResponse
-	6,  // 9: gimpel.v1.AgentControl.GetConfig:output_type -> gimpel.v1.GetConfigResponse
-	11, // 10: gimpel.v1.AgentControl.Heartbeat:output_type -> gimpel.v1.HeartbeatResponse
-	8,  // 11: gimpel.v1.AgentControl.RequestHISession:output_type -> gimpel.v1.HISessionResponse
-	8,  // [8:12] is the sub-list for method output_type
-	4,  // [4:8] is the sub-list for method input_type
+	9,  // 8: gimpel.v1.AgentControl.ReportHISessionClosed:input_type -> gimpel.v1.HISessionClosedRequest
+	4,  // 9: gimpel.v1.AgentControl.Register:output_type -> gimpel.v1.RegisterResponse
+	6,  // 10: gimpel.v1.AgentControl.GetConfig:output_type -> gimpel.v1.GetConfigResponse
+	13, // 11: gimpel.v1.AgentControl.Heartbeat:output_type -> gimpel.v1.HeartbeatResponse
+	8,  // 12: gimpel.v1.AgentControl.RequestHISession:output_type -> gimpel.v1.HISessionResponse
+	10, // 13: gimpel.v1.AgentControl.ReportHISessionClosed:output_type -> gimpel.v1.HISessionClosedResponse
+	9,  // [9:14] is the sub-list for method output_type
+	4,  // [4:9] is the sub-list for method input_type
 	4,  // [4:4] is the sub-list for extension type_name
 	4,  // [4:4] is the sub-list for extension extendee
 	0,  // [0:4] is the sub-list for field type_name
@@ -749,7 +898,7 @@ func file_v1_agent_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_v1_agent_proto_rawDesc), len(file_v1_agent_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   10,
+			NumMessages:   12,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
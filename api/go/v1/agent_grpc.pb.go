@@ -19,10 +19,11 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	AgentControl_Register_FullMethodName         = "/gimpel.v1.AgentControl/Register"
-	AgentControl_GetConfig_FullMethodName        = "/gimpel.v1.AgentControl/GetConfig"
-	AgentControl_Heartbeat_FullMethodName        = "/gimpel.v1.AgentControl/Heartbeat"
-	AgentControl_RequestHISession_FullMethodName = "/gimpel.v1.AgentControl/RequestHISession"
+	AgentControl_Register_FullMethodName              = "/gimpel.v1.AgentControl/Register"
+	AgentControl_GetConfig_FullMethodName             = "/gimpel.v1.AgentControl/GetConfig"
+	AgentControl_Heartbeat_FullMethodName             = "/gimpel.v1.AgentControl/Heartbeat"
+	AgentControl_RequestHISession_FullMethodName      = "/gimpel.v1.AgentControl/RequestHISession"
+	AgentControl_ReportHISessionClosed_FullMethodName = "/gimpel.v1.AgentControl/ReportHISessionClosed"
 )
 
 // AgentControlClient is the client API for AgentControl service.
@@ -33,6 +34,7 @@ type AgentControlClient interface {
 	GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error)
 	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error)
 	RequestHISession(ctx context.Context, in *HISessionRequest, opts ...grpc.CallOption) (*HISessionResponse, error)
+	ReportHISessionClosed(ctx context.Context, in *HISessionClosedRequest, opts ...grpc.CallOption) (*HISessionClosedResponse, error)
 }
 
 type agentControlClient struct {
@@ -83,6 +85,16 @@ func (c *agentControlClient) RequestHISession(ctx context.Context, in *HISession
 	return out, nil
 }
 
+func (c *agentControlClient) ReportHISessionClosed(ctx context.Context, in *HISessionClosedRequest, opts ...grpc.CallOption) (*HISessionClosedResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HISessionClosedResponse)
+	err := c.cc.Invoke(ctx, AgentControl_ReportHISessionClosed_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // AgentControlServer is the server API for AgentControl service.
 // All implementations must embed UnimplementedAgentControlServer
 // for forward compatibility.
@@ -91,6 +103,7 @@ type AgentControlServer interface {
 	GetConfig(context.Context, *GetConfigRequest) (*GetConfigResponse, error)
 	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error)
 	RequestHISession(context.Context, *HISessionRequest) (*HISessionResponse, error)
+	ReportHISessionClosed(context.Context, *HISessionClosedRequest) (*HISessionClosedResponse, error)
 	mustEmbedUnimplementedAgentControlServer()
 }
 
@@ -113,6 +126,9 @@ func (UnimplementedAgentControlServer) Heartbeat(context.Context, *HeartbeatRequ
 func (UnimplementedAgentControlServer) RequestHISession(context.Context, *HISessionRequest) (*HISessionResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "method RequestHISession not implemented")
 }
+func (UnimplementedAgentControlServer) ReportHISessionClosed(context.Context, *HISessionClosedRequest) (*HISessionClosedResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ReportHISessionClosed not implemented")
+}
 func (UnimplementedAgentControlServer) mustEmbedUnimplementedAgentControlServer() {}
 func (UnimplementedAgentControlServer) testEmbeddedByValue()                      {}
 
@@ -206,6 +222,24 @@ func _AgentControl_RequestHISession_Handler(srv interface{}, ctx context.Context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _AgentControl_ReportHISessionClosed_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HISessionClosedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentControlServer).ReportHISessionClosed(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentControl_ReportHISessionClosed_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentControlServer).ReportHISessionClosed(ctx, req.(*HISessionClosedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // AgentControl_ServiceDesc is the grpc.ServiceDesc for AgentControl service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -229,6 +263,10 @@ var AgentControl_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "RequestHISession",
 			Handler:    _AgentControl_RequestHISession_Handler,
 		},
+		{
+			MethodName: "ReportHISessionClosed",
+			Handler:    _AgentControl_ReportHISessionClosed_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "v1/agent.proto",
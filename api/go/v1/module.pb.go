@@ -312,6 +312,9 @@ type ModuleManifest struct {
 	Version       string                 `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
 	PayloadSha256 string                 `protobuf:"bytes,3,opt,name=payload_sha256,json=payloadSha256,proto3" json:"payload_sha256,omitempty"`
 	Timestamp     int64                  `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// kind shares its number with SandboxImageManifest.kind so a sandbox
+	// image manifest never reads as a module manifest.
+	Kind          string `protobuf:"bytes,6,opt,name=kind,proto3" json:"kind,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -374,6 +377,13 @@ func (x *ModuleManifest) GetTimestamp() int64 {
 	return 0
 }
 
+func (x *ModuleManifest) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
 // ModuleImage represents a signed, deployable honeypot module
 type ModuleImage struct {
 	state       protoimpl.MessageState `protogen:"open.v1"`
@@ -870,6 +880,7 @@ type ListenerAssignment struct {
 	Protocol        string                 `protobuf:"bytes,2,opt,name=protocol,proto3" json:"protocol,omitempty"`
 	Port            uint32                 `protobuf:"varint,3,opt,name=port,proto3" json:"port,omitempty"`
 	HighInteraction bool                   `protobuf:"varint,4,opt,name=high_interaction,json=highInteraction,proto3" json:"high_interaction,omitempty"` // Enable high-interaction mode
+	SandboxImage    string                 `protobuf:"bytes,5,opt,name=sandbox_image,json=sandboxImage,proto3" json:"sandbox_image,omitempty"`           // Sandbox image for high-interaction sessions
 	unknownFields   protoimpl.UnknownFields
 	sizeCache       protoimpl.SizeCache
 }
@@ -932,6 +943,13 @@ func (x *ListenerAssignment) GetHighInteraction() bool {
 	return false
 }
 
+func (x *ListenerAssignment) GetSandboxImage() string {
+	if x != nil {
+		return x.SandboxImage
+	}
+	return ""
+}
+
 // AgentModuleConfig contains all module assignments for an agent
 type AgentModuleConfig struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -1486,12 +1504,13 @@ const file_v1_module_proto_rawDesc = "" +
 	"\bmetadata\x18\x03 \x03(\v2,.gimpel.v1.HealthCheckResponse.MetadataEntryR\bmetadata\x1a;\n" +
 	"\rMetadataEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x8c\x01\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xa0\x01\n" +
 	"\x0eModuleManifest\x12\x1b\n" +
 	"\tmodule_id\x18\x01 \x01(\tR\bmoduleId\x12\x18\n" +
 	"\aversion\x18\x02 \x01(\tR\aversion\x12%\n" +
 	"\x0epayload_sha256\x18\x03 \x01(\tR\rpayloadSha256\x12\x1c\n" +
-	"\ttimestamp\x18\x04 \x01(\x03R\ttimestamp\"\xf4\x05\n" +
+	"\ttimestamp\x18\x04 \x01(\x03R\ttimestamp\x12\x12\n" +
+	"\x04kind\x18\x06 \x01(\tR\x04kind\"\xf4\x05\n" +
 	"\vModuleImage\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
 	"\x04name\x18\x02 \x01(\tR\x04name\x12\x18\n" +
@@ -1544,12 +1563,13 @@ const file_v1_module_proto_rawDesc = "" +
 	"\x0fconnection_mode\x18\a \x01(\tR\x0econnectionMode\x1a6\n" +
 	"\bEnvEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x7f\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xa4\x01\n" +
 	"\x12ListenerAssignment\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x1a\n" +
 	"\bprotocol\x18\x02 \x01(\tR\bprotocol\x12\x12\n" +
 	"\x04port\x18\x03 \x01(\rR\x04port\x12)\n" +
-	"\x10high_interaction\x18\x04 \x01(\bR\x0fhighInteraction\"\xa5\x01\n" +
+	"\x10high_interaction\x18\x04 \x01(\bR\x0fhighInteraction\x12#\n" +
+	"\rsandbox_image\x18\x05 \x01(\tR\fsandboxImage\"\xa5\x01\n" +
 	"\x11AgentModuleConfig\x12\x19\n" +
 	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12=\n" +
 	"\vassignments\x18\x02 \x03(\v2\x1b.gimpel.v1.ModuleAssignmentR\vassignments\x12\x18\n" +
@@ -221,6 +221,210 @@ func (x *StopSessionResponse) GetSuccess() bool {
 	return false
 }
 
+// SandboxImageManifest is what is signed for a sandbox image. Kind is
+// always "sandbox_image", so a module manifest cannot pass for one.
+type SandboxImageManifest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Version       string                 `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	PayloadSha256 string                 `protobuf:"bytes,3,opt,name=payload_sha256,json=payloadSha256,proto3" json:"payload_sha256,omitempty"`
+	Timestamp     int64                  `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Port          uint32                 `protobuf:"varint,5,opt,name=port,proto3" json:"port,omitempty"`
+	Kind          string                 `protobuf:"bytes,6,opt,name=kind,proto3" json:"kind,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SandboxImageManifest) Reset() {
+	*x = SandboxImageManifest{}
+	mi := &file_v1_sandbox_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SandboxImageManifest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SandboxImageManifest) ProtoMessage() {}
+
+func (x *SandboxImageManifest) ProtoReflect() protoreflect.Message {
+	mi := &file_v1_sandbox_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SandboxImageManifest.ProtoReflect.Descriptor instead.
+func (*SandboxImageManifest) Descriptor() ([]byte, []int) {
+	return file_v1_sandbox_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SandboxImageManifest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *SandboxImageManifest) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *SandboxImageManifest) GetPayloadSha256() string {
+	if x != nil {
+		return x.PayloadSha256
+	}
+	return ""
+}
+
+func (x *SandboxImageManifest) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *SandboxImageManifest) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *SandboxImageManifest) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+// SandboxImage is a signed OCI image archive that sandbox nodes run HI
+// sessions from.
+type SandboxImage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"` // What listeners ask for, e.g. "ubuntu-22-web"
+	Version       string                 `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	Description   string                 `protobuf:"bytes,3,opt,name=description,proto3" json:"description,omitempty"`
+	Digest        string                 `protobuf:"bytes,4,opt,name=digest,proto3" json:"digest,omitempty"` // SHA256 of the archive
+	SizeBytes     int64                  `protobuf:"varint,5,opt,name=size_bytes,json=sizeBytes,proto3" json:"size_bytes,omitempty"`
+	Port          uint32                 `protobuf:"varint,6,opt,name=port,proto3" json:"port,omitempty"`                        // Service the session endpoint forwards to
+	Manifest      []byte                 `protobuf:"bytes,7,opt,name=manifest,proto3" json:"manifest,omitempty"`                 // Serialized SandboxImageManifest
+	Signature     []byte                 `protobuf:"bytes,8,opt,name=signature,proto3" json:"signature,omitempty"`               // Ed25519 signature of the manifest
+	SignedBy      string                 `protobuf:"bytes,9,opt,name=signed_by,json=signedBy,proto3" json:"signed_by,omitempty"` // Key ID
+	SignedAt      int64                  `protobuf:"varint,10,opt,name=signed_at,json=signedAt,proto3" json:"signed_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SandboxImage) Reset() {
+	*x = SandboxImage{}
+	mi := &file_v1_sandbox_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SandboxImage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SandboxImage) ProtoMessage() {}
+
+func (x *SandboxImage) ProtoReflect() protoreflect.Message {
+	mi := &file_v1_sandbox_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SandboxImage.ProtoReflect.Descriptor instead.
+func (*SandboxImage) Descriptor() ([]byte, []int) {
+	return file_v1_sandbox_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SandboxImage) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *SandboxImage) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *SandboxImage) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *SandboxImage) GetDigest() string {
+	if x != nil {
+		return x.Digest
+	}
+	return ""
+}
+
+func (x *SandboxImage) GetSizeBytes() int64 {
+	if x != nil {
+		return x.SizeBytes
+	}
+	return 0
+}
+
+func (x *SandboxImage) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *SandboxImage) GetManifest() []byte {
+	if x != nil {
+		return x.Manifest
+	}
+	return nil
+}
+
+func (x *SandboxImage) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *SandboxImage) GetSignedBy() string {
+	if x != nil {
+		return x.SignedBy
+	}
+	return ""
+}
+
+func (x *SandboxImage) GetSignedAt() int64 {
+	if x != nil {
+		return x.SignedAt
+	}
+	return 0
+}
+
 var File_v1_sandbox_proto protoreflect.FileDescriptor
 
 const file_v1_sandbox_proto_rawDesc = "" +
@@ -242,7 +446,27 @@ const file_v1_sandbox_proto_rawDesc = "" +
 	"\n" +
 	"session_id\x18\x01 \x01(\tR\tsessionId\"/\n" +
 	"\x13StopSessionResponse\x12\x18\n" +
-	"\asuccess\x18\x01 \x01(\bR\asuccess2\xb2\x01\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\"\xb1\x01\n" +
+	"\x14SandboxImageManifest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\tR\aversion\x12%\n" +
+	"\x0epayload_sha256\x18\x03 \x01(\tR\rpayloadSha256\x12\x1c\n" +
+	"\ttimestamp\x18\x04 \x01(\x03R\ttimestamp\x12\x12\n" +
+	"\x04port\x18\x05 \x01(\rR\x04port\x12\x12\n" +
+	"\x04kind\x18\x06 \x01(\tR\x04kind\"\x9d\x02\n" +
+	"\fSandboxImage\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\tR\aversion\x12 \n" +
+	"\vdescription\x18\x03 \x01(\tR\vdescription\x12\x16\n" +
+	"\x06digest\x18\x04 \x01(\tR\x06digest\x12\x1d\n" +
+	"\n" +
+	"size_bytes\x18\x05 \x01(\x03R\tsizeBytes\x12\x12\n" +
+	"\x04port\x18\x06 \x01(\rR\x04port\x12\x1a\n" +
+	"\bmanifest\x18\a \x01(\fR\bmanifest\x12\x1c\n" +
+	"\tsignature\x18\b \x01(\fR\tsignature\x12\x1b\n" +
+	"\tsigned_by\x18\t \x01(\tR\bsignedBy\x12\x1b\n" +
+	"\tsigned_at\x18\n" +
+	" \x01(\x03R\bsignedAt2\xb2\x01\n" +
 	"\x0eSandboxService\x12R\n" +
 	"\rCreateSession\x12\x1f.gimpel.v1.CreateSessionRequest\x1a .gimpel.v1.CreateSessionResponse\x12L\n" +
 	"\vStopSession\x12\x1d.gimpel.v1.StopSessionRequest\x1a\x1e.gimpel.v1.StopSessionResponseB5Z3github.com/nohaxxjustlags/gimpel/api/go/v1;gimpelv1b\x06proto3"
@@ -259,16 +483,18 @@ func file_v1_sandbox_proto_rawDescGZIP() []byte {
 	return file_v1_sandbox_proto_rawDescData
 }
 
-var file_v1_sandbox_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_v1_sandbox_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
 var file_v1_sandbox_proto_goTypes = []any{
 	(*CreateSessionRequest)(nil),  // 0: gimpel.v1.CreateSessionRequest
 	(*CreateSessionResponse)(nil), // 1: gimpel.v1.CreateSessionResponse
 	(*StopSessionRequest)(nil),    // 2: gimpel.v1.StopSessionRequest
 	(*StopSessionResponse)(nil),   // 3: gimpel.v1.StopSessionResponse
-	nil,                           // 4: gimpel.v1.CreateSessionRequest.EnvEntry
+	(*SandboxImageManifest)(nil),  // 4: gimpel.v1.SandboxImageManifest
+	(*SandboxImage)(nil),          // 5: gimpel.v1.SandboxImage
+	nil,                           // 6: gimpel.v1.CreateSessionRequest.EnvEntry
 }
 var file_v1_sandbox_proto_depIdxs = []int32{
-	4, // 0: gimpel.v1.CreateSessionRequest.env:type_name -> gimpel.v1.CreateSessionRequest.EnvEntry
+	6, // 0: gimpel.v1.CreateSessionRequest.env:type_name -> gimpel.v1.CreateSessionRequest.EnvEntry
 	0, // 1: gimpel.v1.SandboxService.CreateSession:input_type -> gimpel.v1.CreateSessionRequest
 	2, // 2: gimpel.v1.SandboxService.StopSession:input_type -> gimpel.v1.StopSessionRequest
 	1, // 3: gimpel.v1.SandboxService.CreateSession:output_type -> gimpel.v1.CreateSessionResponse
@@ -291,7 +517,7 @@ func file_v1_sandbox_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_v1_sandbox_proto_rawDesc), len(file_v1_sandbox_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   5,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
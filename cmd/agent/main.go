@@ -14,9 +14,12 @@ import (
 
 	"gimpel/internal/agent"
 	"gimpel/internal/agent/config"
+	"gimpel/internal/agent/confine"
 )
 
 func main() {
+	confine.Main()
+
 	configPath := flag.String("config", "/etc/gimpel/agent.yaml", "path to config file")
 	debug := flag.Bool("debug", false, "enable debug logging")
 	
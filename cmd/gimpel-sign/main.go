@@ -148,6 +148,77 @@ var signModuleCmd = &cobra.Command{
 	},
 }
 
+var signSandboxImageCmd = &cobra.Command{
+	Use:   "sign-sandbox-image",
+	Short: "Sign a sandbox image",
+	Long:  `Sign an OCI image archive that sandbox nodes run high-interaction sessions from, and output the signature. Nodes only install images signed by a key they trust.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyFile, _ := cmd.Flags().GetString("key")
+		name, _ := cmd.Flags().GetString("name")
+		version, _ := cmd.Flags().GetString("version")
+		port, _ := cmd.Flags().GetUint32("port")
+		imageFile, _ := cmd.Flags().GetString("image")
+		outputFile, _ := cmd.Flags().GetString("output")
+
+		kp, err := signing.LoadPrivateKey(keyFile)
+		if err != nil {
+			return fmt.Errorf("loading private key: %w", err)
+		}
+
+		imageData, err := os.ReadFile(imageFile)
+		if err != nil {
+			return fmt.Errorf("reading image file: %w", err)
+		}
+
+		signer, err := signing.NewModuleSigner(kp)
+		if err != nil {
+			return fmt.Errorf("creating signer: %w", err)
+		}
+
+		image := &gimpelv1.SandboxImage{
+			Name:      name,
+			Version:   version,
+			Digest:    signing.ComputeImageDigest(imageData),
+			SizeBytes: int64(len(imageData)),
+			Port:      port,
+		}
+
+		if err := signer.SignSandboxImage(image); err != nil {
+			return fmt.Errorf("signing sandbox image: %w", err)
+		}
+
+		fmt.Printf("Sandbox image signed successfully!\n")
+		fmt.Printf("  Name:      %s\n", image.Name)
+		fmt.Printf("  Version:   %s\n", image.Version)
+		fmt.Printf("  Port:      %d\n", image.Port)
+		fmt.Printf("  Digest:    %s\n", image.Digest)
+		fmt.Printf("  Signed by: %s\n", image.SignedBy)
+
+		if outputFile != "" {
+			data := fmt.Sprintf(`{
+  "name": "%s",
+  "version": "%s",
+  "port": %d,
+  "digest": "%s",
+  "manifest": "%x",
+  "signature": "%x",
+  "signed_by": "%s",
+  "signed_at": %d,
+  "size_bytes": %d
+}
+`, image.Name, image.Version, image.Port, image.Digest, image.Manifest,
+				image.Signature, image.SignedBy, image.SignedAt, image.SizeBytes)
+
+			if err := os.WriteFile(outputFile, []byte(data), 0644); err != nil {
+				return fmt.Errorf("writing output file: %w", err)
+			}
+			fmt.Printf("  Metadata:  %s\n", outputFile)
+		}
+
+		return nil
+	},
+}
+
 var verifyModuleCmd = &cobra.Command{
 	Use:   "verify-module",
 	Short: "Verify a module's signature",
@@ -219,6 +290,17 @@ func init() {
 	signModuleCmd.MarkFlagRequired("version")
 	signModuleCmd.MarkFlagRequired("image")
 
+	signSandboxImageCmd.Flags().StringP("key", "k", "", "Path to private key file")
+	signSandboxImageCmd.Flags().StringP("name", "n", "", "Image name listeners refer to")
+	signSandboxImageCmd.Flags().StringP("version", "v", "", "Image version")
+	signSandboxImageCmd.Flags().Uint32P("port", "p", 22, "Port of the service sessions are forwarded to")
+	signSandboxImageCmd.Flags().String("image", "", "Path to OCI image archive")
+	signSandboxImageCmd.Flags().StringP("output", "o", "", "Output file for signature metadata (JSON)")
+	signSandboxImageCmd.MarkFlagRequired("key")
+	signSandboxImageCmd.MarkFlagRequired("name")
+	signSandboxImageCmd.MarkFlagRequired("version")
+	signSandboxImageCmd.MarkFlagRequired("image")
+
 	verifyModuleCmd.Flags().StringP("key", "k", "", "Path to public key file")
 	verifyModuleCmd.Flags().StringP("id", "i", "", "Module ID")
 	verifyModuleCmd.Flags().StringP("version", "v", "", "Module version")
@@ -235,6 +317,7 @@ func init() {
 	rootCmd.AddCommand(generateKeyCmd)
 	rootCmd.AddCommand(showKeyCmd)
 	rootCmd.AddCommand(signModuleCmd)
+	rootCmd.AddCommand(signSandboxImageCmd)
 	rootCmd.AddCommand(verifyModuleCmd)
 }
 
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"gimpel/internal/sandbox/config"
 	"gimpel/internal/sandbox/manager"
+	"gimpel/internal/sandbox/node"
 	"gimpel/internal/sandbox/server"
 )
 
 func main() {
+	manager.Main()
+
 	configFile := flag.String("config", "sandbox.yaml", "Path to configuration file")
 	flag.Parse()
 
@@ -31,6 +36,24 @@ func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 
 	mgr := manager.New(cfg)
+	mgr.StartPools()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var nodeClient *node.Client
+	if cfg.Master.Address != "" {
+		nodeClient = node.New(cfg, mgr)
+		if err := nodeClient.Enroll(ctx); err != nil {
+			log.Fatalf("failed to enroll with master: %v", err)
+		}
+		if err := nodeClient.LoadImages(); err != nil {
+			log.Fatalf("failed to load sandbox images: %v", err)
+		}
+		mgr.SetRecordingSink(nodeClient)
+		mgr.SetEventSink(nodeClient)
+		mgr.SetArtifactSink(nodeClient)
+	}
 
 	srv, err := server.New(cfg, mgr)
 	if err != nil {
@@ -41,11 +64,24 @@ func main() {
 		log.Fatalf("failed to start server: %v", err)
 	}
 
+	if nodeClient != nil {
+		go nodeClient.Run(ctx)
+	}
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
 	<-stop
 
 	log.Info("shutting down sandbox...")
+	cancel()
 	srv.Stop()
+	mgr.Close()
+
+	if nodeClient != nil {
+		// Sends what the sessions reported while stopping.
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		mgr.FlushEvents(flushCtx)
+		flushCancel()
+	}
 }
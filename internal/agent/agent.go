@@ -11,6 +11,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"gimpel/internal/agent/capture"
 	"gimpel/internal/agent/config"
 	"gimpel/internal/agent/control"
 	"gimpel/internal/agent/listener"
@@ -83,12 +84,18 @@ func (a *Agent) initComponents() error {
 		return fmt.Errorf("creating control client: %w", err)
 	}
 
-	a.supervisor, err = module.NewSupervisor(a.cfg, a.emitter)
+	a.supervisor, err = module.NewSupervisor(a.cfg, a.emitter, a.store)
 	if err != nil {
 		return fmt.Errorf("creating supervisor: %w", err)
 	}
 	
 	a.listeners = listener.NewManager(a.cfg, a.supervisor, a.controlClient)
+	a.listeners.SetEmitter(a.emitter)
+	a.supervisor.SetAgentHandler(a.listeners)
+
+	recorder := capture.NewRecorder(a.cfg.Capture, a.emitter)
+	a.supervisor.SetCapture(recorder)
+	a.listeners.SetCapture(recorder)
 
 	if err := a.initModuleLifecycle(); err != nil {
 		return err
@@ -103,8 +110,18 @@ func (a *Agent) Run(ctx context.Context) error {
 		"hostname": a.identity.Hostname,
 	}).Info("starting agent")
 
+	// Re-attach to modules from a previous run before anything starts them
+	// a second time.
+	if err := a.supervisor.Recover(ctx); err != nil {
+		log.WithError(err).Warn("module recovery failed")
+	}
+
 	if err := a.controlClient.Connect(ctx); err != nil {
-		return fmt.Errorf("connecting to control plane: %w", err)
+		if !a.identity.Registered {
+			return fmt.Errorf("connecting to control plane: %w", err)
+		}
+		// The heartbeat loop keeps retrying; meanwhile run from the cache.
+		log.WithError(err).Warn("control plane unavailable, starting from cached deployment")
 	}
 	defer a.controlClient.Close()
 
@@ -119,7 +136,7 @@ func (a *Agent) Run(ctx context.Context) error {
 
 	if a.catalogSyncer != nil {
 		if err := a.catalogSyncer.Connect(ctx); err != nil {
-			return fmt.Errorf("connecting to catalog service: %w", err)
+			log.WithError(err).Warn("catalog service unavailable, starting from cached deployment")
 		}
 		defer a.catalogSyncer.Close()
 
@@ -130,12 +147,13 @@ func (a *Agent) Run(ctx context.Context) error {
 			a.catalogSyncer.GetVerifier(),
 		)
 		a.reconciler = modules.NewReconciler(a.store, a.downloader, a.supervisor)
+		a.reconciler.SetDeploymentLoader(a.catalogSyncer.LoadDeployment)
 		
 		a.reconciler.SetListenerStarter(a.listeners)
 
 		log.Info("performing initial module sync")
 		if err := a.syncModules(ctx); err != nil {
-			log.WithError(err).Warn("initial module sync failed")
+			log.WithError(err).Warn("initial module sync failed, serving cached deployment")
 		}
 	}
 
@@ -334,7 +352,31 @@ func (a *Agent) collectMetrics() (cpuUsage, memUsage float64) {
 	return cpuUsage, memUsage
 }
 
+// syncModules pulls the catalog and assignments from the master and
+// reconciles modules against the stored deployment. When the master cannot
+// be reached the last verified deployment is reconciled anyway, so modules
+// keep running from the cache.
 func (a *Agent) syncModules(ctx context.Context) error {
+	syncErr := a.syncFromMaster(ctx)
+	if syncErr != nil {
+		log.WithError(syncErr).Debug("sync with master failed, reconciling cached deployment")
+	}
+
+	if err := a.reconciler.Reconcile(ctx); err != nil {
+		return fmt.Errorf("reconciling deployments: %w", err)
+	}
+
+	return syncErr
+}
+
+func (a *Agent) syncFromMaster(ctx context.Context) error {
+	if a.catalogSyncer.GetCatalogClient() == nil {
+		if err := a.catalogSyncer.Connect(ctx); err != nil {
+			return fmt.Errorf("connecting to catalog service: %w", err)
+		}
+		a.downloader.SetCatalogClient(a.catalogSyncer.GetCatalogClient())
+	}
+
 	if err := a.catalogSyncer.SyncCatalog(ctx); err != nil {
 		return fmt.Errorf("syncing catalog: %w", err)
 	}
@@ -344,25 +386,49 @@ func (a *Agent) syncModules(ctx context.Context) error {
 		return fmt.Errorf("syncing assignments: %w", err)
 	}
 
-	if err := a.reconciler.Reconcile(ctx); err != nil {
-		return fmt.Errorf("reconciling deployments: %w", err)
-	}
-
 	return nil
 }
 
+const (
+	moduleSyncInterval = 30 * time.Second
+	moduleSyncRetryMin = 5 * time.Second
+	moduleSyncRetryMax = 5 * time.Minute
+)
+
+// runModuleSyncLoop syncs on a fixed interval while the master is reachable
+// and retries with exponential backoff while it is not.
 func (a *Agent) runModuleSyncLoop(ctx context.Context) error {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+	delay := moduleSyncInterval
+	failures := 0
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-ticker.C:
-			if err := a.syncModules(ctx); err != nil {
-				log.WithError(err).Warn("module sync failed")
+		case <-timer.C:
+		}
+
+		if err := a.syncModules(ctx); err != nil {
+			failures++
+			delay = moduleSyncRetryMin << (failures - 1)
+			if delay > moduleSyncRetryMax || delay <= 0 {
+				delay = moduleSyncRetryMax
+			}
+			log.WithError(err).WithFields(log.Fields{
+				"failures": failures,
+				"retry_in": delay,
+			}).Warn("module sync failed, serving cached deployment")
+		} else {
+			if failures > 0 {
+				log.WithField("failures", failures).Info("master reachable again, modules resynced")
 			}
+			failures = 0
+			delay = moduleSyncInterval
 		}
+
+		timer.Reset(delay)
 	}
 }
@@ -0,0 +1,244 @@
+// Package capture records the byte streams of forwarded connections so
+// analysts can replay what a client sent and what it was shown.
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/config"
+	"gimpel/internal/agent/telemetry"
+	"gimpel/pkg/pcapng"
+)
+
+const (
+	FormatPCAPNG = "pcapng"
+	FormatStream = "stream"
+
+	// uploadChunkSize bounds the payload of each capture event. Chunks are
+	// uploaded as they fill so a session's capture is not held until it
+	// closes.
+	uploadChunkSize = 32 * 1024
+)
+
+// streamMagic starts a capture in the stream format. Each record that
+// follows is an 8-byte UnixNano timestamp, a direction byte (0 from the
+// client, 1 from the server), a 4-byte length and the data, big-endian.
+var streamMagic = []byte("GCAP\x01")
+
+// Recorder starts a capture for each session when capture is enabled. A nil
+// Recorder records nothing.
+type Recorder struct {
+	cfg     config.CaptureConfig
+	emitter *telemetry.Emitter
+}
+
+// NewRecorder returns nil when capture is disabled.
+func NewRecorder(cfg config.CaptureConfig, emitter *telemetry.Emitter) *Recorder {
+	if !cfg.Enabled || emitter == nil {
+		return nil
+	}
+	return &Recorder{cfg: cfg, emitter: emitter}
+}
+
+// Start begins recording a session. It returns nil if r is nil.
+func (r *Recorder) Start(moduleID, sessionID, sourceIP string, sourcePort uint32, destIP string, destPort uint32) *Session {
+	if r == nil {
+		return nil
+	}
+
+	s := &Session{
+		recorder:  r,
+		moduleID:  moduleID,
+		sessionID: sessionID,
+		remaining: r.cfg.MaxSessionBytes,
+	}
+	if r.cfg.Format == FormatStream {
+		s.buf.Write(streamMagic)
+		return s
+	}
+
+	// Writes to a bytes.Buffer do not fail.
+	w, _ := pcapng.NewWriter(&s.buf, pcapng.LinkTypeRaw)
+	s.tcp = pcapng.NewTCPStream(w, addrPort(sourceIP, sourcePort), addrPort(destIP, destPort))
+	s.tcp.Handshake(time.Now())
+	return s
+}
+
+// Session buffers one connection's capture and uploads it a chunk at a
+// time. Each chunk carries its offset in the capture; the last one is
+// marked final and carries the totals.
+type Session struct {
+	recorder  *Recorder
+	moduleID  string
+	sessionID string
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	tcp        *pcapng.TCPStream
+	uploaded   int64
+	chunk      int
+	remaining  int64
+	truncated  bool
+	closed     bool
+	fromClient int64
+	fromServer int64
+}
+
+// Record adds data sent by the client (fromClient) or by the server. Data
+// past the session's size cap is counted but not kept.
+func (s *Session) Record(fromClient bool, data []byte) {
+	if s == nil || len(data) == 0 {
+		return
+	}
+	ts := time.Now()
+
+	s.mu.Lock()
+	s.record(ts, fromClient, data)
+	chunks := s.takeChunks(false)
+	s.mu.Unlock()
+
+	s.upload(chunks)
+}
+
+func (s *Session) record(ts time.Time, fromClient bool, data []byte) {
+	if fromClient {
+		s.fromClient += int64(len(data))
+	} else {
+		s.fromServer += int64(len(data))
+	}
+	if s.closed || s.truncated {
+		return
+	}
+	if s.remaining <= 0 {
+		s.truncated = true
+		return
+	}
+	if int64(len(data)) > s.remaining {
+		data = data[:s.remaining]
+		s.truncated = true
+	}
+	s.remaining -= int64(len(data))
+	if len(data) == 0 {
+		return
+	}
+
+	if s.tcp != nil {
+		s.tcp.Write(ts, fromClient, data)
+		return
+	}
+	var hdr [13]byte
+	binary.BigEndian.PutUint64(hdr[0:], uint64(ts.UnixNano()))
+	if !fromClient {
+		hdr[8] = 1
+	}
+	binary.BigEndian.PutUint32(hdr[9:], uint32(len(data)))
+	s.buf.Write(hdr[:])
+	s.buf.Write(data)
+}
+
+// Close finishes the capture and uploads what is left of it.
+func (s *Session) Close() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.tcp != nil {
+		s.tcp.Close(time.Now())
+	}
+	chunks := s.takeChunks(true)
+	length, truncated := s.uploaded, s.truncated
+	s.mu.Unlock()
+
+	s.upload(chunks)
+
+	log.WithFields(log.Fields{
+		"session":   s.sessionID,
+		"bytes":     length,
+		"truncated": truncated,
+	}).Debug("uploaded session capture")
+}
+
+type captureChunk struct {
+	data   []byte
+	labels map[string]string
+}
+
+// takeChunks removes full chunks from the buffer, or everything with the
+// final chunk if final is set. s.mu must be held.
+func (s *Session) takeChunks(final bool) []captureChunk {
+	var chunks []captureChunk
+	for s.buf.Len() >= uploadChunkSize || final {
+		data := bytes.Clone(s.buf.Next(uploadChunkSize))
+		labels := map[string]string{
+			"format": s.recorder.cfg.Format,
+			"chunk":  strconv.Itoa(s.chunk),
+			"offset": strconv.FormatInt(s.uploaded, 10),
+		}
+		s.chunk++
+		s.uploaded += int64(len(data))
+		if final && s.buf.Len() == 0 {
+			labels["final"] = "true"
+			labels["truncated"] = strconv.FormatBool(s.truncated)
+			labels["bytes_client"] = strconv.FormatInt(s.fromClient, 10)
+			labels["bytes_server"] = strconv.FormatInt(s.fromServer, 10)
+			labels["capture_length"] = strconv.FormatInt(s.uploaded, 10)
+			final = false
+		}
+		chunks = append(chunks, captureChunk{data: data, labels: labels})
+	}
+	return chunks
+}
+
+func (s *Session) upload(chunks []captureChunk) {
+	for _, c := range chunks {
+		s.recorder.emitter.EmitCapture(s.moduleID, s.sessionID, c.data, c.labels)
+	}
+}
+
+// Tap returns conn with its reads recorded as client data and its writes
+// as server data. conn is returned unchanged if s is nil.
+func Tap(conn net.Conn, s *Session) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return &tappedConn{Conn: conn, session: s}
+}
+
+type tappedConn struct {
+	net.Conn
+	session *Session
+}
+
+func (c *tappedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.session.Record(true, b[:n])
+	return n, err
+}
+
+func (c *tappedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.session.Record(false, b[:n])
+	return n, err
+}
+
+func addrPort(ip string, port uint32) netip.AddrPort {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		addr = netip.IPv4Unspecified()
+	}
+	return netip.AddrPortFrom(addr, uint16(port))
+}
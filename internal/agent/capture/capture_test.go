@@ -0,0 +1,62 @@
+package capture
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"gimpel/internal/agent/config"
+)
+
+func TestSessionStreamTruncation(t *testing.T) {
+	r := &Recorder{cfg: config.CaptureConfig{Enabled: true, Format: FormatStream, MaxSessionBytes: 8}}
+	s := r.Start("ssh", "session-1", "198.51.100.7", 40000, "192.0.2.1", 22)
+
+	s.Record(true, []byte("root\n"))
+	s.Record(false, []byte("password:"))
+	s.Record(true, []byte("toor\n"))
+
+	data := s.buf.Bytes()
+	if !bytes.HasPrefix(data, streamMagic) {
+		t.Fatal("missing stream magic")
+	}
+	data = data[len(streamMagic):]
+	// Two records: 5 bytes from the client, then the 3 that fit from the
+	// server.
+	if len(data) != 13+5+13+3 || data[8] != 0 || data[13+5+8] != 1 {
+		t.Fatalf("unexpected records %q", data)
+	}
+	if !s.truncated || s.fromClient != 10 || s.fromServer != 9 {
+		t.Errorf("truncated %v, client %d, server %d", s.truncated, s.fromClient, s.fromServer)
+	}
+}
+
+func TestSessionWithoutRoom(t *testing.T) {
+	r := &Recorder{cfg: config.CaptureConfig{Enabled: true, Format: FormatStream, MaxSessionBytes: -1}}
+	s := r.Start("ssh", "session-1", "198.51.100.7", 40000, "192.0.2.1", 22)
+
+	s.Record(true, []byte("root\n"))
+	if !s.truncated || s.buf.Len() != len(streamMagic) {
+		t.Errorf("truncated %v, %d bytes kept", s.truncated, s.buf.Len()-len(streamMagic))
+	}
+}
+
+func TestSessionChunks(t *testing.T) {
+	r := &Recorder{cfg: config.CaptureConfig{Enabled: true, Format: FormatStream, MaxSessionBytes: 1 << 20}}
+	s := r.Start("ssh", "session-1", "198.51.100.7", 40000, "192.0.2.1", 22)
+
+	s.record(time.Now(), true, make([]byte, uploadChunkSize+100))
+	full := s.takeChunks(false)
+	if len(full) != 1 || len(full[0].data) != uploadChunkSize || full[0].labels["offset"] != "0" {
+		t.Fatalf("full chunks = %d", len(full))
+	}
+
+	rest := s.takeChunks(true)
+	if len(rest) != 1 || rest[0].labels["final"] != "true" || rest[0].labels["offset"] != strconv.Itoa(uploadChunkSize) {
+		t.Fatalf("final chunks = %+v", rest)
+	}
+	if want := strconv.Itoa(len(streamMagic) + 13 + uploadChunkSize + 100); rest[0].labels["capture_length"] != want {
+		t.Errorf("capture_length = %s, want %s", rest[0].labels["capture_length"], want)
+	}
+}
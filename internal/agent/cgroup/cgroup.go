@@ -0,0 +1,37 @@
+package cgroup
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrUnsupported = errors.New("cgroup v2 is not available")
+
+const (
+	DefaultMountPoint = "/sys/fs/cgroup"
+	DefaultParent     = "gimpel"
+)
+
+// Limits are the resource limits applied to a module's cgroup. Zero values
+// leave the corresponding controller unlimited.
+type Limits struct {
+	MemoryMaxBytes int64
+
+	CPUPercent int
+
+	PidsMax int64
+}
+
+type Stats struct {
+	MemoryCurrentBytes int64
+
+	CPUUsageUsec uint64
+
+	// CPUPercent is the usage since the previous call to Group.Stats,
+	// relative to a single CPU.
+	CPUPercent float64
+
+	PidsCurrent int64
+
+	SampledAt time.Time
+}
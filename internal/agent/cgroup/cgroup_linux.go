@@ -0,0 +1,344 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var controllers = []string{"memory", "cpu", "pids"}
+
+// cpuPeriodUsec is the cpu.max period used when translating a CPU percentage.
+const cpuPeriodUsec = 100000
+
+type Manager struct {
+	root   string
+	parent string
+}
+
+// NewManager prepares the parent cgroup that holds one child group per
+// module. mountPoint and parent default to DefaultMountPoint and
+// DefaultParent.
+func NewManager(mountPoint, parent string) (*Manager, error) {
+	if mountPoint == "" {
+		mountPoint = DefaultMountPoint
+	}
+	if parent == "" {
+		parent = DefaultParent
+	}
+
+	if _, err := os.Stat(filepath.Join(mountPoint, "cgroup.controllers")); err != nil {
+		return nil, ErrUnsupported
+	}
+
+	m := &Manager{
+		root:   mountPoint,
+		parent: filepath.Join(mountPoint, filepath.Clean("/"+parent)),
+	}
+
+	if err := os.MkdirAll(m.parent, 0755); err != nil {
+		return nil, fmt.Errorf("creating parent cgroup: %w", err)
+	}
+
+	// Every ancestor must delegate the controllers before the module groups
+	// can use them.
+	rel, err := filepath.Rel(m.root, m.parent)
+	if err != nil {
+		return nil, fmt.Errorf("resolving parent cgroup: %w", err)
+	}
+	dir := m.root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if err := enableControllers(dir); err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(dir, part)
+	}
+	if err := enableControllers(m.parent); err != nil {
+		return nil, err
+	}
+
+	log.WithField("path", m.parent).Info("cgroup manager initialized")
+
+	return m, nil
+}
+
+func enableControllers(dir string) error {
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("reading controllers of %s: %w", dir, err)
+	}
+
+	have := make(map[string]bool)
+	for _, c := range strings.Fields(string(available)) {
+		have[c] = true
+	}
+
+	var enable []string
+	for _, c := range controllers {
+		if !have[c] {
+			return fmt.Errorf("controller %s not available in %s", c, dir)
+		}
+		enable = append(enable, "+"+c)
+	}
+
+	if err := writeFile(dir, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+		return fmt.Errorf("enabling controllers in %s: %w", dir, err)
+	}
+	return nil
+}
+
+// Create creates (or reuses) the cgroup for a module and applies limits.
+func (m *Manager) Create(name string, limits Limits) (*Group, error) {
+	path := filepath.Join(m.parent, sanitize(name))
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("creating cgroup: %w", err)
+	}
+
+	g := &Group{path: path}
+	if err := g.Apply(limits); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return g, nil
+}
+
+// Open returns the existing group for name, for example one left behind by a
+// previous agent process.
+func (m *Manager) Open(name string) (*Group, error) {
+	path := filepath.Join(m.parent, sanitize(name))
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &Group{path: path}, nil
+}
+
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+type Group struct {
+	path string
+
+	mu         sync.Mutex
+	lastUsage  uint64
+	lastSample time.Time
+}
+
+func (g *Group) Path() string {
+	return g.path
+}
+
+func (g *Group) Apply(limits Limits) error {
+	memory := "max"
+	if limits.MemoryMaxBytes > 0 {
+		memory = strconv.FormatInt(limits.MemoryMaxBytes, 10)
+	}
+	if err := writeFile(g.path, "memory.max", memory); err != nil {
+		return fmt.Errorf("setting memory.max: %w", err)
+	}
+	if limits.MemoryMaxBytes > 0 {
+		// Keep module memory out of swap so memory.max is a hard ceiling.
+		writeFile(g.path, "memory.swap.max", "0")
+	}
+
+	cpu := fmt.Sprintf("max %d", cpuPeriodUsec)
+	if limits.CPUPercent > 0 {
+		cpu = fmt.Sprintf("%d %d", limits.CPUPercent*cpuPeriodUsec/100, cpuPeriodUsec)
+	}
+	if err := writeFile(g.path, "cpu.max", cpu); err != nil {
+		return fmt.Errorf("setting cpu.max: %w", err)
+	}
+
+	pids := "max"
+	if limits.PidsMax > 0 {
+		pids = strconv.FormatInt(limits.PidsMax, 10)
+	}
+	if err := writeFile(g.path, "pids.max", pids); err != nil {
+		return fmt.Errorf("setting pids.max: %w", err)
+	}
+
+	return nil
+}
+
+// Attach arranges for a process started with attr to be created directly
+// inside the group, so it is never briefly outside its limits. Where the
+// kernel cannot do that the process is moved into the group right after it
+// started instead. The returned function must be called once the start
+// returned, with the new pid or 0 if it failed.
+func (g *Group) Attach(attr *syscall.SysProcAttr) (func(pid int), error) {
+	if !canCloneIntoCgroup() {
+		return func(pid int) {
+			if pid == 0 {
+				return
+			}
+			if err := g.AddProcess(pid); err != nil {
+				log.WithError(err).WithField("cgroup", g.path).Warn("failed to move process into cgroup")
+			}
+		}, nil
+	}
+
+	fd, err := unix.Open(g.path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening cgroup: %w", err)
+	}
+
+	attr.UseCgroupFD = true
+	attr.CgroupFD = fd
+
+	return func(int) { unix.Close(fd) }, nil
+}
+
+// cloneArgs is struct clone_args up to the cgroup field.
+type cloneArgs struct {
+	flags      uint64
+	pidfd      uint64
+	childTID   uint64
+	parentTID  uint64
+	exitSignal uint64
+	stack      uint64
+	stackSize  uint64
+	tls        uint64
+	setTID     uint64
+	setTIDSize uint64
+	cgroup     uint64
+}
+
+// canCloneIntoCgroup reports whether clone3 takes CLONE_INTO_CGROUP. Kernels
+// before 5.7 reject the flag with EINVAL and some container seccomp profiles
+// reject clone3 with ENOSYS. The probe passes a descriptor that is not a
+// cgroup, so a kernel that supports the flag fails it with EBADF and no
+// process is ever created.
+var canCloneIntoCgroup = sync.OnceValue(func() bool {
+	fd, err := unix.Open(os.DevNull, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+
+	args := cloneArgs{flags: unix.CLONE_INTO_CGROUP, cgroup: uint64(fd)}
+	_, _, errno := unix.RawSyscall(unix.SYS_CLONE3, uintptr(unsafe.Pointer(&args)), unsafe.Sizeof(args), 0)
+	if errno == unix.EBADF {
+		return true
+	}
+
+	log.WithError(errno).Warn("kernel cannot start processes inside a cgroup, moving them in after they started")
+	return false
+})
+
+func (g *Group) AddProcess(pid int) error {
+	return writeFile(g.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+func (g *Group) Stats() (*Stats, error) {
+	stats := &Stats{SampledAt: time.Now()}
+
+	memory, err := readInt(g.path, "memory.current")
+	if err != nil {
+		return nil, fmt.Errorf("reading memory.current: %w", err)
+	}
+	stats.MemoryCurrentBytes = memory
+
+	pids, err := readInt(g.path, "pids.current")
+	if err == nil {
+		stats.PidsCurrent = pids
+	}
+
+	usage, err := readCPUUsage(g.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading cpu.stat: %w", err)
+	}
+	stats.CPUUsageUsec = usage
+
+	g.mu.Lock()
+	if !g.lastSample.IsZero() && usage >= g.lastUsage {
+		elapsed := stats.SampledAt.Sub(g.lastSample).Microseconds()
+		if elapsed > 0 {
+			stats.CPUPercent = float64(usage-g.lastUsage) / float64(elapsed) * 100
+		}
+	}
+	g.lastUsage = usage
+	g.lastSample = stats.SampledAt
+	g.mu.Unlock()
+
+	return stats, nil
+}
+
+// Kill terminates every process in the group, including anything the module
+// forked or daemonized.
+func (g *Group) Kill() error {
+	if err := writeFile(g.path, "cgroup.kill", "1"); err == nil {
+		return nil
+	}
+
+	// cgroup.kill needs Linux 5.14; fall back to signalling each member.
+	data, err := os.ReadFile(filepath.Join(g.path, "cgroup.procs"))
+	if err != nil {
+		return fmt.Errorf("reading cgroup.procs: %w", err)
+	}
+	for _, line := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+// Destroy removes the group once its processes have exited.
+func (g *Group) Destroy() error {
+	var err error
+	for i := 0; i < 10; i++ {
+		err = os.Remove(g.path)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("removing cgroup: %w", err)
+}
+
+func writeFile(dir, name, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+func readInt(dir, name string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func readCPUUsage(dir string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("usage_usec not found")
+}
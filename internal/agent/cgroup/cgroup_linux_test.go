@@ -0,0 +1,147 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func fakeCgroupRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTestFile(t, root, "cgroup.controllers", "cpuset cpu io memory pids")
+	writeTestFile(t, filepath.Join(root, "gimpel"), "cgroup.controllers", "cpu memory pids")
+	return root
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestManagerCreateAppliesLimits(t *testing.T) {
+	root := fakeCgroupRoot(t)
+
+	m, err := NewManager(root, "")
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	for _, dir := range []string{root, filepath.Join(root, "gimpel")} {
+		if got := readTestFile(t, dir, "cgroup.subtree_control"); got != "+memory +cpu +pids" {
+			t.Errorf("%s subtree_control = %q", dir, got)
+		}
+	}
+
+	g, err := m.Create("ssh/honeypot", Limits{MemoryMaxBytes: 64 << 20, CPUPercent: 25, PidsMax: 16})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	if filepath.Base(g.Path()) != "ssh_honeypot" {
+		t.Errorf("Path() = %s", g.Path())
+	}
+
+	want := map[string]string{
+		"memory.max": "67108864",
+		"cpu.max":    "25000 100000",
+		"pids.max":   "16",
+	}
+	for name, value := range want {
+		if got := readTestFile(t, g.Path(), name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	if err := g.Apply(Limits{}); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if got := readTestFile(t, g.Path(), "pids.max"); got != "max" {
+		t.Errorf("pids.max = %q, want max", got)
+	}
+}
+
+func TestGroupAttachFallsBackToAddProcess(t *testing.T) {
+	supported := canCloneIntoCgroup
+	canCloneIntoCgroup = func() bool { return false }
+	defer func() { canCloneIntoCgroup = supported }()
+
+	m, err := NewManager(fakeCgroupRoot(t), "")
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	g, err := m.Create("ssh", Limits{})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	attr := &syscall.SysProcAttr{}
+	started, err := g.Attach(attr)
+	if err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	if attr.UseCgroupFD {
+		t.Error("Attach() set UseCgroupFD without kernel support")
+	}
+
+	started(4242)
+	if got := readTestFile(t, g.Path(), "cgroup.procs"); got != "4242" {
+		t.Errorf("cgroup.procs = %q, want 4242", got)
+	}
+}
+
+func TestManagerMissingController(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "cgroup.controllers", "cpu memory")
+
+	if _, err := NewManager(root, "gimpel"); err == nil || !strings.Contains(err.Error(), "pids") {
+		t.Fatalf("NewManager() error = %v, want missing pids controller", err)
+	}
+}
+
+func TestGroupStats(t *testing.T) {
+	dir := t.TempDir()
+	g := &Group{path: dir}
+
+	writeTestFile(t, dir, "memory.current", "1048576\n")
+	writeTestFile(t, dir, "pids.current", "3\n")
+	writeTestFile(t, dir, "cpu.stat", "usage_usec 1000\nuser_usec 800\nsystem_usec 200\n")
+
+	stats, err := g.Stats()
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.MemoryCurrentBytes != 1048576 || stats.PidsCurrent != 3 || stats.CPUUsageUsec != 1000 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	if stats.CPUPercent != 0 {
+		t.Errorf("first sample CPUPercent = %f, want 0", stats.CPUPercent)
+	}
+
+	writeTestFile(t, dir, "cpu.stat", "usage_usec 1000000000\n")
+	stats, err = g.Stats()
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.CPUPercent <= 0 {
+		t.Errorf("second sample CPUPercent = %f, want > 0", stats.CPUPercent)
+	}
+}
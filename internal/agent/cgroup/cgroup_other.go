@@ -0,0 +1,49 @@
+//go:build !linux
+
+package cgroup
+
+import "syscall"
+
+type Manager struct{}
+
+func NewManager(mountPoint, parent string) (*Manager, error) {
+	return nil, ErrUnsupported
+}
+
+func (m *Manager) Create(name string, limits Limits) (*Group, error) {
+	return nil, ErrUnsupported
+}
+
+func (m *Manager) Open(name string) (*Group, error) {
+	return nil, ErrUnsupported
+}
+
+type Group struct{}
+
+func (g *Group) Path() string {
+	return ""
+}
+
+func (g *Group) Apply(limits Limits) error {
+	return ErrUnsupported
+}
+
+func (g *Group) Attach(attr *syscall.SysProcAttr) (func(pid int), error) {
+	return nil, ErrUnsupported
+}
+
+func (g *Group) AddProcess(pid int) error {
+	return ErrUnsupported
+}
+
+func (g *Group) Stats() (*Stats, error) {
+	return nil, ErrUnsupported
+}
+
+func (g *Group) Kill() error {
+	return ErrUnsupported
+}
+
+func (g *Group) Destroy() error {
+	return nil
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -29,19 +30,109 @@ type GatewayConfig struct {
 }
 
 type ListenerConfig struct {
-	ID              string `mapstructure:"id"`
-	Protocol        string `mapstructure:"protocol"`
-	Port            int    `mapstructure:"port"`
-	ModuleID        string `mapstructure:"module_id"`
-	HighInteraction bool   `mapstructure:"high_interaction"`
+	ID              string        `mapstructure:"id"`
+	Protocol        string        `mapstructure:"protocol"`
+	Port            int           `mapstructure:"port"`
+	ModuleID        string        `mapstructure:"module_id"`
+	HighInteraction bool          `mapstructure:"high_interaction"`
+	// Terminal marks a high_interaction listener whose clients speak a
+	// plain-text terminal protocol such as telnet, so the sandbox records
+	// its HI sessions.
+	Terminal        bool          `mapstructure:"terminal"`
+	// Escalation lets the module hand a connection it is serving over to
+	// an HI session, e.g. after the client authenticates.
+	Escalation      bool          `mapstructure:"escalation"`
+	// SandboxImage is the sandbox image HI sessions of this listener run;
+	// empty for the master's default.
+	SandboxImage    string        `mapstructure:"sandbox_image"`
+	// IdleTimeout closes UDP flows (default 60s) and, when set, TCP
+	// connections that see no traffic for that long.
+	IdleTimeout     time.Duration `mapstructure:"idle_timeout"`
+
+	// Transparent is "redirect" or "tproxy" for a catch-all listener fed by
+	// firewall rules. Connections are routed by their original destination
+	// port; ModuleID receives ports without a route.
+	Transparent string            `mapstructure:"transparent"`
+	Routes      []PortRouteConfig `mapstructure:"routes"`
+
+	// Sniff routes connections to modules by the protocol detected in the
+	// client's first bytes. Unmatched protocols go to the port route or
+	// ModuleID.
+	Sniff        []SniffRouteConfig `mapstructure:"sniff"`
+	SniffTimeout time.Duration      `mapstructure:"sniff_timeout"`
+
+	// ProxyProtocol expects a HAProxy PROXY v1/v2 header from peers in
+	// TrustedProxies (CIDRs); other peers are treated as direct clients.
+	ProxyProtocol  bool     `mapstructure:"proxy_protocol"`
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+	TLS ListenerTLSConfig `mapstructure:"tls"`
+
+	Limits ListenerLimitsConfig `mapstructure:"limits"`
+
+	// Tarpit replaces the module with a handler that wastes the client's
+	// time; no module process is involved.
+	Tarpit ListenerTarpitConfig `mapstructure:"tarpit"`
+}
+
+// ListenerTarpitConfig selects a tarpit mode: "ssh" (endless banner), "http"
+// (endless response headers), "keepalive" (a byte every interval) or
+// "window" (a receive window that never opens). Interval defaults to 10s and
+// MaxDuration, how long a client is held, to 1h.
+type ListenerTarpitConfig struct {
+	Mode        string        `mapstructure:"mode"`
+	Interval    time.Duration `mapstructure:"interval"`
+	MaxDuration time.Duration `mapstructure:"max_duration"`
+}
+
+// ListenerLimitsConfig bounds what a single listener accepts. Zero values
+// disable a limit. Overflow is "reset" (default), "tarpit" or "queue".
+type ListenerLimitsConfig struct {
+	MaxConnections int           `mapstructure:"max_connections"`
+	MaxPerSource   int           `mapstructure:"max_per_source"`
+	SourceRate     float64       `mapstructure:"source_rate"`
+	SourceBurst    int           `mapstructure:"source_burst"`
+	SessionTimeout time.Duration `mapstructure:"session_timeout"`
+	Overflow       string        `mapstructure:"overflow"`
+	QueueTimeout   time.Duration `mapstructure:"queue_timeout"`
+	TarpitDuration time.Duration `mapstructure:"tarpit_duration"`
+}
+
+// LimitsConfig holds agent-wide connection limits.
+type LimitsConfig struct {
+	AcceptRate  float64 `mapstructure:"accept_rate"`
+	AcceptBurst int     `mapstructure:"accept_burst"`
+}
+
+// ListenerTLSConfig controls TLS handling at the listener. Terminate hands
+// the module cleartext; without CertFile, certificates are generated for
+// the name the client requests. Fingerprint computes JA3/JA4 either way.
+type ListenerTLSConfig struct {
+	Terminate    bool   `mapstructure:"terminate"`
+	Fingerprint  bool   `mapstructure:"fingerprint"`
+	CertFile     string `mapstructure:"cert_file"`
+	KeyFile      string `mapstructure:"key_file"`
+	CommonName   string `mapstructure:"common_name"`
+	Organization string `mapstructure:"organization"`
+}
+
+type SniffRouteConfig struct {
+	Protocol string `mapstructure:"protocol"`
+	ModuleID string `mapstructure:"module_id"`
+}
+
+type PortRouteConfig struct {
+	Ports    string `mapstructure:"ports"`
+	ModuleID string `mapstructure:"module_id"`
 }
 
 type ResourceLimitsConfig struct {
-	MaxMemoryMB      int64 `mapstructure:"max_memory_mb"`
-	MaxCPUPercent    int   `mapstructure:"max_cpu_percent"`
-	MaxOpenFiles     int64 `mapstructure:"max_open_files"`
-	MaxProcesses     int64 `mapstructure:"max_processes"`
-	NetworkBandwidth int64 `mapstructure:"network_bandwidth_kbps"`
+	MaxMemoryMB      int64         `mapstructure:"max_memory_mb"`
+	MaxCPUPercent    int           `mapstructure:"max_cpu_percent"`
+	MaxOpenFiles     int64         `mapstructure:"max_open_files"`
+	MaxProcesses     int64         `mapstructure:"max_processes"`
+	NetworkBandwidth int64         `mapstructure:"network_bandwidth_kbps"`
+	MaxExecutionTime time.Duration `mapstructure:"max_execution_time"`
 }
 
 type HealthCheckConfig struct {
@@ -57,6 +148,21 @@ type RestartPolicyConfig struct {
 	RestartDelay      time.Duration `mapstructure:"restart_delay"`
 	BackoffMultiplier float64       `mapstructure:"backoff_multiplier"`
 	MaxBackoffDelay   time.Duration `mapstructure:"max_backoff_delay"`
+
+	CrashLoopThreshold int           `mapstructure:"crash_loop_threshold"`
+	CrashLoopWindow    time.Duration `mapstructure:"crash_loop_window"`
+}
+
+type ConfinementConfig struct {
+	Enabled             bool     `mapstructure:"enabled"`
+	SeccompProfile      string   `mapstructure:"seccomp_profile"`
+	AllowSyscalls       []string `mapstructure:"allow_syscalls"`
+	Landlock            bool     `mapstructure:"landlock"`
+	ReadOnlyPaths       []string `mapstructure:"read_only_paths"`
+	ReadWritePaths      []string `mapstructure:"read_write_paths"`
+	NoNewPrivs          bool     `mapstructure:"no_new_privs"`
+	NewNetworkNamespace bool     `mapstructure:"new_network_namespace"`
+	NewMountNamespace   bool     `mapstructure:"new_mount_namespace"`
 }
 
 type ModuleConfig struct {
@@ -74,11 +180,31 @@ type ModuleConfig struct {
 	RequiresRoot        bool `mapstructure:"requires_root"`
 	CanHandleRawPackets bool `mapstructure:"can_handle_raw_packets"`
 
+	// MaxConnections caps concurrent connections across all listeners
+	// routing to the module.
+	MaxConnections int `mapstructure:"max_connections"`
+
 	ResourceLimits ResourceLimitsConfig `mapstructure:"resource_limits"`
 
 	HealthCheck HealthCheckConfig `mapstructure:"health_check"`
 
 	RestartPolicy RestartPolicyConfig `mapstructure:"restart_policy"`
+
+	Confinement ConfinementConfig `mapstructure:"confinement"`
+}
+
+// TarpitOnly reports whether the module has no image and only tarpit
+// listeners, so there is no process to run.
+func (m ModuleConfig) TarpitOnly() bool {
+	if m.Image != "" || len(m.Listeners) == 0 {
+		return false
+	}
+	for _, l := range m.Listeners {
+		if l.Tarpit.Mode == "" {
+			return false
+		}
+	}
+	return true
 }
 
 type RuntimeConfig struct {
@@ -88,6 +214,11 @@ type RuntimeConfig struct {
 	EnableContainerd      bool   `mapstructure:"enable_containerd"`
 	ContainerdAddress     string `mapstructure:"containerd_address"`
 	ContainerdNamespace   string   `mapstructure:"containerd_namespace"`
+	EnableSystemd         bool     `mapstructure:"enable_systemd"`
+	SystemdUserMode       bool     `mapstructure:"systemd_user_mode"`
+	SystemdSlice          string   `mapstructure:"systemd_slice"`
+	CgroupParent          string   `mapstructure:"cgroup_parent"`
+	EnableWasm            bool     `mapstructure:"enable_wasm"`
 	TrustedKeys           []string `mapstructure:"trusted_keys"`
 	ModuleCacheDir        string   `mapstructure:"module_cache_dir"`
 }
@@ -103,6 +234,17 @@ type AgentConfig struct {
 	Gateway      GatewayConfig      `mapstructure:"gateway"`
 	Modules      []ModuleConfig     `mapstructure:"modules"`
 	Runtime      RuntimeConfig      `mapstructure:"runtime"`
+	Limits       LimitsConfig       `mapstructure:"limits"`
+	Capture      CaptureConfig      `mapstructure:"capture"`
+}
+
+// CaptureConfig records the byte streams of forwarded connections and
+// uploads them with the session ID. Format is "pcapng" (default) or
+// "stream"; MaxSessionBytes caps the payload kept per session.
+type CaptureConfig struct {
+	Enabled         bool   `mapstructure:"enabled"`
+	Format          string `mapstructure:"format"`
+	MaxSessionBytes int64  `mapstructure:"max_session_bytes"`
 }
 
 func (c *AgentConfig) Validate() error {
@@ -137,11 +279,78 @@ func (c *AgentConfig) Validate() error {
 		c.Runtime.TrustedKeys = []string{c.DataDir + "/module-signing.pub"}
 	}
 
+	switch c.Capture.Format {
+	case "":
+		c.Capture.Format = "pcapng"
+	case "pcapng", "stream":
+	default:
+		return fmt.Errorf("unknown capture format %q", c.Capture.Format)
+	}
+	if c.Capture.MaxSessionBytes == 0 {
+		c.Capture.MaxSessionBytes = 1024 * 1024
+	}
+	if c.Capture.MaxSessionBytes < 0 {
+		return fmt.Errorf("capture.max_session_bytes must not be negative")
+	}
+
+	if c.Limits.AcceptRate > 0 && c.Limits.AcceptBurst == 0 {
+		c.Limits.AcceptBurst = int(c.Limits.AcceptRate) + 1
+	}
+
 	for i := range c.Modules {
 		mod := &c.Modules[i]
 		for j := range mod.Listeners {
-			if mod.Listeners[j].ModuleID == "" {
-				mod.Listeners[j].ModuleID = mod.ID
+			l := &mod.Listeners[j]
+			if l.ModuleID == "" {
+				l.ModuleID = mod.ID
+			}
+			switch l.Transparent {
+			case "":
+			case "redirect", "tproxy":
+				if !strings.HasPrefix(l.Protocol, "tcp") {
+					return fmt.Errorf("listener %s: transparent mode requires tcp", l.ID)
+				}
+			default:
+				return fmt.Errorf("listener %s: unknown transparent mode %q", l.ID, l.Transparent)
+			}
+			if len(l.Sniff) > 0 && !strings.HasPrefix(l.Protocol, "tcp") {
+				return fmt.Errorf("listener %s: protocol sniffing requires tcp", l.ID)
+			}
+			switch l.Limits.Overflow {
+			case "", "reset", "tarpit", "queue":
+			default:
+				return fmt.Errorf("listener %s: unknown overflow behavior %q", l.ID, l.Limits.Overflow)
+			}
+			switch l.Tarpit.Mode {
+			case "":
+			case "ssh", "http", "keepalive", "window":
+				if !strings.HasPrefix(l.Protocol, "tcp") {
+					return fmt.Errorf("listener %s: tarpit requires tcp", l.ID)
+				}
+				if l.HighInteraction {
+					return fmt.Errorf("listener %s: tarpit cannot be combined with high_interaction", l.ID)
+				}
+				// A window tarpit never moves a byte, so the idle timer
+				// would close every connection it holds.
+				if l.Tarpit.Mode == "window" && l.IdleTimeout > 0 {
+					return fmt.Errorf("listener %s: idle_timeout cannot be combined with tarpit mode window", l.ID)
+				}
+			default:
+				return fmt.Errorf("listener %s: unknown tarpit mode %q", l.ID, l.Tarpit.Mode)
+			}
+			if l.Terminal && !l.HighInteraction {
+				return fmt.Errorf("listener %s: terminal requires high_interaction", l.ID)
+			}
+			if l.SandboxImage != "" && !l.HighInteraction && !l.Escalation {
+				return fmt.Errorf("listener %s: sandbox_image requires high_interaction or escalation", l.ID)
+			}
+			if l.ProxyProtocol {
+				if !strings.HasPrefix(l.Protocol, "tcp") {
+					return fmt.Errorf("listener %s: proxy_protocol requires tcp", l.ID)
+				}
+				if len(l.TrustedProxies) == 0 {
+					return fmt.Errorf("listener %s: proxy_protocol requires trusted_proxies", l.ID)
+				}
 			}
 		}
 	}
@@ -0,0 +1,135 @@
+// Package confine applies seccomp, Landlock and namespace isolation to
+// userspace modules. The agent re-executes itself as a small shim that sets
+// up the confinement on its own process and then execs the module binary, so
+// nothing has to be configured between fork and exec.
+package confine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("module confinement is only supported on linux")
+
+const (
+	// ShimArg is the first argument the agent binary is re-executed with
+	// when it should act as the confinement shim.
+	ShimArg = "__gimpel_confine"
+
+	// EnvProfile carries the JSON encoded Profile to the shim. It is removed
+	// from the environment before the module is executed.
+	EnvProfile = "GIMPEL_CONFINE_PROFILE"
+
+	SeccompNone    = "none"
+	SeccompDefault = "default"
+)
+
+type Profile struct {
+	// Seccomp is "none", "default" or the path to a JSON file with a list of
+	// allowed syscall names.
+	Seccomp string `yaml:"seccomp" json:"seccomp,omitempty"`
+
+	AllowSyscalls []string `yaml:"allow_syscalls" json:"allow_syscalls,omitempty"`
+
+	Landlock bool `yaml:"landlock" json:"landlock,omitempty"`
+
+	ReadOnlyPaths []string `yaml:"read_only_paths" json:"read_only_paths,omitempty"`
+
+	ReadWritePaths []string `yaml:"read_write_paths" json:"read_write_paths,omitempty"`
+
+	NoNewPrivs bool `yaml:"no_new_privs" json:"no_new_privs,omitempty"`
+
+	NewNetworkNamespace bool `yaml:"new_network_namespace" json:"new_network_namespace,omitempty"`
+
+	NewMountNamespace bool `yaml:"new_mount_namespace" json:"new_mount_namespace,omitempty"`
+
+	// MaxOpenFiles is set by the agent from the module's resource limits.
+	MaxOpenFiles uint64 `yaml:"-" json:"max_open_files,omitempty"`
+}
+
+func (p *Profile) seccompEnabled() bool {
+	return p.Seccomp != "" && p.Seccomp != SeccompNone
+}
+
+// Syscalls returns the allowlist for the profile: the built-in or file based
+// list plus any extra syscalls.
+func (p *Profile) Syscalls() ([]string, error) {
+	if !p.seccompEnabled() {
+		return nil, nil
+	}
+
+	var names []string
+	if p.Seccomp == SeccompDefault {
+		names = append(names, defaultSyscalls...)
+	} else {
+		data, err := os.ReadFile(p.Seccomp)
+		if err != nil {
+			return nil, fmt.Errorf("reading seccomp profile: %w", err)
+		}
+		if err := json.Unmarshal(data, &names); err != nil {
+			return nil, fmt.Errorf("parsing seccomp profile %s: %w", p.Seccomp, err)
+		}
+	}
+	names = append(names, p.AllowSyscalls...)
+
+	// The shim execs the module after the filter is installed.
+	names = append(names, "execve")
+
+	seen := make(map[string]bool, len(names))
+	result := names[:0]
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+func (p *Profile) validatePaths() error {
+	for _, path := range append(append([]string{}, p.ReadOnlyPaths...), p.ReadWritePaths...) {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("landlock path %q must be absolute", path)
+		}
+	}
+	return nil
+}
+
+// defaultSyscalls covers what Go and C network daemons need at runtime. It
+// deliberately leaves out mount, ptrace, bpf, kexec, module loading, keyring
+// and namespace syscalls.
+var defaultSyscalls = []string{
+	"accept", "accept4", "access", "arch_prctl", "bind", "brk",
+	"capget", "chdir", "clock_getres", "clock_gettime", "clock_nanosleep",
+	"clone", "clone3", "close", "close_range", "connect", "dup", "dup2", "dup3",
+	"epoll_create", "epoll_create1", "epoll_ctl", "epoll_pwait", "epoll_pwait2", "epoll_wait",
+	"eventfd", "eventfd2", "exit", "exit_group",
+	"faccessat", "faccessat2", "fadvise64", "fallocate", "fchdir", "fchmod", "fchmodat",
+	"fcntl", "fdatasync", "flock", "fork", "fstat", "fstatfs", "fsync", "ftruncate",
+	"futex", "getcwd", "getdents", "getdents64", "getegid", "geteuid", "getgid",
+	"getgroups", "getitimer", "getpeername", "getpgid", "getpgrp", "getpid", "getppid",
+	"getpriority", "getrandom", "getresgid", "getresuid", "getrlimit", "getrusage",
+	"getsid", "getsockname", "getsockopt", "gettid", "gettimeofday", "getuid",
+	"ioctl", "kill", "listen", "lseek", "lstat", "madvise", "membarrier",
+	"mincore", "mkdir", "mkdirat", "mlock", "mmap", "mprotect", "mremap",
+	"msync", "munlock", "munmap", "nanosleep", "newfstatat", "open", "openat", "openat2",
+	"pipe", "pipe2", "poll", "ppoll", "prctl", "pread64", "preadv", "preadv2",
+	"prlimit64", "pselect6", "pwrite64", "pwritev", "pwritev2",
+	"read", "readlink", "readlinkat", "readv", "recvfrom", "recvmmsg", "recvmsg",
+	"rename", "renameat", "renameat2", "restart_syscall", "rmdir", "rseq",
+	"rt_sigaction", "rt_sigpending", "rt_sigprocmask", "rt_sigqueueinfo", "rt_sigreturn",
+	"rt_sigsuspend", "rt_sigtimedwait", "rt_tgsigqueueinfo",
+	"sched_getaffinity", "sched_yield", "select", "sendfile", "sendmmsg", "sendmsg", "sendto",
+	"set_robust_list", "set_tid_address", "setitimer", "setsockopt", "shutdown",
+	"sigaltstack", "socket", "socketpair", "stat", "statfs", "statx", "sysinfo",
+	"tgkill", "time", "timer_create", "timer_delete", "timer_gettime", "timer_settime",
+	"timerfd_create", "timerfd_gettime", "timerfd_settime", "tkill",
+	"umask", "uname", "unlink", "unlinkat", "utimensat", "vfork", "wait4", "waitid",
+	"write", "writev",
+}
@@ -0,0 +1,281 @@
+//go:build linux
+
+package confine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	seccomp "github.com/elastic/go-seccomp-bpf"
+	"github.com/elastic/go-seccomp-bpf/arch"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	llsyscall "github.com/landlock-lsm/go-landlock/landlock/syscall"
+	"golang.org/x/sys/unix"
+)
+
+// System paths stay readable under Landlock so dynamically linked modules can
+// load their libraries and resolve names.
+var (
+	systemReadOnlyDirs  = []string{"/usr", "/lib", "/lib64"}
+	systemReadOnlyFiles = []string{"/etc/ld.so.cache", "/etc/localtime", "/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf"}
+)
+
+// Validate checks that the profile can be applied on this host.
+func (p *Profile) Validate() error {
+	if err := p.validatePaths(); err != nil {
+		return err
+	}
+
+	if p.Landlock {
+		if _, err := llsyscall.LandlockGetABIVersion(); err != nil {
+			return fmt.Errorf("landlock is not supported by the kernel: %w", err)
+		}
+	}
+
+	if p.seccompEnabled() {
+		if !seccomp.Supported() {
+			return fmt.Errorf("seccomp is not supported by the kernel")
+		}
+		policy, err := p.policy()
+		if err != nil {
+			return err
+		}
+		if _, err := policy.Assemble(); err != nil {
+			return fmt.Errorf("invalid seccomp profile: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Profile) policy() (*seccomp.Policy, error) {
+	names, err := p.Syscalls()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := arch.GetInfo("")
+	if err != nil {
+		return nil, fmt.Errorf("seccomp: %w", err)
+	}
+
+	builtin := make(map[string]bool, len(defaultSyscalls))
+	if p.Seccomp == SeccompDefault {
+		for _, name := range defaultSyscalls {
+			builtin[name] = true
+		}
+	}
+
+	allowed := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := info.SyscallNames[name]; !ok {
+			// The built-in list includes legacy syscalls that only exist on
+			// some architectures.
+			if builtin[name] {
+				continue
+			}
+			return nil, fmt.Errorf("unknown syscall %q for %s", name, info.Name)
+		}
+		allowed = append(allowed, name)
+	}
+
+	return &seccomp.Policy{
+		DefaultAction: seccomp.ActionErrno,
+		Syscalls: []seccomp.SyscallGroup{
+			{Action: seccomp.ActionAllow, Names: allowed},
+		},
+	}, nil
+}
+
+// Command builds a command that runs path under the profile. The command
+// re-executes the current binary, which must call Main early in main().
+func Command(ctx context.Context, profile *Profile, path string, args ...string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("resolving agent executable: %w", err)
+	}
+
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return nil, fmt.Errorf("encoding confinement profile: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, self, append([]string{ShimArg, path}, args...)...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", EnvProfile, data))
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+
+	if profile.NewNetworkNamespace {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if profile.NewMountNamespace {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if cmd.SysProcAttr.Cloneflags != 0 && os.Geteuid() != 0 {
+		// Unprivileged agents need a user namespace to create the others.
+		uid, gid := os.Getuid(), os.Getgid()
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	}
+
+	return cmd, nil
+}
+
+// Wrap makes cmd start through the shim, which applies profile before it
+// executes the original program. It is meant for profiles that only set
+// limits; namespaces need Command.
+func Wrap(cmd *exec.Cmd, profile *Profile) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("resolving agent executable: %w", err)
+	}
+
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return fmt.Errorf("encoding confinement profile: %w", err)
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, fmt.Sprintf("%s=%s", EnvProfile, data))
+	cmd.Args = append([]string{self, ShimArg, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	return nil
+}
+
+// Main runs the confinement shim when the process was started by Command and
+// never returns in that case. It is a no-op otherwise.
+func Main() {
+	if len(os.Args) < 3 || os.Args[1] != ShimArg {
+		return
+	}
+
+	if err := runShim(os.Args[2], os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "gimpel confinement: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+func runShim(path string, args []string) error {
+	var profile Profile
+	if err := json.Unmarshal([]byte(os.Getenv(EnvProfile)), &profile); err != nil {
+		return fmt.Errorf("decoding profile: %w", err)
+	}
+	os.Unsetenv(EnvProfile)
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	if profile.MaxOpenFiles > 0 {
+		limit := &unix.Rlimit{Cur: profile.MaxOpenFiles, Max: profile.MaxOpenFiles}
+		if err := unix.Setrlimit(unix.RLIMIT_NOFILE, limit); err != nil {
+			return fmt.Errorf("setting RLIMIT_NOFILE: %w", err)
+		}
+	}
+
+	if profile.NewMountNamespace {
+		if err := setupMountNamespace(); err != nil {
+			return err
+		}
+	}
+
+	if profile.NewNetworkNamespace {
+		if err := loopbackUp(); err != nil {
+			return err
+		}
+	}
+
+	if profile.Landlock {
+		if err := applyLandlock(&profile, path); err != nil {
+			return err
+		}
+	}
+
+	if profile.NoNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("setting no_new_privs: %w", err)
+		}
+	}
+
+	if profile.seccompEnabled() {
+		policy, err := profile.policy()
+		if err != nil {
+			return err
+		}
+		filter := seccomp.Filter{
+			NoNewPrivs: true,
+			Flag:       seccomp.FilterFlagTSync,
+			Policy:     *policy,
+		}
+		if err := seccomp.LoadFilter(filter); err != nil {
+			return fmt.Errorf("loading seccomp filter: %w", err)
+		}
+	}
+
+	return syscall.Exec(path, args, os.Environ())
+}
+
+func setupMountNamespace() error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	if err := unix.Mount("tmpfs", "/tmp", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "size=64m,mode=1777"); err != nil {
+		return fmt.Errorf("mounting private /tmp: %w", err)
+	}
+	return nil
+}
+
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("opening control socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("reading lo flags: %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("bringing up lo: %w", err)
+	}
+	return nil
+}
+
+func applyLandlock(profile *Profile, path string) error {
+	rules := []landlock.Rule{
+		landlock.ROFiles(path),
+		landlock.RODirs(systemReadOnlyDirs...).IgnoreIfMissing(),
+		landlock.ROFiles(systemReadOnlyFiles...).IgnoreIfMissing(),
+		landlock.RWFiles("/dev/null", "/dev/zero", "/dev/urandom", "/dev/random").IgnoreIfMissing(),
+	}
+	if len(profile.ReadOnlyPaths) > 0 {
+		rules = append(rules, landlock.RODirs(profile.ReadOnlyPaths...))
+	}
+	if len(profile.ReadWritePaths) > 0 {
+		rules = append(rules, landlock.RWDirs(profile.ReadWritePaths...))
+	}
+
+	if err := landlock.V5.BestEffort().RestrictPaths(rules...); err != nil {
+		return fmt.Errorf("applying landlock rules: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package confine
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	seccomp "github.com/elastic/go-seccomp-bpf"
+	llsyscall "github.com/landlock-lsm/go-landlock/landlock/syscall"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary doubles as the shim for TestCommandRunsConfined.
+	Main()
+	os.Exit(m.Run())
+}
+
+func TestProfileValidate(t *testing.T) {
+	dir := t.TempDir()
+	custom := filepath.Join(dir, "profile.json")
+	if err := os.WriteFile(custom, []byte(`["read", "write", "exit_group"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		profile Profile
+		wantErr string
+	}{
+		{name: "default", profile: Profile{Seccomp: SeccompDefault, AllowSyscalls: []string{"chroot"}}},
+		{name: "none", profile: Profile{Seccomp: SeccompNone, AllowSyscalls: []string{"bogus"}}},
+		{name: "custom file", profile: Profile{Seccomp: custom}},
+		{name: "unknown syscall", profile: Profile{Seccomp: SeccompDefault, AllowSyscalls: []string{"not_a_syscall"}}, wantErr: "unknown syscall"},
+		{name: "missing file", profile: Profile{Seccomp: filepath.Join(dir, "missing.json")}, wantErr: "reading seccomp profile"},
+		{name: "relative path", profile: Profile{Landlock: true, ReadOnlyPaths: []string{"data"}}, wantErr: "must be absolute"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.profile.seccompEnabled() && !seccomp.Supported() {
+				t.Skip("seccomp not supported")
+			}
+			err := tt.profile.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSyscallsDeduplicatesAndAllowsExec(t *testing.T) {
+	p := Profile{Seccomp: SeccompDefault, AllowSyscalls: []string{"read", "chroot"}}
+	names, err := p.Syscalls()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := make(map[string]int)
+	for _, name := range names {
+		count[name]++
+	}
+	if count["read"] != 1 || count["chroot"] != 1 || count["execve"] != 1 {
+		t.Errorf("Syscalls() counts read=%d chroot=%d execve=%d", count["read"], count["chroot"], count["execve"])
+	}
+	if count["mount"] != 0 || count["ptrace"] != 0 {
+		t.Error("default profile must not allow mount or ptrace")
+	}
+}
+
+func TestValidateRequiresLandlock(t *testing.T) {
+	_, abiErr := llsyscall.LandlockGetABIVersion()
+	err := (&Profile{Landlock: true}).Validate()
+	if abiErr != nil && err == nil {
+		t.Errorf("Validate accepted Landlock on a kernel without it: %v", abiErr)
+	}
+	if abiErr == nil && err != nil {
+		t.Errorf("Validate rejected Landlock on a kernel with it: %v", err)
+	}
+}
+
+func TestCommandRunsConfined(t *testing.T) {
+	if !seccomp.Supported() {
+		t.Skip("seccomp not supported")
+	}
+	sh, err := filepath.EvalSymlinks("/bin/sh")
+	if err != nil {
+		t.Skip("no /bin/sh")
+	}
+
+	profile := &Profile{Seccomp: SeccompDefault, NoNewPrivs: true}
+	cmd, err := Command(context.Background(), profile, sh, "-c", "grep -q '^NoNewPrivs:[[:space:]]*1' /proc/self/status && echo $"+EnvProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("confined command failed: %v: %s", err, out)
+	}
+	if strings.TrimSpace(string(out)) != "" {
+		t.Errorf("profile leaked into module environment: %q", out)
+	}
+}
+
+func TestWrapSetsOpenFilesLimit(t *testing.T) {
+	sh, err := filepath.EvalSymlinks("/bin/sh")
+	if err != nil {
+		t.Skip("no /bin/sh")
+	}
+
+	cmd := exec.Command(sh, "-c", "ulimit -n; ulimit -Hn")
+	if err := Wrap(cmd, &Profile{MaxOpenFiles: 64}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("wrapped command failed: %v: %s", err, out)
+	}
+	if got := strings.Fields(string(out)); len(got) != 2 || got[0] != "64" || got[1] != "64" {
+		t.Errorf("open files limit = %q, want 64 64", out)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package confine
+
+import (
+	"context"
+	"os/exec"
+)
+
+func (p *Profile) Validate() error {
+	return ErrUnsupported
+}
+
+func Command(ctx context.Context, profile *Profile, path string, args ...string) (*exec.Cmd, error) {
+	return nil, ErrUnsupported
+}
+
+func Wrap(cmd *exec.Cmd, profile *Profile) error {
+	return ErrUnsupported
+}
+
+func Main() {}
@@ -173,13 +173,23 @@ func (c *Client) RunHeartbeatLoop(ctx context.Context, interval time.Duration, m
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	failures := 0
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-ticker.C:
-			if err := c.sendHeartbeat(ctx, metricsCollector); err != nil {
-				log.WithError(err).Warn("heartbeat failed")
+			err := c.sendHeartbeat(ctx, metricsCollector)
+			switch {
+			case err != nil && failures == 0:
+				log.WithError(err).Warn("heartbeat failed, control plane unreachable")
+				failures++
+			case err != nil:
+				log.WithError(err).WithField("failures", failures).Debug("heartbeat failed")
+				failures++
+			case failures > 0:
+				log.WithField("failures", failures).Info("control plane reachable again")
+				failures = 0
 			}
 		}
 	}
@@ -191,7 +201,12 @@ func (c *Client) sendHeartbeat(ctx context.Context, metricsCollector func() (flo
 	c.mu.RUnlock()
 
 	if ctrl == nil {
-		return fmt.Errorf("not connected")
+		if err := c.Connect(ctx); err != nil {
+			return fmt.Errorf("not connected: %w", err)
+		}
+		c.mu.RLock()
+		ctrl = c.ctrl
+		c.mu.RUnlock()
 	}
 
 	cpuUsage, memUsage := metricsCollector()
@@ -213,7 +228,10 @@ func (c *Client) sendHeartbeat(ctx context.Context, metricsCollector func() (flo
 	return nil
 }
 
-func (c *Client) RequestHISession(ctx context.Context, listenerID, sourceIP string, sourcePort uint32) (*gimpelv1.HISessionResponse, error) {
+// RequestHISession asks the master for a sandbox session for a source.
+// escalatedBy names the module handing over a live connection, if any, and
+// image the sandbox image to run, if not the master's default.
+func (c *Client) RequestHISession(ctx context.Context, listenerID, sourceIP string, sourcePort uint32, escalatedBy, image string) (*gimpelv1.HISessionResponse, error) {
 	c.mu.RLock()
 	ctrl := c.ctrl
 	c.mu.RUnlock()
@@ -225,7 +243,29 @@ func (c *Client) RequestHISession(ctx context.Context, listenerID, sourceIP stri
 	return ctrl.RequestHISession(ctx, &gimpelv1.HISessionRequest{
 		AgentId:    c.identity.GetAgentID(),
 		ListenerId: listenerID,
-		SourceIp:   sourceIP,
+		SourceIp:     sourceIP,
+		SourcePort:   sourcePort,
+		EscalatedBy:  escalatedBy,
+		SandboxImage: image,
+	})
+}
+
+// ReportHISessionClosed tells the master a tunnel into an HI session closed,
+// so it can stop the session once it goes idle.
+func (c *Client) ReportHISessionClosed(ctx context.Context, sessionID string, sourcePort uint32, reason string) error {
+	c.mu.RLock()
+	ctrl := c.ctrl
+	c.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	_, err := ctrl.ReportHISessionClosed(ctx, &gimpelv1.HISessionClosedRequest{
+		AgentId:    c.identity.GetAgentID(),
+		SessionId:  sessionID,
 		SourcePort: sourcePort,
+		Reason:     reason,
 	})
+	return err
 }
@@ -0,0 +1,237 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/module"
+	"gimpel/pkg/tunnel"
+)
+
+// escalationTimeout bounds the master's answer to an escalation request.
+const escalationTimeout = 30 * time.Second
+
+// escalation is a connection on a listener with escalation enabled that its
+// module may hand over to an HI session.
+type escalation struct {
+	ml         *ManagedListener
+	moduleID   string
+	sourceIP   string
+	sourcePort uint32
+
+	mu sync.Mutex
+	// pending is set while an escalation is being set up, so a second
+	// request is refused without holding mu over the network calls.
+	pending bool
+	tunnel  *tunnel.Conn
+	// endpoint, key and meta describe the escalated tunnel, for the
+	// transcript tunnel a module may open next to it.
+	endpoint   string
+	key        []byte
+	meta       *tunnel.Metadata
+	transcript *tunnel.Conn
+}
+
+// allowEscalation registers a connection handed to moduleID and returns the
+// function that forgets it once the connection closes.
+func (m *Manager) allowEscalation(ml *ManagedListener, moduleID, connID, sourceIP string, sourcePort uint32) func() {
+	if !ml.Config.Escalation {
+		return func() {}
+	}
+
+	m.escalationsMu.Lock()
+	m.escalations[connID] = &escalation{
+		ml:         ml,
+		moduleID:   moduleID,
+		sourceIP:   sourceIP,
+		sourcePort: sourcePort,
+	}
+	m.escalationsMu.Unlock()
+
+	return func() {
+		m.escalationsMu.Lock()
+		delete(m.escalations, connID)
+		m.escalationsMu.Unlock()
+	}
+}
+
+// HandleAgentRequest serves escalation requests from modules. It
+// implements module.AgentHandler.
+func (m *Manager) HandleAgentRequest(moduleID string, req *module.AgentRequest, conn net.Conn) {
+	defer conn.Close()
+
+	m.escalationsMu.Lock()
+	esc := m.escalations[req.ConnectionID]
+	m.escalationsMu.Unlock()
+	if esc == nil || esc.moduleID != moduleID {
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: "connection cannot be escalated"})
+		return
+	}
+
+	switch req.Op {
+	case module.AgentOpEscalate:
+		m.escalate(esc, req, conn)
+	case module.AgentOpRecord:
+		m.record(esc, conn)
+	case module.AgentOpResize:
+		esc.mu.Lock()
+		tc, transcript := esc.tunnel, esc.transcript
+		esc.mu.Unlock()
+		if tc == nil {
+			module.WriteAgentResponse(conn, &module.AgentResponse{Error: "connection is not escalated"})
+			return
+		}
+		size := tunnel.WindowSize{Cols: req.Cols, Rows: req.Rows}
+		if err := tc.Resize(size); err != nil {
+			module.WriteAgentResponse(conn, &module.AgentResponse{Error: err.Error()})
+			return
+		}
+		if transcript != nil {
+			transcript.Resize(size)
+		}
+		module.WriteAgentResponse(conn, &module.AgentResponse{OK: true})
+	default:
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: fmt.Sprintf("unknown op %q", req.Op)})
+	}
+}
+
+// escalate opens an HI session for the connection and splices the module's
+// agent socket connection onto the sandbox tunnel.
+func (m *Manager) escalate(esc *escalation, req *module.AgentRequest, conn net.Conn) {
+	esc.mu.Lock()
+	if esc.tunnel != nil || esc.pending {
+		esc.mu.Unlock()
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: "connection is already escalated"})
+		return
+	}
+	esc.pending = true
+	esc.mu.Unlock()
+
+	failed := func() {
+		esc.mu.Lock()
+		esc.pending = false
+		esc.mu.Unlock()
+	}
+
+	logger := log.WithFields(log.Fields{
+		"connection_id": req.ConnectionID,
+		"module":        esc.moduleID,
+		"listener":      esc.ml.Config.ID,
+	})
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), escalationTimeout)
+	resp, err := m.controlClient.RequestHISession(reqCtx, esc.ml.Config.ID, esc.sourceIP, esc.sourcePort, esc.moduleID, esc.ml.Config.SandboxImage)
+	cancel()
+	if err != nil {
+		failed()
+		logger.WithError(err).Warn("failed to request HI session for escalation")
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: "no HI session available"})
+		return
+	}
+
+	meta := &tunnel.Metadata{
+		SessionID:  resp.SessionId,
+		ListenerID: esc.ml.Config.ID,
+		SourceIP:   esc.sourceIP,
+		SourcePort: esc.sourcePort,
+		Protocol:   esc.ml.Config.Protocol,
+		Labels:     map[string]string{"escalated_by": esc.moduleID},
+		Terminal:   req.Terminal,
+	}
+	tc, err := dialSandbox(resp.SandboxEndpoint, resp.TunnelKey, meta)
+	if err != nil {
+		failed()
+		logger.WithError(err).Warn("failed to reach sandbox for escalation")
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: "sandbox unreachable"})
+		m.reportHIClosed(resp.SessionId, esc.sourcePort, err.Error())
+		return
+	}
+	esc.mu.Lock()
+	esc.pending = false
+	esc.tunnel = tc
+	esc.endpoint, esc.key, esc.meta = resp.SandboxEndpoint, resp.TunnelKey, meta
+	esc.mu.Unlock()
+
+	defer func() {
+		tc.Close()
+		esc.mu.Lock()
+		esc.tunnel = nil
+		esc.mu.Unlock()
+	}()
+
+	if err := module.WriteAgentResponse(conn, &module.AgentResponse{OK: true, SessionID: resp.SessionId}); err != nil {
+		m.reportHIClosed(resp.SessionId, esc.sourcePort, err.Error())
+		return
+	}
+	logger.WithField("session_id", resp.SessionId).Info("connection escalated to HI session")
+
+	reason := "closed"
+	if err := splice(context.Background(), conn, tc); err != nil && !errors.Is(err, io.EOF) {
+		reason = err.Error()
+	}
+	m.reportHIClosed(resp.SessionId, esc.sourcePort, reason)
+}
+
+// record opens a transcript tunnel into the HI session the connection was
+// escalated to and splices the module's agent socket connection onto it.
+// The module writes a copy of the terminal session it relays there for
+// the sandbox to record.
+func (m *Manager) record(esc *escalation, conn net.Conn) {
+	esc.mu.Lock()
+	if esc.tunnel == nil {
+		esc.mu.Unlock()
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: "connection is not escalated"})
+		return
+	}
+	if esc.transcript != nil {
+		esc.mu.Unlock()
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: "connection is already recorded"})
+		return
+	}
+	endpoint, key := esc.endpoint, esc.key
+	meta := *esc.meta
+	meta.Transcript = true
+	esc.mu.Unlock()
+
+	logger := log.WithFields(log.Fields{
+		"session_id": meta.SessionID,
+		"module":     esc.moduleID,
+	})
+
+	tc, err := dialSandbox(endpoint, key, &meta)
+	if err != nil {
+		logger.WithError(err).Warn("failed to open transcript tunnel")
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: "sandbox unreachable"})
+		return
+	}
+	defer tc.Close()
+
+	esc.mu.Lock()
+	if esc.tunnel == nil || esc.transcript != nil {
+		esc.mu.Unlock()
+		module.WriteAgentResponse(conn, &module.AgentResponse{Error: "connection cannot be recorded"})
+		return
+	}
+	esc.transcript = tc
+	esc.mu.Unlock()
+
+	defer func() {
+		esc.mu.Lock()
+		esc.transcript = nil
+		esc.mu.Unlock()
+	}()
+
+	if err := module.WriteAgentResponse(conn, &module.AgentResponse{OK: true, SessionID: meta.SessionID}); err != nil {
+		return
+	}
+	if err := splice(context.Background(), conn, tc); err != nil && !errors.Is(err, io.EOF) {
+		logger.WithError(err).Debug("transcript tunnel closed")
+	}
+}
@@ -0,0 +1,408 @@
+package listener
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	"gimpel/internal/agent/config"
+)
+
+const (
+	overflowReset  = "reset"
+	overflowTarpit = "tarpit"
+	overflowQueue  = "queue"
+
+	defaultQueueTimeout   = 10 * time.Second
+	defaultTarpitDuration = time.Minute
+
+	// maxHeldConnections bounds connections kept open by the tarpit
+	// overflow behavior; beyond it they are reset.
+	maxHeldConnections = 4096
+
+	sourceSweepInterval = time.Minute
+	sourceIdleExpiry    = 5 * time.Minute
+)
+
+// Limit names reported in telemetry.
+const (
+	limitAcceptRate        = "accept_rate"
+	limitMaxConnections    = "max_connections"
+	limitSourceRate        = "source_rate"
+	limitSourceConnections = "source_connections"
+	limitModuleConnections = "module_connections"
+)
+
+type listenerLimits struct {
+	cfg   config.ListenerLimitsConfig
+	slots chan struct{}
+
+	mu        sync.Mutex
+	sources   map[string]*sourceState
+	lastSweep time.Time
+
+	// events throttles limit telemetry so a flood does not become an
+	// event flood; suppressed counts what was dropped.
+	events     *rate.Limiter
+	suppressed atomic.Int64
+}
+
+type sourceState struct {
+	limiter  *rate.Limiter
+	active   int
+	lastSeen time.Time
+}
+
+func newListenerLimits(cfg config.ListenerLimitsConfig) *listenerLimits {
+	if cfg.Overflow == "" {
+		cfg.Overflow = overflowReset
+	}
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = defaultQueueTimeout
+	}
+	if cfg.TarpitDuration <= 0 {
+		cfg.TarpitDuration = defaultTarpitDuration
+	}
+	if cfg.SourceRate > 0 && cfg.SourceBurst <= 0 {
+		cfg.SourceBurst = 1
+	}
+
+	l := &listenerLimits{
+		cfg:       cfg,
+		sources:   make(map[string]*sourceState),
+		lastSweep: time.Now(),
+		events:    rate.NewLimiter(rate.Limit(1), 10),
+	}
+	if cfg.MaxConnections > 0 {
+		l.slots = make(chan struct{}, cfg.MaxConnections)
+	}
+	return l
+}
+
+// acquireConn takes one of the listener's connection slots, waiting up to
+// the queue timeout if wait is set. The returned release must be called
+// once the connection is done; it is nil if the limit tripped.
+func (l *listenerLimits) acquireConn(ctx context.Context, wait bool) func() {
+	if l.slots == nil {
+		return func() {}
+	}
+	if wait {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.cfg.QueueTimeout)
+		defer cancel()
+	}
+	if !acquireSlot(ctx, l.slots, wait) {
+		return nil
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-l.slots }) }
+}
+
+// acquireSource applies the per-source rate and concurrency limits. On
+// failure it returns a nil release and the name of the tripped limit.
+func (l *listenerLimits) acquireSource(ctx context.Context, sourceIP string, wait bool) (func(), string) {
+	src := l.source(sourceIP)
+
+	if src.limiter != nil {
+		if wait {
+			ctx, cancel := context.WithTimeout(ctx, l.cfg.QueueTimeout)
+			err := src.limiter.Wait(ctx)
+			cancel()
+			if err != nil {
+				l.releaseSource(sourceIP)
+				return nil, limitSourceRate
+			}
+		} else if !src.limiter.Allow() {
+			l.releaseSource(sourceIP)
+			return nil, limitSourceRate
+		}
+	}
+
+	if l.cfg.MaxPerSource > 0 {
+		l.mu.Lock()
+		over := src.active > l.cfg.MaxPerSource
+		l.mu.Unlock()
+		if over {
+			l.releaseSource(sourceIP)
+			return nil, limitSourceConnections
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { l.releaseSource(sourceIP) }) }, ""
+}
+
+// source returns the state for sourceIP with the new connection counted
+// as active.
+func (l *listenerLimits) source(sourceIP string) *sourceState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > sourceSweepInterval {
+		for ip, s := range l.sources {
+			if s.active == 0 && now.Sub(s.lastSeen) > sourceIdleExpiry {
+				delete(l.sources, ip)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	s, ok := l.sources[sourceIP]
+	if !ok {
+		s = &sourceState{}
+		if l.cfg.SourceRate > 0 {
+			s.limiter = rate.NewLimiter(rate.Limit(l.cfg.SourceRate), l.cfg.SourceBurst)
+		}
+		l.sources[sourceIP] = s
+	}
+	s.active++
+	s.lastSeen = now
+	return s
+}
+
+func (l *listenerLimits) releaseSource(sourceIP string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.sources[sourceIP]; ok {
+		s.active--
+		s.lastSeen = time.Now()
+	}
+}
+
+// acquireSlot takes a slot from a semaphore channel; a nil channel means
+// no limit.
+func acquireSlot(ctx context.Context, slots chan struct{}, wait bool) bool {
+	if slots == nil {
+		return true
+	}
+	if !wait {
+		select {
+		case slots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// acquireModule enforces the module's MaxConcurrentConnections across all
+// listeners. It returns nil if the module is at its limit.
+func (m *Manager) acquireModule(ctx context.Context, moduleID string, wait bool, timeout time.Duration) func() {
+	slots := m.moduleSlots(moduleID)
+	if slots == nil {
+		return func() {}
+	}
+
+	if wait {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if !acquireSlot(ctx, slots, wait) {
+		return nil
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }
+}
+
+func (m *Manager) moduleSlots(moduleID string) chan struct{} {
+	m.slotsMu.Lock()
+	defer m.slotsMu.Unlock()
+
+	if slots, ok := m.moduleConns[moduleID]; ok {
+		return slots
+	}
+
+	// Wait for the module to be running before fixing its limit.
+	inst := m.supervisor.GetInstance(moduleID)
+	if inst == nil || inst.Spec == nil {
+		return nil
+	}
+
+	var slots chan struct{}
+	if max := inst.Spec.Capabilities.MaxConcurrentConnections; max > 0 {
+		slots = make(chan struct{}, max)
+	}
+	m.moduleConns[moduleID] = slots
+	return slots
+}
+
+// overflow disposes of a connection that tripped a limit.
+func (m *Manager) overflow(ctx context.Context, ml *ManagedListener, conn net.Conn, moduleID, limit string) {
+	// A held connection must not keep the slots it was admitted with.
+	if tracked, ok := conn.(*trackedConn); ok {
+		tracked.release()
+		conn = tracked.Conn
+	}
+
+	sourceIP, _ := splitAddr(conn.RemoteAddr())
+	action := ml.limits.cfg.Overflow
+	if action == overflowQueue {
+		// The queue wait already timed out.
+		action = overflowReset
+	}
+	if action == overflowTarpit && m.held.Add(1) > maxHeldConnections {
+		m.held.Add(-1)
+		action = overflowReset
+	}
+
+	log.WithFields(log.Fields{
+		"listener": ml.Config.ID,
+		"source":   conn.RemoteAddr().String(),
+		"limit":    limit,
+		"action":   action,
+	}).Debug("connection limit exceeded")
+	m.emitLimitExceeded(ml, moduleID, sourceIP, limit, action)
+
+	if action == overflowTarpit {
+		go func() {
+			defer m.held.Add(-1)
+			defer conn.Close()
+
+			timer := time.NewTimer(ml.limits.cfg.TarpitDuration)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+		}()
+		return
+	}
+
+	resetConn(conn)
+}
+
+func (m *Manager) emitLimitExceeded(ml *ManagedListener, moduleID, sourceIP, limit, action string) {
+	if m.emitter == nil {
+		return
+	}
+	if !ml.limits.events.Allow() {
+		ml.limits.suppressed.Add(1)
+		return
+	}
+	m.emitter.EmitLimitExceeded(moduleID, sourceIP, map[string]string{
+		"listener":   ml.Config.ID,
+		"limit":      limit,
+		"action":     action,
+		"suppressed": strconv.FormatInt(ml.limits.suppressed.Swap(0), 10),
+	})
+}
+
+// resetConn closes with a TCP RST instead of a FIN.
+func resetConn(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// trackedConn releases its limit slots when closed and enforces the idle
+// and absolute session timeouts without touching deadlines, which modules
+// use themselves.
+type trackedConn struct {
+	net.Conn
+
+	idleTimeout  time.Duration
+	lastActivity atomic.Int64
+	releaseOnce  sync.Once
+
+	mu        sync.Mutex
+	releases  []func()
+	idleTimer *time.Timer
+	session   *time.Timer
+}
+
+func newTrackedConn(conn net.Conn, idle, session time.Duration) *trackedConn {
+	c := &trackedConn{Conn: conn, idleTimeout: idle}
+	c.touch()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if idle > 0 {
+		c.idleTimer = time.AfterFunc(idle, c.checkIdle)
+	}
+	if session > 0 {
+		c.session = time.AfterFunc(session, func() { c.Close() })
+	}
+	return c
+}
+
+// NetConn returns the wrapped connection.
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *trackedConn) checkIdle() {
+	since := time.Since(time.Unix(0, c.lastActivity.Load()))
+	if since >= c.idleTimeout {
+		c.Close()
+		return
+	}
+	c.mu.Lock()
+	c.idleTimer.Reset(c.idleTimeout - since)
+	c.mu.Unlock()
+}
+
+func (c *trackedConn) onClose(release func()) {
+	c.mu.Lock()
+	c.releases = append(c.releases, release)
+	c.mu.Unlock()
+}
+
+func (c *trackedConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// release frees the connection's limit slots and stops its timers.
+func (c *trackedConn) release() {
+	c.releaseOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		if c.session != nil {
+			c.session.Stop()
+		}
+		for _, release := range c.releases {
+			release()
+		}
+	})
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
@@ -0,0 +1,93 @@
+package listener
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gimpel/internal/agent/config"
+)
+
+func TestListenerLimits(t *testing.T) {
+	ctx := context.Background()
+	l := newListenerLimits(config.ListenerLimitsConfig{MaxConnections: 2, MaxPerSource: 1, SourceRate: 1, SourceBurst: 2})
+
+	first := l.acquireConn(ctx, false)
+	second := l.acquireConn(ctx, false)
+	if first == nil || second == nil {
+		t.Fatal("connections under the limit were refused")
+	}
+	if l.acquireConn(ctx, false) != nil {
+		t.Error("third connection admitted with max_connections 2")
+	}
+	first()
+	first()
+	if release := l.acquireConn(ctx, false); release == nil {
+		t.Error("slot was not returned on release")
+	}
+
+	release, limit := l.acquireSource(ctx, "198.51.100.1", false)
+	if release == nil {
+		t.Fatalf("first connection from source refused: %s", limit)
+	}
+	if _, limit := l.acquireSource(ctx, "198.51.100.1", false); limit != limitSourceConnections {
+		t.Errorf("second concurrent connection from source: limit %q", limit)
+	}
+	release()
+
+	// The burst of 2 was spent above; the bucket refills at 1/s.
+	if _, limit := l.acquireSource(ctx, "198.51.100.1", false); limit != limitSourceRate {
+		t.Errorf("connection over the source rate: limit %q", limit)
+	}
+	if release, _ := l.acquireSource(ctx, "198.51.100.2", false); release == nil {
+		t.Error("another source was limited")
+	}
+}
+
+func TestListenerLimitsQueue(t *testing.T) {
+	l := newListenerLimits(config.ListenerLimitsConfig{MaxConnections: 1, Overflow: overflowQueue, QueueTimeout: time.Second})
+
+	release := l.acquireConn(context.Background(), true)
+	time.AfterFunc(20*time.Millisecond, release)
+
+	start := time.Now()
+	if l.acquireConn(context.Background(), true) == nil {
+		t.Fatal("queued connection was not admitted when a slot freed")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("queued connection did not wait for a slot")
+	}
+}
+
+func TestTrackedConnIdleTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	released := make(chan struct{})
+	c := newTrackedConn(server, 50*time.Millisecond, 0)
+	c.onClose(func() { close(released) })
+
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Traffic keeps the connection open past the idle timeout.
+	for i := 0; i < 4; i++ {
+		time.Sleep(25 * time.Millisecond)
+		if _, err := client.Write([]byte{1}); err != nil {
+			t.Fatalf("connection closed while active: %v", err)
+		}
+	}
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
@@ -2,41 +2,84 @@ package listener
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 
+	"gimpel/internal/agent/capture"
 	"gimpel/internal/agent/config"
 	"gimpel/internal/agent/control"
 	"gimpel/internal/agent/module"
+	"gimpel/internal/agent/telemetry"
+	"gimpel/pkg/netutil"
+	"gimpel/pkg/tunnel"
 )
 
 type Manager struct {
 	cfg           *config.AgentConfig
 	supervisor    *module.Supervisor
 	controlClient *control.Client
+	emitter       *telemetry.Emitter
+	capture       *capture.Recorder
 
 	mu        sync.RWMutex
 	listeners map[string]*ManagedListener
+
+	acceptLimiter *rate.Limiter
+	held          atomic.Int64
+
+	slotsMu     sync.Mutex
+	moduleConns map[string]chan struct{}
+
+	escalationsMu sync.Mutex
+	escalations   map[string]*escalation
 }
 
 type ManagedListener struct {
-	Config   config.ListenerConfig
-	Listener net.Listener
-	cancel   context.CancelFunc
+	Config     config.ListenerConfig
+	Listener   net.Listener
+	PacketConn net.PacketConn
+	cancel     context.CancelFunc
+
+	routes      []portRoute
+	sniffRoutes map[string]string
+
+	trustedProxies []netip.Prefix
+
+	tlsConfig *tls.Config
+
+	limits *listenerLimits
+	tarpit *tarpit
+
+	flowsMu sync.Mutex
+	flows   map[flowKey]*flow
 }
 
 func NewManager(cfg *config.AgentConfig, supervisor *module.Supervisor, controlClient *control.Client) *Manager {
-	return &Manager{
+	m := &Manager{
 		cfg:           cfg,
 		supervisor:    supervisor,
 		controlClient: controlClient,
 		listeners:     make(map[string]*ManagedListener),
+		moduleConns:   make(map[string]chan struct{}),
+		escalations:   make(map[string]*escalation),
 	}
+	if cfg.Limits.AcceptRate > 0 {
+		m.acceptLimiter = rate.NewLimiter(rate.Limit(cfg.Limits.AcceptRate), max(cfg.Limits.AcceptBurst, 1))
+	}
+	return m
 }
 
 func (m *Manager) Run(ctx context.Context) error {
@@ -61,25 +104,89 @@ func (m *Manager) StartListener(ctx context.Context, cfg config.ListenerConfig)
 	}
 
 	addr := fmt.Sprintf(":%d", cfg.Port)
-	ln, err := net.Listen(cfg.Protocol, addr)
-	if err != nil {
-		return fmt.Errorf("binding to %s: %w", addr, err)
-	}
-
 	listenerCtx, cancel := context.WithCancel(ctx)
 	ml := &ManagedListener{
-		Config:   cfg,
-		Listener: ln,
-		cancel:   cancel,
+		Config: cfg,
+		cancel: cancel,
+		limits: newListenerLimits(cfg.Limits),
+	}
+
+	if cfg.ProxyProtocol {
+		prefixes, err := parseTrustedProxies(cfg.TrustedProxies)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("listener %s: %w", cfg.ID, err)
+		}
+		ml.trustedProxies = prefixes
+	}
+
+	if cfg.TLS.Terminate {
+		tlsConfig, err := newListenerTLSConfig(cfg.TLS)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("listener %s: %w", cfg.ID, err)
+		}
+		ml.tlsConfig = tlsConfig
+	}
+
+	if cfg.Tarpit.Mode != "" {
+		ml.tarpit = newTarpit(cfg.Tarpit)
 	}
-	m.listeners[cfg.ID] = ml
 
-	go m.acceptLoop(listenerCtx, ml)
+	if len(cfg.Sniff) > 0 {
+		ml.sniffRoutes = make(map[string]string, len(cfg.Sniff))
+		for _, r := range cfg.Sniff {
+			ml.sniffRoutes[r.Protocol] = r.ModuleID
+		}
+	}
+
+	if isPacketProtocol(cfg.Protocol) {
+		pc, err := net.ListenPacket(cfg.Protocol, addr)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("binding to %s: %w", addr, err)
+		}
+		ml.PacketConn = pc
+		ml.flows = make(map[flowKey]*flow)
+		go m.packetLoop(listenerCtx, ml)
+	} else if cfg.Transparent != "" {
+		routes, err := parseRoutes(cfg)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("listener %s: %w", cfg.ID, err)
+		}
+		ln, err := listenTransparent(listenerCtx, cfg, addr)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("binding to %s: %w", addr, err)
+		}
+		ml.Listener = ln
+		ml.routes = routes
+		go m.acceptLoop(listenerCtx, ml)
+	} else if cfg.Tarpit.Mode == tarpitWindow {
+		ln, err := netutil.ListenSmallWindow(listenerCtx, cfg.Protocol, addr)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("binding to %s: %w", addr, err)
+		}
+		ml.Listener = ln
+		go m.acceptLoop(listenerCtx, ml)
+	} else {
+		ln, err := net.Listen(cfg.Protocol, addr)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("binding to %s: %w", addr, err)
+		}
+		ml.Listener = ln
+		go m.acceptLoop(listenerCtx, ml)
+	}
+	m.listeners[cfg.ID] = ml
 
 	log.WithFields(log.Fields{
 		"listener": cfg.ID,
-		"port":     cfg.Port,
-		"protocol": cfg.Protocol,
+		"port":        cfg.Port,
+		"protocol":    cfg.Protocol,
+		"transparent": cfg.Transparent,
 	}).Info("listener started")
 
 	return nil
@@ -95,7 +202,13 @@ func (m *Manager) StopListener(listenerID string) error {
 	}
 
 	ml.cancel()
-	ml.Listener.Close()
+	if ml.Listener != nil {
+		ml.Listener.Close()
+	}
+	if ml.PacketConn != nil {
+		ml.PacketConn.Close()
+		ml.closeFlows()
+	}
 	delete(m.listeners, listenerID)
 
 	log.WithField("listener", listenerID).Info("listener stopped")
@@ -128,40 +241,195 @@ func (m *Manager) acceptLoop(ctx context.Context, ml *ManagedListener) {
 			}
 		}
 
-		go m.handleConnection(ctx, ml, conn)
+		if m.acceptLimiter != nil {
+			if ml.limits.cfg.Overflow == overflowQueue {
+				// Leave further connections in the kernel backlog.
+				if err := m.acceptLimiter.Wait(ctx); err != nil {
+					conn.Close()
+					return
+				}
+			} else if !m.acceptLimiter.Allow() {
+				m.overflow(ctx, ml, conn, ml.Config.ModuleID, limitAcceptRate)
+				continue
+			}
+		}
+
+		go m.admit(ctx, ml, conn)
 	}
 }
 
-func (m *Manager) handleConnection(ctx context.Context, ml *ManagedListener, conn net.Conn) {
-	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
-	localAddr := conn.LocalAddr().(*net.TCPAddr)
+// admit takes a listener slot for conn and applies the session timeouts.
+func (m *Manager) admit(ctx context.Context, ml *ManagedListener, conn net.Conn) {
+	release := ml.limits.acquireConn(ctx, ml.limits.cfg.Overflow == overflowQueue)
+	if release == nil {
+		m.overflow(ctx, ml, conn, ml.Config.ModuleID, limitMaxConnections)
+		return
+	}
+
+	tracked := newTrackedConn(conn, ml.Config.IdleTimeout, ml.limits.cfg.SessionTimeout)
+	tracked.onClose(release)
+	m.handleConnection(ctx, ml, tracked)
+}
+
+func (m *Manager) handleConnection(ctx context.Context, ml *ManagedListener, tracked *trackedConn) {
+	var conn net.Conn = tracked
+	sourceIP, sourcePort := splitAddr(conn.RemoteAddr())
+	destIP, destPort := splitAddr(conn.LocalAddr())
+
+	metadata := make(map[string]string)
+	if ml.Config.Transparent != "" {
+		destIP, destPort = ml.originalDest(conn)
+	}
+
+	if ml.trustedProxies != nil && ml.trustsProxy(conn.RemoteAddr()) {
+		header, err := readProxyHeader(conn)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"listener": ml.Config.ID,
+				"peer":     conn.RemoteAddr().String(),
+			}).Warn("invalid PROXY protocol header from trusted proxy")
+			conn.Close()
+			return
+		}
+		if header.Source != nil && header.Dest != nil {
+			sourceIP, sourcePort = splitAddr(header.Source)
+			destIP, destPort = splitAddr(header.Dest)
+		}
+		proxyMetadata(conn, header, metadata)
+	}
+
+	// Behind a trusted proxy this is the real client, not the proxy.
+	queue := ml.limits.cfg.Overflow == overflowQueue
+	releaseSource, limit := ml.limits.acquireSource(ctx, sourceIP, queue)
+	if releaseSource == nil {
+		m.overflow(ctx, ml, tracked, ml.Config.ModuleID, limit)
+		return
+	}
+	tracked.onClose(releaseSource)
+
+	if ml.tarpit != nil {
+		m.handleTarpit(ctx, ml, conn, sourceIP)
+		return
+	}
+
+	moduleID := ml.Config.ModuleID
+	if ml.Config.Transparent != "" {
+		moduleID = ml.moduleFor(destPort)
+	}
+
+	if ml.sniffRoutes != nil {
+		timeout := ml.Config.SniffTimeout
+		if timeout <= 0 {
+			timeout = defaultSniffTimeout
+		}
+		sniffed, protocol := sniff(conn, timeout)
+		if sniffed == nil {
+			conn.Close()
+			return
+		}
+		conn = sniffed
+		metadata[MetadataDetectedProtocol] = protocol
+		if routed, ok := ml.sniffRoutes[protocol]; ok {
+			moduleID = routed
+		}
+	}
+
+	releaseModule := m.acquireModule(ctx, moduleID, queue, ml.limits.cfg.QueueTimeout)
+	if releaseModule == nil {
+		m.overflow(ctx, ml, tracked, moduleID, limitModuleConnections)
+		return
+	}
+	tracked.onClose(releaseModule)
 
 	connID := uuid.New().String()
+	if ml.Config.TLS.Terminate || ml.Config.TLS.Fingerprint {
+		peeked, hello, err := peekClientHello(conn)
+		conn = peeked
+		if err != nil {
+			log.WithError(err).WithField("listener", ml.Config.ID).Debug("unreadable ClientHello")
+		}
+		if hello != nil {
+			fingerprintMetadata(hello, metadata)
+
+			if ml.tlsConfig != nil {
+				tlsConn := tls.Server(conn, ml.tlsConfig)
+				tlsConn.SetDeadline(time.Now().Add(clientHelloTimeout))
+				if err := tlsConn.Handshake(); err != nil {
+					log.WithError(err).WithFields(log.Fields{
+						"listener": ml.Config.ID,
+						"ja4":      metadata[MetadataJA4],
+					}).Debug("TLS handshake failed")
+					m.emitTLSFingerprint(ml, moduleID, connID, sourceIP, metadata)
+					conn.Close()
+					return
+				}
+				tlsConn.SetDeadline(time.Time{})
+
+				state := tlsConn.ConnectionState()
+				metadata[MetadataTLSVersion] = tls.VersionName(state.Version)
+				if state.NegotiatedProtocol != "" {
+					metadata[MetadataTLSALPN] = state.NegotiatedProtocol
+				}
+				conn = tlsConn
+			}
+		}
+	}
+
+	if metadata[MetadataJA4] != "" {
+		m.emitTLSFingerprint(ml, moduleID, connID, sourceIP, metadata)
+	}
 
 	log.WithFields(log.Fields{
 		"connection_id": connID,
-		"source":        remoteAddr.String(),
-		"dest":          localAddr.String(),
+		"source":        net.JoinHostPort(sourceIP, strconv.Itoa(int(sourcePort))),
+		"dest":          net.JoinHostPort(destIP, strconv.Itoa(int(destPort))),
 		"listener":      ml.Config.ID,
+		"module":        moduleID,
+		"protocol":      metadata[MetadataDetectedProtocol],
 	}).Debug("accepted connection")
 
 	if ml.Config.HighInteraction {
-		m.handleHIConnection(ctx, ml, conn, connID, remoteAddr)
+		m.handleHIConnection(ctx, ml, conn, connID, sourceIP, sourcePort)
+		return
+	}
+
+	forget := m.allowEscalation(ml, moduleID, connID, sourceIP, sourcePort)
+
+	if handler := m.supervisor.ConnectionHandler(moduleID); handler != nil {
+		req := &module.ConnectionRequest{
+			ConnectionID: connID,
+			ListenerID:   ml.Config.ID,
+			ModuleID:     moduleID,
+			SourceIP:     sourceIP,
+			SourcePort:   sourcePort,
+			DestIP:       destIP,
+			DestPort:     destPort,
+			Protocol:     ml.Config.Protocol,
+			Timestamp:    time.Now(),
+			Conn:         conn,
+			Metadata:     metadata,
+		}
+		if err := handler.HandleConnection(ctx, req); err != nil {
+			log.WithError(err).WithField("module", moduleID).Warn("module failed to handle connection")
+		}
+		forget()
+		conn.Close()
 		return
 	}
 
 	connInfo := &module.ConnectionInfo{
 		ConnectionID: connID,
-		SourceIP:     remoteAddr.IP.String(),
-		SourcePort:   uint32(remoteAddr.Port),
-		DestIP:       localAddr.IP.String(),
-		DestPort:     uint32(localAddr.Port),
+		SourceIP:     sourceIP,
+		SourcePort:   sourcePort,
+		DestIP:       destIP,
+		DestPort:     destPort,
 		Protocol:     ml.Config.Protocol,
 	}
 
-	dataPort, err := m.supervisor.HandleConnection(ctx, ml.Config.ModuleID, connInfo)
+	dataPort, err := m.supervisor.HandleConnection(ctx, moduleID, connInfo)
 	if err != nil {
-		log.WithError(err).WithField("module", ml.Config.ModuleID).Warn("module rejected connection")
+		log.WithError(err).WithField("module", moduleID).Warn("module rejected connection")
+		forget()
 		conn.Close()
 		return
 	}
@@ -169,20 +437,92 @@ func (m *Manager) handleConnection(ctx context.Context, ml *ManagedListener, con
 	moduleAddr := fmt.Sprintf("127.0.0.1:%d", dataPort)
 	moduleConn, err := net.DialTimeout("tcp", moduleAddr, 5*time.Second)
 	if err != nil {
-		log.WithError(err).WithField("module", ml.Config.ModuleID).Warn("failed to connect to module data port")
+		log.WithError(err).WithField("module", moduleID).Warn("failed to connect to module data port")
+		forget()
 		conn.Close()
 		return
 	}
 
-	moduleConn.Write([]byte(connID))
+	handshake := module.ConnectionHandshake{
+		ConnectionID: connID,
+		SourceIP:     sourceIP,
+		SourcePort:   sourcePort,
+		DestIP:       destIP,
+		DestPort:     destPort,
+		Protocol:     ml.Config.Protocol,
+		Timestamp:    time.Now().UnixNano(),
+		Metadata:     metadata,
+	}
+	if err := writeHandshake(moduleConn, handshake); err != nil {
+		log.WithError(err).WithField("module", moduleID).Warn("failed to send connection handshake")
+		forget()
+		conn.Close()
+		moduleConn.Close()
+		return
+	}
 
+	session := m.capture.Start(moduleID, connID, sourceIP, sourcePort, destIP, destPort)
 	go func() {
+		defer forget()
 		defer conn.Close()
 		defer moduleConn.Close()
-		proxyConnections(ctx, conn, moduleConn)
+		defer session.Close()
+		proxyConnections(ctx, capture.Tap(conn, session), moduleConn)
 	}()
 }
 
+// SetEmitter lets the manager emit events about what only the listener
+// sees, such as TLS fingerprints.
+func (m *Manager) SetEmitter(emitter *telemetry.Emitter) {
+	m.emitter = emitter
+}
+
+// SetCapture records the byte streams the manager relays to modules.
+func (m *Manager) SetCapture(r *capture.Recorder) {
+	m.capture = r
+}
+
+// emitTLSFingerprint reports the fingerprints of a connection's ClientHello
+// under the connection's ID, so they join the module's own events for it.
+func (m *Manager) emitTLSFingerprint(ml *ManagedListener, moduleID, connID, sourceIP string, metadata map[string]string) {
+	if m.emitter == nil {
+		return
+	}
+	labels := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		labels[k] = v
+	}
+	labels["listener"] = ml.Config.ID
+	m.emitter.EmitTLSFingerprint(moduleID, connID, sourceIP, labels)
+}
+
+// writeHandshake sends the connection metadata that precedes the payload on
+// a module data connection, framed like a datagram.
+func writeHandshake(w io.Writer, handshake module.ConnectionHandshake) error {
+	data, err := json.Marshal(handshake)
+	if err != nil {
+		return fmt.Errorf("marshaling handshake: %w", err)
+	}
+	return writeDatagram(w, data)
+}
+
+// splitAddr returns the IP and port of a TCP or UDP address.
+func splitAddr(addr net.Addr) (string, uint32) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String(), uint32(a.Port)
+	case *net.UDPAddr:
+		return a.IP.String(), uint32(a.Port)
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), 0
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return host, uint32(p)
+}
+
 func proxyConnections(ctx context.Context, client, server net.Conn) {
 	done := make(chan struct{}, 2)
 
@@ -218,8 +558,10 @@ func copyData(dst, src net.Conn) {
 	}
 }
 
-func (m *Manager) handleHIConnection(ctx context.Context, ml *ManagedListener, conn net.Conn, connID string, remoteAddr *net.TCPAddr) {
-	resp, err := m.controlClient.RequestHISession(ctx, ml.Config.ID, remoteAddr.IP.String(), uint32(remoteAddr.Port))
+func (m *Manager) handleHIConnection(ctx context.Context, ml *ManagedListener, conn net.Conn, connID string, sourceIP string, sourcePort uint32) {
+	defer conn.Close()
+
+	resp, err := m.controlClient.RequestHISession(ctx, ml.Config.ID, sourceIP, sourcePort, "", ml.Config.SandboxImage)
 	if err != nil {
 		log.WithError(err).Warn("failed to request HI session")
 		return
@@ -230,18 +572,56 @@ func (m *Manager) handleHIConnection(ctx context.Context, ml *ManagedListener, c
 		"endpoint":   resp.SandboxEndpoint,
 	}).Debug("HI session established")
 
-	if err := proxyToEndpoint(ctx, conn, resp.SandboxEndpoint); err != nil {
+	meta := &tunnel.Metadata{
+		SessionID:  resp.SessionId,
+		ListenerID: ml.Config.ID,
+		SourceIP:   sourceIP,
+		SourcePort: sourcePort,
+		Protocol:   ml.Config.Protocol,
+		Terminal:   ml.Config.Terminal,
+	}
+	reason := "closed"
+	if err := proxyToEndpoint(ctx, conn, resp.SandboxEndpoint, resp.TunnelKey, meta); err != nil && !errors.Is(err, io.EOF) {
 		log.WithError(err).Warn("HI proxy failed")
+		reason = err.Error()
 	}
+	m.reportHIClosed(resp.SessionId, sourcePort, reason)
 }
 
-func proxyToEndpoint(ctx context.Context, clientConn net.Conn, endpoint string) error {
-	serverConn, err := net.Dial("tcp", endpoint)
+// reportHIClosed tells the master a tunnel into an HI session closed.
+func (m *Manager) reportHIClosed(sessionID string, sourcePort uint32, reason string) {
+	// The listener's context may be gone by now.
+	reportCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.controlClient.ReportHISessionClosed(reportCtx, sessionID, sourcePort, reason); err != nil {
+		log.WithError(err).WithField("session_id", sessionID).Debug("failed to report HI tunnel close")
+	}
+}
+
+func proxyToEndpoint(ctx context.Context, clientConn net.Conn, endpoint string, key []byte, meta *tunnel.Metadata) error {
+	serverConn, err := dialSandbox(endpoint, key, meta)
 	if err != nil {
-		return fmt.Errorf("connecting to sandbox: %w", err)
+		return err
 	}
 	defer serverConn.Close()
+	return splice(ctx, clientConn, serverConn)
+}
+
+func dialSandbox(endpoint string, key []byte, meta *tunnel.Metadata) (*tunnel.Conn, error) {
+	rawConn, err := net.DialTimeout("tcp", endpoint, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to sandbox: %w", err)
+	}
+	serverConn, err := tunnel.Client(rawConn, meta.SessionID, key, meta)
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("opening tunnel to sandbox: %w", err)
+	}
+	return serverConn, nil
+}
 
+// splice copies both ways until either direction ends.
+func splice(ctx context.Context, clientConn, serverConn net.Conn) error {
 	errCh := make(chan error, 2)
 
 	go func() {
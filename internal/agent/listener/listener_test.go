@@ -0,0 +1,53 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"gimpel/internal/agent/module"
+)
+
+// TestHandshakeFraming checks the stream handshake against what the module
+// SDK reads: a big-endian uint16 length, the JSON handshake, then the
+// client's bytes.
+func TestHandshakeFraming(t *testing.T) {
+	want := module.ConnectionHandshake{
+		ConnectionID: "c0ffee",
+		SourceIP:     "198.51.100.7",
+		SourcePort:   40000,
+		DestIP:       "203.0.113.1",
+		DestPort:     22,
+		Protocol:     "tcp",
+		Timestamp:    1700000000,
+		Metadata:     map[string]string{MetadataDetectedProtocol: ProtocolSSH},
+	}
+
+	var stream bytes.Buffer
+	if err := writeHandshake(&stream, want); err != nil {
+		t.Fatal(err)
+	}
+	stream.WriteString("SSH-2.0-scanner\r\n")
+
+	var size uint16
+	if err := binary.Read(&stream, binary.BigEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(&stream, data); err != nil {
+		t.Fatal(err)
+	}
+
+	var got module.ConnectionHandshake
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("handshake is not JSON: %v", err)
+	}
+	if got.ConnectionID != want.ConnectionID || got.SourcePort != want.SourcePort || got.Metadata[MetadataDetectedProtocol] != ProtocolSSH {
+		t.Errorf("handshake = %+v, want %+v", got, want)
+	}
+	if rest := stream.String(); rest != "SSH-2.0-scanner\r\n" {
+		t.Errorf("payload after handshake = %q", rest)
+	}
+}
@@ -0,0 +1,422 @@
+package listener
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/module"
+)
+
+const (
+	defaultFlowIdleTimeout = 60 * time.Second
+	maxDatagramSize        = 65535
+	flowQueueSize          = 64
+)
+
+func isPacketProtocol(protocol string) bool {
+	return strings.HasPrefix(protocol, "udp")
+}
+
+// flowKey identifies a datagram flow by its 5-tuple.
+type flowKey struct {
+	protocol string
+	source   string
+	dest     string
+}
+
+// flow is the pseudo-session for datagrams exchanged with one peer. It
+// implements net.Conn with datagram semantics: each Read returns one
+// datagram and each Write sends one.
+type flow struct {
+	id     string
+	key    flowKey
+	pc     net.PacketConn
+	remote net.Addr
+
+	in        chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+
+	mu              sync.Mutex
+	idle            *time.Timer
+	idleTimeout     time.Duration
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+}
+
+func (m *Manager) packetLoop(ctx context.Context, ml *ManagedListener) {
+	idleTimeout := ml.Config.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultFlowIdleTimeout
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := ml.PacketConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithError(err).WithField("listener", ml.Config.ID).Warn("read error")
+			continue
+		}
+
+		f, created, limit := ml.flowFor(addr, idleTimeout)
+		if f == nil {
+			sourceIP, _ := splitAddr(addr)
+			m.emitLimitExceeded(ml, ml.Config.ModuleID, sourceIP, limit, "drop")
+			continue
+		}
+		f.deliver(append([]byte(nil), buf[:n]...))
+
+		if created {
+			go m.serveFlow(ctx, ml, f)
+		}
+	}
+}
+
+// flowFor returns the flow for datagrams from addr, creating it if the
+// listener's limits allow. Datagrams over a limit are dropped, so overflow
+// behaviors do not apply.
+func (ml *ManagedListener) flowFor(addr net.Addr, idleTimeout time.Duration) (*flow, bool, string) {
+	key := flowKey{
+		protocol: ml.Config.Protocol,
+		source:   addr.String(),
+		dest:     ml.PacketConn.LocalAddr().String(),
+	}
+
+	ml.flowsMu.Lock()
+	defer ml.flowsMu.Unlock()
+
+	if f, ok := ml.flows[key]; ok {
+		return f, false, ""
+	}
+
+	releaseConn := ml.limits.acquireConn(context.Background(), false)
+	if releaseConn == nil {
+		return nil, false, limitMaxConnections
+	}
+	sourceIP, _ := splitAddr(addr)
+	releaseSource, limit := ml.limits.acquireSource(context.Background(), sourceIP, false)
+	if releaseSource == nil {
+		releaseConn()
+		return nil, false, limit
+	}
+
+	f := &flow{
+		id:     uuid.New().String(),
+		key:    key,
+		pc:     ml.PacketConn,
+		remote: addr,
+		in:     make(chan []byte, flowQueueSize),
+		closed: make(chan struct{}),
+
+		idleTimeout:     idleTimeout,
+		deadlineChanged: make(chan struct{}),
+	}
+	f.onClose = func() {
+		ml.flowsMu.Lock()
+		if ml.flows[key] == f {
+			delete(ml.flows, key)
+		}
+		ml.flowsMu.Unlock()
+		releaseSource()
+		releaseConn()
+	}
+	f.idle = time.AfterFunc(idleTimeout, func() {
+		log.WithFields(log.Fields{
+			"connection_id": f.id,
+			"source":        key.source,
+			"listener":      ml.Config.ID,
+		}).Debug("datagram flow idle, closing")
+		f.Close()
+	})
+	ml.flows[key] = f
+
+	return f, true, ""
+}
+
+func (ml *ManagedListener) closeFlows() {
+	ml.flowsMu.Lock()
+	flows := make([]*flow, 0, len(ml.flows))
+	for _, f := range ml.flows {
+		flows = append(flows, f)
+	}
+	ml.flowsMu.Unlock()
+
+	for _, f := range flows {
+		f.Close()
+	}
+}
+
+func (m *Manager) serveFlow(ctx context.Context, ml *ManagedListener, f *flow) {
+	sourceIP, sourcePort := splitAddr(f.remote)
+	destIP, destPort := splitAddr(ml.PacketConn.LocalAddr())
+
+	log.WithFields(log.Fields{
+		"connection_id": f.id,
+		"source":        f.key.source,
+		"dest":          f.key.dest,
+		"listener":      ml.Config.ID,
+	}).Debug("new datagram flow")
+
+	releaseModule := m.acquireModule(ctx, ml.Config.ModuleID, false, 0)
+	if releaseModule == nil {
+		m.emitLimitExceeded(ml, ml.Config.ModuleID, sourceIP, limitModuleConnections, "drop")
+		f.Close()
+		return
+	}
+	defer releaseModule()
+
+	if handler := m.supervisor.ConnectionHandler(ml.Config.ModuleID); handler != nil {
+		req := &module.ConnectionRequest{
+			ConnectionID: f.id,
+			ListenerID:   ml.Config.ID,
+			ModuleID:     ml.Config.ModuleID,
+			SourceIP:     sourceIP,
+			SourcePort:   sourcePort,
+			DestIP:       destIP,
+			DestPort:     destPort,
+			Protocol:     ml.Config.Protocol,
+			Timestamp:    time.Now(),
+			Conn:         f,
+		}
+		if err := handler.HandleConnection(ctx, req); err != nil {
+			log.WithError(err).WithField("module", ml.Config.ModuleID).Warn("module failed to handle flow")
+		}
+		f.Close()
+		return
+	}
+
+	connInfo := &module.ConnectionInfo{
+		ConnectionID: f.id,
+		SourceIP:     sourceIP,
+		SourcePort:   sourcePort,
+		DestIP:       destIP,
+		DestPort:     destPort,
+		Protocol:     ml.Config.Protocol,
+	}
+
+	dataPort, err := m.supervisor.HandleConnection(ctx, ml.Config.ModuleID, connInfo)
+	if err != nil {
+		log.WithError(err).WithField("module", ml.Config.ModuleID).Warn("module rejected flow")
+		f.Close()
+		return
+	}
+	if dataPort == 0 {
+		log.WithField("module", ml.Config.ModuleID).Warn("module has no data port for datagram flows")
+		f.Close()
+		return
+	}
+
+	moduleConn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", dataPort), 5*time.Second)
+	if err != nil {
+		log.WithError(err).WithField("module", ml.Config.ModuleID).Warn("failed to connect to module data port")
+		f.Close()
+		return
+	}
+	defer moduleConn.Close()
+	defer f.Close()
+
+	handshake := module.ConnectionHandshake{
+		ConnectionID: f.id,
+		SourceIP:     sourceIP,
+		SourcePort:   sourcePort,
+		DestIP:       destIP,
+		DestPort:     destPort,
+		Protocol:     ml.Config.Protocol,
+		Timestamp:    time.Now().UnixNano(),
+	}
+	if err := writeHandshake(moduleConn, handshake); err != nil {
+		log.WithError(err).WithField("module", ml.Config.ModuleID).Warn("failed to send flow handshake")
+		return
+	}
+
+	relayDatagrams(ctx, f, moduleConn)
+}
+
+// relayDatagrams copies datagrams between a flow and a module data
+// connection. On the stream each datagram is prefixed with its length as a
+// big-endian uint16 so that message boundaries survive the relay.
+func relayDatagrams(ctx context.Context, f *flow, moduleConn net.Conn) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		defer func() { done <- struct{}{} }()
+		for {
+			select {
+			case data := <-f.in:
+				if err := writeDatagram(moduleConn, data); err != nil {
+					return
+				}
+			case <-f.closed:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer func() { done <- struct{}{} }()
+		r := newDatagramReader(moduleConn)
+		for {
+			data, err := r.next()
+			if err != nil {
+				return
+			}
+			if _, err := f.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func writeDatagram(w io.Writer, data []byte) error {
+	if len(data) > maxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes exceeds %d", len(data), maxDatagramSize)
+	}
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+type datagramReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func newDatagramReader(r io.Reader) *datagramReader {
+	return &datagramReader{r: r, buf: make([]byte, maxDatagramSize)}
+}
+
+// next returns the next datagram; the slice is only valid until the
+// following call.
+func (d *datagramReader) next() ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(d.r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+		return nil, err
+	}
+	return d.buf[:n], nil
+}
+
+// deliver queues an inbound datagram, dropping it if the flow is backed up
+// as the network would.
+func (f *flow) deliver(data []byte) {
+	f.touch()
+	select {
+	case f.in <- data:
+	case <-f.closed:
+	default:
+	}
+}
+
+func (f *flow) touch() {
+	f.mu.Lock()
+	select {
+	case <-f.closed:
+	default:
+		f.idle.Reset(f.idleTimeout)
+	}
+	f.mu.Unlock()
+}
+
+func (f *flow) Read(b []byte) (int, error) {
+	for {
+		f.mu.Lock()
+		deadline, changed := f.readDeadline, f.deadlineChanged
+		f.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case data := <-f.in:
+			n := copy(b, data)
+			if n < len(data) {
+				return n, io.ErrShortBuffer
+			}
+			return n, nil
+		case <-f.closed:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+		}
+	}
+}
+
+func (f *flow) Write(b []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	f.touch()
+	return f.pc.WriteTo(b, f.remote)
+}
+
+func (f *flow) Close() error {
+	f.closeOnce.Do(func() {
+		f.mu.Lock()
+		close(f.closed)
+		f.idle.Stop()
+		f.mu.Unlock()
+		f.onClose()
+	})
+	return nil
+}
+
+func (f *flow) LocalAddr() net.Addr  { return f.pc.LocalAddr() }
+func (f *flow) RemoteAddr() net.Addr { return f.remote }
+
+func (f *flow) SetDeadline(t time.Time) error {
+	return f.SetReadDeadline(t)
+}
+
+func (f *flow) SetReadDeadline(t time.Time) error {
+	f.mu.Lock()
+	f.readDeadline = t
+	close(f.deadlineChanged)
+	f.deadlineChanged = make(chan struct{})
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *flow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package listener
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gimpel/internal/agent/config"
+)
+
+func TestFlowTableAndIdleTimeout(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ml := &ManagedListener{
+		Config:     config.ListenerConfig{ID: "dns", Protocol: "udp"},
+		PacketConn: pc,
+		flows:      make(map[flowKey]*flow),
+		limits:     newListenerLimits(config.ListenerLimitsConfig{}),
+	}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5354}
+
+	f, created, _ := ml.flowFor(peer, 50*time.Millisecond)
+	if !created {
+		t.Fatal("first datagram did not create a flow")
+	}
+	if again, created, _ := ml.flowFor(peer, 50*time.Millisecond); created || again != f {
+		t.Error("datagram from the same peer created a new flow")
+	}
+	if g, created, _ := ml.flowFor(other, time.Minute); !created || g == f {
+		t.Error("datagram from another peer reused a flow")
+	}
+
+	f.deliver([]byte("one"))
+	f.deliver([]byte("two"))
+	buf := make([]byte, 16)
+	for _, want := range []string{"one", "two"} {
+		n, err := f.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Read() = %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+
+	select {
+	case <-f.closed:
+	case <-time.After(time.Second):
+		t.Fatal("idle flow was not closed")
+	}
+	if _, err := f.Read(buf); err != io.EOF {
+		t.Errorf("Read() on closed flow = %v, want EOF", err)
+	}
+	if g, created, _ := ml.flowFor(peer, time.Minute); !created || g == f {
+		t.Error("datagram after idle timeout did not start a new flow")
+	}
+	ml.closeFlows()
+}
+
+func TestDatagramFraming(t *testing.T) {
+	var stream bytes.Buffer
+	for _, d := range [][]byte{[]byte("query"), {}, bytes.Repeat([]byte{1}, 1500)} {
+		if err := writeDatagram(&stream, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := newDatagramReader(&stream)
+	for _, want := range []int{5, 0, 1500} {
+		d, err := r.next()
+		if err != nil || len(d) != want {
+			t.Fatalf("next() = %d bytes, %v, want %d", len(d), err, want)
+		}
+	}
+	if _, err := r.next(); err != io.EOF {
+		t.Errorf("next() at end = %v, want EOF", err)
+	}
+}
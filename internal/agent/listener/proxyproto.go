@@ -0,0 +1,76 @@
+package listener
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"gimpel/pkg/netutil"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+// Metadata keys describing the load balancer a connection came through.
+const (
+	MetadataProxyPeer      = "proxy_peer"
+	MetadataProxyAuthority = "proxy_authority"
+	MetadataProxyALPN      = "proxy_alpn"
+	MetadataProxyUniqueID  = "proxy_unique_id"
+)
+
+func parseTrustedProxies(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(c)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", c, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (ml *ManagedListener) trustsProxy(addr net.Addr) bool {
+	ip, _ := splitAddr(addr)
+	peer, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	peer = peer.Unmap()
+	for _, prefix := range ml.trustedProxies {
+		if prefix.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol header a trusted load balancer
+// sends before the client's data.
+func readProxyHeader(conn net.Conn) (*netutil.ProxyHeader, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	return netutil.ReadProxyHeader(conn)
+}
+
+func proxyMetadata(conn net.Conn, header *netutil.ProxyHeader, metadata map[string]string) {
+	peer, _ := splitAddr(conn.RemoteAddr())
+	metadata[MetadataProxyPeer] = peer
+
+	if v, ok := header.TLV(netutil.ProxyTLVAuthority); ok {
+		metadata[MetadataProxyAuthority] = string(v)
+	}
+	if v, ok := header.TLV(netutil.ProxyTLVALPN); ok {
+		metadata[MetadataProxyALPN] = string(v)
+	}
+	if v, ok := header.TLV(netutil.ProxyTLVUniqueID); ok {
+		metadata[MetadataProxyUniqueID] = hex.EncodeToString(v)
+	}
+}
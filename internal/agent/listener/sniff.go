@@ -0,0 +1,156 @@
+package listener
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// Protocols reported by the sniffer. ProtocolServerFirst means the client
+// sent nothing before the sniff timeout, as SSH, FTP or SMTP clients do
+// while waiting for a banner.
+const (
+	ProtocolSSH         = "ssh"
+	ProtocolTLS         = "tls"
+	ProtocolHTTP        = "http"
+	ProtocolRDP         = "rdp"
+	ProtocolSMB         = "smb"
+	ProtocolRedis       = "redis"
+	ProtocolServerFirst = "server_first"
+	ProtocolUnknown     = "unknown"
+)
+
+// MetadataDetectedProtocol is the ConnectionRequest.Metadata key holding the
+// sniffed protocol.
+const MetadataDetectedProtocol = "detected_protocol"
+
+const (
+	defaultSniffTimeout = 2 * time.Second
+	sniffBufferSize     = 1024
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+	[]byte("TRACE "), []byte("PRI * HTTP/2"),
+}
+
+// classify identifies the protocol from the first bytes sent by a client.
+// more is true while the data is too short to decide.
+func classify(data []byte) (protocol string, more bool) {
+	undecided := false
+	match := func(prefix []byte) bool {
+		n := min(len(data), len(prefix))
+		if !bytes.Equal(data[:n], prefix[:n]) {
+			return false
+		}
+		if n < len(prefix) {
+			undecided = true
+			return false
+		}
+		return true
+	}
+
+	if match([]byte("SSH-")) {
+		return ProtocolSSH, false
+	}
+
+	// TLS handshake record: content type 22, major version 3.
+	if match([]byte{0x16, 0x03}) {
+		return ProtocolTLS, false
+	}
+
+	for _, method := range httpMethods {
+		if match(method) {
+			return ProtocolHTTP, false
+		}
+	}
+
+	// TPKT header followed by an X.224 Connection Request.
+	if match([]byte{0x03, 0x00}) {
+		if len(data) < 6 {
+			return "", true
+		}
+		if data[5]&0xf0 == 0xe0 {
+			return ProtocolRDP, false
+		}
+	}
+
+	// NetBIOS session message carrying SMB1 or SMB2.
+	if len(data) > 0 && data[0] == 0x00 {
+		if len(data) < 8 {
+			return "", true
+		}
+		if (data[4] == 0xff || data[4] == 0xfe) && bytes.Equal(data[5:8], []byte("SMB")) {
+			return ProtocolSMB, false
+		}
+	}
+
+	// RESP array of bulk strings, e.g. "*1\r\n$4\r\nPING\r\n".
+	if len(data) > 0 && data[0] == '*' {
+		if len(data) < 2 {
+			return "", true
+		}
+		if data[1] >= '0' && data[1] <= '9' {
+			return ProtocolRedis, false
+		}
+	}
+
+	if undecided {
+		return "", true
+	}
+	return ProtocolUnknown, false
+}
+
+// sniff reads the first bytes of conn until classify decides or timeout
+// passes. The returned connection replays the consumed bytes. It returns a
+// nil connection if the client went away before sending anything.
+func sniff(conn net.Conn, timeout time.Duration) (net.Conn, string) {
+	buf := make([]byte, sniffBufferSize)
+	n := 0
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		nr, err := conn.Read(buf[n:])
+		n += nr
+
+		if n > 0 {
+			if protocol, more := classify(buf[:n]); !more {
+				return &peekedConn{Conn: conn, prefix: buf[:n]}, protocol
+			}
+			if n == len(buf) {
+				return &peekedConn{Conn: conn, prefix: buf[:n]}, ProtocolUnknown
+			}
+		}
+
+		if err != nil {
+			switch {
+			case n > 0:
+				return &peekedConn{Conn: conn, prefix: buf[:n]}, ProtocolUnknown
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				return conn, ProtocolServerFirst
+			default:
+				return nil, ""
+			}
+		}
+	}
+}
+
+// peekedConn returns prefix before reading from the underlying connection.
+type peekedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,69 @@
+package listener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+		more bool
+	}{
+		{name: "ssh", data: "SSH-2.0-OpenSSH_9.6\r\n", want: ProtocolSSH},
+		{name: "tls", data: "\x16\x03\x01\x02\x00\x01", want: ProtocolTLS},
+		{name: "http", data: "GET / HTTP/1.1\r\n", want: ProtocolHTTP},
+		{name: "http2 preface", data: "PRI * HTTP/2.0\r\n", want: ProtocolHTTP},
+		{name: "rdp", data: "\x03\x00\x00\x13\x0e\xe0\x00\x00", want: ProtocolRDP},
+		{name: "smb2", data: "\x00\x00\x00\x45\xfeSMB", want: ProtocolSMB},
+		{name: "redis", data: "*1\r\n$4\r\nPING\r\n", want: ProtocolRedis},
+		{name: "unknown", data: "hello\n", want: ProtocolUnknown},
+		{name: "partial method", data: "GE", more: true},
+		{name: "partial ssh", data: "SS", more: true},
+		{name: "partial tpkt", data: "\x03\x00\x00", more: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, more := classify([]byte(tt.data))
+			if got != tt.want || more != tt.more {
+				t.Errorf("classify(%q) = %q, %v, want %q, %v", tt.data, got, more, tt.want, tt.more)
+			}
+		})
+	}
+}
+
+func TestSniffReplaysPeekedBytes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		client.Write([]byte("GE"))
+		client.Write([]byte("T / HTTP/1.1\r\n"))
+	}()
+
+	conn, protocol := sniff(server, time.Second)
+	if protocol != ProtocolHTTP {
+		t.Fatalf("sniff() protocol = %q, want http", protocol)
+	}
+
+	buf := make([]byte, 16)
+	n, err := io.ReadFull(conn, buf)
+	if err != nil || string(buf[:n]) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("replayed %q, %v", buf[:n], err)
+	}
+}
+
+func TestSniffServerFirst(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn, protocol := sniff(server, 50*time.Millisecond)
+	if protocol != ProtocolServerFirst || conn != server {
+		t.Errorf("sniff() = %v, %q, want the original conn and server_first", conn, protocol)
+	}
+}
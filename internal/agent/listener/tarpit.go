@@ -0,0 +1,224 @@
+package listener
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/config"
+	"gimpel/pkg/netutil"
+)
+
+const (
+	tarpitSSH       = "ssh"
+	tarpitHTTP      = "http"
+	tarpitKeepalive = "keepalive"
+	tarpitWindow    = "window"
+
+	defaultTarpitInterval    = 10 * time.Second
+	defaultTarpitMaxDuration = time.Hour
+
+	// maxTarpitSources bounds the per-source totals; the table is reset
+	// when it fills.
+	maxTarpitSources = 65536
+)
+
+// tarpit holds clients of a tarpit listener and keeps per-source totals of
+// what they lost to it.
+type tarpit struct {
+	mode        string
+	interval    time.Duration
+	maxDuration time.Duration
+
+	mu      sync.Mutex
+	sources map[string]*tarpitTotals
+}
+
+type tarpitTotals struct {
+	connections int64
+	held        time.Duration
+	bytesSent   int64
+	bytesRecv   int64
+}
+
+func newTarpit(cfg config.ListenerTarpitConfig) *tarpit {
+	t := &tarpit{
+		mode:        cfg.Mode,
+		interval:    cfg.Interval,
+		maxDuration: cfg.MaxDuration,
+		sources:     make(map[string]*tarpitTotals),
+	}
+	if t.interval <= 0 {
+		t.interval = defaultTarpitInterval
+	}
+	if t.maxDuration <= 0 {
+		t.maxDuration = defaultTarpitMaxDuration
+	}
+	return t
+}
+
+// hold keeps conn busy until the client gives up, the maximum duration
+// passes or ctx ends, and returns what the connection cost the client.
+func (t *tarpit) hold(ctx context.Context, conn net.Conn) tarpitTotals {
+	start := time.Now()
+	var sent, recv atomic.Int64
+
+	// The window mode never reads, so a client hanging up only shows in the
+	// socket state, which is checked on every interval.
+	var peer net.Conn = conn
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		peer = nc.NetConn()
+	}
+
+	done := make(chan struct{})
+	if t.mode != tarpitWindow {
+		// Drain what the client sends so it never blocks on writing, and
+		// notice when it hangs up. The window mode relies on never reading.
+		go func() {
+			defer close(done)
+			n, _ := io.Copy(io.Discard, conn)
+			recv.Add(n)
+		}()
+	}
+
+	timer := time.NewTimer(t.maxDuration)
+	defer timer.Stop()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	if t.mode == tarpitHTTP {
+		n, _ := conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
+		sent.Add(int64(n))
+	}
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			if t.mode == tarpitWindow {
+				if closed, _ := netutil.PeerClosed(peer); closed {
+					break loop
+				}
+			}
+			chunk := t.chunk()
+			if chunk == nil {
+				continue
+			}
+			n, err := conn.Write(chunk)
+			sent.Add(int64(n))
+			if err != nil {
+				break loop
+			}
+		case <-done:
+			break loop
+		case <-timer.C:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	conn.Close()
+	if t.mode != tarpitWindow {
+		<-done
+	}
+
+	return tarpitTotals{
+		connections: 1,
+		held:        time.Since(start),
+		bytesSent:   sent.Load(),
+		bytesRecv:   recv.Load(),
+	}
+}
+
+// chunk returns what to send on each interval.
+func (t *tarpit) chunk() []byte {
+	switch t.mode {
+	case tarpitSSH:
+		return randomBannerLine()
+	case tarpitHTTP:
+		return randomHeader()
+	case tarpitKeepalive:
+		return []byte{0}
+	}
+	return nil
+}
+
+// record adds a finished connection to its source's totals and returns the
+// new totals.
+func (t *tarpit) record(sourceIP string, c tarpitTotals) tarpitTotals {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sources[sourceIP]
+	if !ok {
+		if len(t.sources) >= maxTarpitSources {
+			clear(t.sources)
+		}
+		s = &tarpitTotals{}
+		t.sources[sourceIP] = s
+	}
+	s.connections += c.connections
+	s.held += c.held
+	s.bytesSent += c.bytesSent
+	s.bytesRecv += c.bytesRecv
+	return *s
+}
+
+// randomBannerLine returns a line a client reading the SSH version exchange
+// skips while it waits for one starting with "SSH-" (RFC 4253 4.2).
+func randomBannerLine() []byte {
+	line := make([]byte, 3+rand.IntN(30), 35)
+	for i := range line {
+		line[i] = byte(' ' + rand.IntN('~'-' '+1))
+	}
+	if line[0] == 'S' {
+		line[0] = 's'
+	}
+	return append(line, '\r', '\n')
+}
+
+func randomHeader() []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	b := []byte("X-")
+	n := 4 + rand.IntN(8)
+	for i := 0; i < n; i++ {
+		b = append(b, letters[rand.IntN(len(letters))])
+	}
+	b = append(b, ':', ' ')
+	b = strconv.AppendUint(b, rand.Uint64(), 36)
+	return append(b, '\r', '\n')
+}
+
+func (m *Manager) handleTarpit(ctx context.Context, ml *ManagedListener, conn net.Conn, sourceIP string) {
+	log.WithFields(log.Fields{
+		"listener": ml.Config.ID,
+		"source":   conn.RemoteAddr().String(),
+		"mode":     ml.tarpit.mode,
+	}).Debug("tarpitting connection")
+
+	c := ml.tarpit.hold(ctx, conn)
+	total := ml.tarpit.record(sourceIP, c)
+
+	if m.emitter == nil {
+		return
+	}
+	m.emitter.EmitTarpit(ml.Config.ModuleID, sourceIP, map[string]string{
+		"listener":              ml.Config.ID,
+		"mode":                  ml.tarpit.mode,
+		"held_ms":               strconv.FormatInt(c.held.Milliseconds(), 10),
+		"bytes_sent":            strconv.FormatInt(c.bytesSent, 10),
+		"bytes_received":        strconv.FormatInt(c.bytesRecv, 10),
+		"source_connections":    strconv.FormatInt(total.connections, 10),
+		"source_held_ms":        strconv.FormatInt(total.held.Milliseconds(), 10),
+		"source_bytes_sent":     strconv.FormatInt(total.bytesSent, 10),
+		"source_bytes_received": strconv.FormatInt(total.bytesRecv, 10),
+	})
+}
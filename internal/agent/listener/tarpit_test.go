@@ -0,0 +1,96 @@
+package listener
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gimpel/internal/agent/config"
+	"gimpel/pkg/netutil"
+)
+
+func TestTarpitSSHBanner(t *testing.T) {
+	tp := newTarpit(config.ListenerTarpitConfig{Mode: tarpitSSH, Interval: 10 * time.Millisecond})
+	server, client := net.Pipe()
+
+	result := make(chan tarpitTotals, 1)
+	go func() { result <- tp.hold(context.Background(), server) }()
+
+	r := bufio.NewReader(client)
+	var read int
+	for i := 0; i < 3; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "SSH-") || !strings.HasSuffix(line, "\r\n") {
+			t.Errorf("banner line %q", line)
+		}
+		read += len(line)
+	}
+	client.Write([]byte("SSH-2.0-scanner\r\n"))
+	client.Close()
+
+	var c tarpitTotals
+	select {
+	case c = <-result:
+	case <-time.After(time.Second):
+		t.Fatal("tarpit did not release a client that hung up")
+	}
+	if c.bytesSent < int64(read) || c.bytesRecv != 17 {
+		t.Errorf("sent %d received %d, want at least %d and 17", c.bytesSent, c.bytesRecv, read)
+	}
+
+	tp.record("198.51.100.7", c)
+	total := tp.record("198.51.100.7", c)
+	if total.connections != 2 || total.bytesSent != 2*c.bytesSent || total.held != 2*c.held {
+		t.Errorf("source totals %+v after two connections of %+v", total, c)
+	}
+}
+
+func TestTarpitWindowNoticesHangup(t *testing.T) {
+	ln, err := netutil.ListenSmallWindow(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("small window listener: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp := newTarpit(config.ListenerTarpitConfig{Mode: tarpitWindow, Interval: 10 * time.Millisecond, MaxDuration: 10 * time.Second})
+	result := make(chan tarpitTotals, 1)
+	go func() { result <- tp.hold(context.Background(), newTrackedConn(server, 0, 0)) }()
+
+	client.Write([]byte("SSH-2.0-scanner\r\n"))
+	client.Close()
+
+	select {
+	case c := <-result:
+		if c.bytesRecv != 0 {
+			t.Errorf("window mode read %d bytes", c.bytesRecv)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("window tarpit did not release a client that hung up")
+	}
+}
+
+func TestTarpitMaxDuration(t *testing.T) {
+	tp := newTarpit(config.ListenerTarpitConfig{Mode: tarpitWindow, MaxDuration: 20 * time.Millisecond})
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := tp.hold(context.Background(), server)
+	if c.held < 20*time.Millisecond || c.bytesSent != 0 {
+		t.Errorf("held %v sent %d", c.held, c.bytesSent)
+	}
+}
@@ -0,0 +1,243 @@
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	mathrand "math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gimpel/internal/agent/config"
+	"gimpel/pkg/tlsfp"
+)
+
+// Metadata keys set for TLS connections.
+const (
+	MetadataJA3        = "ja3"
+	MetadataJA3Hash    = "ja3_hash"
+	MetadataJA4        = "ja4"
+	MetadataTLSSNI     = "tls_sni"
+	MetadataTLSVersion = "tls_version"
+	MetadataTLSALPN    = "tls_alpn"
+)
+
+const (
+	clientHelloTimeout  = 5 * time.Second
+	maxClientHelloBytes = 4 * (16*1024 + 5)
+	maxGeneratedCerts   = 256
+)
+
+// peekClientHello reads the ClientHello if the client opens with a TLS
+// handshake record. The returned connection replays everything read; hello
+// is nil for non-TLS clients.
+func peekClientHello(conn net.Conn) (net.Conn, *tlsfp.ClientHello, error) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 0, 2048)
+	chunk := make([]byte, 2048)
+	for {
+		n, err := conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		if len(buf) > 0 {
+			length, more, lenErr := tlsfp.RecordLength(buf)
+			switch {
+			case errors.Is(lenErr, tlsfp.ErrNotClientHello):
+				return &peekedConn{Conn: conn, prefix: buf}, nil, nil
+			case lenErr != nil:
+				return &peekedConn{Conn: conn, prefix: buf}, nil, lenErr
+			case !more:
+				hello, err := tlsfp.ParseClientHello(buf[:length])
+				return &peekedConn{Conn: conn, prefix: buf}, hello, err
+			case len(buf) >= maxClientHelloBytes:
+				return &peekedConn{Conn: conn, prefix: buf}, nil, fmt.Errorf("ClientHello exceeds %d bytes", maxClientHelloBytes)
+			}
+		}
+
+		if err != nil {
+			return &peekedConn{Conn: conn, prefix: buf}, nil, err
+		}
+	}
+}
+
+func fingerprintMetadata(hello *tlsfp.ClientHello, metadata map[string]string) {
+	ja3, ja3Hash := hello.JA3()
+	metadata[MetadataJA3] = ja3
+	metadata[MetadataJA3Hash] = ja3Hash
+	metadata[MetadataJA4] = hello.JA4()
+	if hello.ServerName != "" {
+		metadata[MetadataTLSSNI] = hello.ServerName
+	}
+}
+
+// newListenerTLSConfig returns the server config for a terminating
+// listener: the configured certificate, or certificates generated on
+// demand for whatever name the client asks for.
+func newListenerTLSConfig(cfg config.ListenerTLSConfig) (*tls.Config, error) {
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading listener certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	gen, err := newCertGenerator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: gen.certificate}, nil
+}
+
+// certGenerator issues leaf certificates from a private issuer, so that
+// clients see an ordinary two-certificate chain instead of a bare
+// self-signed certificate.
+type certGenerator struct {
+	defaultName  string
+	organization string
+
+	issuer    *x509.Certificate
+	issuerKey *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func newCertGenerator(cfg config.ListenerTLSConfig) (*certGenerator, error) {
+	name := cfg.CommonName
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	org := cfg.Organization
+	if org == "" {
+		org = "Internal Services"
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating issuer key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := backdate(365, 3*365)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Country:      []string{"US"},
+			Organization: []string{org},
+			CommonName:   org + " Issuing CA",
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("creating issuer certificate: %w", err)
+	}
+	issuer, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing issuer certificate: %w", err)
+	}
+
+	return &certGenerator{
+		defaultName:  name,
+		organization: org,
+		issuer:       issuer,
+		issuerKey:    key,
+		certs:        make(map[string]*tls.Certificate),
+	}, nil
+}
+
+func (g *certGenerator) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	if name == "" {
+		name = g.defaultName
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if cert, ok := g.certs[name]; ok {
+		return cert, nil
+	}
+	cert, err := g.issue(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.certs) >= maxGeneratedCerts {
+		clear(g.certs)
+	}
+	g.certs[name] = cert
+	return cert, nil
+}
+
+func (g *certGenerator) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-lived and issued some weeks ago, like an ACME certificate.
+	notBefore := backdate(7, 60)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.AddDate(0, 0, 90),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, g.issuer, &key.PublicKey, g.issuerKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate for %s: %w", name, err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, g.issuer.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial: %w", err)
+	}
+	return serial, nil
+}
+
+// backdate returns a time between minDays and maxDays ago, truncated to the
+// hour.
+func backdate(minDays, maxDays int) time.Time {
+	days := minDays + mathrand.IntN(maxDays-minDays+1)
+	return time.Now().AddDate(0, 0, -days).Truncate(time.Hour)
+}
@@ -0,0 +1,65 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+
+	"gimpel/internal/agent/config"
+)
+
+func TestTLSTerminationWithGeneratedCertificate(t *testing.T) {
+	tlsConfig, err := newListenerTLSConfig(config.ListenerTLSConfig{Terminate: true, CommonName: "mail.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	type result struct {
+		chain []*x509.Certificate
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c := tls.Client(client, &tls.Config{ServerName: "vpn.example.org", InsecureSkipVerify: true})
+		if err := c.Handshake(); err != nil {
+			done <- result{err: err}
+			return
+		}
+		c.Write([]byte("hello"))
+		done <- result{chain: c.ConnectionState().PeerCertificates}
+	}()
+
+	conn, hello, err := peekClientHello(server)
+	if err != nil || hello == nil {
+		t.Fatalf("peekClientHello() = %v, %v", hello, err)
+	}
+	metadata := make(map[string]string)
+	fingerprintMetadata(hello, metadata)
+	if metadata[MetadataTLSSNI] != "vpn.example.org" || metadata[MetadataJA4] == "" || metadata[MetadataJA3Hash] == "" {
+		t.Errorf("metadata = %v", metadata)
+	}
+
+	tlsConn := tls.Server(conn, tlsConfig)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(tlsConn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.chain) != 2 {
+		t.Fatalf("chain length = %d, want leaf and issuer", len(res.chain))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(res.chain[1])
+	if _, err := res.chain[0].Verify(x509.VerifyOptions{DNSName: "vpn.example.org", Roots: roots}); err != nil {
+		t.Errorf("leaf does not verify for the requested name: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/config"
+	"gimpel/pkg/netutil"
+)
+
+// portRoute sends connections whose original destination port falls in
+// ports to a module.
+type portRoute struct {
+	ports    []netutil.PortRange
+	moduleID string
+}
+
+func parseRoutes(cfg config.ListenerConfig) ([]portRoute, error) {
+	routes := make([]portRoute, 0, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		ports, err := netutil.ParsePortRanges(r.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("route to %s: %w", r.ModuleID, err)
+		}
+		routes = append(routes, portRoute{ports: ports, moduleID: r.ModuleID})
+	}
+	return routes, nil
+}
+
+func listenTransparent(ctx context.Context, cfg config.ListenerConfig, addr string) (net.Listener, error) {
+	if netutil.TransparentMode(cfg.Transparent) == netutil.TransparentTProxy {
+		return netutil.ListenTransparent(ctx, cfg.Protocol, addr)
+	}
+	return net.Listen(cfg.Protocol, addr)
+}
+
+// moduleFor picks the module for a destination port, falling back to the
+// listener's own module.
+func (ml *ManagedListener) moduleFor(destPort uint32) string {
+	for _, r := range ml.routes {
+		for _, pr := range r.ports {
+			if pr.Contains(destPort) {
+				return r.moduleID
+			}
+		}
+	}
+	return ml.Config.ModuleID
+}
+
+// originalDest returns where the client was actually connecting to. With
+// TPROXY the socket keeps the original local address; with REDIRECT it has
+// to be queried from conntrack.
+func (ml *ManagedListener) originalDest(conn net.Conn) (string, uint32) {
+	if netutil.TransparentMode(ml.Config.Transparent) == netutil.TransparentRedirect {
+		addr, err := netutil.OriginalDst(conn)
+		if err == nil {
+			return splitAddr(addr)
+		}
+		log.WithError(err).WithField("listener", ml.Config.ID).Debug("no original destination, using local address")
+	}
+	return splitAddr(conn.LocalAddr())
+}
@@ -0,0 +1,146 @@
+package module
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Modules reach the agent over a second Unix socket next to their control
+// socket, passed to them as GIMPEL_AGENT_SOCKET. Each connection carries
+// one AgentRequest answered by an AgentResponse, both as a big-endian
+// uint16 length and JSON. An accepted escalation then turns the connection
+// into a byte stream to the sandbox; an accepted record does the same for
+// a transcript of the escalated session.
+const (
+	AgentOpEscalate = "escalate"
+	AgentOpRecord   = "record"
+	AgentOpResize   = "resize"
+)
+
+const agentRequestTimeout = 10 * time.Second
+
+type AgentRequest struct {
+	Op           string `json:"op"`
+	ConnectionID string `json:"connection_id"`
+	Cols         uint16 `json:"cols,omitempty"`
+	Rows         uint16 `json:"rows,omitempty"`
+	// Terminal marks an escalation whose stream the module fills with the
+	// decrypted terminal session instead of the attacker's raw bytes.
+	Terminal bool `json:"terminal,omitempty"`
+}
+
+type AgentResponse struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// AgentHandler serves requests from modules. It owns conn and must close
+// it.
+type AgentHandler interface {
+	HandleAgentRequest(moduleID string, req *AgentRequest, conn net.Conn)
+}
+
+// AgentSocketPath returns where the agent listens for a module whose
+// control socket is socketPath.
+func AgentSocketPath(socketPath string) string {
+	return strings.TrimSuffix(socketPath, ".sock") + ".agent.sock"
+}
+
+// SetAgentHandler serves the agent socket of modules connected after the
+// call.
+func (s *Supervisor) SetAgentHandler(h AgentHandler) {
+	s.mu.Lock()
+	s.agentHandler = h
+	s.mu.Unlock()
+}
+
+// serveAgentSocket listens on a module's agent socket. Callers hold s.mu.
+func (s *Supervisor) serveAgentSocket(moduleID, socketPath string) {
+	if s.agentHandler == nil {
+		return
+	}
+	if _, ok := s.agentSockets[moduleID]; ok {
+		return
+	}
+
+	path := AgentSocketPath(socketPath)
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.WithError(err).WithField("module", moduleID).Warn("failed to listen on module agent socket")
+		return
+	}
+	// Modules may run as another user. Requests are only honoured for
+	// connections the agent handed to this module.
+	if err := os.Chmod(path, 0666); err != nil {
+		log.WithError(err).WithField("module", moduleID).Warn("failed to set agent socket permissions")
+	}
+	s.agentSockets[moduleID] = ln
+
+	handler := s.agentHandler
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveAgentConn(handler, moduleID, conn)
+		}
+	}()
+}
+
+// closeAgentSocket stops serving a module's agent socket. Callers hold
+// s.mu.
+func (s *Supervisor) closeAgentSocket(moduleID string) {
+	if ln, ok := s.agentSockets[moduleID]; ok {
+		ln.Close()
+		delete(s.agentSockets, moduleID)
+	}
+}
+
+func serveAgentConn(handler AgentHandler, moduleID string, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(agentRequestTimeout))
+	var req AgentRequest
+	if err := readAgentFrame(conn, &req); err != nil {
+		log.WithError(err).WithField("module", moduleID).Debug("invalid agent socket request")
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	handler.HandleAgentRequest(moduleID, &req, conn)
+}
+
+// WriteAgentResponse answers a request read from an agent socket.
+func WriteAgentResponse(w io.Writer, resp *AgentResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0xffff {
+		return fmt.Errorf("agent response too large")
+	}
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+	_, err = w.Write(append(frame, data...))
+	return err
+}
+
+func readAgentFrame(r io.Reader, v interface{}) error {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,55 @@
+package module
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// waitInstance adapts the instance exit state to the channel returned by
+// ModuleRuntime.Wait.
+func waitInstance(instance *ModuleInstance) <-chan ExitStatus {
+	ch := make(chan ExitStatus, 1)
+	go func() {
+		<-instance.Exited()
+		status, _ := instance.ExitStatus()
+		ch <- status
+		close(ch)
+	}()
+	return ch
+}
+
+// exitStatusFromError converts the result of exec.Cmd.Wait.
+func exitStatusFromError(err error) ExitStatus {
+	if err == nil {
+		return ExitStatus{Reason: "exited"}
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return ExitStatus{
+				Code:   -1,
+				Signal: ws.Signal().String(),
+				Reason: "signaled",
+				Err:    err,
+			}
+		}
+		return ExitStatus{Code: exitErr.ExitCode(), Reason: "exited", Err: err}
+	}
+
+	return ExitStatus{Code: -1, Reason: "lost", Err: err}
+}
+
+// markProcessExited updates the instance after its process has been reaped.
+func markProcessExited(instance *ModuleInstance, err error) ExitStatus {
+	status := exitStatusFromError(err)
+	if err != nil {
+		instance.LastError = err
+		instance.State = ModuleStateFailed
+	} else {
+		instance.State = ModuleStateStopped
+	}
+	instance.setExited(status)
+	return status
+}
@@ -13,10 +13,13 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/capture"
 )
 
 type ConnectionForwarder struct {
 	defaultMode ConnectionMode
+	capture     *capture.Recorder
 
 	mu         sync.RWMutex
 	forwarders map[string]*ModuleForwarder
@@ -29,6 +32,7 @@ type ModuleForwarder struct {
 	dataPort   int
 
 	controlConn *net.UnixConn
+	capture     *capture.Recorder
 
 	activeConns sync.Map
 
@@ -71,6 +75,14 @@ func NewConnectionForwarder(defaultMode ConnectionMode) *ConnectionForwarder {
 	}
 }
 
+// SetCapture records connections relayed to modules registered after the
+// call.
+func (cf *ConnectionForwarder) SetCapture(r *capture.Recorder) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.capture = r
+}
+
 func (cf *ConnectionForwarder) RegisterModule(moduleID, socketPath string, dataPort int, mode ConnectionMode) error {
 	cf.mu.Lock()
 	defer cf.mu.Unlock()
@@ -84,6 +96,7 @@ func (cf *ConnectionForwarder) RegisterModule(moduleID, socketPath string, dataP
 		mode:       mode,
 		socketPath: socketPath,
 		dataPort:   dataPort,
+		capture:    cf.capture,
 		metrics:    &ForwarderMetrics{},
 	}
 
@@ -283,6 +296,11 @@ func (mf *ModuleForwarder) forwardProxy(ctx context.Context, req *ConnectionRequ
 }
 
 func (mf *ModuleForwarder) relay(ctx context.Context, client, server net.Conn, fc *ForwardedConnection) {
+	req := fc.Request
+	session := mf.capture.Start(mf.moduleID, fc.ID, req.SourceIP, req.SourcePort, req.DestIP, req.DestPort)
+	defer session.Close()
+	client = capture.Tap(client, session)
+
 	done := make(chan struct{}, 2)
 
 	go func() {
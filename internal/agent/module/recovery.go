@@ -0,0 +1,208 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/config"
+	"gimpel/internal/agent/store"
+)
+
+// Recover re-attaches to modules that were running when the previous agent
+// process exited. Modules that cannot be adopted are cleaned up and started
+// fresh. It must run before any module is started.
+func (s *Supervisor) Recover(ctx context.Context) error {
+	if s.store == nil {
+		return nil
+	}
+
+	records, err := s.store.ListContainers()
+	if err != nil {
+		return fmt.Errorf("listing module records: %w", err)
+	}
+
+	for _, rec := range records {
+		if rec.Status != store.ContainerStatusRunning {
+			s.store.DeleteContainer(rec.ID)
+			continue
+		}
+
+		var cfg config.ModuleConfig
+		if err := json.Unmarshal(rec.Config, &cfg); err != nil || cfg.ID == "" {
+			log.WithError(err).WithField("module", rec.ModuleID).Warn("discarding unreadable module record")
+			s.store.DeleteContainer(rec.ID)
+			continue
+		}
+
+		if err := s.recoverModule(ctx, cfg, rec); err != nil {
+			log.WithError(err).WithField("module", cfg.ID).Error("failed to recover module")
+		}
+	}
+
+	return nil
+}
+
+func (s *Supervisor) recoverModule(ctx context.Context, cfg config.ModuleConfig, rec *store.Container) error {
+	spec := s.configToSpec(cfg)
+	if rec.Runtime != "" {
+		spec.ExecutionMode = ExecutionMode(rec.Runtime)
+	}
+
+	instance := &ModuleInstance{
+		ID:           cfg.ID,
+		Spec:         spec,
+		PID:          rec.PID,
+		ContainerID:  rec.ContainerID,
+		UnitName:     rec.UnitName,
+		SocketPath:   rec.SocketPath,
+		DataPort:     rec.DataPort,
+		StartedAt:    rec.StartedAt,
+		State:        ModuleStateRunning,
+		RestartCount: rec.RestartCount,
+		Metrics:      &ModuleMetrics{},
+	}
+
+	// Never signal a PID that has since been reused by another process.
+	if instance.PID != 0 {
+		if started, err := processStartTime(instance.PID); err != nil || started != rec.ProcessStartTime {
+			instance.PID = 0
+		}
+	}
+
+	fields := log.Fields{
+		"module":  cfg.ID,
+		"runtime": spec.ExecutionMode,
+	}
+
+	runtime, err := s.runtimeMgr.GetRuntime(spec.ExecutionMode)
+	if err != nil {
+		log.WithFields(fields).WithError(err).Warn("runtime of recorded module is unavailable, starting fresh")
+		s.store.DeleteContainer(rec.ID)
+		return s.StartModule(ctx, cfg)
+	}
+
+	recoverable, ok := runtime.(RecoverableRuntime)
+	if !ok {
+		s.store.DeleteContainer(rec.ID)
+		return s.StartModule(ctx, cfg)
+	}
+
+	adoptErr := recoverable.Adopt(ctx, instance)
+	if adoptErr == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.instances[cfg.ID] = instance
+		s.configs[cfg.ID] = cfg
+		go s.watchExit(ctx, instance)
+
+		if err := s.connectModule(cfg, instance); err != nil {
+			if instance.StopFunc != nil {
+				instance.StopFunc()
+			}
+			delete(s.instances, cfg.ID)
+			s.deleteRecord(cfg.ID)
+			return fmt.Errorf("reconnecting to adopted module: %w", err)
+		}
+		s.saveRecord(cfg, instance)
+
+		log.WithFields(fields).WithField("pid", instance.PID).Info("module recovered")
+		return nil
+	}
+
+	log.WithFields(fields).WithError(adoptErr).Info("cannot adopt module, cleaning up")
+	if err := recoverable.Cleanup(ctx, instance); err != nil {
+		log.WithFields(fields).WithError(err).Warn("failed to clean up module from previous run")
+	}
+	s.store.DeleteContainer(rec.ID)
+
+	return s.StartModule(ctx, cfg)
+}
+
+// saveRecord persists what a restarted agent needs to find the module again.
+// Callers hold s.mu.
+func (s *Supervisor) saveRecord(cfg config.ModuleConfig, instance *ModuleInstance) {
+	if s.store == nil {
+		return
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		log.WithError(err).WithField("module", cfg.ID).Warn("failed to encode module config")
+		return
+	}
+
+	rec := &store.Container{
+		ID:           instance.ID,
+		ModuleID:     instance.ID,
+		ImageRef:     instance.Spec.Image,
+		Status:       store.ContainerStatusRunning,
+		PID:          instance.PID,
+		Env:          instance.Spec.Env,
+		StartedAt:    instance.StartedAt,
+		RestartCount: instance.RestartCount,
+		Runtime:      string(instance.Spec.ExecutionMode),
+		ContainerID:  instance.ContainerID,
+		UnitName:     instance.UnitName,
+		SocketPath:   instance.SocketPath,
+		DataPort:     instance.DataPort,
+		Config:       data,
+	}
+	if instance.PID != 0 {
+		rec.ProcessStartTime, _ = processStartTime(instance.PID)
+	}
+
+	if err := s.store.SaveContainer(rec); err != nil {
+		log.WithError(err).WithField("module", instance.ID).Warn("failed to save module record")
+	}
+}
+
+func (s *Supervisor) markRecordExited(instance *ModuleInstance, status ExitStatus) {
+	if s.store == nil {
+		return
+	}
+
+	state := store.ContainerStatusStopped
+	errMsg := ""
+	if !status.Success() {
+		state = store.ContainerStatusFailed
+		if status.Err != nil {
+			errMsg = status.Err.Error()
+		}
+	}
+	if err := s.store.UpdateContainerStatus(instance.ID, state, errMsg); err != nil {
+		log.WithError(err).WithField("module", instance.ID).Debug("failed to update module record")
+	}
+}
+
+func (s *Supervisor) deleteRecord(moduleID string) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.DeleteContainer(moduleID); err != nil {
+		log.WithError(err).WithField("module", moduleID).Warn("failed to delete module record")
+	}
+}
+
+// processStartTime returns the start time of pid in clock ticks since boot,
+// which together with the PID identifies a process across PID reuse.
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name may contain spaces; fields resume after its ')'.
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("short /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
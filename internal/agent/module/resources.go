@@ -0,0 +1,121 @@
+package module
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/cgroup"
+	"gimpel/internal/agent/confine"
+)
+
+func cgroupLimits(limits ResourceLimits) cgroup.Limits {
+	return cgroup.Limits{
+		MemoryMaxBytes: limits.MaxMemoryMB * 1024 * 1024,
+		CPUPercent:     limits.MaxCPUPercent,
+		PidsMax:        limits.MaxProcesses,
+	}
+}
+
+// prepareCgroup creates the module's cgroup and configures cmd to start
+// inside it. The returned release function must be called after cmd.Start.
+func prepareCgroup(cgroups *cgroup.Manager, spec *ModuleSpec, cmd *exec.Cmd) (*cgroup.Group, func(), error) {
+	if cgroups == nil {
+		return nil, func() {}, nil
+	}
+
+	group, err := cgroups.Create(spec.ID, cgroupLimits(spec.ResourceLimits))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attached, err := group.Attach(cmd.SysProcAttr)
+	if err != nil {
+		group.Destroy()
+		return nil, nil, err
+	}
+
+	release := func() {
+		pid := 0
+		if cmd.Process != nil {
+			pid = cmd.Process.Pid
+		}
+		attached(pid)
+	}
+	return group, release, nil
+}
+
+// limitOpenFiles makes cmd start through the confinement shim, so the module
+// already runs with its RLIMIT_NOFILE when it is executed.
+func limitOpenFiles(spec *ModuleSpec, cmd *exec.Cmd) {
+	if spec.ResourceLimits.MaxOpenFiles <= 0 {
+		return
+	}
+	profile := &confine.Profile{MaxOpenFiles: uint64(spec.ResourceLimits.MaxOpenFiles)}
+	if err := confine.Wrap(cmd, profile); err != nil {
+		log.WithError(err).WithField("module", spec.ID).Warn("failed to apply open files limit")
+	}
+}
+
+func updateResourceMetrics(inst *ModuleInstance) {
+	if inst.Cgroup == nil || inst.Metrics == nil {
+		return
+	}
+
+	stats, err := inst.Cgroup.Stats()
+	if err != nil {
+		log.WithError(err).WithField("module", inst.ID).Debug("failed to read cgroup stats")
+		return
+	}
+
+	inst.Metrics.MemoryUsageBytes = stats.MemoryCurrentBytes
+	inst.Metrics.CPUUsagePercent = stats.CPUPercent
+}
+
+// killProcessTree kills the module process and, when it runs in its own
+// cgroup, everything it spawned.
+func killProcessTree(cmd *exec.Cmd, group *cgroup.Group) {
+	if group != nil {
+		if err := group.Kill(); err == nil {
+			return
+		}
+	}
+	cmd.Process.Kill()
+}
+
+// cleanupOrphan kills a module process left behind by a previous agent
+// process. instance.PID must only be set when it is known to still belong to
+// the module.
+func cleanupOrphan(cgroups *cgroup.Manager, instance *ModuleInstance) error {
+	if cgroups != nil {
+		if group, err := cgroups.Open(instance.ID); err == nil {
+			group.Kill()
+			defer group.Destroy()
+		}
+	}
+
+	if instance.PID != 0 {
+		if err := syscall.Kill(instance.PID, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("killing orphaned process %d: %w", instance.PID, err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for syscall.Kill(instance.PID, 0) == nil {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("orphaned process %d did not exit", instance.PID)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if instance.SocketPath != "" {
+		os.Remove(instance.SocketPath)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/containerd/containerd"
@@ -118,6 +119,7 @@ func (r *ContainerdRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Modul
 
 	envVars := []string{
 		fmt.Sprintf("GIMPEL_SOCKET=%s", spec.SocketPath),
+		fmt.Sprintf("GIMPEL_AGENT_SOCKET=%s", AgentSocketPath(spec.SocketPath)),
 		fmt.Sprintf("GIMPEL_MODULE_ID=%s", spec.ID),
 		fmt.Sprintf("GIMPEL_EXECUTION_MODE=%s", spec.ExecutionMode),
 		fmt.Sprintf("GIMPEL_CONNECTION_MODE=%s", spec.ConnectionMode),
@@ -126,14 +128,7 @@ func (r *ContainerdRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Modul
 		envVars = append(envVars, fmt.Sprintf("%s=%s", k, v))
 	}
 
-	if existingContainer, err := r.client.LoadContainer(ctx, spec.ID); err == nil {
-		log.WithField("module", spec.ID).Debug("cleaning up existing container")
-		if task, err := existingContainer.Task(ctx, nil); err == nil {
-			task.Kill(ctx, 9)
-			task.Delete(ctx)
-		}
-		existingContainer.Delete(ctx, containerd.WithSnapshotCleanup)
-	}
+	r.removeContainer(ctx, spec.ID)
 
 	container, err := r.client.NewContainer(
 		ctx,
@@ -164,6 +159,15 @@ func (r *ContainerdRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Modul
 		return nil, fmt.Errorf("creating task: %w", err)
 	}
 
+	// Wait has to be called before Start so a fast exit is not missed.
+	waitCtx := namespaces.WithNamespace(context.Background(), r.namespace)
+	exitCh, err := task.Wait(waitCtx)
+	if err != nil {
+		task.Delete(ctx)
+		container.Delete(ctx, containerd.WithSnapshotCleanup)
+		return nil, fmt.Errorf("waiting on task: %w", err)
+	}
+
 	if err := task.Start(ctx); err != nil {
 		task.Delete(ctx)
 		container.Delete(ctx, containerd.WithSnapshotCleanup)
@@ -181,18 +185,13 @@ func (r *ContainerdRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Modul
 		ID:          spec.ID,
 		Spec:        spec,
 		ContainerID: container.ID(),
+		PID:         int(task.Pid()),
 		SocketPath:  spec.SocketPath,
 		StartedAt:   time.Now(),
 		State:       ModuleStateRunning,
 		Metrics:     &ModuleMetrics{},
-		StopFunc: func() {
-			stopCtx := context.Background()
-			stopCtx = namespaces.WithNamespace(stopCtx, r.namespace)
-			task.Kill(stopCtx, 15)
-			task.Delete(stopCtx)
-			container.Delete(stopCtx, containerd.WithSnapshotCleanup)
-		},
 	}
+	r.supervise(instance, container, task, exitCh)
 
 	log.WithFields(log.Fields{
 		"module":    spec.ID,
@@ -203,6 +202,111 @@ func (r *ContainerdRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Modul
 	return instance, nil
 }
 
+// supervise installs the stop function and records the exit status once the
+// task exits.
+func (r *ContainerdRuntime) supervise(instance *ModuleInstance, container containerd.Container, task containerd.Task, exitCh <-chan containerd.ExitStatus) {
+	instance.StopFunc = func() {
+		stopCtx := namespaces.WithNamespace(context.Background(), r.namespace)
+		task.Kill(stopCtx, 15)
+		select {
+		case <-instance.Exited():
+		case <-time.After(10 * time.Second):
+			task.Kill(stopCtx, 9)
+			<-instance.Exited()
+		}
+		task.Delete(stopCtx)
+		container.Delete(stopCtx, containerd.WithSnapshotCleanup)
+	}
+
+	go func() {
+		result := <-exitCh
+		code, exitedAt, err := result.Result()
+		status := ExitStatus{Code: int(code), Reason: "exited", Err: err, ExitedAt: exitedAt}
+		if err != nil {
+			status.Reason = "lost"
+		} else if code > 128 {
+			status.Reason = "signaled"
+			status.Signal = syscall.Signal(code - 128).String()
+		}
+		switch {
+		case err != nil:
+			instance.LastError = err
+			instance.State = ModuleStateFailed
+		case code != 0:
+			instance.LastError = fmt.Errorf("container exited with status %d", code)
+			instance.State = ModuleStateFailed
+		default:
+			instance.State = ModuleStateStopped
+		}
+		instance.setExited(status)
+	}()
+}
+
+func (r *ContainerdRuntime) removeContainer(ctx context.Context, id string) {
+	existingContainer, err := r.client.LoadContainer(ctx, id)
+	if err != nil {
+		return
+	}
+	log.WithField("module", id).Debug("cleaning up existing container")
+	if task, err := existingContainer.Task(ctx, nil); err == nil {
+		task.Kill(ctx, 9)
+		task.Delete(ctx, containerd.WithProcessKill)
+	}
+	existingContainer.Delete(ctx, containerd.WithSnapshotCleanup)
+}
+
+func (r *ContainerdRuntime) Adopt(ctx context.Context, instance *ModuleInstance) error {
+	if instance.ContainerID == "" {
+		return fmt.Errorf("no container recorded for module %s", instance.ID)
+	}
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+
+	container, err := r.client.LoadContainer(ctx, instance.ContainerID)
+	if err != nil {
+		return fmt.Errorf("loading container: %w", err)
+	}
+	task, err := container.Task(ctx, cio.NewAttach(cio.WithStdio))
+	if err != nil {
+		return fmt.Errorf("loading task: %w", err)
+	}
+
+	status, err := task.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("reading task status: %w", err)
+	}
+	if status.Status != containerd.Running {
+		return fmt.Errorf("task is %s", status.Status)
+	}
+
+	exitCh, err := task.Wait(namespaces.WithNamespace(context.Background(), r.namespace))
+	if err != nil {
+		return fmt.Errorf("waiting on task: %w", err)
+	}
+
+	if err := waitForSocket(instance.SocketPath, 5*time.Second); err != nil {
+		return err
+	}
+
+	instance.PID = int(task.Pid())
+	r.supervise(instance, container, task, exitCh)
+
+	log.WithFields(log.Fields{
+		"module":    instance.ID,
+		"container": instance.ContainerID,
+		"pid":       instance.PID,
+	}).Info("adopted running containerd module")
+
+	return nil
+}
+
+func (r *ContainerdRuntime) Cleanup(ctx context.Context, instance *ModuleInstance) error {
+	if instance.ContainerID == "" {
+		return nil
+	}
+	r.removeContainer(namespaces.WithNamespace(ctx, r.namespace), instance.ContainerID)
+	return nil
+}
+
 func (r *ContainerdRuntime) Stop(ctx context.Context, instance *ModuleInstance) error {
 	if instance.StopFunc != nil {
 		instance.StopFunc()
@@ -235,6 +339,10 @@ func (r *ContainerdRuntime) IsRunning(ctx context.Context, instance *ModuleInsta
 	return status.Status == containerd.Running
 }
 
+func (r *ContainerdRuntime) Wait(instance *ModuleInstance) <-chan ExitStatus {
+	return waitInstance(instance)
+}
+
 func (r *ContainerdRuntime) Logs(ctx context.Context, instance *ModuleInstance, lines int) ([]string, error) {
 	return nil, fmt.Errorf("logs not implemented for containerd runtime")
 }
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package module
+
+import "errors"
+
+// ContainerdRuntime is never constructed off Linux.
+type ContainerdRuntime struct {
+	ModuleRuntime
+}
+
+func NewContainerdRuntime(address, namespace string) (*ContainerdRuntime, error) {
+	return nil, errors.New("containerd runtime is only supported on linux")
+}
@@ -6,6 +6,8 @@ import (
 	"sync"
 
 	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/cgroup"
 )
 
 type RuntimeManager struct {
@@ -16,6 +18,8 @@ type RuntimeManager struct {
 
 	privilegedConfig *PrivilegedRuntimeConfig
 
+	cgroups *cgroup.Manager
+
 	containerdAddress   string
 	containerdNamespace string
 }
@@ -32,6 +36,16 @@ type RuntimeManagerConfig struct {
 	ContainerdAddress string
 
 	ContainerdNamespace string
+
+	EnableSystemd bool
+
+	SystemdConfig *SystemdRuntimeConfig
+
+	CgroupParent string
+
+	EnableWasm bool
+
+	Events EventSink
 }
 
 func NewRuntimeManager(cfg *RuntimeManagerConfig) (*RuntimeManager, error) {
@@ -44,7 +58,14 @@ func NewRuntimeManager(cfg *RuntimeManagerConfig) (*RuntimeManager, error) {
 		rm.defaultRuntime = ExecutionModeUserspace
 	}
 
-	rm.runtimes[ExecutionModeUserspace] = NewUserspaceRuntime()
+	cgroups, err := cgroup.NewManager("", cfg.CgroupParent)
+	if err != nil {
+		log.WithError(err).Warn("cgroup manager unavailable, module resource limits will not be enforced")
+	} else {
+		rm.cgroups = cgroups
+	}
+
+	rm.runtimes[ExecutionModeUserspace] = NewUserspaceRuntime(rm.cgroups)
 
 	if cfg.EnablePrivileged {
 		privCfg := cfg.PrivilegedConfig
@@ -52,7 +73,7 @@ func NewRuntimeManager(cfg *RuntimeManagerConfig) (*RuntimeManager, error) {
 			privCfg = &PrivilegedRuntimeConfig{}
 		}
 
-		privRuntime, err := NewPrivilegedRuntime(privCfg)
+		privRuntime, err := NewPrivilegedRuntime(privCfg, rm.cgroups)
 		if err != nil {
 			log.WithError(err).Warn("failed to initialize privileged runtime")
 		} else {
@@ -77,6 +98,24 @@ func NewRuntimeManager(cfg *RuntimeManagerConfig) (*RuntimeManager, error) {
 		}
 	}
 
+	if cfg.EnableSystemd {
+		systemdCfg := cfg.SystemdConfig
+		if systemdCfg == nil {
+			systemdCfg = &SystemdRuntimeConfig{}
+		}
+
+		systemdRuntime, err := NewSystemdRuntime(systemdCfg)
+		if err != nil {
+			log.WithError(err).Warn("failed to initialize systemd runtime")
+		} else {
+			rm.runtimes[ExecutionModeSystemd] = systemdRuntime
+		}
+	}
+
+	if cfg.EnableWasm {
+		rm.runtimes[ExecutionModeWasm] = NewWasmRuntime(cfg.Events)
+	}
+
 	log.WithFields(log.Fields{
 		"default":  rm.defaultRuntime,
 		"runtimes": rm.availableRuntimes(),
@@ -137,6 +176,10 @@ func (rm *RuntimeManager) StartModule(ctx context.Context, spec *ModuleSpec) (*M
 		return nil, fmt.Errorf("selecting runtime: %w", err)
 	}
 
+	if spec.Confinement != nil && runtime.Type() != ExecutionModeUserspace {
+		return nil, fmt.Errorf("confinement is only supported for userspace modules, not %s", runtime.Type())
+	}
+
 	log.WithFields(log.Fields{
 		"module":  spec.ID,
 		"runtime": runtime.Type(),
@@ -154,6 +197,15 @@ func (rm *RuntimeManager) StopModule(ctx context.Context, instance *ModuleInstan
 	return runtime.Stop(ctx, instance)
 }
 
+func (rm *RuntimeManager) WaitModule(instance *ModuleInstance) (<-chan ExitStatus, error) {
+	runtime, err := rm.GetRuntime(instance.Spec.ExecutionMode)
+	if err != nil {
+		return nil, fmt.Errorf("getting runtime: %w", err)
+	}
+
+	return runtime.Wait(instance), nil
+}
+
 func (rm *RuntimeManager) RegisterRuntime(mode ExecutionMode, runtime ModuleRuntime) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
@@ -15,6 +15,8 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/cgroup"
 )
 
 type PrivilegedRuntime struct {
@@ -29,6 +31,8 @@ type PrivilegedRuntime struct {
 	useCapabilities bool
 
 	requiredCapabilities []string
+
+	cgroups *cgroup.Manager
 }
 
 type PrivilegedRuntimeConfig struct {
@@ -45,7 +49,7 @@ type PrivilegedRuntimeConfig struct {
 	RequiredCapabilities []string
 }
 
-func NewPrivilegedRuntime(cfg *PrivilegedRuntimeConfig) (*PrivilegedRuntime, error) {
+func NewPrivilegedRuntime(cfg *PrivilegedRuntimeConfig, cgroups *cgroup.Manager) (*PrivilegedRuntime, error) {
 	sudoPath := cfg.SudoPath
 	if sudoPath == "" {
 		var err error
@@ -81,6 +85,7 @@ func NewPrivilegedRuntime(cfg *PrivilegedRuntimeConfig) (*PrivilegedRuntime, err
 		targetGroup:          cfg.TargetGroup,
 		useCapabilities:      cfg.UseCapabilities,
 		requiredCapabilities: cfg.RequiredCapabilities,
+		cgroups:              cgroups,
 	}, nil
 }
 
@@ -123,17 +128,29 @@ func (r *PrivilegedRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Modul
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
+	limitOpenFiles(spec, cmd)
 
 	cmd.Stdout = &moduleLogger{moduleID: spec.ID, level: "info"}
 	cmd.Stderr = &moduleLogger{moduleID: spec.ID, level: "error"}
 
-	if err := cmd.Start(); err != nil {
+	group, release, err := prepareCgroup(r.cgroups, spec, cmd)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("preparing cgroup: %w", err)
+	}
+
+	err = cmd.Start()
+	release()
+	if err != nil {
 		cancel()
+		if group != nil {
+			group.Destroy()
+		}
 		return nil, fmt.Errorf("starting privileged process: %w", err)
 	}
 
 	if err := waitForSocket(spec.SocketPath, 30*time.Second); err != nil {
-		cmd.Process.Kill()
+		killProcessTree(cmd, group)
 		cancel()
 		return nil, fmt.Errorf("waiting for module socket: %w", err)
 	}
@@ -146,22 +163,22 @@ func (r *PrivilegedRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Modul
 		ID:         spec.ID,
 		Spec:       spec,
 		PID:        cmd.Process.Pid,
+		Cgroup:     group,
 		SocketPath: spec.SocketPath,
 		StartedAt:  time.Now(),
 		State:      ModuleStateRunning,
 		Metrics:    &ModuleMetrics{},
-		StopFunc: func() {
-			cmd.Process.Signal(syscall.SIGTERM)
-			done := make(chan error, 1)
-			go func() { done <- cmd.Wait() }()
-			select {
-			case <-done:
-			case <-time.After(10 * time.Second):
-				cmd.Process.Kill()
-				cmd.Process.Signal(syscall.SIGKILL)
-			}
-			cancel()
-		},
+	}
+	instance.StopFunc = func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-instance.Exited():
+		case <-time.After(10 * time.Second):
+			killProcessTree(cmd, group)
+			cmd.Process.Signal(syscall.SIGKILL)
+			<-instance.Exited()
+		}
+		cancel()
 	}
 
 	go r.monitorProcess(cmd, instance)
@@ -204,6 +221,7 @@ func (r *PrivilegedRuntime) buildEnvironment(spec *ModuleSpec) []string {
 
 	env = append(env,
 		fmt.Sprintf("GIMPEL_SOCKET=%s", spec.SocketPath),
+		fmt.Sprintf("GIMPEL_AGENT_SOCKET=%s", AgentSocketPath(spec.SocketPath)),
 		fmt.Sprintf("GIMPEL_MODULE_ID=%s", spec.ID),
 		fmt.Sprintf("GIMPEL_EXECUTION_MODE=%s", spec.ExecutionMode),
 		fmt.Sprintf("GIMPEL_CONNECTION_MODE=%s", spec.ConnectionMode),
@@ -219,13 +237,17 @@ func (r *PrivilegedRuntime) buildEnvironment(spec *ModuleSpec) []string {
 func (r *PrivilegedRuntime) monitorProcess(cmd *exec.Cmd, instance *ModuleInstance) {
 	err := cmd.Wait()
 	if err != nil {
-		instance.LastError = err
-		instance.State = ModuleStateFailed
 		log.WithError(err).WithField("module", instance.ID).Error("privileged module exited with error")
 	} else {
-		instance.State = ModuleStateStopped
 		log.WithField("module", instance.ID).Info("privileged module exited normally")
 	}
+
+	if instance.Cgroup != nil {
+		instance.Cgroup.Kill()
+		instance.Cgroup.Destroy()
+	}
+
+	markProcessExited(instance, err)
 }
 
 func (r *PrivilegedRuntime) Stop(ctx context.Context, instance *ModuleInstance) error {
@@ -263,6 +285,20 @@ func (r *PrivilegedRuntime) IsRunning(ctx context.Context, instance *ModuleInsta
 	return err == nil
 }
 
+func (r *PrivilegedRuntime) Wait(instance *ModuleInstance) <-chan ExitStatus {
+	return waitInstance(instance)
+}
+
+// Adopt always fails: the module's stdout and stderr were pipes owned by the
+// previous agent process, so the module cannot be supervised again.
+func (r *PrivilegedRuntime) Adopt(ctx context.Context, instance *ModuleInstance) error {
+	return fmt.Errorf("privileged modules cannot be adopted")
+}
+
+func (r *PrivilegedRuntime) Cleanup(ctx context.Context, instance *ModuleInstance) error {
+	return cleanupOrphan(r.cgroups, instance)
+}
+
 func (r *PrivilegedRuntime) Logs(ctx context.Context, instance *ModuleInstance, lines int) ([]string, error) {
 	return nil, fmt.Errorf("logs not available for privileged runtime")
 }
@@ -0,0 +1,489 @@
+//go:build linux
+
+package module
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	sdbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/coreos/go-systemd/v22/unit"
+	godbus "github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// systemdBus is the subset of the systemd D-Bus API used by SystemdRuntime.
+type systemdBus interface {
+	StartTransientUnitContext(ctx context.Context, name string, mode string, properties []sdbus.Property, ch chan<- string) (int, error)
+	StopUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+	KillUnitWithTarget(ctx context.Context, name string, target sdbus.Who, signal int32) error
+	ResetFailedUnitContext(ctx context.Context, name string) error
+	GetUnitPropertyContext(ctx context.Context, unit string, propertyName string) (*sdbus.Property, error)
+	GetServicePropertyContext(ctx context.Context, service string, propertyName string) (*sdbus.Property, error)
+	Close()
+}
+
+type SystemdRuntime struct {
+	bus      systemdBus
+	userMode bool
+	slice    string
+
+	// pollInterval is how often running units are checked for an exit.
+	pollInterval time.Duration
+
+	journal func(ctx context.Context, unitName string, lines int) ([]string, error)
+
+	mu    sync.Mutex
+	stops map[*ModuleInstance]func(context.Context) error
+}
+
+type SystemdRuntimeConfig struct {
+	UserMode bool
+
+	Slice string
+}
+
+func NewSystemdRuntime(cfg *SystemdRuntimeConfig) (*SystemdRuntime, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var conn *sdbus.Conn
+	var err error
+	if cfg.UserMode {
+		conn, err = sdbus.NewUserConnectionContext(ctx)
+	} else {
+		conn, err = sdbus.NewSystemConnectionContext(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to systemd: %w", err)
+	}
+
+	return newSystemdRuntime(conn, cfg), nil
+}
+
+func newSystemdRuntime(bus systemdBus, cfg *SystemdRuntimeConfig) *SystemdRuntime {
+	r := &SystemdRuntime{
+		bus:      bus,
+		userMode: cfg.UserMode,
+		slice:    cfg.Slice,
+
+		pollInterval: time.Second,
+
+		stops: make(map[*ModuleInstance]func(context.Context) error),
+	}
+	if r.slice == "" {
+		r.slice = "gimpel.slice"
+	}
+	r.journal = r.readJournal
+	return r
+}
+
+func (r *SystemdRuntime) Name() string {
+	return "systemd"
+}
+
+func (r *SystemdRuntime) Type() ExecutionMode {
+	return ExecutionModeSystemd
+}
+
+func (r *SystemdRuntime) Start(ctx context.Context, spec *ModuleSpec) (*ModuleInstance, error) {
+	socketDir := filepath.Dir(spec.SocketPath)
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		return nil, fmt.Errorf("creating socket dir: %w", err)
+	}
+
+	os.Remove(spec.SocketPath)
+
+	if err := os.Chmod(spec.Image, 0755); err != nil {
+		return nil, fmt.Errorf("making module executable: %w", err)
+	}
+
+	unitName := systemdUnitName(spec.ID)
+
+	// A unit left in the failed state from a previous run blocks reuse of the name.
+	r.bus.ResetFailedUnitContext(ctx, unitName)
+
+	ch := make(chan string, 1)
+	if _, err := r.bus.StartTransientUnitContext(ctx, unitName, "fail", r.unitProperties(spec), ch); err != nil {
+		return nil, fmt.Errorf("starting unit %s: %w", unitName, err)
+	}
+
+	if err := waitForJob(ctx, ch); err != nil {
+		r.bus.ResetFailedUnitContext(ctx, unitName)
+		return nil, fmt.Errorf("starting unit %s: %w", unitName, err)
+	}
+
+	if err := waitForSocket(spec.SocketPath, 10*time.Second); err != nil {
+		r.stopUnit(ctx, unitName)
+		return nil, fmt.Errorf("waiting for socket: %w", err)
+	}
+
+	pid := r.mainPID(ctx, unitName)
+
+	instance := &ModuleInstance{
+		ID:         spec.ID,
+		Spec:       spec,
+		PID:        pid,
+		UnitName:   unitName,
+		SocketPath: spec.SocketPath,
+		StartedAt:  time.Now(),
+		State:      ModuleStateRunning,
+		Metrics:    &ModuleMetrics{},
+	}
+	r.supervise(instance)
+
+	log.WithFields(log.Fields{
+		"module": spec.ID,
+		"unit":   unitName,
+		"pid":    pid,
+		"socket": spec.SocketPath,
+	}).Info("systemd module started")
+
+	return instance, nil
+}
+
+func (r *SystemdRuntime) unitProperties(spec *ModuleSpec) []sdbus.Property {
+	socketDir := filepath.Dir(spec.SocketPath)
+
+	env := []string{
+		fmt.Sprintf("GIMPEL_SOCKET=%s", spec.SocketPath),
+		fmt.Sprintf("GIMPEL_AGENT_SOCKET=%s", AgentSocketPath(spec.SocketPath)),
+		fmt.Sprintf("GIMPEL_MODULE_ID=%s", spec.ID),
+		fmt.Sprintf("GIMPEL_EXECUTION_MODE=%s", ExecutionModeSystemd),
+		fmt.Sprintf("GIMPEL_CONNECTION_MODE=%s", spec.ConnectionMode),
+	}
+	keys := make([]string, 0, len(spec.Env))
+	for k := range spec.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", k, spec.Env[k]))
+	}
+
+	writable := []string{socketDir}
+	if spec.WorkingDir != "" {
+		writable = append(writable, spec.WorkingDir)
+	}
+
+	props := []sdbus.Property{
+		sdbus.PropDescription(fmt.Sprintf("gimpel module %s", spec.ID)),
+		sdbus.PropType("simple"),
+		sdbus.PropExecStart([]string{spec.Image}, true),
+		sdbus.PropSlice(r.slice),
+		systemdProp("Environment", env),
+		systemdProp("ProtectSystem", "strict"),
+		systemdProp("ReadWritePaths", writable),
+		systemdProp("PrivateTmp", true),
+		systemdProp("NoNewPrivileges", true),
+		systemdProp("TimeoutStopUSec", uint64(5*time.Second/time.Microsecond)),
+	}
+
+	if r.userMode {
+		// Sandboxing directives need a user namespace under the user manager.
+		props = append(props, systemdProp("PrivateUsers", true))
+	}
+
+	if spec.WorkingDir != "" {
+		props = append(props, systemdProp("WorkingDirectory", spec.WorkingDir))
+	}
+
+	limits := spec.ResourceLimits
+	if limits.MaxMemoryMB > 0 {
+		props = append(props, systemdProp("MemoryMax", uint64(limits.MaxMemoryMB)*1024*1024))
+	}
+	if limits.MaxCPUPercent > 0 {
+		// CPUQuota=N% is expressed over D-Bus as microseconds of CPU time per second.
+		props = append(props, systemdProp("CPUQuotaPerSecUSec", uint64(limits.MaxCPUPercent)*10000))
+	}
+	if limits.MaxProcesses > 0 {
+		props = append(props, systemdProp("TasksMax", uint64(limits.MaxProcesses)))
+	}
+	if limits.MaxOpenFiles > 0 {
+		props = append(props,
+			systemdProp("LimitNOFILE", uint64(limits.MaxOpenFiles)),
+			systemdProp("LimitNOFILESoft", uint64(limits.MaxOpenFiles)),
+		)
+	}
+
+	return props
+}
+
+func (r *SystemdRuntime) Stop(ctx context.Context, instance *ModuleInstance) error {
+	r.mu.Lock()
+	stop := r.stops[instance]
+	delete(r.stops, instance)
+	r.mu.Unlock()
+
+	var err error
+	switch {
+	case stop != nil:
+		err = stop(ctx)
+	case instance.StopFunc != nil:
+		instance.StopFunc()
+	case instance.UnitName != "":
+		err = r.stopUnit(ctx, instance.UnitName)
+	}
+	if err != nil {
+		return fmt.Errorf("stopping module %s: %w", instance.ID, err)
+	}
+	log.WithField("module", instance.ID).Info("systemd module stopped")
+	return nil
+}
+
+// supervise installs the stop function and starts watching the unit for an
+// exit.
+func (r *SystemdRuntime) supervise(instance *ModuleInstance) {
+	unitName := instance.UnitName
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	stop := func(ctx context.Context) error {
+		stopWatch()
+		err := r.stopUnit(ctx, unitName)
+		instance.State = ModuleStateStopped
+		instance.setExited(ExitStatus{Reason: "stopped"})
+		return err
+	}
+
+	r.mu.Lock()
+	r.stops[instance] = stop
+	r.mu.Unlock()
+
+	instance.StopFunc = func() {
+		r.forget(instance)
+		stopCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := stop(stopCtx); err != nil {
+			log.WithError(err).WithField("unit", unitName).Warn("failed to stop unit")
+		}
+	}
+
+	go r.watchUnit(watchCtx, instance)
+}
+
+func (r *SystemdRuntime) forget(instance *ModuleInstance) {
+	r.mu.Lock()
+	delete(r.stops, instance)
+	r.mu.Unlock()
+}
+
+func (r *SystemdRuntime) Adopt(ctx context.Context, instance *ModuleInstance) error {
+	if instance.UnitName == "" {
+		return fmt.Errorf("no unit recorded for module %s", instance.ID)
+	}
+	if !r.IsRunning(ctx, instance) {
+		return fmt.Errorf("unit %s is not running", instance.UnitName)
+	}
+	if err := waitForSocket(instance.SocketPath, 5*time.Second); err != nil {
+		return err
+	}
+
+	instance.PID = r.mainPID(ctx, instance.UnitName)
+	r.supervise(instance)
+
+	log.WithFields(log.Fields{
+		"module": instance.ID,
+		"unit":   instance.UnitName,
+		"pid":    instance.PID,
+	}).Info("adopted running systemd module")
+
+	return nil
+}
+
+func (r *SystemdRuntime) Cleanup(ctx context.Context, instance *ModuleInstance) error {
+	if instance.UnitName == "" {
+		return nil
+	}
+	if r.IsRunning(ctx, instance) {
+		return r.stopUnit(ctx, instance.UnitName)
+	}
+	r.bus.ResetFailedUnitContext(ctx, instance.UnitName)
+	return nil
+}
+
+// watchUnit polls the unit until it leaves the active states and records how
+// the main process ended.
+func (r *SystemdRuntime) watchUnit(ctx context.Context, instance *ModuleInstance) {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		prop, err := r.bus.GetUnitPropertyContext(ctx, instance.UnitName, "ActiveState")
+		if err != nil {
+			continue
+		}
+		state, _ := prop.Value.Value().(string)
+		if state != "inactive" && state != "failed" {
+			continue
+		}
+
+		status := r.unitExitStatus(ctx, instance.UnitName)
+		if status.Success() {
+			instance.State = ModuleStateStopped
+		} else {
+			instance.LastError = fmt.Errorf("unit %s %s", instance.UnitName, state)
+			instance.State = ModuleStateFailed
+		}
+		instance.setExited(status)
+		r.forget(instance)
+		return
+	}
+}
+
+func (r *SystemdRuntime) unitExitStatus(ctx context.Context, unitName string) ExitStatus {
+	status := ExitStatus{Reason: "exited"}
+
+	code, _ := r.serviceProperty(ctx, unitName, "ExecMainCode").(int32)
+	value, _ := r.serviceProperty(ctx, unitName, "ExecMainStatus").(int32)
+	switch code {
+	case 1: // CLD_EXITED
+		status.Code = int(value)
+	case 2, 3: // CLD_KILLED, CLD_DUMPED
+		status.Code = -1
+		status.Signal = syscall.Signal(value).String()
+		status.Reason = "signaled"
+	}
+
+	if result, _ := r.serviceProperty(ctx, unitName, "Result").(string); result == "oom-kill" {
+		status.Reason = "oom-killed"
+		status.Err = fmt.Errorf("unit %s was killed by the OOM killer", unitName)
+	}
+	return status
+}
+
+func (r *SystemdRuntime) serviceProperty(ctx context.Context, unitName, name string) interface{} {
+	prop, err := r.bus.GetServicePropertyContext(ctx, unitName, name)
+	if err != nil {
+		return nil
+	}
+	return prop.Value.Value()
+}
+
+func (r *SystemdRuntime) stopUnit(ctx context.Context, unitName string) error {
+	ch := make(chan string, 1)
+	if _, err := r.bus.StopUnitContext(ctx, unitName, "replace", ch); err != nil {
+		return fmt.Errorf("stopping unit %s: %w", unitName, err)
+	}
+
+	if err := waitForJob(ctx, ch); err != nil {
+		r.bus.ResetFailedUnitContext(ctx, unitName)
+		return fmt.Errorf("stopping unit %s: %w", unitName, err)
+	}
+
+	// A transient unit that stopped cleanly is unloaded, so there is nothing
+	// left to reset.
+	if err := r.bus.ResetFailedUnitContext(ctx, unitName); err != nil && !isNoSuchUnit(err) {
+		return fmt.Errorf("resetting unit %s: %w", unitName, err)
+	}
+	return nil
+}
+
+func isNoSuchUnit(err error) bool {
+	var dbusErr godbus.Error
+	return errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.systemd1.NoSuchUnit"
+}
+
+func (r *SystemdRuntime) Signal(ctx context.Context, instance *ModuleInstance, signal int) error {
+	if instance.UnitName == "" {
+		return fmt.Errorf("no unit for module %s", instance.ID)
+	}
+	return r.bus.KillUnitWithTarget(ctx, instance.UnitName, sdbus.Main, int32(signal))
+}
+
+func (r *SystemdRuntime) IsRunning(ctx context.Context, instance *ModuleInstance) bool {
+	if instance.UnitName == "" {
+		return false
+	}
+	prop, err := r.bus.GetUnitPropertyContext(ctx, instance.UnitName, "ActiveState")
+	if err != nil {
+		return false
+	}
+	state, _ := prop.Value.Value().(string)
+	return state == "active" || state == "activating" || state == "reloading"
+}
+
+func (r *SystemdRuntime) Wait(instance *ModuleInstance) <-chan ExitStatus {
+	return waitInstance(instance)
+}
+
+func (r *SystemdRuntime) Logs(ctx context.Context, instance *ModuleInstance, lines int) ([]string, error) {
+	if instance.UnitName == "" {
+		return nil, fmt.Errorf("no unit for module %s", instance.ID)
+	}
+	return r.journal(ctx, instance.UnitName, lines)
+}
+
+func (r *SystemdRuntime) readJournal(ctx context.Context, unitName string, lines int) ([]string, error) {
+	if lines <= 0 {
+		lines = 100
+	}
+
+	unitFlag := "--unit"
+	if r.userMode {
+		unitFlag = "--user-unit"
+	}
+
+	out, err := exec.CommandContext(ctx, "journalctl", unitFlag, unitName,
+		"--lines", fmt.Sprintf("%d", lines), "--no-pager", "--output", "cat").Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+
+	var result []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		result = append(result, scanner.Text())
+	}
+	return result, scanner.Err()
+}
+
+func (r *SystemdRuntime) mainPID(ctx context.Context, unitName string) int {
+	prop, err := r.bus.GetServicePropertyContext(ctx, unitName, "MainPID")
+	if err != nil {
+		return 0
+	}
+	pid, _ := prop.Value.Value().(uint32)
+	return int(pid)
+}
+
+func (r *SystemdRuntime) Close() error {
+	r.bus.Close()
+	return nil
+}
+
+func systemdUnitName(moduleID string) string {
+	return fmt.Sprintf("gimpel-module-%s.service", unit.UnitNameEscape(moduleID))
+}
+
+func systemdProp(name string, value interface{}) sdbus.Property {
+	return sdbus.Property{Name: name, Value: godbus.MakeVariant(value)}
+}
+
+func waitForJob(ctx context.Context, ch <-chan string) error {
+	select {
+	case result := <-ch:
+		if result != "done" {
+			return fmt.Errorf("job finished with result %q", result)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for systemd job")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package module
+
+import "errors"
+
+var errSystemdUnsupported = errors.New("systemd runtime is only supported on linux")
+
+// SystemdRuntime is never constructed off Linux.
+type SystemdRuntime struct {
+	ModuleRuntime
+}
+
+type SystemdRuntimeConfig struct {
+	UserMode bool
+
+	Slice string
+}
+
+func NewSystemdRuntime(cfg *SystemdRuntimeConfig) (*SystemdRuntime, error) {
+	return nil, errSystemdUnsupported
+}
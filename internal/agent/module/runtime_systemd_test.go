@@ -0,0 +1,287 @@
+//go:build linux
+
+package module
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	sdbus "github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+)
+
+type fakeUnit struct {
+	props    map[string]interface{}
+	listener net.Listener
+	active   bool
+	signals  []int32
+}
+
+type fakeSystemdBus struct {
+	mu     sync.Mutex
+	units  map[string]*fakeUnit
+	socket string
+
+	resetErr error
+}
+
+func newFakeSystemdBus(socket string) *fakeSystemdBus {
+	return &fakeSystemdBus{units: make(map[string]*fakeUnit), socket: socket}
+}
+
+func (b *fakeSystemdBus) StartTransientUnitContext(ctx context.Context, name string, mode string, properties []sdbus.Property, ch chan<- string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	u := &fakeUnit{props: make(map[string]interface{}), active: true}
+	for _, p := range properties {
+		u.props[p.Name] = p.Value.Value()
+	}
+
+	ln, err := net.Listen("unix", b.socket)
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	u.listener = ln
+
+	b.units[name] = u
+	ch <- "done"
+	return 1, nil
+}
+
+func (b *fakeSystemdBus) StopUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if u, ok := b.units[name]; ok {
+		u.active = false
+		u.listener.Close()
+	}
+	ch <- "done"
+	return 2, nil
+}
+
+func (b *fakeSystemdBus) KillUnitWithTarget(ctx context.Context, name string, target sdbus.Who, signal int32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if u, ok := b.units[name]; ok {
+		u.signals = append(u.signals, signal)
+	}
+	return nil
+}
+
+func (b *fakeSystemdBus) ResetFailedUnitContext(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.resetErr
+}
+
+func (b *fakeSystemdBus) GetUnitPropertyContext(ctx context.Context, unit string, propertyName string) (*sdbus.Property, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := "inactive"
+	if u, ok := b.units[unit]; ok && u.active {
+		state = "active"
+	}
+	return &sdbus.Property{Name: propertyName, Value: godbus.MakeVariant(state)}, nil
+}
+
+func (b *fakeSystemdBus) GetServicePropertyContext(ctx context.Context, service string, propertyName string) (*sdbus.Property, error) {
+	return &sdbus.Property{Name: propertyName, Value: godbus.MakeVariant(uint32(4242))}, nil
+}
+
+func (b *fakeSystemdBus) Close() {}
+
+func TestSystemdRuntimeLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "module")
+	if err := os.WriteFile(image, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "run", "module.sock")
+
+	bus := newFakeSystemdBus(socket)
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		t.Fatal(err)
+	}
+	r := newSystemdRuntime(bus, &SystemdRuntimeConfig{})
+	r.journal = func(ctx context.Context, unitName string, lines int) ([]string, error) {
+		return []string{unitName}, nil
+	}
+
+	spec := &ModuleSpec{
+		ID:         "ssh/honeypot",
+		Image:      image,
+		SocketPath: socket,
+		Env:        map[string]string{"B": "2", "A": "1"},
+		ResourceLimits: ResourceLimits{
+			MaxMemoryMB:   64,
+			MaxCPUPercent: 50,
+			MaxOpenFiles:  1024,
+			MaxProcesses:  32,
+		},
+	}
+
+	ctx := context.Background()
+	inst, err := r.Start(ctx, spec)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	if inst.UnitName != "gimpel-module-ssh-honeypot.service" {
+		t.Errorf("UnitName = %q", inst.UnitName)
+	}
+	if inst.PID != 4242 {
+		t.Errorf("PID = %d, want 4242", inst.PID)
+	}
+
+	props := bus.units[inst.UnitName].props
+	wantProps := map[string]interface{}{
+		"MemoryMax":          uint64(64 * 1024 * 1024),
+		"CPUQuotaPerSecUSec": uint64(500000),
+		"TasksMax":           uint64(32),
+		"LimitNOFILE":        uint64(1024),
+		"ProtectSystem":      "strict",
+		"PrivateTmp":         true,
+		"NoNewPrivileges":    true,
+		"Slice":              "gimpel.slice",
+	}
+	for name, want := range wantProps {
+		if got := props[name]; got != want {
+			t.Errorf("property %s = %v, want %v", name, got, want)
+		}
+	}
+
+	env, _ := props["Environment"].([]string)
+	if len(env) < 2 || env[len(env)-2] != "A=1" || env[len(env)-1] != "B=2" {
+		t.Errorf("Environment = %v", env)
+	}
+
+	if !r.IsRunning(ctx, inst) {
+		t.Error("IsRunning() = false after start")
+	}
+
+	if err := r.Signal(ctx, inst, 1); err != nil {
+		t.Fatalf("Signal() error = %v", err)
+	}
+	if got := bus.units[inst.UnitName].signals; len(got) != 1 || got[0] != 1 {
+		t.Errorf("signals = %v", got)
+	}
+
+	logs, err := r.Logs(ctx, inst, 10)
+	if err != nil || len(logs) != 1 || logs[0] != inst.UnitName {
+		t.Errorf("Logs() = %v, %v", logs, err)
+	}
+
+	if err := r.Stop(ctx, inst); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if r.IsRunning(ctx, inst) {
+		t.Error("IsRunning() = true after stop")
+	}
+}
+
+func TestSystemdRuntimeStopErrors(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "module")
+	if err := os.WriteFile(image, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "module.sock")
+
+	bus := newFakeSystemdBus(socket)
+	r := newSystemdRuntime(bus, &SystemdRuntimeConfig{})
+
+	ctx := context.Background()
+	inst, err := r.Start(ctx, &ModuleSpec{ID: "stop", Image: image, SocketPath: socket})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	resetErr := godbus.Error{Name: "org.freedesktop.DBus.Error.AccessDenied"}
+	bus.mu.Lock()
+	bus.resetErr = resetErr
+	bus.mu.Unlock()
+
+	err = r.Stop(ctx, inst)
+	var got godbus.Error
+	if !errors.As(err, &got) || got.Name != resetErr.Name {
+		t.Fatalf("Stop() error = %v, want %v", err, resetErr)
+	}
+
+	inst, err = r.Start(ctx, &ModuleSpec{ID: "stop", Image: image, SocketPath: socket})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	bus.mu.Lock()
+	bus.resetErr = godbus.Error{Name: "org.freedesktop.systemd1.NoSuchUnit"}
+	bus.mu.Unlock()
+
+	if err := r.Stop(ctx, inst); err != nil {
+		t.Errorf("Stop() of an unloaded unit error = %v", err)
+	}
+}
+
+func TestSystemdRuntimeAdoptAndWait(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "module")
+	if err := os.WriteFile(image, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "module.sock")
+
+	bus := newFakeSystemdBus(socket)
+	ctx := context.Background()
+	started, err := newSystemdRuntime(bus, &SystemdRuntimeConfig{}).Start(ctx, &ModuleSpec{ID: "web", Image: image, SocketPath: socket})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	// A new agent process only knows what was persisted.
+	r := newSystemdRuntime(bus, &SystemdRuntimeConfig{})
+	r.pollInterval = 10 * time.Millisecond
+	inst := &ModuleInstance{ID: "web", Spec: started.Spec, UnitName: started.UnitName, SocketPath: socket}
+	if err := r.Adopt(ctx, inst); err != nil {
+		t.Fatalf("Adopt() error = %v", err)
+	}
+	if inst.PID != 4242 {
+		t.Errorf("PID = %d, want 4242", inst.PID)
+	}
+
+	bus.mu.Lock()
+	bus.units[inst.UnitName].active = false
+	bus.mu.Unlock()
+
+	select {
+	case status := <-r.Wait(inst):
+		if status.Reason != "exited" {
+			t.Errorf("exit reason = %q", status.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() did not report the unit exit")
+	}
+
+	if err := r.Adopt(ctx, &ModuleInstance{ID: "web", UnitName: inst.UnitName, SocketPath: socket}); err == nil {
+		t.Error("Adopt() of an inactive unit succeeded")
+	}
+	if err := r.Cleanup(ctx, inst); err != nil {
+		t.Errorf("Cleanup() error = %v", err)
+	}
+}
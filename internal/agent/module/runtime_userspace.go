@@ -10,13 +10,18 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/agent/cgroup"
+	"gimpel/internal/agent/confine"
 )
 
-type UserspaceRuntime struct{}
+type UserspaceRuntime struct {
+	cgroups *cgroup.Manager
+}
 
-func NewUserspaceRuntime() *UserspaceRuntime {
+func NewUserspaceRuntime(cgroups *cgroup.Manager) *UserspaceRuntime {
 	log.Warn("⚠️  Using USERSPACE runtime - NO ISOLATION! This is for development only.")
-	return &UserspaceRuntime{}
+	return &UserspaceRuntime{cgroups: cgroups}
 }
 
 func (r *UserspaceRuntime) Name() string {
@@ -40,9 +45,14 @@ func (r *UserspaceRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Module
 	}
 
 	procCtx, cancel := context.WithCancel(ctx)
-	cmd := exec.CommandContext(procCtx, spec.Image)
-	cmd.Env = append(os.Environ(),
+	cmd, err := r.command(procCtx, spec)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	cmd.Env = append(cmd.Env,
 		fmt.Sprintf("GIMPEL_SOCKET=%s", spec.SocketPath),
+		fmt.Sprintf("GIMPEL_AGENT_SOCKET=%s", AgentSocketPath(spec.SocketPath)),
 		fmt.Sprintf("GIMPEL_MODULE_ID=%s", spec.ID),
 		fmt.Sprintf("GIMPEL_EXECUTION_MODE=%s", spec.ExecutionMode),
 		fmt.Sprintf("GIMPEL_CONNECTION_MODE=%s", spec.ConnectionMode),
@@ -58,13 +68,24 @@ func (r *UserspaceRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Module
 	cmd.Stdout = &moduleLogger{moduleID: spec.ID, level: "info"}
 	cmd.Stderr = &moduleLogger{moduleID: spec.ID, level: "error"}
 
-	if err := cmd.Start(); err != nil {
+	group, release, err := prepareCgroup(r.cgroups, spec, cmd)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("preparing cgroup: %w", err)
+	}
+
+	err = cmd.Start()
+	release()
+	if err != nil {
 		cancel()
+		if group != nil {
+			group.Destroy()
+		}
 		return nil, fmt.Errorf("starting process: %w", err)
 	}
 
 	if err := waitForSocket(spec.SocketPath, 10*time.Second); err != nil {
-		cmd.Process.Kill()
+		killProcessTree(cmd, group)
 		cancel()
 		return nil, fmt.Errorf("waiting for socket: %w", err)
 	}
@@ -73,31 +94,30 @@ func (r *UserspaceRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Module
 		ID:         spec.ID,
 		Spec:       spec,
 		PID:        cmd.Process.Pid,
+		Cgroup:     group,
 		SocketPath: spec.SocketPath,
 		StartedAt:  time.Now(),
 		State:      ModuleStateRunning,
 		Metrics:    &ModuleMetrics{},
-		StopFunc: func() {
-			cmd.Process.Signal(os.Interrupt)
-			done := make(chan error, 1)
-			go func() { done <- cmd.Wait() }()
-			select {
-			case <-done:
-			case <-time.After(5 * time.Second):
-				cmd.Process.Kill()
-			}
-			cancel()
-		},
+	}
+	instance.StopFunc = func() {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-instance.Exited():
+		case <-time.After(5 * time.Second):
+			killProcessTree(cmd, group)
+			<-instance.Exited()
+		}
+		cancel()
 	}
 
 	go func() {
 		err := cmd.Wait()
-		if err != nil {
-			instance.LastError = err
-			instance.State = ModuleStateFailed
-		} else {
-			instance.State = ModuleStateStopped
+		if group != nil {
+			group.Kill()
+			group.Destroy()
 		}
+		markProcessExited(instance, err)
 	}()
 
 	log.WithFields(log.Fields{
@@ -109,6 +129,51 @@ func (r *UserspaceRuntime) Start(ctx context.Context, spec *ModuleSpec) (*Module
 	return instance, nil
 }
 
+// command builds the module command, wrapping it in the confinement shim
+// when the spec declares a profile.
+func (r *UserspaceRuntime) command(ctx context.Context, spec *ModuleSpec) (*exec.Cmd, error) {
+	if spec.Confinement == nil {
+		cmd := exec.CommandContext(ctx, spec.Image)
+		cmd.Env = os.Environ()
+		limitOpenFiles(spec, cmd)
+		return cmd, nil
+	}
+
+	profile := *spec.Confinement
+	if spec.ResourceLimits.MaxOpenFiles > 0 {
+		profile.MaxOpenFiles = uint64(spec.ResourceLimits.MaxOpenFiles)
+	}
+	if profile.NewNetworkNamespace {
+		// Listeners relay connections to the module's data port on the
+		// host's loopback, which a module in its own namespace cannot see.
+		return nil, fmt.Errorf("confinement with a new network namespace is not supported: listeners cannot reach the module")
+	}
+
+	profile.ReadWritePaths = append([]string{filepath.Dir(spec.SocketPath)}, profile.ReadWritePaths...)
+	if spec.WorkingDir != "" {
+		profile.ReadWritePaths = append(profile.ReadWritePaths, spec.WorkingDir)
+	}
+
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid confinement profile: %w", err)
+	}
+
+	cmd, err := confine.Command(ctx, &profile, spec.Image)
+	if err != nil {
+		return nil, fmt.Errorf("building confined command: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"module":   spec.ID,
+		"seccomp":  profile.Seccomp,
+		"landlock": profile.Landlock,
+		"netns":    profile.NewNetworkNamespace,
+		"mountns":  profile.NewMountNamespace,
+	}).Info("starting module with confinement")
+
+	return cmd, nil
+}
+
 func (r *UserspaceRuntime) Stop(ctx context.Context, instance *ModuleInstance) error {
 	if instance.StopFunc != nil {
 		instance.StopFunc()
@@ -140,6 +205,20 @@ func (r *UserspaceRuntime) IsRunning(ctx context.Context, instance *ModuleInstan
 	return err == nil
 }
 
+func (r *UserspaceRuntime) Wait(instance *ModuleInstance) <-chan ExitStatus {
+	return waitInstance(instance)
+}
+
+// Adopt always fails: the module's stdout and stderr were pipes owned by the
+// previous agent process, so the module cannot be supervised again.
+func (r *UserspaceRuntime) Adopt(ctx context.Context, instance *ModuleInstance) error {
+	return fmt.Errorf("userspace modules cannot be adopted")
+}
+
+func (r *UserspaceRuntime) Cleanup(ctx context.Context, instance *ModuleInstance) error {
+	return cleanupOrphan(r.cgroups, instance)
+}
+
 func (r *UserspaceRuntime) Logs(ctx context.Context, instance *ModuleInstance, lines int) ([]string, error) {
 	return nil, fmt.Errorf("logs not available for userspace runtime")
 }
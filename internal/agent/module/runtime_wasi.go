@@ -0,0 +1,577 @@
+package module
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+
+	gimpelv1 "gimpel/api/go/v1"
+)
+
+// EventSink receives events emitted by modules that run inside the agent.
+type EventSink interface {
+	Emit(event *gimpelv1.Event)
+}
+
+const (
+	wasmHostModule = "gimpel"
+
+	wasmPageSize = 64 * 1024
+	// wasmMaxRead caps what one conn_read call reads.
+	wasmMaxRead = 64 * 1024
+
+	defaultWasmMemoryMB      = 128
+	defaultWasmExecutionTime = 5 * time.Minute
+
+	wasmLogLines = 500
+)
+
+// WasmRuntime runs WASI modules with wazero. Each connection gets a fresh
+// instance of the module whose _start function handles that one connection
+// through the "gimpel" host functions:
+//
+//	conn_read(buf_ptr, buf_len u32) i32        bytes read, 0 on EOF, -1 on error
+//	conn_write(buf_ptr, buf_len u32) i32       bytes written, -1 on error
+//	conn_close()
+//	conn_info(buf_ptr, buf_len u32) i32        JSON connection info; returns the
+//	                                           full length, writes only if it fits
+//	emit_event(type u32, labels_ptr, labels_len, payload_ptr, payload_len u32) i32
+//	log(level u32, msg_ptr, msg_len u32)
+//
+// ResourceLimits.MaxMemoryMB is the memory budget of the module as a whole.
+// Each instance may grow to the module's declared maximum memory, or to the
+// whole budget if it declares none, and connections wait until enough of
+// the budget is free to run one more instance. wazero has no instruction
+// metering, so the execution budget is the wall-clock time an instance may
+// run, taken from ResourceLimits.MaxExecutionTime.
+type WasmRuntime struct {
+	events EventSink
+}
+
+func NewWasmRuntime(events EventSink) *WasmRuntime {
+	return &WasmRuntime{events: events}
+}
+
+func (r *WasmRuntime) Name() string {
+	return "wasm"
+}
+
+func (r *WasmRuntime) Type() ExecutionMode {
+	return ExecutionModeWasm
+}
+
+func (r *WasmRuntime) Start(ctx context.Context, spec *ModuleSpec) (*ModuleInstance, error) {
+	code, err := os.ReadFile(spec.Image)
+	if err != nil {
+		return nil, fmt.Errorf("reading wasm module: %w", err)
+	}
+
+	memoryMB := spec.ResourceLimits.MaxMemoryMB
+	if memoryMB <= 0 {
+		memoryMB = defaultWasmMemoryMB
+	}
+
+	runtimeCfg := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(memoryMB * 1024 * 1024 / wasmPageSize)).
+		WithCloseOnContextDone(true)
+
+	// The wazero runtime outlives the Start call, so it must not inherit its
+	// cancellation.
+	rtCtx, cancel := context.WithCancel(context.Background())
+	rt := wazero.NewRuntimeWithConfig(rtCtx, runtimeCfg)
+
+	if _, err := wasi_snapshot_preview1.Instantiate(rtCtx, rt); err != nil {
+		rt.Close(rtCtx)
+		cancel()
+		return nil, fmt.Errorf("instantiating WASI: %w", err)
+	}
+
+	if err := instantiateWasmHost(rtCtx, rt); err != nil {
+		rt.Close(rtCtx)
+		cancel()
+		return nil, fmt.Errorf("instantiating host module: %w", err)
+	}
+
+	compiled, err := rt.CompileModule(rtCtx, code)
+	if err != nil {
+		rt.Close(rtCtx)
+		cancel()
+		return nil, fmt.Errorf("compiling wasm module: %w", err)
+	}
+
+	// Only as many instances run at once as their memory ceilings fit in
+	// the budget.
+	limitPages := uint32(memoryMB * 1024 * 1024 / wasmPageSize)
+	instances := max(1, limitPages/wasmInstancePages(compiled, limitPages))
+
+	budget := spec.ResourceLimits.MaxExecutionTime
+	if budget <= 0 {
+		budget = defaultWasmExecutionTime
+	}
+
+	instance := &ModuleInstance{
+		ID:        spec.ID,
+		Spec:      spec,
+		StartedAt: time.Now(),
+		State:     ModuleStateRunning,
+		Metrics:   &ModuleMetrics{},
+	}
+
+	handler := &wasmModule{
+		spec:     spec,
+		instance: instance,
+		runtime:  rt,
+		compiled: compiled,
+		budget:   budget,
+		slots:    make(chan struct{}, instances),
+		events:   r.events,
+		logs:     newLogRing(wasmLogLines),
+		ctx:      rtCtx,
+	}
+	instance.Handler = handler
+	instance.StopFunc = func() {
+		// Cancelling the runtime context ends in-flight connections first.
+		cancel()
+		handler.close()
+		instance.setExited(ExitStatus{Reason: "stopped"})
+	}
+
+	log.WithFields(log.Fields{
+		"module":     spec.ID,
+		"memory_mb":  memoryMB,
+		"instances":  instances,
+		"max_exec":   budget,
+		"exports":    len(compiled.ExportedFunctions()),
+		"image_size": len(code),
+	}).Info("wasm module loaded")
+
+	return instance, nil
+}
+
+func (r *WasmRuntime) Stop(ctx context.Context, instance *ModuleInstance) error {
+	if instance.StopFunc != nil {
+		instance.StopFunc()
+	}
+	instance.State = ModuleStateStopped
+	log.WithField("module", instance.ID).Info("wasm module stopped")
+	return nil
+}
+
+func (r *WasmRuntime) Signal(ctx context.Context, instance *ModuleInstance, signal int) error {
+	return fmt.Errorf("signals are not supported for wasm modules")
+}
+
+func (r *WasmRuntime) IsRunning(ctx context.Context, instance *ModuleInstance) bool {
+	handler, ok := instance.Handler.(*wasmModule)
+	return ok && !handler.closed.Load()
+}
+
+// Wait reports the module as exited only once it is stopped. Guest traps are
+// confined to the connection that caused them.
+func (r *WasmRuntime) Wait(instance *ModuleInstance) <-chan ExitStatus {
+	return waitInstance(instance)
+}
+
+func (r *WasmRuntime) Logs(ctx context.Context, instance *ModuleInstance, lines int) ([]string, error) {
+	handler, ok := instance.Handler.(*wasmModule)
+	if !ok {
+		return nil, fmt.Errorf("module %s is not a wasm module", instance.ID)
+	}
+	return handler.logs.last(lines), nil
+}
+
+type wasmModule struct {
+	spec     *ModuleSpec
+	instance *ModuleInstance
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	budget   time.Duration
+	slots    chan struct{}
+	events   EventSink
+	logs     *logRing
+
+	ctx    context.Context
+	active sync.WaitGroup
+	closed atomic.Bool
+}
+
+func (m *wasmModule) SupportsConnectionMode(mode ConnectionMode) bool {
+	return mode == ConnectionModeProxy
+}
+
+func (m *wasmModule) HandleConnection(ctx context.Context, req *ConnectionRequest) error {
+	if req.Conn == nil {
+		return fmt.Errorf("wasm modules require a connection")
+	}
+	if m.closed.Load() {
+		req.Conn.Close()
+		return fmt.Errorf("module %s is stopped", m.spec.ID)
+	}
+
+	m.active.Add(1)
+	defer m.active.Done()
+
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		req.Conn.Close()
+		return fmt.Errorf("waiting for memory budget: %w", ctx.Err())
+	case <-m.ctx.Done():
+		req.Conn.Close()
+		return fmt.Errorf("module %s is stopped", m.spec.ID)
+	}
+	defer func() { <-m.slots }()
+
+	metrics := m.instance.Metrics
+	atomic.AddInt64(&metrics.ConnectionsTotal, 1)
+	atomic.AddInt64(&metrics.ConnectionsActive, 1)
+	defer atomic.AddInt64(&metrics.ConnectionsActive, -1)
+
+	ctx, cancel := context.WithTimeout(ctx, m.budget)
+	defer cancel()
+
+	// Stopping the module must also end in-flight connections.
+	stopRuntime := context.AfterFunc(m.ctx, cancel)
+	defer stopRuntime()
+
+	conn := &wasmConn{req: req, module: m}
+	defer conn.close()
+
+	// Host calls block in Read; expiring the deadline wakes them up.
+	stopDeadline := context.AfterFunc(ctx, func() { req.Conn.SetDeadline(time.Now()) })
+	defer stopDeadline()
+
+	cfg := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(m.spec.ID).
+		WithEnv("GIMPEL_MODULE_ID", m.spec.ID).
+		WithEnv("GIMPEL_CONNECTION_ID", req.ConnectionID).
+		WithEnv("GIMPEL_EXECUTION_MODE", string(ExecutionModeWasm)).
+		WithStdout(m.logs.writer(m.spec.ID, "info")).
+		WithStderr(m.logs.writer(m.spec.ID, "error")).
+		WithRandSource(rand.Reader).
+		WithSysWalltime().
+		WithSysNanotime()
+	for k, v := range m.spec.Env {
+		cfg = cfg.WithEnv(k, v)
+	}
+
+	mod, err := m.runtime.InstantiateModule(context.WithValue(ctx, wasmConnKey{}, conn), m.compiled, cfg)
+	if mod != nil {
+		mod.Close(context.Background())
+	}
+
+	var exitErr *sys.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 0:
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		atomic.AddInt64(&metrics.ErrorsTotal, 1)
+		return fmt.Errorf("module %s exceeded its execution budget of %s", m.spec.ID, m.budget)
+	default:
+		atomic.AddInt64(&metrics.ErrorsTotal, 1)
+		return fmt.Errorf("running wasm module: %w", err)
+	}
+}
+
+func (m *wasmModule) close() {
+	if m.closed.Swap(true) {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		log.WithField("module", m.spec.ID).Warn("timed out waiting for wasm connections to finish")
+	}
+
+	m.runtime.Close(context.Background())
+}
+
+type wasmConnKey struct{}
+
+type wasmConn struct {
+	req    *ConnectionRequest
+	module *wasmModule
+
+	closeOnce sync.Once
+}
+
+func (c *wasmConn) close() {
+	c.closeOnce.Do(func() { c.req.Conn.Close() })
+}
+
+type wasmConnInfo struct {
+	ConnectionID string            `json:"connection_id"`
+	ListenerID   string            `json:"listener_id"`
+	SourceIP     string            `json:"source_ip"`
+	SourcePort   uint32            `json:"source_port"`
+	DestIP       string            `json:"dest_ip"`
+	DestPort     uint32            `json:"dest_port"`
+	Protocol     string            `json:"protocol"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+func connFromContext(ctx context.Context) *wasmConn {
+	conn, _ := ctx.Value(wasmConnKey{}).(*wasmConn)
+	return conn
+}
+
+func instantiateWasmHost(ctx context.Context, rt wazero.Runtime) error {
+	_, err := rt.NewHostModuleBuilder(wasmHostModule).
+		NewFunctionBuilder().WithFunc(hostConnRead).Export("conn_read").
+		NewFunctionBuilder().WithFunc(hostConnWrite).Export("conn_write").
+		NewFunctionBuilder().WithFunc(hostConnClose).Export("conn_close").
+		NewFunctionBuilder().WithFunc(hostConnInfo).Export("conn_info").
+		NewFunctionBuilder().WithFunc(hostEmitEvent).Export("emit_event").
+		NewFunctionBuilder().WithFunc(hostLog).Export("log").
+		Instantiate(ctx)
+	return err
+}
+
+func hostConnRead(ctx context.Context, mod api.Module, ptr, size uint32) int32 {
+	conn := connFromContext(ctx)
+	if conn == nil {
+		return -1
+	}
+
+	// The guest picks size; read at most wasmMaxRead into a range that is
+	// inside its memory.
+	size = min(size, wasmMaxRead)
+	if uint64(ptr)+uint64(size) > uint64(mod.Memory().Size()) {
+		return -1
+	}
+	buf := make([]byte, size)
+	n, err := conn.req.Conn.Read(buf)
+	if n > 0 {
+		if !mod.Memory().Write(ptr, buf[:n]) {
+			return -1
+		}
+		atomic.AddInt64(&conn.module.instance.Metrics.BytesReceived, int64(n))
+		return int32(n)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return -1
+	}
+	return 0
+}
+
+func hostConnWrite(ctx context.Context, mod api.Module, ptr, size uint32) int32 {
+	conn := connFromContext(ctx)
+	if conn == nil {
+		return -1
+	}
+
+	data, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return -1
+	}
+	n, err := conn.req.Conn.Write(data)
+	atomic.AddInt64(&conn.module.instance.Metrics.BytesSent, int64(n))
+	if err != nil {
+		return -1
+	}
+	return int32(n)
+}
+
+func hostConnClose(ctx context.Context, mod api.Module) {
+	if conn := connFromContext(ctx); conn != nil {
+		conn.close()
+	}
+}
+
+func hostConnInfo(ctx context.Context, mod api.Module, ptr, size uint32) int32 {
+	conn := connFromContext(ctx)
+	if conn == nil {
+		return -1
+	}
+
+	req := conn.req
+	data, err := json.Marshal(wasmConnInfo{
+		ConnectionID: req.ConnectionID,
+		ListenerID:   req.ListenerID,
+		SourceIP:     req.SourceIP,
+		SourcePort:   req.SourcePort,
+		DestIP:       req.DestIP,
+		DestPort:     req.DestPort,
+		Protocol:     req.Protocol,
+		Metadata:     req.Metadata,
+	})
+	if err != nil {
+		return -1
+	}
+
+	if uint32(len(data)) <= size && !mod.Memory().Write(ptr, data) {
+		return -1
+	}
+	return int32(len(data))
+}
+
+func hostEmitEvent(ctx context.Context, mod api.Module, eventType, labelsPtr, labelsLen, payloadPtr, payloadLen uint32) int32 {
+	conn := connFromContext(ctx)
+	if conn == nil {
+		return -1
+	}
+
+	var labels map[string]string
+	if labelsLen > 0 {
+		raw, ok := mod.Memory().Read(labelsPtr, labelsLen)
+		if !ok {
+			return -1
+		}
+		if err := json.Unmarshal(raw, &labels); err != nil {
+			return -1
+		}
+	}
+
+	var payload []byte
+	if payloadLen > 0 {
+		raw, ok := mod.Memory().Read(payloadPtr, payloadLen)
+		if !ok {
+			return -1
+		}
+		payload = append([]byte(nil), raw...)
+	}
+
+	if conn.module.events == nil {
+		return 0
+	}
+
+	req := conn.req
+	conn.module.events.Emit(&gimpelv1.Event{
+		EventId:     uuid.New().String(),
+		ModuleId:    conn.module.spec.ID,
+		SessionId:   req.ConnectionID,
+		Type:        gimpelv1.EventType(eventType),
+		TimestampNs: time.Now().UnixNano(),
+		SourceIp:    req.SourceIP,
+		SourcePort:  req.SourcePort,
+		DestIp:      req.DestIP,
+		DestPort:    req.DestPort,
+		Protocol:    req.Protocol,
+		Labels:      labels,
+		Payload:     payload,
+	})
+	return 0
+}
+
+func hostLog(ctx context.Context, mod api.Module, level, ptr, size uint32) {
+	msg, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return
+	}
+
+	levels := []string{"debug", "info", "warn", "error"}
+	name := "info"
+	if int(level) < len(levels) {
+		name = levels[level]
+	}
+
+	moduleID := ""
+	var logs *logRing
+	if conn := connFromContext(ctx); conn != nil {
+		moduleID = conn.module.spec.ID
+		logs = conn.module.logs
+	}
+	if logs != nil {
+		logs.writer(moduleID, name).Write(msg)
+		return
+	}
+	(&moduleLogger{moduleID: moduleID, level: name}).Write(msg)
+}
+
+// logRing keeps the most recent module output for Logs while still
+// forwarding it to the agent log.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size)}
+}
+
+func (l *logRing) add(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % len(l.lines)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+func (l *logRing) last(n int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ordered []string
+	if l.full {
+		ordered = append(ordered, l.lines[l.next:]...)
+	}
+	ordered = append(ordered, l.lines[:l.next]...)
+
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+func (l *logRing) writer(moduleID, level string) *ringWriter {
+	return &ringWriter{ring: l, logger: &moduleLogger{moduleID: moduleID, level: level}}
+}
+
+type ringWriter struct {
+	ring   *logRing
+	logger *moduleLogger
+}
+
+func (w *ringWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			w.ring.add(line)
+		}
+	}
+	return w.logger.Write(p)
+}
+
+// wasmInstancePages is how many pages one instance of compiled may use:
+// the declared maximum of its memory, capped at limit.
+func wasmInstancePages(compiled wazero.CompiledModule, limit uint32) uint32 {
+	pages := limit
+	memories := compiled.ImportedMemories()
+	for _, mem := range compiled.ExportedMemories() {
+		memories = append(memories, mem)
+	}
+	for _, mem := range memories {
+		if n, ok := mem.Max(); ok && n > 0 && n < pages {
+			pages = n
+		}
+	}
+	return max(pages, 1)
+}
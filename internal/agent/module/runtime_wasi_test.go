@@ -0,0 +1,162 @@
+package module
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gimpelv1 "gimpel/api/go/v1"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*gimpelv1.Event
+}
+
+func (s *recordingSink) Emit(event *gimpelv1.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+func buildWasmGuest(t *testing.T) string {
+	t.Helper()
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	out := filepath.Join(t.TempDir(), "echo.wasm")
+	cmd := exec.Command(goBin, "build", "-o", out, "./testdata/wasm-echo")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm", "GOFLAGS=")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building wasm guest: %v\n%s", err, output)
+	}
+	return out
+}
+
+func TestWasmRuntimeHandlesConnection(t *testing.T) {
+	image := buildWasmGuest(t)
+	sink := &recordingSink{}
+	r := NewWasmRuntime(sink)
+
+	ctx := context.Background()
+	inst, err := r.Start(ctx, &ModuleSpec{ID: "echo", Image: image, ResourceLimits: ResourceLimits{MaxMemoryMB: 64}})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer r.Stop(ctx, inst)
+
+	if !r.IsRunning(ctx, inst) || inst.Handler == nil {
+		t.Fatal("wasm module not running or has no handler")
+	}
+
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- inst.Handler.HandleConnection(ctx, &ConnectionRequest{
+			ConnectionID: "conn-1",
+			SourceIP:     "203.0.113.7",
+			SourcePort:   40000,
+			Protocol:     "tcp",
+			Conn:         server,
+		})
+	}()
+
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "echo: hello" {
+		t.Errorf("reply = %q", reply)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("HandleConnection() error = %v", err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(sink.events))
+	}
+	ev := sink.events[0]
+	if ev.Type != gimpelv1.EventType_EVENT_TYPE_CUSTOM || ev.ModuleId != "echo" || ev.SessionId != "conn-1" ||
+		ev.Labels["seen_ip"] != "203.0.113.7" || string(ev.Payload) != "hello" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if inst.Metrics.ConnectionsTotal != 1 || inst.Metrics.BytesSent != int64(len(reply)) {
+		t.Errorf("metrics = %+v", inst.Metrics)
+	}
+}
+
+func TestWasmRuntimeExecutionBudget(t *testing.T) {
+	image := buildWasmGuest(t)
+	r := NewWasmRuntime(nil)
+
+	ctx := context.Background()
+	inst, err := r.Start(ctx, &ModuleSpec{
+		ID:             "spin",
+		Image:          image,
+		Env:            map[string]string{"MODE": "spin"},
+		ResourceLimits: ResourceLimits{MaxExecutionTime: 200 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer r.Stop(ctx, inst)
+
+	_, server := net.Pipe()
+	err = inst.Handler.HandleConnection(ctx, &ConnectionRequest{ConnectionID: "conn-2", Conn: server})
+	if err == nil || !strings.Contains(err.Error(), "execution budget") {
+		t.Fatalf("HandleConnection() error = %v, want budget exceeded", err)
+	}
+}
+
+func TestWasmRuntimeMemoryBudget(t *testing.T) {
+	image := buildWasmGuest(t)
+	r := NewWasmRuntime(nil)
+
+	// The guest declares no maximum memory, so one instance takes the whole
+	// budget.
+	ctx := context.Background()
+	inst, err := r.Start(ctx, &ModuleSpec{
+		ID:             "spin",
+		Image:          image,
+		Env:            map[string]string{"MODE": "spin"},
+		ResourceLimits: ResourceLimits{MaxMemoryMB: 64, MaxExecutionTime: 2 * time.Second},
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer r.Stop(ctx, inst)
+
+	_, first := net.Pipe()
+	go inst.Handler.HandleConnection(ctx, &ConnectionRequest{ConnectionID: "conn-a", Conn: first})
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&inst.Metrics.ConnectionsActive) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("first connection not started")
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, second := net.Pipe()
+	err = inst.Handler.HandleConnection(waitCtx, &ConnectionRequest{ConnectionID: "conn-b", Conn: second})
+	if err == nil || !strings.Contains(err.Error(), "memory budget") {
+		t.Fatalf("HandleConnection() error = %v, want waiting for memory budget", err)
+	}
+}
@@ -3,18 +3,24 @@ package module
 import (
 	"context"
 	"fmt"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"gimpel/internal/agent/capture"
 	"gimpel/internal/agent/config"
+	"gimpel/internal/agent/confine"
+	"gimpel/internal/agent/store"
 	"gimpel/internal/agent/telemetry"
 )
 
 type Supervisor struct {
 	cfg     *config.AgentConfig
 	emitter *telemetry.Emitter
+	store   *store.Store
 
 	runtimeMgr *RuntimeManager
 	forwarder  *ConnectionForwarder
@@ -23,17 +29,36 @@ type Supervisor struct {
 	instances map[string]*ModuleInstance
 	clients   map[string]*Client
 
+	// configs keeps the last config each module was started with so
+	// restarts work for modules deployed after startup.
+	configs    map[string]config.ModuleConfig
+	exits      map[string][]time.Time
+	restarting map[string]bool
+
 	healthInterval time.Duration
 	healthTimeout  time.Duration
+
+	agentHandler AgentHandler
+	agentSockets map[string]net.Listener
 }
 
-func NewSupervisor(cfg *config.AgentConfig, emitter *telemetry.Emitter) (*Supervisor, error) {
+func NewSupervisor(cfg *config.AgentConfig, emitter *telemetry.Emitter, st *store.Store) (*Supervisor, error) {
 	runtimeMgrCfg := &RuntimeManagerConfig{
 		DefaultRuntime:      ExecutionMode(cfg.Runtime.DefaultExecutionMode),
 		EnablePrivileged:    cfg.Runtime.EnablePrivileged,
 		EnableContainerd:    cfg.Runtime.EnableContainerd,
 		ContainerdAddress:   cfg.Runtime.ContainerdAddress,
 		ContainerdNamespace: cfg.Runtime.ContainerdNamespace,
+		EnableSystemd:       cfg.Runtime.EnableSystemd,
+		SystemdConfig: &SystemdRuntimeConfig{
+			UserMode: cfg.Runtime.SystemdUserMode,
+			Slice:    cfg.Runtime.SystemdSlice,
+		},
+		CgroupParent: cfg.Runtime.CgroupParent,
+		EnableWasm:   cfg.Runtime.EnableWasm,
+	}
+	if emitter != nil {
+		runtimeMgrCfg.Events = emitter
 	}
 
 	if runtimeMgrCfg.DefaultRuntime == "" {
@@ -54,10 +79,15 @@ func NewSupervisor(cfg *config.AgentConfig, emitter *telemetry.Emitter) (*Superv
 	s := &Supervisor{
 		cfg:            cfg,
 		emitter:        emitter,
+		store:          st,
 		runtimeMgr:     runtimeMgr,
 		forwarder:      forwarder,
 		instances:      make(map[string]*ModuleInstance),
 		clients:        make(map[string]*Client),
+		configs:        make(map[string]config.ModuleConfig),
+		exits:          make(map[string][]time.Time),
+		restarting:     make(map[string]bool),
+		agentSockets:   make(map[string]net.Listener),
 		healthInterval: 10 * time.Second,
 		healthTimeout:  5 * time.Second,
 	}
@@ -69,6 +99,9 @@ func (s *Supervisor) Run(ctx context.Context) error {
 	log.Info("starting module supervisor v2")
 
 	for _, modCfg := range s.cfg.Modules {
+		if modCfg.TarpitOnly() {
+			continue
+		}
 		if err := s.StartModule(ctx, modCfg); err != nil {
 			log.WithError(err).WithField("module", modCfg.ID).Error("failed to start module")
 		}
@@ -111,31 +144,53 @@ func (s *Supervisor) StartModule(ctx context.Context, cfg config.ModuleConfig) e
 	}
 
 	s.instances[cfg.ID] = instance
+	s.configs[cfg.ID] = cfg
+	go s.watchExit(ctx, instance)
 
-	client, err := NewClient(instance.SocketPath)
-	if err != nil {
+	if instance.Handler != nil {
+		s.saveRecord(cfg, instance)
+		log.WithFields(log.Fields{
+			"module":  cfg.ID,
+			"runtime": spec.ExecutionMode,
+		}).Info("module started successfully")
+		return nil
+	}
+
+	if err := s.connectModule(cfg, instance); err != nil {
 		if instance.StopFunc != nil {
 			instance.StopFunc()
 		}
 		delete(s.instances, cfg.ID)
+		return err
+	}
+	s.saveRecord(cfg, instance)
+
+	log.WithFields(log.Fields{
+		"module": cfg.ID,
+		"pid":    instance.PID,
+		"socket": instance.SocketPath,
+	}).Info("module started successfully")
+
+	return nil
+}
+
+// connectModule creates the control client and registers the module with
+// the connection forwarder. Callers hold s.mu.
+func (s *Supervisor) connectModule(cfg config.ModuleConfig, instance *ModuleInstance) error {
+	client, err := NewClient(instance.SocketPath)
+	if err != nil {
 		return fmt.Errorf("creating module client: %w", err)
 	}
 	s.clients[cfg.ID] = client
 
 	connMode := ConnectionMode(cfg.ConnectionMode)
 	if connMode == "" {
-		connMode = spec.ConnectionMode
+		connMode = instance.Spec.ConnectionMode
 	}
 	if err := s.forwarder.RegisterModule(cfg.ID, instance.SocketPath, instance.DataPort, connMode); err != nil {
 		log.WithError(err).WithField("module", cfg.ID).Warn("failed to register connection forwarder")
 	}
-
-	log.WithFields(log.Fields{
-		"module": cfg.ID,
-		"pid":    instance.PID,
-		"socket": instance.SocketPath,
-	}).Info("module started successfully")
-
+	s.serveAgentSocket(cfg.ID, instance.SocketPath)
 	return nil
 }
 
@@ -154,12 +209,14 @@ func (s *Supervisor) StopModule(ctx context.Context, moduleID string) error {
 	}
 
 	s.forwarder.UnregisterModule(moduleID)
+	s.closeAgentSocket(moduleID)
 
 	if err := s.runtimeMgr.StopModule(ctx, instance); err != nil {
 		log.WithError(err).WithField("module", moduleID).Warn("error stopping module")
 	}
 
 	delete(s.instances, moduleID)
+	s.deleteRecord(moduleID)
 
 	log.WithField("module", moduleID).Info("module stopped")
 	return nil
@@ -192,6 +249,19 @@ func (s *Supervisor) GetClient(moduleID string) *Client {
 	return s.clients[moduleID]
 }
 
+// ConnectionHandler returns the in-process handler of a module that takes
+// connections directly, or nil when the module is reached over its socket.
+func (s *Supervisor) ConnectionHandler(moduleID string) ConnectionHandler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	instance, ok := s.instances[moduleID]
+	if !ok || instance.Handler == nil {
+		return nil
+	}
+	return instance.Handler
+}
+
 func (s *Supervisor) HandleConnection(ctx context.Context, moduleID string, conn *ConnectionInfo) (int32, error) {
 	client := s.GetClient(moduleID)
 	if client == nil {
@@ -201,6 +271,11 @@ func (s *Supervisor) HandleConnection(ctx context.Context, moduleID string, conn
 	return client.HandleConnection(ctx, conn)
 }
 
+// SetCapture records the byte streams of connections forwarded to modules.
+func (s *Supervisor) SetCapture(r *capture.Recorder) {
+	s.forwarder.SetCapture(r)
+}
+
 func (s *Supervisor) ForwardConnection(ctx context.Context, req *ConnectionRequest) error {
 	return s.forwarder.Forward(ctx, req)
 }
@@ -245,12 +320,15 @@ func (s *Supervisor) configToSpec(cfg config.ModuleConfig) *ModuleSpec {
 		Capabilities: ModuleCapabilities{
 			RequiresRoot:        cfg.RequiresRoot,
 			CanHandleRawPackets: cfg.CanHandleRawPackets,
+
+			MaxConcurrentConnections: cfg.MaxConnections,
 		},
 		ResourceLimits: ResourceLimits{
-			MaxMemoryMB:   cfg.ResourceLimits.MaxMemoryMB,
-			MaxCPUPercent: cfg.ResourceLimits.MaxCPUPercent,
-			MaxOpenFiles:  cfg.ResourceLimits.MaxOpenFiles,
-			MaxProcesses:  cfg.ResourceLimits.MaxProcesses,
+			MaxMemoryMB:      cfg.ResourceLimits.MaxMemoryMB,
+			MaxCPUPercent:    cfg.ResourceLimits.MaxCPUPercent,
+			MaxOpenFiles:     cfg.ResourceLimits.MaxOpenFiles,
+			MaxProcesses:     cfg.ResourceLimits.MaxProcesses,
+			MaxExecutionTime: cfg.ResourceLimits.MaxExecutionTime,
 		},
 		RestartPolicy: RestartPolicy{
 			Policy:            cfg.RestartPolicy.Policy,
@@ -258,6 +336,9 @@ func (s *Supervisor) configToSpec(cfg config.ModuleConfig) *ModuleSpec {
 			RestartDelay:      cfg.RestartPolicy.RestartDelay,
 			BackoffMultiplier: cfg.RestartPolicy.BackoffMultiplier,
 			MaxBackoffDelay:   cfg.RestartPolicy.MaxBackoffDelay,
+
+			CrashLoopThreshold: cfg.RestartPolicy.CrashLoopThreshold,
+			CrashLoopWindow:    cfg.RestartPolicy.CrashLoopWindow,
 		},
 		HealthCheck: HealthCheckConfig{
 			Enabled:  cfg.HealthCheck.Enabled,
@@ -267,6 +348,19 @@ func (s *Supervisor) configToSpec(cfg config.ModuleConfig) *ModuleSpec {
 		},
 	}
 
+	if cfg.Confinement.Enabled {
+		spec.Confinement = &confine.Profile{
+			Seccomp:             cfg.Confinement.SeccompProfile,
+			AllowSyscalls:       cfg.Confinement.AllowSyscalls,
+			Landlock:            cfg.Confinement.Landlock,
+			ReadOnlyPaths:       cfg.Confinement.ReadOnlyPaths,
+			ReadWritePaths:      cfg.Confinement.ReadWritePaths,
+			NoNewPrivs:          cfg.Confinement.NoNewPrivs,
+			NewNetworkNamespace: cfg.Confinement.NewNetworkNamespace,
+			NewMountNamespace:   cfg.Confinement.NewMountNamespace,
+		}
+	}
+
 	if spec.HealthCheck.Interval == 0 {
 		spec.HealthCheck.Interval = 10 * time.Second
 	}
@@ -289,6 +383,12 @@ func (s *Supervisor) configToSpec(cfg config.ModuleConfig) *ModuleSpec {
 	if spec.RestartPolicy.MaxBackoffDelay == 0 {
 		spec.RestartPolicy.MaxBackoffDelay = 5 * time.Minute
 	}
+	if spec.RestartPolicy.CrashLoopThreshold == 0 {
+		spec.RestartPolicy.CrashLoopThreshold = 5
+	}
+	if spec.RestartPolicy.CrashLoopWindow == 0 {
+		spec.RestartPolicy.CrashLoopWindow = 2 * time.Minute
+	}
 
 	return spec
 }
@@ -306,6 +406,8 @@ func (s *Supervisor) checkHealth(ctx context.Context) {
 			continue
 		}
 
+		updateResourceMetrics(inst)
+
 		client := s.GetClient(inst.ID)
 		if client == nil {
 			continue
@@ -349,25 +451,7 @@ func (s *Supervisor) handleUnhealthyModule(ctx context.Context, inst *ModuleInst
 			return
 		}
 
-		delay := spec.RestartPolicy.RestartDelay
-		for i := 0; i < inst.RestartCount; i++ {
-			delay = time.Duration(float64(delay) * spec.RestartPolicy.BackoffMultiplier)
-			if delay > spec.RestartPolicy.MaxBackoffDelay {
-				delay = spec.RestartPolicy.MaxBackoffDelay
-				break
-			}
-		}
-
-		log.WithFields(log.Fields{
-			"module":        inst.ID,
-			"restart_count": inst.RestartCount + 1,
-			"delay":         delay,
-		}).Info("scheduling module restart")
-
-		go func() {
-			time.Sleep(delay)
-			s.restartModule(ctx, inst.ID)
-		}()
+		s.scheduleRestart(ctx, inst)
 
 	case "never":
 		log.WithField("module", inst.ID).Warn("module unhealthy but restart policy is 'never'")
@@ -380,6 +464,177 @@ func (s *Supervisor) handleUnhealthyModule(ctx context.Context, inst *ModuleInst
 	}
 }
 
+// watchExit waits for the module to exit and applies its restart policy.
+// Exits caused by StopModule are ignored because the instance has already
+// been removed by the time the lock is available.
+func (s *Supervisor) watchExit(ctx context.Context, inst *ModuleInstance) {
+	exitCh, err := s.runtimeMgr.WaitModule(inst)
+	if err != nil {
+		log.WithError(err).WithField("module", inst.ID).Warn("cannot watch module for exit")
+		return
+	}
+
+	var status ExitStatus
+	select {
+	case <-ctx.Done():
+		return
+	case status = <-exitCh:
+	}
+
+	s.mu.Lock()
+	if s.instances[inst.ID] != inst {
+		s.mu.Unlock()
+		return
+	}
+	action := s.exitAction(inst, status)
+	s.markRecordExited(inst, status)
+	s.mu.Unlock()
+
+	fields := log.Fields{
+		"module":        inst.ID,
+		"exit_code":     status.Code,
+		"reason":        status.Reason,
+		"uptime":        status.ExitedAt.Sub(inst.StartedAt).Round(time.Second),
+		"restart_count": inst.RestartCount,
+		"action":        action,
+	}
+	if status.Signal != "" {
+		fields["signal"] = status.Signal
+	}
+	if status.Err != nil {
+		fields["error"] = status.Err
+	}
+	if status.Success() {
+		log.WithFields(fields).Info("module exited")
+	} else {
+		log.WithFields(fields).Error("module crashed")
+	}
+
+	s.emitModuleExit(inst, status, action)
+
+	if action == "restart" {
+		s.scheduleRestart(ctx, inst)
+	}
+}
+
+// exitAction decides what happens after an exit: "restart", "none" when the
+// policy does not ask for one, "max_restarts" or "crash_loop". Callers hold
+// s.mu.
+func (s *Supervisor) exitAction(inst *ModuleInstance, status ExitStatus) string {
+	policy := inst.Spec.RestartPolicy
+
+	switch policy.Policy {
+	case "always":
+	case "on-failure":
+		if status.Success() {
+			return "none"
+		}
+	case "never":
+		return "none"
+	default:
+		log.WithFields(log.Fields{
+			"module": inst.ID,
+			"policy": policy.Policy,
+		}).Warn("unknown restart policy")
+		return "none"
+	}
+
+	// A module that stayed up for a whole window starts over with the
+	// shortest backoff.
+	if policy.CrashLoopWindow > 0 && status.ExitedAt.Sub(inst.StartedAt) >= policy.CrashLoopWindow {
+		inst.RestartCount = 0
+	}
+
+	recent := s.exits[inst.ID][:0]
+	for _, t := range s.exits[inst.ID] {
+		if status.ExitedAt.Sub(t) < policy.CrashLoopWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, status.ExitedAt)
+	s.exits[inst.ID] = recent
+
+	if policy.CrashLoopThreshold > 0 && len(recent) >= policy.CrashLoopThreshold {
+		inst.State = ModuleStateFailed
+		inst.LastError = fmt.Errorf("crash loop: %d exits within %s", len(recent), policy.CrashLoopWindow)
+		return "crash_loop"
+	}
+
+	if policy.MaxRestarts > 0 && inst.RestartCount >= policy.MaxRestarts {
+		inst.State = ModuleStateFailed
+		inst.LastError = fmt.Errorf("exceeded %d restarts", policy.MaxRestarts)
+		return "max_restarts"
+	}
+
+	return "restart"
+}
+
+func (s *Supervisor) emitModuleExit(inst *ModuleInstance, status ExitStatus, action string) {
+	if s.emitter == nil {
+		return
+	}
+
+	labels := map[string]string{
+		"exit_code":     strconv.Itoa(status.Code),
+		"reason":        status.Reason,
+		"action":        action,
+		"restart_count": strconv.Itoa(inst.RestartCount),
+		"uptime_ms":     strconv.FormatInt(status.ExitedAt.Sub(inst.StartedAt).Milliseconds(), 10),
+	}
+	if status.Signal != "" {
+		labels["signal"] = status.Signal
+	}
+	if status.Err != nil {
+		labels["error"] = status.Err.Error()
+	}
+	s.emitter.EmitModuleExit(inst.ID, labels)
+}
+
+// restartDelay returns the backoff before the next restart.
+func restartDelay(policy RestartPolicy, restartCount int) time.Duration {
+	delay := policy.RestartDelay
+	for i := 0; i < restartCount; i++ {
+		delay = time.Duration(float64(delay) * policy.BackoffMultiplier)
+		if delay > policy.MaxBackoffDelay {
+			return policy.MaxBackoffDelay
+		}
+	}
+	return delay
+}
+
+func (s *Supervisor) scheduleRestart(ctx context.Context, inst *ModuleInstance) {
+	s.mu.Lock()
+	if s.restarting[inst.ID] {
+		s.mu.Unlock()
+		return
+	}
+	s.restarting[inst.ID] = true
+	s.mu.Unlock()
+
+	delay := restartDelay(inst.Spec.RestartPolicy, inst.RestartCount)
+
+	log.WithFields(log.Fields{
+		"module":        inst.ID,
+		"restart_count": inst.RestartCount + 1,
+		"delay":         delay,
+	}).Info("scheduling module restart")
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+
+		s.mu.Lock()
+		delete(s.restarting, inst.ID)
+		s.mu.Unlock()
+
+		if ctx.Err() == nil {
+			s.restartModule(ctx, inst.ID)
+		}
+	}()
+}
+
 func (s *Supervisor) restartModule(ctx context.Context, moduleID string) {
 	s.mu.RLock()
 	inst, ok := s.instances[moduleID]
@@ -389,13 +644,15 @@ func (s *Supervisor) restartModule(ctx context.Context, moduleID string) {
 	}
 	spec := inst.Spec
 	restartCount := inst.RestartCount
+	cfg, ok := s.configs[moduleID]
 	s.mu.RUnlock()
 
-	var cfg config.ModuleConfig
-	for _, c := range s.cfg.Modules {
-		if c.ID == moduleID {
-			cfg = c
-			break
+	if !ok {
+		for _, c := range s.cfg.Modules {
+			if c.ID == moduleID {
+				cfg = c
+				break
+			}
 		}
 	}
 
@@ -406,6 +663,7 @@ func (s *Supervisor) restartModule(ctx context.Context, moduleID string) {
 
 	if err := s.StartModule(ctx, cfg); err != nil {
 		log.WithError(err).WithField("module", moduleID).Error("failed to restart module")
+		s.restartFailed(ctx, inst, restartCount+1, err)
 		return
 	}
 
@@ -413,10 +671,39 @@ func (s *Supervisor) restartModule(ctx context.Context, moduleID string) {
 	if newInst, ok := s.instances[moduleID]; ok {
 		newInst.RestartCount = restartCount + 1
 		newInst.Spec = spec
+		s.saveRecord(cfg, newInst)
 	}
 	s.mu.Unlock()
 }
 
+// restartFailed keeps a module whose restart failed in the instance table
+// and treats the failure like another crash, so it is retried with backoff
+// until the policy gives up.
+func (s *Supervisor) restartFailed(ctx context.Context, inst *ModuleInstance, restartCount int, err error) {
+	s.mu.Lock()
+	if _, ok := s.instances[inst.ID]; ok {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	inst.State = ModuleStateFailed
+	inst.LastError = err
+	inst.RestartCount = restartCount
+	inst.StartedAt = now
+	s.instances[inst.ID] = inst
+
+	status := ExitStatus{Code: -1, Reason: "start_failed", Err: err, ExitedAt: now}
+	action := s.exitAction(inst, status)
+	s.markRecordExited(inst, status)
+	s.mu.Unlock()
+
+	s.emitModuleExit(inst, status, action)
+
+	if action == "restart" {
+		s.scheduleRestart(ctx, inst)
+	}
+}
+
 func (s *Supervisor) GetMetrics(moduleID string) *ModuleMetrics {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
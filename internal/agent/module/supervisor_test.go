@@ -0,0 +1,116 @@
+package module
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRestartDelay(t *testing.T) {
+	policy := RestartPolicy{
+		RestartDelay:      time.Second,
+		BackoffMultiplier: 2,
+		MaxBackoffDelay:   10 * time.Second,
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for count, expected := range want {
+		if got := restartDelay(policy, count); got != expected {
+			t.Errorf("restartDelay(%d) = %s, want %s", count, got, expected)
+		}
+	}
+}
+
+func TestExitAction(t *testing.T) {
+	newSupervisor := func() *Supervisor {
+		return &Supervisor{exits: make(map[string][]time.Time)}
+	}
+	newInstance := func(policy string) *ModuleInstance {
+		return &ModuleInstance{
+			ID:        "mod",
+			StartedAt: time.Now(),
+			Spec: &ModuleSpec{RestartPolicy: RestartPolicy{
+				Policy:             policy,
+				MaxRestarts:        3,
+				CrashLoopThreshold: 5,
+				CrashLoopWindow:    time.Minute,
+			}},
+		}
+	}
+	crash := ExitStatus{Code: 1, Reason: "exited", Err: errors.New("exit status 1")}
+
+	tests := []struct {
+		name   string
+		policy string
+		status ExitStatus
+		want   string
+	}{
+		{name: "on-failure crash", policy: "on-failure", status: crash, want: "restart"},
+		{name: "on-failure clean exit", policy: "on-failure", status: ExitStatus{Reason: "exited"}, want: "none"},
+		{name: "always clean exit", policy: "always", status: ExitStatus{Reason: "exited"}, want: "restart"},
+		{name: "never", policy: "never", status: crash, want: "none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.status.ExitedAt = time.Now()
+			if got := newSupervisor().exitAction(newInstance(tt.policy), tt.status); got != tt.want {
+				t.Errorf("exitAction() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("max restarts", func(t *testing.T) {
+		inst := newInstance("on-failure")
+		inst.RestartCount = 3
+		crash.ExitedAt = time.Now()
+		if got := newSupervisor().exitAction(inst, crash); got != "max_restarts" {
+			t.Errorf("exitAction() = %q, want max_restarts", got)
+		}
+		if inst.State != ModuleStateFailed {
+			t.Errorf("state = %v, want failed", inst.State)
+		}
+	})
+
+	t.Run("crash loop", func(t *testing.T) {
+		s := newSupervisor()
+		inst := newInstance("always")
+		inst.Spec.RestartPolicy.MaxRestarts = 0
+
+		var got string
+		for i := 0; i < 5; i++ {
+			crash.ExitedAt = time.Now()
+			got = s.exitAction(inst, crash)
+		}
+		if got != "crash_loop" {
+			t.Errorf("exitAction() after 5 quick exits = %q, want crash_loop", got)
+		}
+	})
+
+	t.Run("stable run resets backoff", func(t *testing.T) {
+		inst := newInstance("on-failure")
+		inst.RestartCount = 3
+		inst.StartedAt = time.Now().Add(-2 * time.Minute)
+		crash.ExitedAt = time.Now()
+		if got := newSupervisor().exitAction(inst, crash); got != "restart" || inst.RestartCount != 0 {
+			t.Errorf("exitAction() = %q with restart count %d, want restart with 0", got, inst.RestartCount)
+		}
+	})
+}
+
+func TestExitStatusFromError(t *testing.T) {
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	if status := exitStatusFromError(err); status.Code != 3 || status.Reason != "exited" || status.Success() {
+		t.Errorf("exit 3: %+v", status)
+	}
+
+	err = exec.Command("sh", "-c", "kill -9 $$").Run()
+	if status := exitStatusFromError(err); status.Signal != "killed" || status.Reason != "signaled" {
+		t.Errorf("kill -9: %+v", status)
+	}
+
+	if status := exitStatusFromError(nil); !status.Success() {
+		t.Errorf("nil error: %+v", status)
+	}
+}
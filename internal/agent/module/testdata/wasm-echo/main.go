@@ -0,0 +1,48 @@
+//go:build wasip1
+
+// Command wasm-echo is a test guest for the wasm runtime. It answers the first
+// read with "echo: " plus the data and reports one custom event.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gimpel conn_read
+func connRead(ptr unsafe.Pointer, size uint32) int32
+
+//go:wasmimport gimpel conn_write
+func connWrite(ptr unsafe.Pointer, size uint32) int32
+
+//go:wasmimport gimpel conn_info
+func connInfo(ptr unsafe.Pointer, size uint32) int32
+
+//go:wasmimport gimpel emit_event
+func emitEvent(eventType uint32, labelsPtr unsafe.Pointer, labelsLen uint32, payloadPtr unsafe.Pointer, payloadLen uint32) int32
+
+func main() {
+	if os.Getenv("MODE") == "spin" {
+		for {
+		}
+	}
+
+	buf := make([]byte, 256)
+	n := connInfo(unsafe.Pointer(&buf[0]), uint32(len(buf)))
+	var info struct {
+		SourceIP string `json:"source_ip"`
+	}
+	json.Unmarshal(buf[:n], &info)
+
+	n = connRead(unsafe.Pointer(&buf[0]), uint32(len(buf)))
+	if n <= 0 {
+		os.Exit(1)
+	}
+
+	reply := append([]byte("echo: "), buf[:n]...)
+	connWrite(unsafe.Pointer(&reply[0]), uint32(len(reply)))
+
+	labels, _ := json.Marshal(map[string]string{"seen_ip": info.SourceIP})
+	emitEvent(100, unsafe.Pointer(&labels[0]), uint32(len(labels)), unsafe.Pointer(&buf[0]), uint32(n))
+}
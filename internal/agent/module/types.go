@@ -3,7 +3,11 @@ package module
 import (
 	"context"
 	"net"
+	"sync"
 	"time"
+
+	"gimpel/internal/agent/cgroup"
+	"gimpel/internal/agent/confine"
 )
 
 type ModuleState int
@@ -25,6 +29,8 @@ const (
 	ExecutionModeContainerd ExecutionMode = "containerd"
 
 	ExecutionModeSystemd ExecutionMode = "systemd"
+
+	ExecutionModeWasm ExecutionMode = "wasm"
 )
 
 type ConnectionMode string
@@ -61,6 +67,8 @@ type ResourceLimits struct {
 	MaxProcesses int64 `yaml:"max_processes" json:"max_processes"`
 
 	NetworkBandwidthKbps int64 `yaml:"network_bandwidth_kbps" json:"network_bandwidth_kbps"`
+
+	MaxExecutionTime time.Duration `yaml:"max_execution_time" json:"max_execution_time"`
 }
 
 type ModuleSpec struct {
@@ -87,6 +95,8 @@ type ModuleSpec struct {
 	RestartPolicy RestartPolicy `yaml:"restart_policy" json:"restart_policy"`
 
 	HealthCheck HealthCheckConfig `yaml:"health_check" json:"health_check"`
+
+	Confinement *confine.Profile `yaml:"confinement" json:"confinement,omitempty"`
 }
 
 type RestartPolicy struct {
@@ -99,6 +109,12 @@ type RestartPolicy struct {
 	BackoffMultiplier float64 `yaml:"backoff_multiplier" json:"backoff_multiplier"`
 
 	MaxBackoffDelay time.Duration `yaml:"max_backoff_delay" json:"max_backoff_delay"`
+
+	// CrashLoopThreshold exits within CrashLoopWindow mark the module as
+	// crash looping and stop further restarts.
+	CrashLoopThreshold int `yaml:"crash_loop_threshold" json:"crash_loop_threshold"`
+
+	CrashLoopWindow time.Duration `yaml:"crash_loop_window" json:"crash_loop_window"`
 }
 
 type HealthCheckConfig struct {
@@ -157,6 +173,40 @@ type ModuleRuntime interface {
 	IsRunning(ctx context.Context, instance *ModuleInstance) bool
 
 	Logs(ctx context.Context, instance *ModuleInstance, lines int) ([]string, error)
+
+	// Wait returns a channel that receives the exit status once the module
+	// has exited, whether it crashed or was stopped.
+	Wait(instance *ModuleInstance) <-chan ExitStatus
+}
+
+// RecoverableRuntime is implemented by runtimes whose modules can outlive the
+// agent process.
+type RecoverableRuntime interface {
+	// Adopt re-attaches to a module started by a previous agent process. The
+	// instance carries the identifiers that were persisted at start.
+	Adopt(ctx context.Context, instance *ModuleInstance) error
+
+	// Cleanup removes whatever is left of a module that cannot be adopted.
+	Cleanup(ctx context.Context, instance *ModuleInstance) error
+}
+
+type ExitStatus struct {
+	// Code is the exit code, or -1 when the process was killed by a signal.
+	Code int
+
+	Signal string
+
+	// Reason is a short machine readable cause such as "exited", "signaled",
+	// "stopped" or "lost".
+	Reason string
+
+	Err error
+
+	ExitedAt time.Time
+}
+
+func (s ExitStatus) Success() bool {
+	return s.Code == 0 && s.Signal == "" && s.Err == nil
 }
 
 type ModuleInstance struct {
@@ -168,6 +218,10 @@ type ModuleInstance struct {
 
 	ContainerID string
 
+	UnitName string
+
+	Cgroup *cgroup.Group
+
 	SocketPath string
 
 	DataPort int
@@ -185,6 +239,55 @@ type ModuleInstance struct {
 	StopFunc func()
 
 	Metrics *ModuleMetrics
+
+	// Handler is set by runtimes that run the module inside the agent and
+	// take connections directly instead of over the module socket.
+	Handler ConnectionHandler
+
+	exitMu   sync.Mutex
+	exitOnce sync.Once
+	exited   chan struct{}
+	exit     ExitStatus
+}
+
+func (i *ModuleInstance) exitChan() chan struct{} {
+	i.exitMu.Lock()
+	defer i.exitMu.Unlock()
+	if i.exited == nil {
+		i.exited = make(chan struct{})
+	}
+	return i.exited
+}
+
+// setExited records the exit status. Only the first call has any effect.
+func (i *ModuleInstance) setExited(status ExitStatus) {
+	i.exitOnce.Do(func() {
+		if status.ExitedAt.IsZero() {
+			status.ExitedAt = time.Now()
+		}
+		ch := i.exitChan()
+		i.exitMu.Lock()
+		i.exit = status
+		i.exitMu.Unlock()
+		close(ch)
+	})
+}
+
+// Exited returns a channel that is closed when the module has exited.
+func (i *ModuleInstance) Exited() <-chan struct{} {
+	return i.exitChan()
+}
+
+// ExitStatus returns the exit status and whether the module has exited.
+func (i *ModuleInstance) ExitStatus() (ExitStatus, bool) {
+	select {
+	case <-i.exitChan():
+		i.exitMu.Lock()
+		defer i.exitMu.Unlock()
+		return i.exit, true
+	default:
+		return ExitStatus{}, false
+	}
 }
 
 type ModuleMetrics struct {
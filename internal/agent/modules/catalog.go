@@ -8,6 +8,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
 
 	gimpelv1 "gimpel/api/go/v1"
 	"gimpel/internal/agent/config"
@@ -220,11 +221,44 @@ func (cs *CatalogSyncer) SyncAssignments(ctx context.Context) (*store.Deployment
 		log.Warn("assignments are unsigned; skipping assignment signature verification")
 	}
 
+	raw, err := proto.Marshal(agentConfig)
+	if err != nil {
+		return nil, fmt.Errorf("encoding assignments: %w", err)
+	}
+
+	deployment := deploymentFromConfig(agentConfig)
+	deployment.Raw = raw
+	deployment.ReceivedAt = time.Now()
+
+	log.WithFields(log.Fields{
+		"version":     deployment.Version,
+		"assignments": len(deployment.Modules),
+	}).Info("assignments updated and verified")
+
+	cs.mu.Lock()
+	cs.configVersion = deployment.Version
+	cs.mu.Unlock()
+
+	if err := cs.store.SaveDeploymentConfig(deployment); err != nil {
+		return nil, fmt.Errorf("saving deployment config: %w", err)
+	}
+
+	if err := cs.store.SaveAgentState(&store.AgentState{
+		AgentID:        cs.agentID,
+		CatalogVersion: cs.catalogVersion,
+		ConfigVersion:  deployment.Version,
+	}); err != nil {
+		log.WithError(err).Warn("failed to save agent state")
+	}
+
+	return deployment, nil
+}
+
+func deploymentFromConfig(agentConfig *gimpelv1.AgentModuleConfig) *store.DeploymentConfig {
 	deployment := &store.DeploymentConfig{
-		Version:    agentConfig.Version,
-		Signature:  agentConfig.Signature,
-		ReceivedAt: time.Now(),
-		Modules:    make([]store.ModuleDeployment, 0, len(agentConfig.Assignments)),
+		Version:   agentConfig.Version,
+		Signature: agentConfig.Signature,
+		Modules:   make([]store.ModuleDeployment, 0, len(agentConfig.Assignments)),
 	}
 
 	for _, assignment := range agentConfig.Assignments {
@@ -235,6 +269,7 @@ func (cs *CatalogSyncer) SyncAssignments(ctx context.Context) (*store.Deployment
 				Protocol:        l.Protocol,
 				Port:            l.Port,
 				HighInteraction: l.HighInteraction,
+				SandboxImage:    l.SandboxImage,
 			})
 		}
 
@@ -248,27 +283,42 @@ func (cs *CatalogSyncer) SyncAssignments(ctx context.Context) (*store.Deployment
 		})
 	}
 
-	log.WithFields(log.Fields{
-		"version":     deployment.Version,
-		"assignments": len(deployment.Modules),
-	}).Info("assignments updated and verified")
+	return deployment
+}
 
-	cs.mu.Lock()
-	cs.configVersion = deployment.Version
-	cs.mu.Unlock()
+// LoadDeployment returns the stored deployment after verifying the signed
+// config it was built from again. The module list is rebuilt from that
+// config, so only what the master signed is ever deployed from cache.
+func (cs *CatalogSyncer) LoadDeployment() (*store.DeploymentConfig, error) {
+	stored, err := cs.store.GetDeploymentConfig()
+	if err != nil || stored == nil {
+		return stored, err
+	}
 
-	if err := cs.store.SaveDeploymentConfig(deployment); err != nil {
-		return nil, fmt.Errorf("saving deployment config: %w", err)
+	if len(stored.Raw) == 0 {
+		if len(stored.Signature) > 0 {
+			return nil, fmt.Errorf("stored deployment %d is signed but the signed config was not kept", stored.Version)
+		}
+		log.Warn("stored deployment is unsigned; skipping deployment signature verification")
+		return stored, nil
 	}
 
-	if err := cs.store.SaveAgentState(&store.AgentState{
-		AgentID:        cs.agentID,
-		CatalogVersion: cs.catalogVersion,
-		ConfigVersion:  deployment.Version,
-	}); err != nil {
-		log.WithError(err).Warn("failed to save agent state")
+	var agentConfig gimpelv1.AgentModuleConfig
+	if err := proto.Unmarshal(stored.Raw, &agentConfig); err != nil {
+		return nil, fmt.Errorf("decoding stored deployment: %w", err)
+	}
+
+	if len(agentConfig.Signature) > 0 {
+		if err := cs.verifier.VerifyAgentConfig(&agentConfig); err != nil {
+			return nil, fmt.Errorf("stored deployment signature verification failed: %w", err)
+		}
+	} else {
+		log.Warn("stored deployment is unsigned; skipping deployment signature verification")
 	}
 
+	deployment := deploymentFromConfig(&agentConfig)
+	deployment.Raw = stored.Raw
+	deployment.ReceivedAt = stored.ReceivedAt
 	return deployment, nil
 }
 
@@ -0,0 +1,91 @@
+package modules
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	gimpelv1 "gimpel/api/go/v1"
+	"gimpel/internal/agent/store"
+	"gimpel/pkg/signing"
+)
+
+type memoryStore struct {
+	Store
+	deployment *store.DeploymentConfig
+}
+
+func (m *memoryStore) GetDeploymentConfig() (*store.DeploymentConfig, error) {
+	return m.deployment, nil
+}
+
+func signedDeployment(t *testing.T, kp *signing.KeyPair) *store.DeploymentConfig {
+	t.Helper()
+
+	signer, err := signing.NewModuleSigner(kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &gimpelv1.AgentModuleConfig{
+		AgentId: "agent-1",
+		Version: 7,
+		Assignments: []*gimpelv1.ModuleAssignment{{
+			ModuleId:  "ssh",
+			Version:   "1.0.0",
+			Listeners: []*gimpelv1.ListenerAssignment{{Id: "ssh-22", Protocol: "tcp", Port: 22}},
+		}},
+	}
+	if err := signer.SignAgentConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := proto.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := deploymentFromConfig(cfg)
+	deployment.Raw = raw
+	return deployment
+}
+
+func TestLoadDeploymentVerifiesStoredConfig(t *testing.T) {
+	kp, err := signing.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := &memoryStore{deployment: signedDeployment(t, kp)}
+	cs := &CatalogSyncer{store: st, verifier: signing.NewModuleVerifier(kp)}
+
+	// Edits to the decoded module list are ignored; it is rebuilt from Raw.
+	st.deployment.Modules = append(st.deployment.Modules, store.ModuleDeployment{ModuleID: "injected", Enabled: true})
+
+	deployment, err := cs.LoadDeployment()
+	if err != nil {
+		t.Fatalf("LoadDeployment() error = %v", err)
+	}
+	if len(deployment.Modules) != 1 || deployment.Modules[0].ModuleID != "ssh" || deployment.Modules[0].Listeners[0].Port != 22 {
+		t.Errorf("LoadDeployment() modules = %+v", deployment.Modules)
+	}
+
+	var tampered gimpelv1.AgentModuleConfig
+	if err := proto.Unmarshal(st.deployment.Raw, &tampered); err != nil {
+		t.Fatal(err)
+	}
+	tampered.Assignments[0].ModuleId = "other"
+	st.deployment.Raw, _ = proto.Marshal(&tampered)
+	if _, err := cs.LoadDeployment(); err == nil {
+		t.Error("LoadDeployment() accepted a tampered config")
+	}
+
+	other, _ := signing.GenerateKeyPair()
+	st.deployment = signedDeployment(t, other)
+	if _, err := cs.LoadDeployment(); err == nil {
+		t.Error("LoadDeployment() accepted a config signed by an untrusted key")
+	}
+
+	st.deployment = &store.DeploymentConfig{Version: 3, Signature: []byte("sig")}
+	if _, err := cs.LoadDeployment(); err == nil {
+		t.Error("LoadDeployment() accepted a signed deployment without the signed config")
+	}
+}
@@ -37,11 +37,22 @@ func NewModuleDownloader(client gimpelv1.ModuleCatalogServiceClient, s Store, ca
 func (md *ModuleDownloader) DownloadModule(ctx context.Context, moduleID, version string) (*store.ModuleCache, error) {
 	cached, err := md.store.GetModuleCache(moduleID, version)
 	if err == nil && cached != nil && cached.Verified {
-		log.WithFields(log.Fields{
-			"module":  moduleID,
-			"version": version,
-		}).Debug("module already in cache")
-		return cached, nil
+		if err := md.VerifyCached(cached); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"module":  moduleID,
+				"version": version,
+			}).Warn("cached module failed verification, downloading again")
+		} else {
+			log.WithFields(log.Fields{
+				"module":  moduleID,
+				"version": version,
+			}).Debug("module already in cache")
+			return cached, nil
+		}
+	}
+
+	if md.catalogClient == nil {
+		return nil, fmt.Errorf("module %s version %s is not cached and the catalog is unavailable", moduleID, version)
 	}
 
 	log.WithFields(log.Fields{
@@ -175,6 +186,8 @@ func (md *ModuleDownloader) DownloadModule(ctx context.Context, moduleID, versio
 		SignedBy:     verifyResp.SignedBy,
 		DownloadedAt: time.Now(),
 		Verified:     true,
+		Manifest:     verifyResp.Manifest,
+		SignedAt:     verifyResp.SignedAt,
 	}
 
 	if err := md.store.SaveModuleCache(cache); err != nil {
@@ -190,6 +203,44 @@ func (md *ModuleDownloader) DownloadModule(ctx context.Context, moduleID, versio
 	return cache, nil
 }
 
+// SetCatalogClient sets the client used for downloads once the catalog
+// service becomes reachable. It must not be called concurrently with
+// DownloadModule.
+func (md *ModuleDownloader) SetCatalogClient(client gimpelv1.ModuleCatalogServiceClient) {
+	md.catalogClient = client
+}
+
+// VerifyCached checks a cached image against its recorded digest and, when
+// the signed manifest was kept, its signature.
+func (md *ModuleDownloader) VerifyCached(cache *store.ModuleCache) error {
+	file, err := os.Open(cache.ImagePath)
+	if err != nil {
+		return fmt.Errorf("opening cached image: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return fmt.Errorf("hashing cached image: %w", err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != cache.Digest {
+		return fmt.Errorf("digest mismatch: have %s, recorded %s", digest, cache.Digest)
+	}
+
+	if len(cache.Manifest) == 0 {
+		return nil
+	}
+	return md.verifier.VerifyModule(&gimpelv1.ModuleImage{
+		Id:        cache.ModuleID,
+		Version:   cache.Version,
+		Digest:    cache.Digest,
+		Manifest:  cache.Manifest,
+		Signature: cache.Signature,
+		SignedBy:  cache.SignedBy,
+		SignedAt:  cache.SignedAt,
+	})
+}
+
 func (md *ModuleDownloader) GetCachedModule(moduleID, version string) (*store.ModuleCache, error) {
 	return md.store.GetModuleCache(moduleID, version)
 }
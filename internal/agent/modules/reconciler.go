@@ -22,6 +22,8 @@ type Reconciler struct {
 	downloader      *ModuleDownloader
 	supervisor      *module.Supervisor
 	listenerStarter ListenerStarter
+
+	loadDeployment func() (*store.DeploymentConfig, error)
 }
 
 func NewReconciler(store Store, downloader *ModuleDownloader, supervisor *module.Supervisor) *Reconciler {
@@ -29,6 +31,8 @@ func NewReconciler(store Store, downloader *ModuleDownloader, supervisor *module
 		store:      store,
 		downloader: downloader,
 		supervisor: supervisor,
+
+		loadDeployment: store.GetDeploymentConfig,
 	}
 }
 
@@ -36,8 +40,14 @@ func (r *Reconciler) SetListenerStarter(ls ListenerStarter) {
 	r.listenerStarter = ls
 }
 
+// SetDeploymentLoader replaces how the deployment is read from the store,
+// for example to verify its signature before use.
+func (r *Reconciler) SetDeploymentLoader(load func() (*store.DeploymentConfig, error)) {
+	r.loadDeployment = load
+}
+
 func (r *Reconciler) Reconcile(ctx context.Context) error {
-	deployment, err := r.store.GetDeploymentConfig()
+	deployment, err := r.loadDeployment()
 	if err != nil {
 		return fmt.Errorf("getting deployment config: %w", err)
 	}
@@ -65,6 +75,8 @@ func (r *Reconciler) Reconcile(ctx context.Context) error {
 		if runningMap[modDeploy.ModuleID] {
 			log.WithField("module", modDeploy.ModuleID).Debug("module already running")
 			delete(runningMap, modDeploy.ModuleID)
+			// Modules adopted after an agent restart still need listeners.
+			r.startListeners(ctx, modDeploy.ModuleID, deploymentListeners(modDeploy))
 			continue
 		}
 
@@ -81,23 +93,7 @@ func (r *Reconciler) Reconcile(ctx context.Context) error {
 			continue
 		}
 
-		if r.listenerStarter != nil {
-			for _, lCfg := range modCfg.Listeners {
-				if err := r.listenerStarter.StartListener(ctx, lCfg); err != nil {
-					log.WithError(err).WithFields(log.Fields{
-						"module":   modDeploy.ModuleID,
-						"listener": lCfg.ID,
-						"port":     lCfg.Port,
-					}).Error("failed to start listener")
-				} else {
-					log.WithFields(log.Fields{
-						"module":   modDeploy.ModuleID,
-						"listener": lCfg.ID,
-						"port":     lCfg.Port,
-					}).Info("listener started")
-				}
-			}
-		}
+		r.startListeners(ctx, modDeploy.ModuleID, modCfg.Listeners)
 
 		log.WithFields(log.Fields{
 			"module":  modDeploy.ModuleID,
@@ -115,7 +111,22 @@ func (r *Reconciler) Reconcile(ctx context.Context) error {
 	return nil
 }
 
-func (r *Reconciler) deploymentToConfig(deploy store.ModuleDeployment, cache *store.ModuleCache) config.ModuleConfig {
+func (r *Reconciler) startListeners(ctx context.Context, moduleID string, listeners []config.ListenerConfig) {
+	if r.listenerStarter == nil {
+		return
+	}
+	for _, lCfg := range listeners {
+		if err := r.listenerStarter.StartListener(ctx, lCfg); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"module":   moduleID,
+				"listener": lCfg.ID,
+				"port":     lCfg.Port,
+			}).Error("failed to start listener")
+		}
+	}
+}
+
+func deploymentListeners(deploy store.ModuleDeployment) []config.ListenerConfig {
 	listeners := make([]config.ListenerConfig, 0, len(deploy.Listeners))
 	for _, l := range deploy.Listeners {
 		listeners = append(listeners, config.ListenerConfig{
@@ -124,8 +135,14 @@ func (r *Reconciler) deploymentToConfig(deploy store.ModuleDeployment, cache *st
 			Port:            int(l.Port),
 			ModuleID:        deploy.ModuleID,
 			HighInteraction: l.HighInteraction,
+			SandboxImage:    l.SandboxImage,
 		})
 	}
+	return listeners
+}
+
+func (r *Reconciler) deploymentToConfig(deploy store.ModuleDeployment, cache *store.ModuleCache) config.ModuleConfig {
+	listeners := deploymentListeners(deploy)
 
 	execMode := deploy.ExecutionMode
 	if execMode == "" {
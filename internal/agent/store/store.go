@@ -1,6 +1,7 @@
 package store
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -74,6 +75,11 @@ type ModuleCache struct {
 	SignedBy     string    `json:"signed_by"`
 	DownloadedAt time.Time `json:"downloaded_at"`
 	Verified     bool      `json:"verified"`
+
+	// Manifest and SignedAt complete the signed module image so the cache
+	// entry can be verified again without the master.
+	Manifest []byte `json:"manifest,omitempty"`
+	SignedAt int64  `json:"signed_at,omitempty"`
 }
 
 type Container struct {
@@ -89,6 +95,15 @@ type Container struct {
 	StoppedAt     time.Time         `json:"stopped_at,omitempty"`
 	RestartCount  int               `json:"restart_count"`
 	LastError     string            `json:"last_error,omitempty"`
+
+	// Fields below let a restarted agent find and re-attach to the module.
+	Runtime          string          `json:"runtime,omitempty"`
+	ContainerID      string          `json:"container_id,omitempty"`
+	UnitName         string          `json:"unit_name,omitempty"`
+	SocketPath       string          `json:"socket_path,omitempty"`
+	DataPort         int             `json:"data_port,omitempty"`
+	ProcessStartTime uint64          `json:"process_start_time,omitempty"`
+	Config           json.RawMessage `json:"config,omitempty"`
 }
 
 type ContainerStatus string
@@ -127,6 +142,10 @@ type DeploymentConfig struct {
 	Signature  []byte             `json:"signature"`
 	SignedBy   string             `json:"signed_by"`
 	ReceivedAt time.Time          `json:"received_at"`
+
+	// Raw is the signed assignment config as received, so the deployment can
+	// be verified again before it is used without the master.
+	Raw []byte `json:"raw,omitempty"`
 }
 
 type ModuleDeployment struct {
@@ -143,4 +162,5 @@ type ListenerConfig struct {
 	Protocol        string `json:"protocol"`
 	Port            uint32 `json:"port"`
 	HighInteraction bool   `json:"high_interaction"`
+	SandboxImage    string `json:"sandbox_image,omitempty"`
 }
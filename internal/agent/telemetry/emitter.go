@@ -7,11 +7,16 @@ import (
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
 
 	gimpelv1 "gimpel/api/go/v1"
 	"gimpel/internal/agent/config"
 )
 
+// maxBatchBytes keeps each batch well under the gateway's 4 MiB message
+// limit, whatever the batch size.
+const maxBatchBytes = 1024 * 1024
+
 type Emitter struct {
 	cfg     *config.AgentConfig
 	agentID string
@@ -51,6 +56,7 @@ func (e *Emitter) Run(ctx context.Context) error {
 	defer ticker.Stop()
 
 	batch := make([]*gimpelv1.Event, 0, e.cfg.Gateway.BatchSize)
+	batchBytes := 0
 
 	for {
 		select {
@@ -60,15 +66,18 @@ func (e *Emitter) Run(ctx context.Context) error {
 
 		case event := <-e.eventCh:
 			batch = append(batch, event)
-			if len(batch) >= e.cfg.Gateway.BatchSize {
+			batchBytes += proto.Size(event)
+			if len(batch) >= e.cfg.Gateway.BatchSize || batchBytes >= maxBatchBytes {
 				e.flushBatch(ctx, batch)
 				batch = batch[:0]
+				batchBytes = 0
 			}
 
 		case <-ticker.C:
 			if len(batch) > 0 {
 				e.flushBatch(ctx, batch)
 				batch = batch[:0]
+				batchBytes = 0
 			}
 			e.drainBuffer(ctx)
 		}
@@ -93,7 +102,7 @@ func (e *Emitter) Emit(event *gimpelv1.Event) {
 	}
 }
 
-func (e *Emitter) EmitConnectionOpen(moduleID, sessionID, sourceIP, destIP, protocol string, sourcePort, destPort uint32) {
+func (e *Emitter) EmitConnectionOpen(moduleID, sessionID, sourceIP, destIP, protocol string, sourcePort, destPort uint32, labels map[string]string) {
 	e.Emit(&gimpelv1.Event{
 		ModuleId:   moduleID,
 		SessionId:  sessionID,
@@ -103,6 +112,7 @@ func (e *Emitter) EmitConnectionOpen(moduleID, sessionID, sourceIP, destIP, prot
 		DestIp:     destIP,
 		DestPort:   destPort,
 		Protocol:   protocol,
+		Labels:     labels,
 	})
 }
 
@@ -132,17 +142,77 @@ func (e *Emitter) EmitCommand(moduleID, sessionID string, payload []byte) {
 	})
 }
 
+// EmitModuleExit reports that a module process exited and what the
+// supervisor did about it.
+func (e *Emitter) EmitModuleExit(moduleID string, labels map[string]string) {
+	e.emitTyped("module_exit", moduleID, "", "", nil, labels)
+}
+
+// EmitLimitExceeded reports a connection refused, queued or tarpitted by a
+// listener limit.
+func (e *Emitter) EmitLimitExceeded(moduleID, sourceIP string, labels map[string]string) {
+	e.emitTyped("limit_exceeded", moduleID, "", sourceIP, nil, labels)
+}
+
+// EmitTarpit reports the time and bytes a tarpit listener took from a
+// client.
+func (e *Emitter) EmitTarpit(moduleID, sourceIP string, labels map[string]string) {
+	e.emitTyped("tarpit", moduleID, "", sourceIP, nil, labels)
+}
+
+// EmitTLSFingerprint reports the JA3/JA4 fingerprints a listener computed
+// for a connection.
+func (e *Emitter) EmitTLSFingerprint(moduleID, sessionID, sourceIP string, labels map[string]string) {
+	e.emitTyped("tls_fingerprint", moduleID, sessionID, sourceIP, nil, labels)
+}
+
+// EmitCapture uploads part of a session's recorded byte stream.
+func (e *Emitter) EmitCapture(moduleID, sessionID string, payload []byte, labels map[string]string) {
+	e.emitTyped("capture", moduleID, sessionID, "", payload, labels)
+}
+
+// emitTyped emits a custom event whose kind is given by its "event" label.
+func (e *Emitter) emitTyped(kind, moduleID, sessionID, sourceIP string, payload []byte, labels map[string]string) {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels["event"] = kind
+	e.Emit(&gimpelv1.Event{
+		ModuleId:  moduleID,
+		SessionId: sessionID,
+		Type:      gimpelv1.EventType_EVENT_TYPE_CUSTOM,
+		SourceIp:  sourceIP,
+		Labels:    labels,
+		Payload:   payload,
+	})
+}
+
+// flushBatch sends events in batches of at most maxBatchBytes, buffering
+// what could not be sent.
 func (e *Emitter) flushBatch(ctx context.Context, events []*gimpelv1.Event) {
-	if len(events) == 0 {
-		return
+	for len(events) > 0 {
+		n := splitBatch(events, maxBatchBytes)
+		if err := e.gw.SendBatch(ctx, e.agentID, events[:n]); err != nil {
+			log.WithError(err).WithField("count", len(events)).Warn("failed to send batch, buffering")
+			for _, ev := range events {
+				e.buffer.Push(ev)
+			}
+			return
+		}
+		events = events[n:]
 	}
+}
 
-	if err := e.gw.SendBatch(ctx, e.agentID, events); err != nil {
-		log.WithError(err).WithField("count", len(events)).Warn("failed to send batch, buffering")
-		for _, ev := range events {
-			e.buffer.Push(ev)
+// splitBatch returns how many of events fit in maxBytes, and at least one.
+func splitBatch(events []*gimpelv1.Event, maxBytes int) int {
+	size := 0
+	for i, ev := range events {
+		size += proto.Size(ev)
+		if size > maxBytes && i > 0 {
+			return i
 		}
 	}
+	return len(events)
 }
 
 func (e *Emitter) drainBuffer(ctx context.Context) {
@@ -152,16 +222,7 @@ func (e *Emitter) drainBuffer(ctx context.Context) {
 		return
 	}
 
-	if len(events) == 0 {
-		return
-	}
-
-	if err := e.gw.SendBatch(ctx, e.agentID, events); err != nil {
-		log.WithError(err).Warn("failed to drain buffer")
-		for _, ev := range events {
-			e.buffer.Push(ev)
-		}
-	}
+	e.flushBatch(ctx, events)
 }
 
 func (e *Emitter) Flush(ctx context.Context) {
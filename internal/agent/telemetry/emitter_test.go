@@ -0,0 +1,25 @@
+package telemetry
+
+import (
+	"testing"
+
+	gimpelv1 "gimpel/api/go/v1"
+)
+
+func TestSplitBatch(t *testing.T) {
+	events := []*gimpelv1.Event{
+		{Payload: make([]byte, 600)},
+		{Payload: make([]byte, 600)},
+		{Payload: make([]byte, 600)},
+	}
+	if n := splitBatch(events, 1000); n != 1 {
+		t.Errorf("split at %d, want 1", n)
+	}
+	if n := splitBatch(events, 10000); n != 3 {
+		t.Errorf("split at %d, want 3", n)
+	}
+	// An event over the limit still goes out on its own.
+	if n := splitBatch(events, 100); n != 1 {
+		t.Errorf("split at %d, want 1", n)
+	}
+}
@@ -20,6 +20,11 @@ type GatewayConfig struct {
 	TLS           TLSConfig     `mapstructure:"tls"`
 	LogLevel      string        `mapstructure:"log_level"`
 	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// CaptureDir is where the session captures agents upload are written,
+	// up to CaptureQuota bytes per agent. Captures are only accepted from
+	// agents with a client certificate signed by TLS.CAFile.
+	CaptureDir   string `mapstructure:"capture_dir"`
+	CaptureQuota int64  `mapstructure:"capture_quota"`
 }
 
 func (c *GatewayConfig) Validate() error {
@@ -29,6 +34,15 @@ func (c *GatewayConfig) Validate() error {
 	if c.LogLevel == "" {
 		c.LogLevel = "info"
 	}
+	if c.CaptureDir == "" {
+		c.CaptureDir = "/var/lib/gimpel-gateway/captures"
+	}
+	if c.CaptureQuota == 0 {
+		c.CaptureQuota = 10 << 30
+	}
+	if c.CaptureQuota < 0 {
+		return fmt.Errorf("capture_quota must not be negative")
+	}
 	return nil
 }
 
@@ -0,0 +1,121 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+
+	gimpelv1 "gimpel/api/go/v1"
+)
+
+// maxCaptureBytes caps the offset a capture chunk may be written at.
+const maxCaptureBytes = 1 << 30
+
+var captureName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var captureExt = map[string]string{
+	"pcapng": ".pcapng",
+	"stream": ".gcap",
+}
+
+// CaptureStore writes the session captures agents upload to
+// <dir>/<agent ID>/<session ID>.<format>. Each chunk is written at its
+// offset, so retried or reordered batches land in place, and the totals
+// of the final chunk go to <session ID>.json next to it. Chunks that would
+// take an agent's directory past quota bytes are refused.
+type CaptureStore struct {
+	dir   string
+	quota int64
+
+	mu   sync.Mutex
+	used map[string]int64
+}
+
+func NewCaptureStore(dir string, quota int64) (*CaptureStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating capture dir: %w", err)
+	}
+	return &CaptureStore{dir: dir, quota: quota, used: make(map[string]int64)}, nil
+}
+
+// IsCapture tells whether ev is a capture chunk.
+func IsCapture(ev *gimpelv1.Event) bool {
+	return ev.Type == gimpelv1.EventType_EVENT_TYPE_CUSTOM && ev.Labels["event"] == "capture"
+}
+
+// Write stores one capture chunk from agentID.
+func (c *CaptureStore) Write(agentID string, ev *gimpelv1.Event) error {
+	if !captureName.MatchString(agentID) || !captureName.MatchString(ev.SessionId) {
+		return fmt.Errorf("invalid agent %q or session %q", agentID, ev.SessionId)
+	}
+	ext, ok := captureExt[ev.Labels["format"]]
+	if !ok {
+		return fmt.Errorf("unknown capture format %q", ev.Labels["format"])
+	}
+	offset, err := strconv.ParseInt(ev.Labels["offset"], 10, 64)
+	if err != nil || offset < 0 || offset+int64(len(ev.Payload)) > maxCaptureBytes {
+		return fmt.Errorf("invalid capture offset %q", ev.Labels["offset"])
+	}
+
+	dir := filepath.Join(c.dir, agentID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	base := filepath.Join(dir, ev.SessionId)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	used, ok := c.used[agentID]
+	if !ok {
+		used = dirSize(dir)
+	}
+	grow := offset + int64(len(ev.Payload))
+	if fi, err := os.Stat(base + ext); err == nil {
+		grow -= fi.Size()
+	}
+	grow = max(grow, 0)
+	if used+grow > c.quota {
+		return fmt.Errorf("agent %s is over its capture quota of %d bytes", agentID, c.quota)
+	}
+	c.used[agentID] = used + grow
+
+	f, err := os.OpenFile(base+ext, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(ev.Payload, offset)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing capture: %w", err)
+	}
+
+	if ev.Labels["final"] != "true" {
+		return nil
+	}
+	meta, err := json.MarshalIndent(map[string]interface{}{
+		"module_id": ev.ModuleId,
+		"labels":    ev.Labels,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	c.used[agentID] += int64(len(meta))
+	return os.WriteFile(base+".json", meta, 0600)
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	gimpelv1 "gimpel/api/go/v1"
+)
+
+func TestCaptureStore(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCaptureStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := func(offset, data string, final bool) *gimpelv1.Event {
+		ev := &gimpelv1.Event{
+			SessionId: "session-1",
+			Type:      gimpelv1.EventType_EVENT_TYPE_CUSTOM,
+			Labels:    map[string]string{"event": "capture", "format": "stream", "offset": offset},
+			Payload:   []byte(data),
+		}
+		if final {
+			ev.Labels["final"] = "true"
+		}
+		return ev
+	}
+
+	// Chunks arriving out of order still land in place.
+	for _, ev := range []*gimpelv1.Event{chunk("5", "world", true), chunk("0", "hello", false)} {
+		if err := c.Write("agent-1", ev); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "agent-1", "session-1.gcap"))
+	if err != nil || string(data) != "helloworld" {
+		t.Errorf("capture = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "agent-1", "session-1.json")); err != nil {
+		t.Errorf("missing capture metadata: %v", err)
+	}
+
+	bad := chunk("0", "x", false)
+	bad.SessionId = "../escape"
+	if err := c.Write("agent-1", bad); err == nil {
+		t.Error("Write accepted a session ID with a path in it")
+	}
+}
+
+func TestCaptureStoreQuota(t *testing.T) {
+	c, err := NewCaptureStore(t.TempDir(), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(session, offset, data string) *gimpelv1.Event {
+		return &gimpelv1.Event{
+			SessionId: session,
+			Type:      gimpelv1.EventType_EVENT_TYPE_CUSTOM,
+			Labels:    map[string]string{"event": "capture", "format": "stream", "offset": offset},
+			Payload:   []byte(data),
+		}
+	}
+
+	if err := c.Write("agent-1", chunk("session-1", "0", "hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// A retried chunk takes no more room.
+	if err := c.Write("agent-1", chunk("session-1", "0", "hello")); err != nil {
+		t.Fatalf("retried Write: %v", err)
+	}
+	if err := c.Write("agent-1", chunk("session-2", "0", "world")); err == nil {
+		t.Error("Write went over the agent's quota")
+	}
+	if err := c.Write("agent-2", chunk("session-1", "0", "world")); err != nil {
+		t.Errorf("Write for another agent: %v", err)
+	}
+}
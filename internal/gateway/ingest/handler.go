@@ -1,10 +1,13 @@
 package ingest
 
 import (
+	"context"
 	"io"
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
 	gimpelv1 "gimpel/api/go/v1"
@@ -12,16 +15,23 @@ import (
 
 type Handler struct {
 	gimpelv1.UnimplementedIngestionServiceServer
+
+	captures *CaptureStore
 }
 
-func NewHandler() *Handler {
-	return &Handler{}
+// NewHandler returns a handler that stores capture chunks in captures, or
+// drops them if it is nil. Chunks are stored under the agent ID of the
+// verified client certificate and dropped from clients without one.
+func NewHandler(captures *CaptureStore) *Handler {
+	return &Handler{captures: captures}
 }
 
 func (h *Handler) StreamEvents(stream gimpelv1.IngestionService_StreamEventsServer) error {
 	log.Info("started event stream")
 	defer log.Info("stopped event stream")
 
+	peerID, verified := verifiedAgent(stream.Context())
+
 	for {
 		req, err := stream.Recv()
 		if err == io.EOF {
@@ -48,6 +58,30 @@ func (h *Handler) StreamEvents(stream gimpelv1.IngestionService_StreamEventsServ
 				"module_id":  event.ModuleId,
 				"session_id": event.SessionId,
 			}).Debug("event received")
+
+			if h.captures != nil && IsCapture(event) {
+				if !verified {
+					logger.WithField("session_id", event.SessionId).Warn("dropping capture chunk from an unverified client")
+					continue
+				}
+				if err := h.captures.Write(peerID, event); err != nil {
+					logger.WithError(err).WithField("session_id", event.SessionId).Warn("failed to store capture chunk")
+				}
+			}
 		}
 	}
 }
+
+// verifiedAgent returns the agent ID of the stream's client certificate if
+// it was verified.
+func verifiedAgent(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return "", false
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName, true
+}
@@ -3,6 +3,7 @@ package ingest
 import (
 	"context"
 	"io"
+	"os"
 	"testing"
 	"time"
 
@@ -36,7 +37,7 @@ func (m *MockStream) Context() context.Context {
 }
 
 func TestStreamEvents(t *testing.T) {
-	handler := NewHandler()
+	handler := NewHandler(nil)
 	mockStream := new(MockStream)
 
 	events := []*gimpelv1.Event{
@@ -65,3 +66,31 @@ func TestStreamEvents(t *testing.T) {
 
 	mockStream.AssertExpectations(t)
 }
+
+func TestStreamEventsDropsUnverifiedCaptures(t *testing.T) {
+	dir := t.TempDir()
+	captures, err := NewCaptureStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(captures)
+	mockStream := new(MockStream)
+
+	mockStream.On("Recv").Return(&gimpelv1.StreamEventsRequest{
+		Batch: &gimpelv1.EventBatch{
+			AgentId: "agent-1",
+			Events: []*gimpelv1.Event{{
+				SessionId: "session-1",
+				Type:      gimpelv1.EventType_EVENT_TYPE_CUSTOM,
+				Labels:    map[string]string{"event": "capture", "format": "stream", "offset": "0"},
+				Payload:   []byte("hello"),
+			}},
+		},
+	}, nil).Once()
+	mockStream.On("Recv").Return(nil, io.EOF).Once()
+	mockStream.On("SendAndClose", mock.Anything).Return(nil)
+
+	assert.NoError(t, handler.StreamEvents(mockStream))
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries, "capture from a client without a verified certificate was stored")
+}
@@ -30,6 +30,17 @@ func New(cfg *config.GatewayConfig) (*Server, error) {
 }
 
 func (s *Server) Start() error {
+	var captures *ingest.CaptureStore
+	if s.cfg.TLS.CAFile != "" {
+		var err error
+		captures, err = ingest.NewCaptureStore(s.cfg.CaptureDir, s.cfg.CaptureQuota)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Warn("tls.ca_file is not set, dropping capture uploads from unverified agents")
+	}
+
 	ln, err := net.Listen("tcp", s.cfg.ListenAddress)
 	if err != nil {
 		return fmt.Errorf("binding to %s: %w", s.cfg.ListenAddress, err)
@@ -43,7 +54,7 @@ func (s *Server) Start() error {
 
 	s.grpcServer = grpc.NewServer(opts...)
 
-	handler := ingest.NewHandler()
+	handler := ingest.NewHandler(captures)
 	gimpelv1.RegisterIngestionServiceServer(s.grpcServer, handler)
 
 	log.WithField("address", s.cfg.ListenAddress).Info("gateway server starting")
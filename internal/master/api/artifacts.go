@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gimpel/pkg/artifact"
+	"gimpel/pkg/nodeapi"
+	"gimpel/pkg/storage"
+)
+
+// ArtifactInfo is a file a session left behind. Available tells whether
+// the master holds its content; files over the sandbox's size limit are
+// only described.
+type ArtifactInfo struct {
+	Path      string    `json:"path"`
+	Change    string    `json:"change"`
+	EventType string    `json:"event_type"`
+	Time      time.Time `json:"time"`
+	SHA256    string    `json:"sha256,omitempty"`
+	SHA1      string    `json:"sha1,omitempty"`
+	MD5       string    `json:"md5,omitempty"`
+	Size      string    `json:"size"`
+	FileType  string    `json:"file_type,omitempty"`
+	Available bool      `json:"available"`
+}
+
+// HandleListArtifacts lists the files a session created or modified, from
+// the sandbox's file events.
+func (sa *SessionAPI) HandleListArtifacts(w http.ResponseWriter, r *http.Request) {
+	infos := []ArtifactInfo{}
+	for _, typ := range []string{nodeapi.EventFileAccess, nodeapi.EventMalwareDetected} {
+		events, err := sa.store.ListSessionEvents(r.PathValue("id"), typ, 0)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list events: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, ev := range events {
+			info := ArtifactInfo{
+				Path:      ev.Labels["path"],
+				Change:    ev.Labels["change"],
+				EventType: ev.Type,
+				Time:      ev.Time,
+				SHA256:    ev.Labels["sha256"],
+				SHA1:      ev.Labels["sha1"],
+				MD5:       ev.Labels["md5"],
+				Size:      ev.Labels["size"],
+				FileType:  ev.Labels["file_type"],
+			}
+			if info.SHA256 != "" {
+				a, err := sa.store.GetArtifact(info.SHA256)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("failed to get artifact: %v", err), http.StatusInternalServerError)
+					return
+				}
+				info.Available = a != nil
+			}
+			infos = append(infos, info)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"artifacts": infos})
+}
+
+// HandleDownloadArtifact serves an artifact's content. It is whatever the
+// attacker dropped, so it is never served inline.
+func (sa *SessionAPI) HandleDownloadArtifact(w http.ResponseWriter, r *http.Request) {
+	sha256 := r.PathValue("sha256")
+	if !artifact.ValidSHA256(sha256) {
+		http.Error(w, "invalid sha256", http.StatusBadRequest)
+		return
+	}
+	file, a, err := sa.store.OpenArtifact(sha256)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open artifact: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.SHA256+".bin"))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", a.StoredAt, file)
+}
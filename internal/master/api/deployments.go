@@ -36,6 +36,7 @@ type ListenerRequest struct {
 	Protocol        string `json:"protocol"`
 	Port            uint32 `json:"port"`
 	HighInteraction bool   `json:"high_interaction,omitempty"`
+	SandboxImage    string `json:"sandbox_image,omitempty"`
 }
 
 type DeploymentResponse struct {
@@ -58,6 +59,7 @@ type ListenerInfo struct {
 	Protocol        string `json:"protocol"`
 	Port            uint32 `json:"port"`
 	HighInteraction bool   `json:"high_interaction"`
+	SandboxImage    string `json:"sandbox_image,omitempty"`
 }
 
 func (da *DeploymentAPI) HandleCreateDeployment(w http.ResponseWriter, r *http.Request) {
@@ -114,6 +116,7 @@ func (da *DeploymentAPI) HandleCreateDeployment(w http.ResponseWriter, r *http.R
 				Protocol:        l.Protocol,
 				Port:            l.Port,
 				HighInteraction: l.HighInteraction,
+				SandboxImage:    l.SandboxImage,
 			})
 		}
 
@@ -147,6 +150,7 @@ func (da *DeploymentAPI) HandleCreateDeployment(w http.ResponseWriter, r *http.R
 				Protocol:        l.Protocol,
 				Port:            l.Port,
 				HighInteraction: l.HighInteraction,
+				SandboxImage:    l.SandboxImage,
 			})
 		}
 
@@ -207,6 +211,7 @@ func (da *DeploymentAPI) HandleGetDeployment(w http.ResponseWriter, r *http.Requ
 				Protocol:        l.Protocol,
 				Port:            l.Port,
 				HighInteraction: l.HighInteraction,
+				SandboxImage:    l.SandboxImage,
 			})
 		}
 
@@ -348,6 +353,7 @@ func (da *DeploymentAPI) HandleListDeployments(w http.ResponseWriter, r *http.Re
 					Protocol:        l.Protocol,
 					Port:            l.Port,
 					HighInteraction: l.HighInteraction,
+					SandboxImage:    l.SandboxImage,
 				})
 			}
 
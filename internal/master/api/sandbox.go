@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"gimpel/internal/master/session"
+	"gimpel/pkg/nodeapi"
+)
+
+type SandboxAPI struct {
+	sessions *session.SessionManager
+}
+
+type SandboxNodeInfo struct {
+	ID             string              `json:"id"`
+	Hostname       string              `json:"hostname,omitempty"`
+	Address        string              `json:"address"`
+	Static         bool                `json:"static,omitempty"`
+	Status         string              `json:"status"`
+	Labels         map[string]string   `json:"labels,omitempty"`
+	Images         []string            `json:"images,omitempty"`
+	Capacity       nodeapi.Capacity    `json:"capacity"`
+	Pools          []nodeapi.PoolStats `json:"pools,omitempty"`
+	PlacedSessions int                 `json:"placed_sessions"`
+	RegisteredAt   time.Time           `json:"registered_at"`
+	LastSeenAt     time.Time           `json:"last_seen_at,omitempty"`
+}
+
+type PlacementInfo struct {
+	SessionID   string    `json:"session_id"`
+	AgentID     string    `json:"agent_id"`
+	ListenerID  string    `json:"listener_id"`
+	SourceIP    string    `json:"source_ip"`
+	SandboxNode string    `json:"sandbox_node"`
+	Endpoint    string    `json:"endpoint"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func NewSandboxAPI(sessions *session.SessionManager) *SandboxAPI {
+	return &SandboxAPI{sessions: sessions}
+}
+
+func (sa *SandboxAPI) HandleListNodes(w http.ResponseWriter, r *http.Request) {
+	placed := sa.placedSessions()
+
+	nodes := sa.sessions.Nodes().List()
+	infos := make([]SandboxNodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		infos = append(infos, SandboxNodeInfo{
+			ID:             node.ID,
+			Hostname:       node.Hostname,
+			Address:        node.Address,
+			Static:         node.Static,
+			Status:         string(node.Status),
+			Labels:         node.Labels,
+			Images:         node.Images,
+			Capacity:       node.Capacity,
+			Pools:          node.Pools,
+			PlacedSessions: placed[node.ID],
+			RegisteredAt:   node.RegisteredAt,
+			LastSeenAt:     node.LastSeenAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": infos})
+}
+
+func (sa *SandboxAPI) HandleGetNode(w http.ResponseWriter, r *http.Request) {
+	node, ok := sa.sessions.Nodes().Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "sandbox node not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SandboxNodeInfo{
+		ID:             node.ID,
+		Hostname:       node.Hostname,
+		Address:        node.Address,
+		Static:         node.Static,
+		Status:         string(node.Status),
+		Labels:         node.Labels,
+		Images:         node.Images,
+		Capacity:       node.Capacity,
+		Pools:          node.Pools,
+		PlacedSessions: sa.placedSessions()[node.ID],
+		RegisteredAt:   node.RegisteredAt,
+		LastSeenAt:     node.LastSeenAt,
+	})
+}
+
+func (sa *SandboxAPI) HandleListPlacements(w http.ResponseWriter, r *http.Request) {
+	sessions := sa.sessions.ListActiveSessions()
+	infos := make([]PlacementInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, PlacementInfo{
+			SessionID:   s.ID,
+			AgentID:     s.AgentID,
+			ListenerID:  s.ListenerID,
+			SourceIP:    s.SourceIP,
+			SandboxNode: s.SandboxNode,
+			Endpoint:    s.SandboxEndpoint,
+			CreatedAt:   s.CreatedAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"placements": infos})
+}
+
+func (sa *SandboxAPI) placedSessions() map[string]int {
+	placed := make(map[string]int)
+	for _, s := range sa.sessions.ListActiveSessions() {
+		placed[s.SandboxNode]++
+	}
+	return placed
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/master/store"
+	"gimpel/pkg/storage"
+)
+
+type SandboxImageAPI struct {
+	store *store.Store
+}
+
+func NewSandboxImageAPI(s *store.Store) *SandboxImageAPI {
+	return &SandboxImageAPI{store: s}
+}
+
+type SandboxImageInfo struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	Description string    `json:"description,omitempty"`
+	Digest      string    `json:"digest"`
+	Port        uint32    `json:"port"`
+	Size        int64     `json:"size_bytes"`
+	SignedBy    string    `json:"signed_by"`
+	SignedAt    int64     `json:"signed_at,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func sandboxImageInfo(img *store.SandboxImage) SandboxImageInfo {
+	return SandboxImageInfo{
+		Name:        img.Name,
+		Version:     img.Version,
+		Description: img.Description,
+		Digest:      img.Digest,
+		Port:        img.Port,
+		Size:        img.SizeBytes,
+		SignedBy:    img.SignedBy,
+		SignedAt:    img.SignedAt.Unix(),
+		CreatedAt:   img.CreatedAt,
+	}
+}
+
+// HandleUploadImage takes an image archive with the metadata gimpel-sign
+// sign-sandbox-image wrote for it. Nodes pick it up on their next
+// heartbeat.
+func (sa *SandboxImageAPI) HandleUploadImage(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(64 << 20); err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	img := &store.SandboxImage{
+		Name:        r.FormValue("name"),
+		Version:     r.FormValue("version"),
+		Description: r.FormValue("description"),
+		SignedBy:    r.FormValue("signed_by"),
+	}
+	if img.Name == "" || img.Version == "" || r.FormValue("manifest") == "" || r.FormValue("signature") == "" || img.SignedBy == "" {
+		http.Error(w, "name, version, manifest, signature and signed_by are required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if img.Manifest, err = hex.DecodeString(r.FormValue("manifest")); err != nil {
+		http.Error(w, "invalid manifest encoding", http.StatusBadRequest)
+		return
+	}
+	if img.Signature, err = hex.DecodeString(r.FormValue("signature")); err != nil {
+		http.Error(w, "invalid signature encoding", http.StatusBadRequest)
+		return
+	}
+	if s := r.FormValue("signed_at"); s != "" {
+		signedAt, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid signed_at", http.StatusBadRequest)
+			return
+		}
+		img.SignedAt = time.Unix(signedAt, 0)
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get file: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if err := sa.store.StoreSandboxImage(img, file); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrInvalidSandboxImage) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("failed to store sandbox image: %v", err), status)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"image":     img.Name,
+		"version":   img.Version,
+		"signed_by": img.SignedBy,
+	}).Info("sandbox image uploaded")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sandboxImageInfo(img))
+}
+
+func (sa *SandboxImageAPI) HandleListImages(w http.ResponseWriter, r *http.Request) {
+	images, err := sa.store.ListSandboxImages()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list sandbox images: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]SandboxImageInfo, 0, len(images))
+	for _, img := range images {
+		infos = append(infos, sandboxImageInfo(img))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"images": infos})
+}
+
+func (sa *SandboxImageAPI) HandleDeleteImage(w http.ResponseWriter, r *http.Request) {
+	err := sa.store.DeleteSandboxImage(r.PathValue("name"), r.PathValue("version"))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "sandbox image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete sandbox image: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
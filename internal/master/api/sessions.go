@@ -0,0 +1,302 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gimpel/internal/master/session"
+	"gimpel/internal/master/store"
+	"gimpel/pkg/asciicast"
+	"gimpel/pkg/storage"
+)
+
+const defaultReplayIdleLimit = 2 * time.Second
+
+type SessionAPI struct {
+	store    *store.Store
+	sessions *session.SessionManager
+}
+
+type SessionInfo struct {
+	ID             string    `json:"id"`
+	AgentID        string    `json:"agent_id"`
+	ListenerID     string    `json:"listener_id"`
+	SourceIP       string    `json:"source_ip"`
+	SourcePort     uint32    `json:"source_port"`
+	SandboxNode    string    `json:"sandbox_node"`
+	Endpoint       string    `json:"endpoint"`
+	Image          string    `json:"image,omitempty"`
+	EscalatedBy    string    `json:"escalated_by,omitempty"`
+	State          string    `json:"state"`
+	EndReason      string    `json:"end_reason,omitempty"`
+	OpenTunnels    int       `json:"open_tunnels"`
+	Tunnels        int       `json:"tunnels"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	EndedAt        time.Time `json:"ended_at,omitempty"`
+
+	Recordings []RecordingInfo `json:"recordings,omitempty"`
+}
+
+type RecordingInfo struct {
+	Name        string    `json:"name"`
+	SandboxNode string    `json:"sandbox_node"`
+	SizeBytes   int64     `json:"size_bytes"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Events      int       `json:"events"`
+	Duration    float64   `json:"duration"`
+	StartedAt   time.Time `json:"started_at"`
+	StoredAt    time.Time `json:"stored_at"`
+}
+
+func NewSessionAPI(s *store.Store, sessions *session.SessionManager) *SessionAPI {
+	return &SessionAPI{store: s, sessions: sessions}
+}
+
+func toSessionInfo(s *store.HISession) SessionInfo {
+	return SessionInfo{
+		ID:             s.ID,
+		AgentID:        s.AgentID,
+		ListenerID:     s.ListenerID,
+		SourceIP:       s.SourceIP,
+		SourcePort:     s.SourcePort,
+		SandboxNode:    s.SandboxNode,
+		Endpoint:       s.SandboxEndpoint,
+		Image:          s.Image,
+		EscalatedBy:    s.EscalatedBy,
+		State:          s.State,
+		EndReason:      s.EndReason,
+		OpenTunnels:    s.OpenTunnels,
+		Tunnels:        s.Tunnels,
+		CreatedAt:      s.CreatedAt,
+		LastActivityAt: s.LastActivityAt,
+		EndedAt:        s.EndedAt,
+	}
+}
+
+func toRecordingInfo(rec *store.Recording) RecordingInfo {
+	return RecordingInfo{
+		Name:        rec.Name,
+		SandboxNode: rec.SandboxNode,
+		SizeBytes:   rec.SizeBytes,
+		Width:       rec.Width,
+		Height:      rec.Height,
+		Events:      rec.Events,
+		Duration:    rec.Duration,
+		StartedAt:   rec.StartedAt,
+		StoredAt:    rec.StoredAt,
+	}
+}
+
+// HandleListSessions lists sessions, newest first. ?state=active or
+// ?state=ended filters them.
+func (sa *SessionAPI) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := sa.store.ListHISessions(r.URL.Query().Get("state"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, toSessionInfo(s))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sessions": infos})
+}
+
+func (sa *SessionAPI) HandleGetSession(w http.ResponseWriter, r *http.Request) {
+	s, err := sa.store.GetHISession(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if s == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	recordings, err := sa.store.ListRecordings(s.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list recordings: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	info := toSessionInfo(s)
+	for _, rec := range recordings {
+		info.Recordings = append(info.Recordings, toRecordingInfo(rec))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// HandleListRecordings lists a session's terminal recordings, one per
+// tunnel, in the order the tunnels were opened.
+func (sa *SessionAPI) HandleListRecordings(w http.ResponseWriter, r *http.Request) {
+	recordings, err := sa.store.ListRecordings(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list recordings: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]RecordingInfo, 0, len(recordings))
+	for _, rec := range recordings {
+		infos = append(infos, toRecordingInfo(rec))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recordings": infos})
+}
+
+// HandleListEvents returns telemetry the sandbox reported for a session,
+// oldest first. ?type= filters by event type and ?limit= caps the count.
+func (sa *SessionAPI) HandleListEvents(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events, err := sa.store.ListSessionEvents(r.PathValue("id"), r.URL.Query().Get("type"), limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list events: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []*store.SessionEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"events": events})
+}
+
+// HandleDownloadRecording serves a recording as an asciicast v2 file.
+func (sa *SessionAPI) HandleDownloadRecording(w http.ResponseWriter, r *http.Request) {
+	file, rec, ok := sa.openRecording(w, r)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rec.SessionID+"-"+rec.Name+".cast"))
+	http.ServeContent(w, r, "", rec.StoredAt, file)
+}
+
+// HandleReplayRecording streams a recording in real time: the header line,
+// then each event when it is due. ?speed= scales playback and ?idle_limit=
+// (seconds, default 2, 0 for none) shortens long pauses; event times in
+// the stream are adjusted to match.
+func (sa *SessionAPI) HandleReplayRecording(w http.ResponseWriter, r *http.Request) {
+	speed := 1.0
+	if v := r.URL.Query().Get("speed"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "speed must be a positive number", http.StatusBadRequest)
+			return
+		}
+		speed = parsed
+	}
+	idleLimit := defaultReplayIdleLimit.Seconds()
+	if v := r.URL.Query().Get("idle_limit"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "idle_limit must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+		idleLimit = parsed
+	}
+
+	file, _, ok := sa.openRecording(w, r)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	cast, err := asciicast.NewReader(file)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read recording: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Cache-Control", "no-cache")
+	enc := json.NewEncoder(w)
+	enc.Encode(cast.Header)
+
+	ctx := r.Context()
+	start := time.Now()
+	var last, played float64
+	for {
+		ev, err := cast.Next()
+		if err != nil {
+			return
+		}
+		gap := ev.Time - last
+		if idleLimit > 0 && gap > idleLimit {
+			gap = idleLimit
+		}
+		last = ev.Time
+		played += gap / speed
+
+		if wait := time.Until(start.Add(time.Duration(played * float64(time.Second)))); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		ev.Time = played
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func (sa *SessionAPI) openRecording(w http.ResponseWriter, r *http.Request) (io.ReadSeekCloser, *store.Recording, bool) {
+	file, rec, err := sa.store.OpenRecording(r.PathValue("id"), r.PathValue("name"))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open recording: %v", err), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return file, rec, true
+}
+
+// HandleDeleteSession kills a live session and stops it on its sandbox.
+func (sa *SessionAPI) HandleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	err := sa.sessions.EndSession(r.Context(), r.PathValue("id"), session.EndReasonTerminated)
+	if errors.Is(err, session.ErrSessionNotFound) {
+		http.Error(w, "no active session with that ID", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		// The session is ended either way; the sandbox failed to clean up.
+		http.Error(w, fmt.Sprintf("session ended but sandbox stop failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "terminated",
+	})
+}
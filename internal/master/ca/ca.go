@@ -135,10 +135,20 @@ func (ca *CA) CACertPEM() []byte {
 	return ca.certPEM
 }
 
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return pool
+}
+
 type CertRequest struct {
 	AgentID   string
 	Hostname  string
 	PublicIPs []string
+
+	// Server also allows the certificate to authenticate a TLS server, for
+	// peers the master dials. AgentID is added as a DNS name to verify.
+	Server bool
 }
 
 type SignedCert struct {
@@ -177,6 +187,10 @@ func (ca *CA) IssueCertificate(req *CertRequest) (*SignedCert, error) {
 		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
+	if req.Server {
+		template.DNSNames = append(template.DNSNames, req.AgentID)
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.privateKey)
 	if err != nil {
@@ -31,7 +31,31 @@ type RegistryConfig struct {
 }
 
 type SandboxConfig struct {
+	// Nodes are static sandbox addresses, dialed without TLS. Nodes that
+	// register through NodeListenAddress are dialed with mutual TLS.
 	Nodes []string `mapstructure:"nodes"`
+
+	NodeListenAddress string        `mapstructure:"node_listen_address"`
+	HeartbeatTimeout  time.Duration `mapstructure:"heartbeat_timeout"`
+
+	// Placement is "least_loaded", which spreads sessions over nodes, or
+	// "affinity", which keeps an agent's sessions on the node already
+	// serving it while it has room.
+	Placement string `mapstructure:"placement"`
+
+	// DefaultImage is the sandbox image of listeners that do not choose
+	// one.
+	DefaultImage string `mapstructure:"default_image"`
+
+	// Sessions are stopped on their sandbox after MaxSessionDuration, or
+	// once no tunnel has been open for IdleTimeout.
+	MaxSessionDuration time.Duration `mapstructure:"max_session_duration"`
+	IdleTimeout        time.Duration `mapstructure:"idle_timeout"`
+
+	// MaxRecordingSize caps each terminal recording a node uploads.
+	MaxRecordingSize int64 `mapstructure:"max_recording_size"`
+	// MaxArtifactSize caps each file a node collects from a session.
+	MaxArtifactSize int64 `mapstructure:"max_artifact_size"`
 }
 
 type ModuleStoreConfig struct {
@@ -79,6 +103,35 @@ func (c *MasterConfig) Validate() error {
 		c.Registry.CleanupInterval = 1 * time.Minute
 	}
 
+	if c.Sandbox.NodeListenAddress == "" {
+		c.Sandbox.NodeListenAddress = ":9443"
+	}
+	if c.Sandbox.HeartbeatTimeout == 0 {
+		c.Sandbox.HeartbeatTimeout = 30 * time.Second
+	}
+	if c.Sandbox.MaxSessionDuration == 0 {
+		c.Sandbox.MaxSessionDuration = time.Hour
+	}
+	if c.Sandbox.IdleTimeout == 0 {
+		c.Sandbox.IdleTimeout = 5 * time.Minute
+	}
+	if c.Sandbox.MaxRecordingSize == 0 {
+		c.Sandbox.MaxRecordingSize = 64 * 1024 * 1024
+	}
+	if c.Sandbox.MaxArtifactSize == 0 {
+		c.Sandbox.MaxArtifactSize = 64 * 1024 * 1024
+	}
+	if c.Sandbox.DefaultImage == "" {
+		c.Sandbox.DefaultImage = "default-honeypot"
+	}
+	switch c.Sandbox.Placement {
+	case "":
+		c.Sandbox.Placement = "least_loaded"
+	case "least_loaded", "affinity":
+	default:
+		return fmt.Errorf("unknown sandbox placement %q", c.Sandbox.Placement)
+	}
+
 	if c.ModuleStore.DataDir == "" {
 		c.ModuleStore.DataDir = c.DataDir + "/modules"
 	}
@@ -97,6 +97,7 @@ func (h *ModuleCatalogHandler) GetModuleAssignments(ctx context.Context, req *gi
 				Protocol:        l.Protocol,
 				Port:            l.Port,
 				HighInteraction: l.HighInteraction,
+				SandboxImage:    l.SandboxImage,
 			})
 		}
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"time"
 
@@ -161,7 +162,7 @@ func (h *Handler) RequestHISession(ctx context.Context, req *gimpelv1.HISessionR
 		return nil, fmt.Errorf("satellite not registered")
 	}
 
-	sess, err := h.sessionMgr.CreateSession(ctx, req.AgentId, req.ListenerId, req.SourceIp, req.SourcePort)
+	sess, err := h.sessionMgr.CreateSession(ctx, req.AgentId, req.ListenerId, req.SourceIp, req.SourcePort, req.EscalatedBy, req.SandboxImage)
 	if err != nil {
 		return nil, fmt.Errorf("creating session: %w", err)
 	}
@@ -173,6 +174,24 @@ func (h *Handler) RequestHISession(ctx context.Context, req *gimpelv1.HISessionR
 	}, nil
 }
 
+func (h *Handler) ReportHISessionClosed(ctx context.Context, req *gimpelv1.HISessionClosedRequest) (*gimpelv1.HISessionClosedResponse, error) {
+	if err := h.sessionMgr.TunnelClosed(req.SessionId); err != nil {
+		if errors.Is(err, session.ErrSessionNotFound) {
+			return &gimpelv1.HISessionClosedResponse{Ok: false}, nil
+		}
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"session_id":  req.SessionId,
+		"agent_id":    req.AgentId,
+		"source_port": req.SourcePort,
+		"reason":      req.Reason,
+	}).Debug("HI tunnel closed")
+
+	return &gimpelv1.HISessionClosedResponse{Ok: true}, nil
+}
+
 func generateAgentID() (string, error) {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
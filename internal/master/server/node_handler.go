@@ -0,0 +1,363 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/master/ca"
+	"gimpel/internal/master/session"
+	"gimpel/internal/master/store"
+	"gimpel/pkg/nodeapi"
+	"gimpel/pkg/storage"
+)
+
+const maxEventBatch = 8 << 20
+
+// NodeHandler serves sandbox node registration, heartbeats, recording and
+// artifact uploads, session telemetry and the sandbox image catalog. It is
+// mounted on a TLS listener that asks for client
+// certificates: registration is authorized by a pairing token, everything
+// else by the certificate issued at registration.
+type NodeHandler struct {
+	store        *store.Store
+	ca           *ca.CA
+	nodes        *session.NodeRegistry
+	maxRecording int64
+	maxArtifact  int64
+}
+
+func NewNodeHandler(s *store.Store, caInstance *ca.CA, nodes *session.NodeRegistry, maxRecording, maxArtifact int64) *NodeHandler {
+	return &NodeHandler{
+		store:        s,
+		ca:           caInstance,
+		nodes:        nodes,
+		maxRecording: maxRecording,
+		maxArtifact:  maxArtifact,
+	}
+}
+
+func (h *NodeHandler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("POST "+nodeapi.RegisterPath, h.HandleRegister)
+	mux.HandleFunc("POST "+nodeapi.HeartbeatPath, h.HandleHeartbeat)
+	mux.HandleFunc("PUT "+nodeapi.RecordingPath, h.HandleRecording)
+	mux.HandleFunc("PUT "+nodeapi.ArtifactPath, h.HandleArtifact)
+	mux.HandleFunc("POST "+nodeapi.EventsPath, h.HandleEvents)
+	mux.HandleFunc("GET "+nodeapi.ImagesPath, h.HandleImages)
+	mux.HandleFunc("GET "+nodeapi.ImagePath, h.HandleImage)
+}
+
+func (h *NodeHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	var req nodeapi.RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Address == "" {
+		http.Error(w, "token and address are required", http.StatusBadRequest)
+		return
+	}
+	host, _, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid address: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	pr, err := h.store.GetPairingByToken(req.Token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("checking pairing token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if pr == nil || pr.Used || time.Now().After(pr.ExpiresAt) {
+		http.Error(w, "pairing token is invalid or expired", http.StatusForbidden)
+		return
+	}
+
+	nodeID, err := generateNodeID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("generating node ID: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The master dials nodes by address and verifies them by ID.
+	signedCert, err := h.ca.IssueCertificate(&ca.CertRequest{
+		AgentID:   nodeID,
+		Hostname:  req.Hostname,
+		PublicIPs: []string{host},
+		Server:    true,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("issuing certificate: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	node := &store.SandboxNode{
+		ID:       nodeID,
+		Hostname: req.Hostname,
+		Address:  req.Address,
+		Labels:   req.Labels,
+		Images:   req.Images,
+		Capacity: req.Capacity,
+	}
+	if err := h.nodes.Register(node); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.store.MarkPairingUsed(pr.ID, nodeID, req.Hostname); err != nil {
+		log.WithError(err).Warn("failed to mark pairing as used")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodeapi.RegisterResponse{
+		NodeID:        nodeID,
+		Certificate:   signedCert.Certificate,
+		PrivateKey:    signedCert.PrivateKey,
+		CACertificate: h.ca.CACertPEM(),
+	})
+}
+
+func (h *NodeHandler) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !peerIsNode(r, id) {
+		http.Error(w, "client certificate does not match node", http.StatusForbidden)
+		return
+	}
+
+	var hb nodeapi.Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+		http.Error(w, fmt.Sprintf("invalid heartbeat: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.nodes.Heartbeat(id, &hb); err != nil {
+		if errors.Is(err, session.ErrUnknownNode) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := nodeapi.HeartbeatResponse{OK: true}
+	if catalog, err := h.imageCatalog(); err != nil {
+		log.WithError(err).Warn("failed to list sandbox images")
+	} else {
+		resp.ImageCatalog = catalog.Version
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleImages returns the sandbox image catalog.
+func (h *NodeHandler) HandleImages(w http.ResponseWriter, r *http.Request) {
+	if !peerIsNode(r, r.PathValue("id")) {
+		http.Error(w, "client certificate does not match node", http.StatusForbidden)
+		return
+	}
+
+	catalog, err := h.imageCatalog()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalog)
+}
+
+// HandleImage streams a sandbox image archive.
+func (h *NodeHandler) HandleImage(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !peerIsNode(r, id) {
+		http.Error(w, "client certificate does not match node", http.StatusForbidden)
+		return
+	}
+
+	file, img, err := h.store.OpenSandboxImage(r.PathValue("name"), r.PathValue("version"))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "sandbox image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	log.WithFields(log.Fields{
+		"node_id": id,
+		"image":   img.Name,
+		"version": img.Version,
+	}).Info("streaming sandbox image")
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	http.ServeContent(w, r, "", img.CreatedAt, file)
+}
+
+// imageCatalog lists the latest version of every sandbox image. Its
+// version is a hash of what it lists.
+func (h *NodeHandler) imageCatalog() (*nodeapi.ImageCatalog, error) {
+	images, err := h.store.LatestSandboxImages()
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := &nodeapi.ImageCatalog{Images: make([]nodeapi.Image, 0, len(images))}
+	hash := sha256.New()
+	for _, img := range images {
+		catalog.Images = append(catalog.Images, nodeapi.Image{
+			Name:        img.Name,
+			Version:     img.Version,
+			Description: img.Description,
+			Digest:      img.Digest,
+			SizeBytes:   img.SizeBytes,
+			Port:        img.Port,
+			Manifest:    img.Manifest,
+			Signature:   img.Signature,
+			SignedBy:    img.SignedBy,
+			SignedAt:    img.SignedAt.Unix(),
+		})
+		fmt.Fprintf(hash, "%s:%s:%s\n", img.Name, img.Version, img.Digest)
+	}
+	catalog.Version = hex.EncodeToString(hash.Sum(nil)[:8])
+	return catalog, nil
+}
+
+// HandleRecording stores a terminal recording for a session that was
+// placed on the uploading node.
+func (h *NodeHandler) HandleRecording(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !peerIsNode(r, id) {
+		http.Error(w, "client certificate does not match node", http.StatusForbidden)
+		return
+	}
+
+	sessionID := r.PathValue("session")
+	sess, err := h.store.GetHISession(sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if sess == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if sess.SandboxNode != id {
+		http.Error(w, "session was not placed on this node", http.StatusForbidden)
+		return
+	}
+
+	rec, err := h.store.StoreRecording(sessionID, r.PathValue("name"), id, r.Body, h.maxRecording)
+	switch {
+	case errors.Is(err, store.ErrRecordingTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, store.ErrInvalidRecording):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rec)
+}
+
+// HandleArtifact stores a file a node collected from one of its sessions.
+// Which sessions it came from is told by their file events.
+func (h *NodeHandler) HandleArtifact(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !peerIsNode(r, id) {
+		http.Error(w, "client certificate does not match node", http.StatusForbidden)
+		return
+	}
+
+	a, err := h.store.StoreArtifact(r.PathValue("sha256"), id, r.Body, h.maxArtifact)
+	switch {
+	case errors.Is(err, store.ErrArtifactTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, store.ErrInvalidArtifact):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// HandleEvents stores session telemetry. Events for sessions that were not
+// placed on the posting node are dropped.
+func (h *NodeHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !peerIsNode(r, id) {
+		http.Error(w, "client certificate does not match node", http.StatusForbidden)
+		return
+	}
+
+	var batch nodeapi.EventBatch
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventBatch)).Decode(&batch); err != nil {
+		http.Error(w, fmt.Sprintf("invalid event batch: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	placed := make(map[string]bool)
+	events := batch.Events[:0]
+	for _, ev := range batch.Events {
+		ok, seen := placed[ev.SessionID]
+		if !seen {
+			sess, err := h.store.GetHISession(ev.SessionID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ok = sess != nil && sess.SandboxNode == id
+			placed[ev.SessionID] = ok
+		}
+		if ok {
+			events = append(events, ev)
+		}
+	}
+	if dropped := len(batch.Events) - len(events); dropped > 0 {
+		log.WithFields(log.Fields{
+			"node":    id,
+			"dropped": dropped,
+		}).Warn("dropped events for sessions not placed on node")
+	}
+
+	if err := h.store.PutSessionEvents(id, events); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodeapi.EventsResponse{Accepted: len(events)})
+}
+
+func peerIsNode(r *http.Request, id string) bool {
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && r.TLS.PeerCertificates[0].Subject.CommonName == id
+}
+
+func generateNodeID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sandbox-" + hex.EncodeToString(b), nil
+}
@@ -12,6 +12,9 @@ func (s *Server) RegisterRESTAPIs(mux *http.ServeMux) {
 	moduleAPI := api.NewModuleAPI(s.Store)
 	deploymentAPI := api.NewDeploymentAPI(s.Store)
 	pairingAPI := api.NewPairingAPI(s.Store)
+	sandboxAPI := api.NewSandboxAPI(s.SessionMgr)
+	sandboxImageAPI := api.NewSandboxImageAPI(s.Store)
+	sessionAPI := api.NewSessionAPI(s.Store, s.SessionMgr)
 
 	corsMiddleware := func(h http.HandlerFunc) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +50,24 @@ func (s *Server) RegisterRESTAPIs(mux *http.ServeMux) {
 	mux.Handle("GET /api/v1/pairings", corsMiddleware(pairingAPI.HandleListPairings))
 	mux.Handle("GET /api/v1/pairings/active", corsMiddleware(pairingAPI.HandleGetActivePairings))
 
+	mux.Handle("GET /api/v1/sandbox/nodes", corsMiddleware(sandboxAPI.HandleListNodes))
+	mux.Handle("GET /api/v1/sandbox/nodes/{id}", corsMiddleware(sandboxAPI.HandleGetNode))
+	mux.Handle("GET /api/v1/sandbox/placements", corsMiddleware(sandboxAPI.HandleListPlacements))
+	mux.Handle("POST /api/v1/sandbox/images", corsMiddleware(sandboxImageAPI.HandleUploadImage))
+	mux.Handle("GET /api/v1/sandbox/images", corsMiddleware(sandboxImageAPI.HandleListImages))
+	mux.Handle("DELETE /api/v1/sandbox/images/{name}/{version}", corsMiddleware(sandboxImageAPI.HandleDeleteImage))
+
+	mux.Handle("GET /api/v1/sessions", corsMiddleware(sessionAPI.HandleListSessions))
+	mux.Handle("GET /api/v1/sessions/{id}", corsMiddleware(sessionAPI.HandleGetSession))
+	mux.Handle("DELETE /api/v1/sessions/{id}", corsMiddleware(sessionAPI.HandleDeleteSession))
+	mux.Handle("GET /api/v1/sessions/{id}/events", corsMiddleware(sessionAPI.HandleListEvents))
+	mux.Handle("GET /api/v1/sessions/{id}/artifacts", corsMiddleware(sessionAPI.HandleListArtifacts))
+	mux.Handle("GET /api/v1/sessions/{id}/recordings", corsMiddleware(sessionAPI.HandleListRecordings))
+	mux.Handle("GET /api/v1/sessions/{id}/recordings/{name}", corsMiddleware(sessionAPI.HandleDownloadRecording))
+	mux.Handle("GET /api/v1/sessions/{id}/recordings/{name}/replay", corsMiddleware(sessionAPI.HandleReplayRecording))
+
+	mux.Handle("GET /api/v1/artifacts/{sha256}", corsMiddleware(sessionAPI.HandleDownloadArtifact))
+
 	log.Info("REST API handlers registered")
 }
 
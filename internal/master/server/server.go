@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 
@@ -24,6 +26,8 @@ type Server struct {
 
 	grpcServer *grpc.Server
 	listener   net.Listener
+	nodeServer *http.Server
+	cancel     context.CancelFunc
 
 	Store      *store.Store
 	CA         *ca.CA
@@ -37,23 +41,64 @@ func New(cfg *config.MasterConfig) (*Server, error) {
 	}
 
 	masterStore, err := store.New(&store.Config{
-		DBPath:   filepath.Join(cfg.DataDir, "master.db"),
-		ImageDir: filepath.Join(cfg.DataDir, "images"),
+		DBPath:       filepath.Join(cfg.DataDir, "master.db"),
+		ImageDir:     filepath.Join(cfg.DataDir, "images"),
+		RecordingDir: filepath.Join(cfg.DataDir, "recordings"),
+		ArtifactDir:  filepath.Join(cfg.DataDir, "artifacts"),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("initializing store: %w", err)
 	}
 
+	nodes, err := session.NewNodeRegistry(masterStore, &cfg.Sandbox)
+	if err != nil {
+		masterStore.Close()
+		return nil, err
+	}
+
+	nodeTLS, err := sandboxClientTLS(caInstance)
+	if err != nil {
+		masterStore.Close()
+		return nil, err
+	}
+
+	sessionMgr, err := session.NewSessionManager(&cfg.Sandbox, masterStore, nodes, nodeTLS)
+	if err != nil {
+		masterStore.Close()
+		return nil, err
+	}
+
 	s := &Server{
 		cfg:        cfg,
 		CA:         caInstance,
-		SessionMgr: session.NewSessionManager(&cfg.Sandbox),
+		SessionMgr: sessionMgr,
 		Store:      masterStore,
 	}
 
 	return s, nil
 }
 
+// sandboxClientTLS issues the master a client certificate for dialing
+// sandbox nodes, which only accept peers signed by the CA.
+func sandboxClientTLS(caInstance *ca.CA) (*tls.Config, error) {
+	hostname, _ := os.Hostname()
+	signed, err := caInstance.IssueCertificate(&ca.CertRequest{
+		AgentID:  "master",
+		Hostname: hostname,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("issuing sandbox client certificate: %w", err)
+	}
+	cert, err := tls.X509KeyPair(signed.Certificate, signed.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading sandbox client certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caInstance.CertPool(),
+	}, nil
+}
+
 func (s *Server) Start() error {
 	ln, err := net.Listen("tcp", s.cfg.ListenAddress)
 	if err != nil {
@@ -82,6 +127,14 @@ func (s *Server) Start() error {
 		}
 	}()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.SessionMgr.Run(ctx)
+
+	if err := s.startNodeServer(); err != nil {
+		return fmt.Errorf("starting sandbox node server: %w", err)
+	}
+
 	restAddr := ":8080"
 	if s.cfg.RESTAddress != "" {
 		restAddr = s.cfg.RESTAddress
@@ -97,6 +150,13 @@ func (s *Server) Stop() {
 	if s.grpcServer != nil {
 		s.grpcServer.GracefulStop()
 	}
+	if s.nodeServer != nil {
+		s.nodeServer.Close()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.SessionMgr.Close()
 	if s.Store != nil {
 		s.Store.Close()
 	}
@@ -135,3 +195,55 @@ func (s *Server) buildServerOptions() ([]grpc.ServerOption, error) {
 
 	return opts, nil
 }
+
+// startNodeServer serves sandbox node registration and heartbeats over TLS,
+// with the master's certificate if one is configured.
+func (s *Server) startNodeServer() error {
+	var cert tls.Certificate
+	var err error
+	if s.cfg.TLS.CertFile != "" && s.cfg.TLS.KeyFile != "" {
+		cert, err = tls.LoadX509KeyPair(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+	} else {
+		hostname, _ := os.Hostname()
+		var signed *ca.SignedCert
+		signed, err = s.CA.IssueCertificate(&ca.CertRequest{
+			AgentID:   "master",
+			Hostname:  hostname,
+			PublicIPs: []string{"127.0.0.1"},
+			Server:    true,
+		})
+		if err == nil {
+			cert, err = tls.X509KeyPair(signed.Certificate, signed.PrivateKey)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("loading TLS cert: %w", err)
+	}
+
+	ln, err := net.Listen("tcp", s.cfg.Sandbox.NodeListenAddress)
+	if err != nil {
+		return fmt.Errorf("binding to %s: %w", s.cfg.Sandbox.NodeListenAddress, err)
+	}
+
+	mux := http.NewServeMux()
+	NewNodeHandler(s.Store, s.CA, s.SessionMgr.Nodes(), s.cfg.Sandbox.MaxRecordingSize, s.cfg.Sandbox.MaxArtifactSize).Register(mux)
+
+	s.nodeServer = &http.Server{
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    s.CA.CertPool(),
+		},
+	}
+
+	log.WithField("address", s.cfg.Sandbox.NodeListenAddress).Info("sandbox node server starting")
+
+	go func() {
+		if err := s.nodeServer.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("sandbox node server error")
+		}
+	}()
+
+	return nil
+}
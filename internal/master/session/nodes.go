@@ -0,0 +1,229 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/master/config"
+	"gimpel/internal/master/store"
+	"gimpel/pkg/nodeapi"
+)
+
+// failureCooldown is how long a node that failed a request is skipped, even
+// if it keeps sending heartbeats.
+const failureCooldown = 30 * time.Second
+
+var ErrUnknownNode = errors.New("unknown sandbox node")
+
+type nodeState struct {
+	node     store.SandboxNode
+	failedAt time.Time
+	// sessions is what the node last reported running, until the session
+	// manager takes it.
+	sessions []string
+}
+
+func (st *nodeState) usable(now time.Time) bool {
+	if now.Sub(st.failedAt) < failureCooldown {
+		return false
+	}
+	return st.node.Static || st.node.Status == store.SatelliteStatusOnline
+}
+
+// NodeRegistry tracks sandbox nodes and their health. Registered nodes are
+// persisted and come back offline after a restart until they heartbeat;
+// static nodes from the config are always considered up unless a request
+// to them fails.
+type NodeRegistry struct {
+	store   *store.Store
+	timeout time.Duration
+
+	mu    sync.RWMutex
+	nodes map[string]*nodeState
+}
+
+func NewNodeRegistry(s *store.Store, cfg *config.SandboxConfig) (*NodeRegistry, error) {
+	r := &NodeRegistry{
+		store:   s,
+		timeout: cfg.HeartbeatTimeout,
+		nodes:   make(map[string]*nodeState),
+	}
+
+	persisted, err := s.ListSandboxNodes()
+	if err != nil {
+		return nil, fmt.Errorf("loading sandbox nodes: %w", err)
+	}
+	for _, node := range persisted {
+		node.Status = store.SatelliteStatusOffline
+		r.nodes[node.ID] = &nodeState{node: *node}
+	}
+
+	for _, addr := range cfg.Nodes {
+		r.nodes[addr] = &nodeState{node: store.SandboxNode{
+			ID:           addr,
+			Address:      addr,
+			Static:       true,
+			Status:       store.SatelliteStatusOnline,
+			RegisteredAt: time.Now(),
+		}}
+	}
+	if len(cfg.Nodes) > 0 {
+		log.WithField("nodes", cfg.Nodes).Warn("static sandbox nodes are dialed without TLS")
+	}
+
+	return r, nil
+}
+
+func (r *NodeRegistry) Register(node *store.SandboxNode) error {
+	node.Status = store.SatelliteStatusOnline
+	node.RegisteredAt = time.Now()
+	node.LastSeenAt = node.RegisteredAt
+	if err := r.store.PutSandboxNode(node); err != nil {
+		return fmt.Errorf("storing sandbox node: %w", err)
+	}
+
+	r.mu.Lock()
+	r.nodes[node.ID] = &nodeState{node: *node}
+	r.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"node_id":      node.ID,
+		"address":      node.Address,
+		"max_sessions": node.Capacity.MaxSessions,
+	}).Info("sandbox node registered")
+	return nil
+}
+
+func (r *NodeRegistry) Heartbeat(id string, hb *nodeapi.Heartbeat) error {
+	r.mu.Lock()
+	st, ok := r.nodes[id]
+	if !ok || st.node.Static {
+		r.mu.Unlock()
+		return ErrUnknownNode
+	}
+	if st.node.Status != store.SatelliteStatusOnline {
+		log.WithField("node_id", id).Info("sandbox node online")
+	}
+	st.node.Address = hb.Address
+	st.node.Labels = hb.Labels
+	st.node.Images = hb.Images
+	st.node.Capacity = hb.Capacity
+	st.node.Pools = hb.Pools
+	st.sessions = hb.Sessions
+	st.node.Status = store.SatelliteStatusOnline
+	st.node.LastSeenAt = time.Now()
+	node := st.node
+	r.mu.Unlock()
+
+	return r.store.PutSandboxNode(&node)
+}
+
+func (r *NodeRegistry) Get(id string) (store.SandboxNode, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	st, ok := r.nodes[id]
+	if !ok {
+		return store.SandboxNode{}, false
+	}
+	return st.node, true
+}
+
+func (r *NodeRegistry) List() []store.SandboxNode {
+	r.mu.RLock()
+	nodes := make([]store.SandboxNode, 0, len(r.nodes))
+	for _, st := range r.nodes {
+		nodes = append(nodes, st.node)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// Usable reports whether sessions can be placed on or kept on a node.
+func (r *NodeRegistry) Usable(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	st, ok := r.nodes[id]
+	return ok && st.usable(time.Now())
+}
+
+func (r *NodeRegistry) available() []store.SandboxNode {
+	now := time.Now()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var nodes []store.SandboxNode
+	for _, st := range r.nodes {
+		if st.usable(now) {
+			nodes = append(nodes, st.node)
+		}
+	}
+	return nodes
+}
+
+func (r *NodeRegistry) markFailed(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st, ok := r.nodes[id]; ok {
+		st.failedAt = time.Now()
+		st.node.Status = store.SatelliteStatusUnreachable
+	}
+}
+
+func (r *NodeRegistry) markHealthy(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st, ok := r.nodes[id]; ok {
+		st.failedAt = time.Time{}
+		if st.node.Static {
+			st.node.Status = store.SatelliteStatusOnline
+		}
+	}
+}
+
+// expire marks registered nodes whose heartbeats stopped as offline and
+// returns their IDs.
+// takeSessions returns the sessions nodes reported running since the last
+// call, by node ID.
+func (r *NodeRegistry) takeSessions() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reported := make(map[string][]string)
+	for id, st := range r.nodes {
+		if st.sessions != nil {
+			reported[id] = st.sessions
+			st.sessions = nil
+		}
+	}
+	return reported
+}
+
+func (r *NodeRegistry) expire() []string {
+	cutoff := time.Now().Add(-r.timeout)
+
+	var lost []store.SandboxNode
+	r.mu.Lock()
+	for _, st := range r.nodes {
+		if st.node.Static || st.node.Status == store.SatelliteStatusOffline || st.node.LastSeenAt.After(cutoff) {
+			continue
+		}
+		st.node.Status = store.SatelliteStatusOffline
+		lost = append(lost, st.node)
+	}
+	r.mu.Unlock()
+
+	ids := make([]string, 0, len(lost))
+	for i := range lost {
+		if err := r.store.PutSandboxNode(&lost[i]); err != nil {
+			log.WithError(err).WithField("node_id", lost[i].ID).Warn("failed to store sandbox node status")
+		}
+		ids = append(ids, lost[i].ID)
+	}
+	return ids
+}
@@ -0,0 +1,101 @@
+package session
+
+import (
+	"slices"
+	"sort"
+
+	"gimpel/internal/master/store"
+)
+
+const (
+	PlacementLeastLoaded = "least_loaded"
+	PlacementAffinity    = "affinity"
+)
+
+// placementRequest is what the scheduler knows about a session to place.
+type placementRequest struct {
+	image string
+	// load is the number of active sessions the master has on each node,
+	// which is newer than what the nodes last reported.
+	load map[string]int
+	// agentLoad is the same, counting only the requesting agent's sessions.
+	agentLoad map[string]int
+}
+
+type Scheduler struct {
+	strategy string
+}
+
+func NewScheduler(strategy string) *Scheduler {
+	return &Scheduler{strategy: strategy}
+}
+
+// rank orders nodes from best to worst for req and drops those that are
+// full or do not have the image. Static nodes do not report their images
+// and are kept, after the nodes known to have it. The caller tries them in
+// order, which is how failover works.
+func (s *Scheduler) rank(nodes []store.SandboxNode, req *placementRequest) []store.SandboxNode {
+	type candidate struct {
+		node        store.SandboxNode
+		affine      bool
+		hasImage    bool
+		warm        bool
+		utilization float64
+	}
+
+	candidates := make([]candidate, 0, len(nodes))
+	for _, node := range nodes {
+		active := max(node.Capacity.ActiveSessions, req.load[node.ID])
+		if node.Capacity.MaxSessions > 0 && active >= node.Capacity.MaxSessions {
+			continue
+		}
+		hasImage := slices.Contains(node.Images, req.image)
+		if req.image != "" && !hasImage && !node.Static {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			node:        node,
+			affine:      s.strategy == PlacementAffinity && req.agentLoad[node.ID] > 0,
+			hasImage:    hasImage,
+			warm:        hasWarm(node, req.image),
+			utilization: float64(active) / float64(max(node.Capacity.MaxSessions, 1)),
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.affine != b.affine {
+			return a.affine
+		}
+		if a.hasImage != b.hasImage {
+			return a.hasImage
+		}
+		if a.warm != b.warm {
+			return a.warm
+		}
+		if a.utilization != b.utilization {
+			return a.utilization < b.utilization
+		}
+		if a.node.Capacity.CPUUsage != b.node.Capacity.CPUUsage {
+			return a.node.Capacity.CPUUsage < b.node.Capacity.CPUUsage
+		}
+		return a.node.ID < b.node.ID
+	})
+
+	ranked := make([]store.SandboxNode, len(candidates))
+	for i, c := range candidates {
+		ranked[i] = c.node
+	}
+	return ranked
+}
+
+// hasWarm reports whether node had a paused environment of image ready at
+// its last heartbeat.
+func hasWarm(node store.SandboxNode, image string) bool {
+	for _, p := range node.Pools {
+		if p.Image == image && p.Ready > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package session
+
+import (
+	"testing"
+
+	"gimpel/internal/master/store"
+	"gimpel/pkg/nodeapi"
+)
+
+func testNodes() []store.SandboxNode {
+	return []store.SandboxNode{
+		{ID: "a", Capacity: nodeapi.Capacity{MaxSessions: 10, ActiveSessions: 5}},
+		{ID: "b", Capacity: nodeapi.Capacity{MaxSessions: 10, ActiveSessions: 1}},
+		{ID: "c", Capacity: nodeapi.Capacity{MaxSessions: 2, ActiveSessions: 2}},
+	}
+}
+
+func rankedIDs(nodes []store.SandboxNode) []string {
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.ID
+	}
+	return ids
+}
+
+func TestSchedulerLeastLoaded(t *testing.T) {
+	s := NewScheduler(PlacementLeastLoaded)
+
+	got := rankedIDs(s.rank(testNodes(), &placementRequest{}))
+	if len(got) != 2 || got[0] != "b" || got[1] != "a" {
+		t.Fatalf("rank = %v, want [b a]", got)
+	}
+
+	// Sessions the master placed since the last heartbeat count too.
+	got = rankedIDs(s.rank(testNodes(), &placementRequest{load: map[string]int{"b": 7}}))
+	if got[0] != "a" {
+		t.Fatalf("rank = %v, want a first", got)
+	}
+
+	// Affinity is ignored by least-loaded placement.
+	got = rankedIDs(s.rank(testNodes(), &placementRequest{agentLoad: map[string]int{"a": 1}}))
+	if got[0] != "b" {
+		t.Fatalf("rank = %v, want b first", got)
+	}
+}
+
+func TestSchedulerAffinity(t *testing.T) {
+	s := NewScheduler(PlacementAffinity)
+
+	got := rankedIDs(s.rank(testNodes(), &placementRequest{agentLoad: map[string]int{"a": 1}}))
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("rank = %v, want [a b]", got)
+	}
+
+	// A full node is skipped even if the agent is on it.
+	got = rankedIDs(s.rank(testNodes(), &placementRequest{agentLoad: map[string]int{"c": 2}}))
+	if got[0] != "b" {
+		t.Fatalf("rank = %v, want b first", got)
+	}
+}
+
+func TestSchedulerRequiresImage(t *testing.T) {
+	nodes := testNodes()
+	nodes[0].Images = []string{"router"}
+
+	got := rankedIDs(NewScheduler(PlacementLeastLoaded).rank(nodes, &placementRequest{image: "router"}))
+	if len(got) != 1 || got[0] != "a" {
+		t.Fatalf("rank = %v, want [a]", got)
+	}
+
+	// Static nodes do not report images and come after those that have it.
+	nodes[1].Static = true
+	got = rankedIDs(NewScheduler(PlacementLeastLoaded).rank(nodes, &placementRequest{image: "router"}))
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("rank = %v, want [a b]", got)
+	}
+}
+
+func TestSchedulerPrefersWarmPool(t *testing.T) {
+	nodes := testNodes()
+	nodes[0].Images = []string{"router"}
+	nodes[1].Images = []string{"router"}
+	nodes[0].Pools = []nodeapi.PoolStats{{Image: "router", Size: 2, Ready: 1}}
+	nodes[1].Pools = []nodeapi.PoolStats{{Image: "router", Size: 2}}
+
+	got := rankedIDs(NewScheduler(PlacementLeastLoaded).rank(nodes, &placementRequest{image: "router"}))
+	if got[0] != "a" {
+		t.Fatalf("rank = %v, want a first", got)
+	}
+}
@@ -2,16 +2,22 @@ package session
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	gimpelv1 "gimpel/api/go/v1"
 	"gimpel/internal/master/config"
+	"gimpel/internal/master/store"
 )
 
 type SessionState int
@@ -22,6 +28,25 @@ const (
 	SessionStateEnded
 )
 
+func (s SessionState) String() string {
+	switch s {
+	case SessionStatePending:
+		return "pending"
+	case SessionStateActive:
+		return "active"
+	default:
+		return "ended"
+	}
+}
+
+// Reasons a session ended.
+const (
+	EndReasonIdle        = "idle"
+	EndReasonMaxDuration = "max_duration"
+	EndReasonTerminated  = "terminated"
+	EndReasonNodeLost    = "node_lost"
+)
+
 type HISession struct {
 	ID              string
 	AgentID         string
@@ -30,117 +55,565 @@ type HISession struct {
 	SourcePort      uint32
 	SandboxNode     string
 	SandboxEndpoint string
+	Image           string
 	TunnelKey       []byte
-	State           SessionState
-	CreatedAt       time.Time
-	EndedAt         time.Time
+	// EscalatedBy is the module that handed a live connection over to the
+	// session, if it did not start on a high-interaction listener.
+	EscalatedBy string
+	State       SessionState
+	EndReason   string
+	// OpenTunnels counts agent tunnels that have not reported closing;
+	// Tunnels counts all that were opened.
+	OpenTunnels    int
+	Tunnels        int
+	CreatedAt      time.Time
+	LastActivityAt time.Time
+	EndedAt        time.Time
+}
+
+func (s *HISession) record() *store.HISession {
+	rec := &store.HISession{
+		ID:              s.ID,
+		AgentID:         s.AgentID,
+		ListenerID:      s.ListenerID,
+		SourceIP:        s.SourceIP,
+		SourcePort:      s.SourcePort,
+		SandboxNode:     s.SandboxNode,
+		SandboxEndpoint: s.SandboxEndpoint,
+		Image:           s.Image,
+		EscalatedBy:     s.EscalatedBy,
+		State:           s.State.String(),
+		EndReason:       s.EndReason,
+		OpenTunnels:     s.OpenTunnels,
+		Tunnels:         s.Tunnels,
+		CreatedAt:       s.CreatedAt,
+		LastActivityAt:  s.LastActivityAt,
+		EndedAt:         s.EndedAt,
+	}
+	// Ended sessions no longer need their key.
+	if s.State != SessionStateEnded {
+		rec.TunnelKey = s.TunnelKey
+	}
+	return rec
 }
 
+const (
+	reapInterval = 5 * time.Second
+	stopTimeout  = 30 * time.Second
+)
+
+var (
+	ErrNoNodes         = errors.New("no sandbox node available")
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// SessionManager places high-interaction sessions on sandbox nodes. While a
+// session is active every request from the same source IP is routed to it,
+// so an attacker who reconnects lands in the same environment. Sessions are
+// persisted and stopped on their node when they end.
 type SessionManager struct {
-	cfg *config.SandboxConfig
+	cfg       *config.SandboxConfig
+	store     *store.Store
+	nodes     *NodeRegistry
+	scheduler *Scheduler
+	tls       *tls.Config
 
 	mu       sync.RWMutex
 	sessions map[string]*HISession
-	nodeIdx  int
+	sticky   map[stickyKey]string
+	placing  map[stickyKey]chan struct{}
+	// creating holds the IDs of sessions being created, which nodes may
+	// report before they are tracked.
+	creating map[string]bool
+
+	connMu sync.Mutex
+	conns  map[string]*nodeConn
+}
+
+type nodeConn struct {
+	address string
+	conn    *grpc.ClientConn
+	client  gimpelv1.SandboxServiceClient
 }
 
-func NewSessionManager(cfg *config.SandboxConfig) *SessionManager {
-	return &SessionManager{
-		cfg:      cfg,
-		sessions: make(map[string]*HISession),
+// NewSessionManager returns a manager that dials registered nodes with
+// tlsCfg, verifying each node's certificate against its ID. Sessions that
+// were active when the master stopped are picked up again.
+func NewSessionManager(cfg *config.SandboxConfig, s *store.Store, nodes *NodeRegistry, tlsCfg *tls.Config) (*SessionManager, error) {
+	m := &SessionManager{
+		cfg:       cfg,
+		store:     s,
+		nodes:     nodes,
+		scheduler: NewScheduler(cfg.Placement),
+		tls:       tlsCfg,
+		sessions:  make(map[string]*HISession),
+		sticky:    make(map[stickyKey]string),
+		placing:   make(map[stickyKey]chan struct{}),
+		creating:  make(map[string]bool),
+		conns:     make(map[string]*nodeConn),
 	}
+
+	active, err := s.ListHISessions(SessionStateActive.String())
+	if err != nil {
+		return nil, fmt.Errorf("loading sessions: %w", err)
+	}
+	for _, rec := range active {
+		m.sessions[rec.ID] = &HISession{
+			ID:              rec.ID,
+			AgentID:         rec.AgentID,
+			ListenerID:      rec.ListenerID,
+			SourceIP:        rec.SourceIP,
+			SourcePort:      rec.SourcePort,
+			SandboxNode:     rec.SandboxNode,
+			SandboxEndpoint: rec.SandboxEndpoint,
+			Image:           rec.Image,
+			TunnelKey:       rec.TunnelKey,
+			EscalatedBy:     rec.EscalatedBy,
+			State:           SessionStateActive,
+			OpenTunnels:     rec.OpenTunnels,
+			Tunnels:         rec.Tunnels,
+			CreatedAt:       rec.CreatedAt,
+			LastActivityAt:  rec.LastActivityAt,
+		}
+		m.sticky[m.stickyKey(rec.SourceIP, rec.Image)] = rec.ID
+	}
+	if len(active) > 0 {
+		log.WithField("sessions", len(active)).Info("restored active HI sessions")
+	}
+
+	return m, nil
+}
+
+func (m *SessionManager) Nodes() *NodeRegistry {
+	return m.nodes
 }
 
-func (m *SessionManager) CreateSession(ctx context.Context, agentID, listenerID, sourceIP string, sourcePort uint32) (*HISession, error) {
-	if len(m.cfg.Nodes) == 0 {
-		return nil, fmt.Errorf("no sandbox nodes configured")
+// CreateSession places a session running image, or the configured default
+// image if it is empty.
+func (m *SessionManager) CreateSession(ctx context.Context, agentID, listenerID, sourceIP string, sourcePort uint32, escalatedBy, image string) (*HISession, error) {
+	key := m.stickyKey(sourceIP, image)
+	image = key.image
+	session, done, err := m.claimSticky(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if session != nil {
+		log.WithFields(log.Fields{
+			"session_id": session.ID,
+			"source_ip":  sourceIP,
+			"image":      image,
+		}).Debug("routing source to its existing HI session")
+		return session, nil
 	}
+	defer done()
 
 	sessionID := fmt.Sprintf("hi-%s-%d", agentID, time.Now().UnixNano())
+	m.mu.Lock()
+	m.creating[sessionID] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.creating, sessionID)
+		m.mu.Unlock()
+	}()
 
-	node := m.selectNode()
+	req := &placementRequest{image: image}
+	req.load, req.agentLoad = m.nodeLoad(agentID)
+	candidates := m.scheduler.rank(m.nodes.available(), req)
+	if len(candidates) == 0 {
+		return nil, ErrNoNodes
+	}
 
-	conn, err := grpc.NewClient(node, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, fmt.Errorf("dialing sandbox node %s: %w", node, err)
+	var lastErr error
+	for _, node := range candidates {
+		resp, err := m.createOn(ctx, node, sessionID, image)
+		if err != nil {
+			lastErr = err
+			if status.Code(err) != codes.ResourceExhausted {
+				m.nodes.markFailed(node.ID)
+				m.dropConn(node.ID)
+			}
+			log.WithError(err).WithField("sandbox_node", node.ID).Warn("sandbox node failed to create session")
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		m.nodes.markHealthy(node.ID)
+
+		now := time.Now()
+		session := &HISession{
+			ID:              sessionID,
+			AgentID:         agentID,
+			ListenerID:      listenerID,
+			SourceIP:        sourceIP,
+			SourcePort:      sourcePort,
+			SandboxNode:     node.ID,
+			SandboxEndpoint: resp.Endpoint,
+			Image:           image,
+			TunnelKey:       resp.TunnelKey,
+			EscalatedBy:     escalatedBy,
+			State:           SessionStateActive,
+			OpenTunnels:     1,
+			Tunnels:         1,
+			CreatedAt:       now,
+			LastActivityAt:  now,
+		}
+
+		m.mu.Lock()
+		m.sessions[sessionID] = session
+		m.sticky[key] = sessionID
+		m.persist(session)
+		m.mu.Unlock()
+
+		log.WithFields(log.Fields{
+			"session_id":   sessionID,
+			"agent_id":     agentID,
+			"sandbox_node": node.ID,
+			"image":        image,
+			"escalated_by": escalatedBy,
+		}).Info("HI session created")
+
+		return session, nil
 	}
-	defer conn.Close()
 
-	client := gimpelv1.NewSandboxServiceClient(conn)
+	return nil, fmt.Errorf("creating session: %w", lastErr)
+}
 
-	req := &gimpelv1.CreateSessionRequest{
+func (m *SessionManager) createOn(ctx context.Context, node store.SandboxNode, sessionID, image string) (*gimpelv1.CreateSessionResponse, error) {
+	client, err := m.client(node)
+	if err != nil {
+		return nil, err
+	}
+	return client.CreateSession(ctx, &gimpelv1.CreateSessionRequest{
 		SessionId: sessionID,
-		Image:     "default-honeypot",
-		Env:       map[string]string{"AGENT_ID": agentID},
+		Image:     image,
+	})
+}
+
+// client returns a connection to node, reused across sessions until the
+// node moves or fails.
+func (m *SessionManager) client(node store.SandboxNode) (gimpelv1.SandboxServiceClient, error) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	if nc, ok := m.conns[node.ID]; ok {
+		if nc.address == node.Address {
+			return nc.client, nil
+		}
+		nc.conn.Close()
+		delete(m.conns, node.ID)
 	}
 
-	resp, err := client.CreateSession(ctx, req)
+	creds := insecure.NewCredentials()
+	if !node.Static {
+		tlsCfg := m.tls.Clone()
+		tlsCfg.ServerName = node.ID
+		creds = credentials.NewTLS(tlsCfg)
+	}
+	conn, err := grpc.NewClient(node.Address, grpc.WithTransportCredentials(creds))
 	if err != nil {
-		return nil, fmt.Errorf("creating session on sandbox %s: %w", node, err)
+		return nil, fmt.Errorf("dialing sandbox node %s: %w", node.ID, err)
 	}
 
-	session := &HISession{
-		ID:              sessionID,
-		AgentID:         agentID,
-		ListenerID:      listenerID,
-		SourceIP:        sourceIP,
-		SourcePort:      sourcePort,
-		SandboxNode:     node,
-		SandboxEndpoint: resp.Endpoint,
-		TunnelKey:       resp.TunnelKey,
-		State:           SessionStateActive,
-		CreatedAt:       time.Now(),
+	nc := &nodeConn{
+		address: node.Address,
+		conn:    conn,
+		client:  gimpelv1.NewSandboxServiceClient(conn),
 	}
+	m.conns[node.ID] = nc
+	return nc.client, nil
+}
 
-	m.mu.Lock()
-	m.sessions[sessionID] = session
-	m.mu.Unlock()
+func (m *SessionManager) dropConn(nodeID string) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	if nc, ok := m.conns[nodeID]; ok {
+		nc.conn.Close()
+		delete(m.conns, nodeID)
+	}
+}
 
-	log.WithFields(log.Fields{
-		"session_id":   sessionID,
-		"agent_id":     agentID,
-		"sandbox_node": node,
-	}).Info("HI session created")
+// stickyKey identifies the session a source is routed to: an attacker
+// keeps one environment per image, whichever listener they come through.
+type stickyKey struct {
+	sourceIP string
+	image    string
+}
 
-	return session, nil
+func (m *SessionManager) stickyKey(sourceIP, image string) stickyKey {
+	if image == "" {
+		image = m.cfg.DefaultImage
+	}
+	return stickyKey{sourceIP: sourceIP, image: image}
 }
 
-func (m *SessionManager) GetSession(sessionID string) (*HISession, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	session, ok := m.sessions[sessionID]
-	return session, ok
+// claimSticky returns the active session of key, counting a new tunnel to
+// it. If there is none it reserves key for the caller to place one and
+// returns done to release it; callers for the same key wait meanwhile, so
+// concurrent connections from a source share one session.
+func (m *SessionManager) claimSticky(ctx context.Context, key stickyKey) (*HISession, func(), error) {
+	for {
+		m.mu.Lock()
+		if session := m.stickySession(key); session != nil {
+			m.mu.Unlock()
+			return session, nil, nil
+		}
+		wait, ok := m.placing[key]
+		if !ok {
+			placed := make(chan struct{})
+			m.placing[key] = placed
+			m.mu.Unlock()
+			return nil, func() {
+				m.mu.Lock()
+				delete(m.placing, key)
+				m.mu.Unlock()
+				close(placed)
+			}, nil
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// stickySession returns the active session of key, counting a new tunnel
+// to it, if its node is still usable. m.mu must be held.
+func (m *SessionManager) stickySession(key stickyKey) *HISession {
+	id, ok := m.sticky[key]
+	if !ok {
+		return nil
+	}
+	session := m.sessions[id]
+	if session == nil || !m.nodes.Usable(session.SandboxNode) {
+		delete(m.sticky, key)
+		return nil
+	}
+	session.OpenTunnels++
+	session.Tunnels++
+	session.LastActivityAt = time.Now()
+	m.persist(session)
+	return session
 }
 
-func (m *SessionManager) EndSession(sessionID string) {
+// TunnelClosed records that an agent tunnel into the session closed.
+func (m *SessionManager) TunnelClosed(sessionID string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if session, ok := m.sessions[sessionID]; ok {
-		session.State = SessionStateEnded
-		session.EndedAt = time.Now()
-		log.WithField("session_id", sessionID).Info("HI session ended")
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if session.OpenTunnels > 0 {
+		session.OpenTunnels--
 	}
+	session.LastActivityAt = time.Now()
+	m.persist(session)
+	return nil
 }
 
-func (m *SessionManager) ListActiveSessions() []*HISession {
+// nodeLoad counts active sessions per node, overall and for agentID.
+func (m *SessionManager) nodeLoad(agentID string) (load, agentLoad map[string]int) {
+	load = make(map[string]int)
+	agentLoad = make(map[string]int)
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	for _, session := range m.sessions {
+		load[session.SandboxNode]++
+		if session.AgentID == agentID {
+			agentLoad[session.SandboxNode]++
+		}
+	}
+	return load, agentLoad
+}
+
+// Run marks nodes that stop sending heartbeats as offline, ending their
+// sessions so their sources are placed elsewhere, and stops sessions that
+// ran too long or went idle, or that nodes report but the master no longer
+// tracks.
+func (m *SessionManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, id := range m.nodes.expire() {
+				m.failover(id)
+			}
+			m.reap(ctx, time.Now())
+			m.stopOrphans(ctx)
+		}
+	}
+}
+
+func (m *SessionManager) reap(ctx context.Context, now time.Time) {
+	var expired []*HISession
+	var reasons []string
 
-	active := make([]*HISession, 0)
+	m.mu.Lock()
 	for _, session := range m.sessions {
-		if session.State != SessionStateEnded {
-			active = append(active, session)
+		var reason string
+		switch {
+		case now.Sub(session.CreatedAt) >= m.cfg.MaxSessionDuration:
+			reason = EndReasonMaxDuration
+		case session.OpenTunnels == 0 && now.Sub(session.LastActivityAt) >= m.cfg.IdleTimeout:
+			reason = EndReasonIdle
+		default:
+			continue
 		}
+		m.end(session, reason)
+		expired = append(expired, session)
+		reasons = append(reasons, reason)
+	}
+	m.mu.Unlock()
+
+	for i, session := range expired {
+		log.WithFields(log.Fields{
+			"session_id": session.ID,
+			"reason":     reasons[i],
+		}).Info("HI session expired")
+		m.stopOnNode(ctx, session.SandboxNode, session.ID)
 	}
-	return active
 }
 
-func (m *SessionManager) selectNode() string {
+// stopOrphans stops the sessions nodes reported running that the master
+// has ended, such as those of a node that came back after being lost.
+func (m *SessionManager) stopOrphans(ctx context.Context) {
+	for nodeID, sessions := range m.nodes.takeSessions() {
+		for _, id := range sessions {
+			m.mu.RLock()
+			_, tracked := m.sessions[id]
+			tracked = tracked || m.creating[id]
+			m.mu.RUnlock()
+			if tracked {
+				continue
+			}
+			log.WithFields(log.Fields{
+				"session_id":   id,
+				"sandbox_node": nodeID,
+			}).Info("stopping untracked HI session")
+			m.stopOnNode(ctx, nodeID, id)
+		}
+	}
+}
+
+func (m *SessionManager) failover(nodeID string) {
+	m.dropConn(nodeID)
+
+	ended := 0
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	for _, session := range m.sessions {
+		if session.SandboxNode == nodeID {
+			m.end(session, EndReasonNodeLost)
+			ended++
+		}
+	}
+	m.mu.Unlock()
 
-	node := m.cfg.Nodes[m.nodeIdx%len(m.cfg.Nodes)]
-	m.nodeIdx++
-	return node
+	log.WithFields(log.Fields{
+		"node_id":        nodeID,
+		"sessions_ended": ended,
+	}).Warn("sandbox node lost")
+}
+
+// EndSession ends a session and stops it on its sandbox node.
+func (m *SessionManager) EndSession(ctx context.Context, sessionID, reason string) error {
+	m.mu.Lock()
+	session, ok := m.sessions[sessionID]
+	if ok {
+		m.end(session, reason)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	log.WithFields(log.Fields{
+		"session_id": sessionID,
+		"reason":     reason,
+	}).Info("HI session ended")
+	return m.stopOnNode(ctx, session.SandboxNode, session.ID)
+}
+
+// end marks session ended and forgets it. m.mu must be held.
+func (m *SessionManager) end(session *HISession, reason string) {
+	session.State = SessionStateEnded
+	session.EndReason = reason
+	session.EndedAt = time.Now()
+	delete(m.sessions, session.ID)
+	if key := m.stickyKey(session.SourceIP, session.Image); m.sticky[key] == session.ID {
+		delete(m.sticky, key)
+	}
+	m.persist(session)
+}
+
+func (m *SessionManager) stopOnNode(ctx context.Context, nodeID, sessionID string) error {
+	node, ok := m.nodes.Get(nodeID)
+	if !ok {
+		return nil
+	}
+	client, err := m.client(node)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, stopTimeout)
+	defer cancel()
+	if _, err := client.StopSession(ctx, &gimpelv1.StopSessionRequest{SessionId: sessionID}); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"session_id":   sessionID,
+			"sandbox_node": node.ID,
+		}).Warn("failed to stop session on sandbox")
+		return fmt.Errorf("stopping session on %s: %w", node.ID, err)
+	}
+	return nil
+}
+
+// persist stores session. m.mu must be held so updates are written in order.
+func (m *SessionManager) persist(session *HISession) {
+	if err := m.store.PutHISession(session.record()); err != nil {
+		log.WithError(err).WithField("session_id", session.ID).Warn("failed to store session")
+	}
+}
+
+// Close releases the connections to sandbox nodes.
+func (m *SessionManager) Close() {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	for id, nc := range m.conns {
+		nc.conn.Close()
+		delete(m.conns, id)
+	}
+}
+
+func (m *SessionManager) GetSession(sessionID string) (*HISession, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, false
+	}
+	s := *session
+	return &s, true
+}
+
+func (m *SessionManager) ListActiveSessions() []*HISession {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	active := make([]*HISession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		s := *session
+		active = append(active, &s)
+	}
+	return active
 }
@@ -0,0 +1,247 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	gimpelv1 "gimpel/api/go/v1"
+	"gimpel/internal/master/config"
+	"gimpel/internal/master/store"
+)
+
+type fakeSandbox struct {
+	gimpelv1.UnimplementedSandboxServiceServer
+
+	mu      sync.Mutex
+	created []string
+	stopped []string
+	delay   time.Duration
+}
+
+func (f *fakeSandbox) CreateSession(ctx context.Context, req *gimpelv1.CreateSessionRequest) (*gimpelv1.CreateSessionResponse, error) {
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created = append(f.created, req.SessionId)
+	return &gimpelv1.CreateSessionResponse{Endpoint: "127.0.0.1:6000", TunnelKey: make([]byte, 32)}, nil
+}
+
+func (f *fakeSandbox) StopSession(ctx context.Context, req *gimpelv1.StopSessionRequest) (*gimpelv1.StopSessionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = append(f.stopped, req.SessionId)
+	return &gimpelv1.StopSessionResponse{Success: true}, nil
+}
+
+func (f *fakeSandbox) stoppedIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.stopped...)
+}
+
+func testManager(t *testing.T) (*SessionManager, *fakeSandbox, *store.Store) {
+	t.Helper()
+
+	fake := &fakeSandbox{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	gimpelv1.RegisterSandboxServiceServer(srv, fake)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	dir := t.TempDir()
+	s, err := store.New(&store.Config{DBPath: filepath.Join(dir, "master.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	cfg := &config.SandboxConfig{
+		Nodes:              []string{ln.Addr().String()},
+		HeartbeatTimeout:   30 * time.Second,
+		Placement:          PlacementLeastLoaded,
+		DefaultImage:       "default-honeypot",
+		MaxSessionDuration: time.Hour,
+		IdleTimeout:        time.Minute,
+	}
+	nodes, err := NewNodeRegistry(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewSessionManager(cfg, s, nodes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m, fake, s
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	m, fake, s := testManager(t)
+	ctx := context.Background()
+
+	first, err := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.7", 40000, "", "")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	second, err := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.7", 40001, "", "")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if second.ID != first.ID {
+		t.Fatalf("same source got session %s, want %s", second.ID, first.ID)
+	}
+	if len(fake.created) != 1 {
+		t.Fatalf("sandbox created %d sessions, want 1", len(fake.created))
+	}
+
+	// One tunnel is still open, so the session is not idle.
+	if err := m.TunnelClosed(first.ID); err != nil {
+		t.Fatalf("TunnelClosed: %v", err)
+	}
+	m.reap(ctx, time.Now().Add(2*time.Minute))
+	if len(fake.stoppedIDs()) != 0 {
+		t.Fatal("session with an open tunnel was stopped")
+	}
+
+	m.TunnelClosed(first.ID)
+	m.reap(ctx, time.Now().Add(2*time.Minute))
+	if got := fake.stoppedIDs(); len(got) != 1 || got[0] != first.ID {
+		t.Fatalf("stopped = %v, want [%s]", got, first.ID)
+	}
+
+	rec, err := s.GetHISession(first.ID)
+	if err != nil || rec == nil {
+		t.Fatalf("GetHISession: %v", err)
+	}
+	if rec.State != "ended" || rec.EndReason != EndReasonIdle || rec.Tunnels != 2 {
+		t.Errorf("record = %s/%s with %d tunnels, want ended/idle with 2", rec.State, rec.EndReason, rec.Tunnels)
+	}
+	if rec.TunnelKey != nil {
+		t.Error("ended session kept its tunnel key")
+	}
+
+	// The source gets a fresh session now.
+	third, err := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.7", 40002, "", "")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if third.ID == first.ID {
+		t.Error("ended session was reused")
+	}
+}
+
+func TestStickySessionPerImage(t *testing.T) {
+	m, fake, _ := testManager(t)
+	fake.delay = 50 * time.Millisecond
+	ctx := context.Background()
+
+	// Concurrent connections from one source share a session.
+	var wg sync.WaitGroup
+	ids := make([]string, 4)
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess, err := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.7", uint32(40000+i), "", "")
+			if err != nil {
+				t.Errorf("CreateSession: %v", err)
+				return
+			}
+			ids[i] = sess.ID
+		}()
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("concurrent connections got sessions %v, want one", ids)
+		}
+	}
+
+	// Another listener's image gets its own environment.
+	web, err := m.CreateSession(ctx, "agent-1", "http", "203.0.113.7", 40010, "", "ubuntu-22-web")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if web.ID == ids[0] || web.Image != "ubuntu-22-web" {
+		t.Errorf("web listener got session %s running %s", web.ID, web.Image)
+	}
+	if def, _ := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.7", 40011, "", "default-honeypot"); def.ID != ids[0] {
+		t.Errorf("default image named explicitly got session %s, want %s", def.ID, ids[0])
+	}
+}
+
+func TestSessionMaxDuration(t *testing.T) {
+	m, fake, _ := testManager(t)
+	ctx := context.Background()
+
+	sess, err := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.7", 40000, "", "")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	m.reap(ctx, time.Now().Add(2*time.Hour))
+	if got := fake.stoppedIDs(); len(got) != 1 || got[0] != sess.ID {
+		t.Fatalf("stopped = %v, want [%s]", got, sess.ID)
+	}
+}
+
+func TestSessionEndAndRestore(t *testing.T) {
+	m, fake, s := testManager(t)
+	ctx := context.Background()
+
+	kept, _ := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.7", 40000, "", "")
+	killed, _ := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.8", 40000, "", "")
+
+	if err := m.EndSession(ctx, killed.ID, EndReasonTerminated); err != nil {
+		t.Fatalf("EndSession: %v", err)
+	}
+	if got := fake.stoppedIDs(); len(got) != 1 || got[0] != killed.ID {
+		t.Fatalf("stopped = %v, want [%s]", got, killed.ID)
+	}
+	if err := m.EndSession(ctx, killed.ID, EndReasonTerminated); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("ending twice: err = %v, want ErrSessionNotFound", err)
+	}
+
+	restored, err := NewSessionManager(m.cfg, s, m.nodes, nil)
+	if err != nil {
+		t.Fatalf("NewSessionManager: %v", err)
+	}
+	active := restored.ListActiveSessions()
+	if len(active) != 1 || active[0].ID != kept.ID {
+		t.Fatalf("restored %d sessions, want only %s", len(active), kept.ID)
+	}
+}
+
+func TestStopOrphanedSessions(t *testing.T) {
+	m, fake, _ := testManager(t)
+	ctx := context.Background()
+
+	kept, err := m.CreateSession(ctx, "agent-1", "ssh", "203.0.113.7", 40000, "", "")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	// The node reports a session the master ended while it was lost.
+	m.nodes.mu.Lock()
+	m.nodes.nodes[kept.SandboxNode].sessions = []string{kept.ID, "hi-agent-1-1"}
+	m.nodes.mu.Unlock()
+
+	m.stopOrphans(ctx)
+	if got := fake.stoppedIDs(); len(got) != 1 || got[0] != "hi-agent-1-1" {
+		t.Fatalf("stopped = %v, want [hi-agent-1-1]", got)
+	}
+	m.stopOrphans(ctx)
+	if got := fake.stoppedIDs(); len(got) != 1 {
+		t.Errorf("stopped = %v after the report was handled", got)
+	}
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/pkg/artifact"
+	"gimpel/pkg/storage"
+)
+
+var (
+	ErrArtifactTooLarge = errors.New("artifact exceeds size limit")
+	ErrInvalidArtifact  = errors.New("invalid artifact")
+)
+
+// StoreArtifact stores a collected file under its SHA-256, which the
+// content must match. Uploading a file that is already stored only reads
+// the body.
+func (s *Store) StoreArtifact(sha256, node string, reader io.Reader, maxBytes int64) (*Artifact, error) {
+	if !artifact.ValidSHA256(sha256) {
+		return nil, fmt.Errorf("%w: bad sha256 %q", ErrInvalidArtifact, sha256)
+	}
+	existing, err := s.GetArtifact(sha256)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		io.Copy(io.Discard, io.LimitReader(reader, maxBytes))
+		return existing, nil
+	}
+
+	dir := filepath.Join(s.artifactDir, sha256[:2])
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("creating artifact directory: %w", err)
+	}
+	path := filepath.Join(dir, sha256)
+
+	file, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp file: %w", err)
+	}
+	tmpPath := file.Name()
+	digests, fileType, err := artifact.Copy(file, io.LimitReader(reader, maxBytes+1))
+	file.Close()
+	switch {
+	case err != nil:
+		err = fmt.Errorf("writing artifact: %w", err)
+	case digests.Size > maxBytes:
+		err = ErrArtifactTooLarge
+	case digests.SHA256 != sha256:
+		err = fmt.Errorf("%w: content hashes to %s", ErrInvalidArtifact, digests.SHA256)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("renaming artifact file: %w", err)
+	}
+	a := &Artifact{
+		Digests:     digests,
+		FileType:    fileType,
+		SandboxNode: node,
+		Path:        path,
+		StoredAt:    time.Now(),
+	}
+	if err := s.db.PutJSON(BucketArtifacts, sha256, a); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("storing artifact metadata: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"sha256": sha256,
+		"type":   fileType,
+		"size":   digests.Size,
+		"node":   node,
+	}).Info("artifact stored")
+
+	return a, nil
+}
+
+func (s *Store) GetArtifact(sha256 string) (*Artifact, error) {
+	var a Artifact
+	if err := s.db.GetJSON(BucketArtifacts, sha256, &a); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *Store) OpenArtifact(sha256 string) (*os.File, *Artifact, error) {
+	a, err := s.GetArtifact(sha256)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a == nil {
+		return nil, nil, storage.ErrNotFound
+	}
+
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening artifact file: %w", err)
+	}
+	return file, a, nil
+}
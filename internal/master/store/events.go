@@ -0,0 +1,72 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"gimpel/pkg/nodeapi"
+)
+
+// PutSessionEvents stores telemetry a sandbox node reported for sessions
+// placed on it.
+func (s *Store) PutSessionEvents(node string, events []nodeapi.Event) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BucketEvents))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", BucketEvents)
+		}
+		for _, ev := range events {
+			id := make([]byte, 8)
+			if _, err := rand.Read(id); err != nil {
+				return err
+			}
+			if ev.Time.IsZero() {
+				ev.Time = time.Now()
+			}
+			se := SessionEvent{ID: hex.EncodeToString(id), SandboxNode: node, Event: ev}
+			data, err := json.Marshal(&se)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(SessionEventKey(ev.SessionID, ev.Time, se.ID)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListSessionEvents returns a session's events of type typ, or of every
+// type if typ is empty, oldest first. A limit of zero returns them all.
+func (s *Store) ListSessionEvents(sessionID, typ string, limit int) ([]*SessionEvent, error) {
+	var events []*SessionEvent
+	prefix := []byte(sessionID + ":")
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BucketEvents))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", BucketEvents)
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var ev SessionEvent
+			if err := unmarshalJSON(v, &ev); err != nil {
+				return err
+			}
+			if typ != "" && ev.Type != typ {
+				continue
+			}
+			events = append(events, &ev)
+			if limit > 0 && len(events) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return events, err
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/pkg/asciicast"
+	"gimpel/pkg/storage"
+)
+
+var (
+	ErrRecordingTooLarge = errors.New("recording exceeds size limit")
+	ErrInvalidRecording  = errors.New("invalid recording")
+)
+
+// StoreRecording validates an asciicast recording and stores it, replacing
+// an earlier upload with the same name. Names are tunnel numbers.
+func (s *Store) StoreRecording(sessionID, name, node string, reader io.Reader, maxBytes int64) (*Recording, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil || !validPathComponent(sessionID) {
+		return nil, fmt.Errorf("%w: bad name %q for session %q", ErrInvalidRecording, name, sessionID)
+	}
+
+	dir := filepath.Join(s.recordingDir, sessionID)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("creating recording directory: %w", err)
+	}
+	path := filepath.Join(dir, name+".cast")
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("creating temp file: %w", err)
+	}
+	size, err := io.Copy(file, io.LimitReader(reader, maxBytes+1))
+	file.Close()
+	if err == nil && size > maxBytes {
+		err = ErrRecordingTooLarge
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("writing recording: %w", err)
+	}
+
+	rec := &Recording{
+		SessionID:   sessionID,
+		Name:        name,
+		SandboxNode: node,
+		Path:        path,
+		SizeBytes:   size,
+		StoredAt:    time.Now(),
+	}
+	if err := summarizeRecording(tmpPath, rec); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecording, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("renaming recording file: %w", err)
+	}
+	if err := s.db.PutJSON(BucketRecordings, RecordingKey(sessionID, name), rec); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("storing recording metadata: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"session_id": sessionID,
+		"recording":  name,
+		"duration":   rec.Duration,
+		"size":       size,
+	}).Info("recording stored")
+
+	return rec, nil
+}
+
+func summarizeRecording(path string, rec *Recording) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := asciicast.NewReader(f)
+	if err != nil {
+		return err
+	}
+	rec.Width, rec.Height = r.Header.Width, r.Header.Height
+	rec.StartedAt = time.Unix(r.Header.Timestamp, 0)
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec.Events++
+		rec.Duration = ev.Time
+	}
+}
+
+func (s *Store) GetRecording(sessionID, name string) (*Recording, error) {
+	var rec Recording
+	if err := s.db.GetJSON(BucketRecordings, RecordingKey(sessionID, name), &rec); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// ListRecordings returns a session's recordings in tunnel order.
+func (s *Store) ListRecordings(sessionID string) ([]*Recording, error) {
+	var recordings []*Recording
+	err := s.db.ForEach(BucketRecordings, func(_, value []byte) error {
+		var rec Recording
+		if err := unmarshalJSON(value, &rec); err != nil {
+			return err
+		}
+		if rec.SessionID == sessionID {
+			recordings = append(recordings, &rec)
+		}
+		return nil
+	})
+	sort.Slice(recordings, func(i, j int) bool {
+		a, _ := strconv.Atoi(recordings[i].Name)
+		b, _ := strconv.Atoi(recordings[j].Name)
+		return a < b
+	})
+	return recordings, err
+}
+
+func (s *Store) OpenRecording(sessionID, name string) (*os.File, *Recording, error) {
+	rec, err := s.GetRecording(sessionID, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec == nil {
+		return nil, nil, storage.ErrNotFound
+	}
+
+	file, err := os.Open(rec.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening recording file: %w", err)
+	}
+	return file, rec, nil
+}
+
+func validPathComponent(s string) bool {
+	return s != "" && s != "." && s != ".." && filepath.Base(s) == s
+}
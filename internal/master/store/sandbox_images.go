@@ -0,0 +1,165 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/pkg/signing"
+	"gimpel/pkg/storage"
+)
+
+var ErrInvalidSandboxImage = errors.New("invalid sandbox image")
+
+var sandboxImageName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// StoreSandboxImage stores an image archive with its signed manifest,
+// replacing an earlier upload of the same version. The signature is
+// checked by the nodes; the master only makes sure the manifest describes
+// this archive.
+func (s *Store) StoreSandboxImage(img *SandboxImage, reader io.Reader) error {
+	if !sandboxImageName.MatchString(img.Name) || !sandboxImageName.MatchString(img.Version) {
+		return fmt.Errorf("%w: bad name %q or version %q", ErrInvalidSandboxImage, img.Name, img.Version)
+	}
+	manifest, err := signing.ParseSandboxImageManifest(img.Manifest)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSandboxImage, err)
+	}
+	if manifest.Name != img.Name || manifest.Version != img.Version {
+		return fmt.Errorf("%w: manifest is for %s:%s", ErrInvalidSandboxImage, manifest.Name, manifest.Version)
+	}
+
+	dir := filepath.Join(s.imageDir, "sandbox")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating image directory: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s_%s.tar", img.Name, img.Version))
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), reader)
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("writing image: %w", err)
+	}
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if digest != manifest.PayloadSha256 {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%w: archive is %s, manifest says %s", ErrInvalidSandboxImage, digest, manifest.PayloadSha256)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("renaming image file: %w", err)
+	}
+
+	img.Digest = digest
+	img.Port = manifest.Port
+	img.SizeBytes = size
+	img.Path = path
+	img.CreatedAt = time.Now()
+	if err := s.db.PutJSON(BucketSandboxImages, ModuleKey(img.Name, img.Version), img); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("storing image metadata: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"image":   img.Name,
+		"version": img.Version,
+		"digest":  digest,
+		"size":    size,
+	}).Info("sandbox image stored")
+
+	return nil
+}
+
+func (s *Store) GetSandboxImage(name, version string) (*SandboxImage, error) {
+	var img SandboxImage
+	if err := s.db.GetJSON(BucketSandboxImages, ModuleKey(name, version), &img); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &img, nil
+}
+
+// ListSandboxImages returns every stored version, by name and upload time.
+func (s *Store) ListSandboxImages() ([]*SandboxImage, error) {
+	var images []*SandboxImage
+	err := s.db.ForEach(BucketSandboxImages, func(_, value []byte) error {
+		var img SandboxImage
+		if err := unmarshalJSON(value, &img); err != nil {
+			return err
+		}
+		images = append(images, &img)
+		return nil
+	})
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Name != images[j].Name {
+			return images[i].Name < images[j].Name
+		}
+		return images[i].CreatedAt.Before(images[j].CreatedAt)
+	})
+	return images, err
+}
+
+// LatestSandboxImages returns the most recently uploaded version of each
+// image, which is what nodes install.
+func (s *Store) LatestSandboxImages() ([]*SandboxImage, error) {
+	images, err := s.ListSandboxImages()
+	if err != nil {
+		return nil, err
+	}
+	var latest []*SandboxImage
+	for i, img := range images {
+		if i+1 == len(images) || images[i+1].Name != img.Name {
+			latest = append(latest, img)
+		}
+	}
+	return latest, nil
+}
+
+func (s *Store) OpenSandboxImage(name, version string) (*os.File, *SandboxImage, error) {
+	img, err := s.GetSandboxImage(name, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if img == nil {
+		return nil, nil, storage.ErrNotFound
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening image file: %w", err)
+	}
+	return file, img, nil
+}
+
+func (s *Store) DeleteSandboxImage(name, version string) error {
+	img, err := s.GetSandboxImage(name, version)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return storage.ErrNotFound
+	}
+	if img.Path != "" {
+		os.Remove(img.Path)
+	}
+	return s.db.Delete(BucketSandboxImages, ModuleKey(name, version))
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"time"
+
+	"gimpel/pkg/storage"
+)
+
+func (s *Store) PutSandboxNode(node *SandboxNode) error {
+	if node.RegisteredAt.IsZero() {
+		node.RegisteredAt = time.Now()
+	}
+	return s.db.PutJSON(BucketSandboxNodes, node.ID, node)
+}
+
+func (s *Store) GetSandboxNode(id string) (*SandboxNode, error) {
+	var node SandboxNode
+	if err := s.db.GetJSON(BucketSandboxNodes, id, &node); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (s *Store) ListSandboxNodes() ([]*SandboxNode, error) {
+	var nodes []*SandboxNode
+	err := s.db.ForEach(BucketSandboxNodes, func(_, value []byte) error {
+		var node SandboxNode
+		if err := unmarshalJSON(value, &node); err != nil {
+			return err
+		}
+		nodes = append(nodes, &node)
+		return nil
+	})
+	return nodes, err
+}
+
+func (s *Store) DeleteSandboxNode(id string) error {
+	return s.db.Delete(BucketSandboxNodes, id)
+}
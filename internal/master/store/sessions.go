@@ -0,0 +1,40 @@
+package store
+
+import (
+	"sort"
+
+	"gimpel/pkg/storage"
+)
+
+func (s *Store) PutHISession(session *HISession) error {
+	return s.db.PutJSON(BucketSessions, session.ID, session)
+}
+
+func (s *Store) GetHISession(id string) (*HISession, error) {
+	var session HISession
+	if err := s.db.GetJSON(BucketSessions, id, &session); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ListHISessions returns sessions in state, or all of them if state is
+// empty, newest first.
+func (s *Store) ListHISessions(state string) ([]*HISession, error) {
+	var sessions []*HISession
+	err := s.db.ForEach(BucketSessions, func(_, value []byte) error {
+		var session HISession
+		if err := unmarshalJSON(value, &session); err != nil {
+			return err
+		}
+		if state == "" || session.State == state {
+			sessions = append(sessions, &session)
+		}
+		return nil
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions, err
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"time"
 
+	"gimpel/pkg/artifact"
+	"gimpel/pkg/nodeapi"
 	"gimpel/pkg/storage"
 
 	log "github.com/sirupsen/logrus"
@@ -19,16 +21,24 @@ const (
 	BucketSettings      = "settings"
 	BucketPairings      = "pairings"
 	BucketPairingTokens = "pairing_tokens"
+	BucketSandboxNodes  = "sandbox_nodes"
+	BucketRecordings    = "recordings"
+	BucketArtifacts     = "artifacts"
+	BucketSandboxImages = "sandbox_images"
 )
 
 type Store struct {
-	db       *storage.DB
-	imageDir string
+	db           *storage.DB
+	imageDir     string
+	recordingDir string
+	artifactDir  string
 }
 
 type Config struct {
-	DBPath   string
-	ImageDir string
+	DBPath       string
+	ImageDir     string
+	RecordingDir string
+	ArtifactDir  string
 }
 
 func New(cfg *Config) (*Store, error) {
@@ -43,6 +53,10 @@ func New(cfg *Config) (*Store, error) {
 		BucketSettings,
 		BucketPairings,
 		BucketPairingTokens,
+		BucketSandboxNodes,
+		BucketRecordings,
+		BucketArtifacts,
+		BucketSandboxImages,
 	}
 
 	db, err := storage.Open(opts)
@@ -53,8 +67,10 @@ func New(cfg *Config) (*Store, error) {
 	log.WithField("path", cfg.DBPath).Info("master store opened")
 
 	return &Store{
-		db:       db,
-		imageDir: cfg.ImageDir,
+		db:           db,
+		imageDir:     cfg.ImageDir,
+		recordingDir: cfg.RecordingDir,
+		artifactDir:  cfg.ArtifactDir,
 	}, nil
 }
 
@@ -89,6 +105,73 @@ const (
 	SatelliteStatusPending     SatelliteStatus = "pending"
 )
 
+type SandboxNode struct {
+	ID           string              `json:"id"`
+	Hostname     string              `json:"hostname"`
+	Address      string              `json:"address"`
+	Labels       map[string]string   `json:"labels"`
+	Images       []string            `json:"images"`
+	Capacity     nodeapi.Capacity    `json:"capacity"`
+	Pools        []nodeapi.PoolStats `json:"pools,omitempty"`
+	Static       bool                `json:"static,omitempty"`
+	Status       SatelliteStatus     `json:"status"`
+	RegisteredAt time.Time           `json:"registered_at"`
+	LastSeenAt   time.Time           `json:"last_seen_at"`
+}
+
+// HISession is a high-interaction session placed on a sandbox node.
+type HISession struct {
+	ID              string    `json:"id"`
+	AgentID         string    `json:"agent_id"`
+	ListenerID      string    `json:"listener_id"`
+	SourceIP        string    `json:"source_ip"`
+	SourcePort      uint32    `json:"source_port"`
+	SandboxNode     string    `json:"sandbox_node"`
+	SandboxEndpoint string    `json:"sandbox_endpoint"`
+	TunnelKey       []byte    `json:"tunnel_key,omitempty"`
+	EscalatedBy     string    `json:"escalated_by,omitempty"`
+	Image           string    `json:"image,omitempty"`
+	State           string    `json:"state"`
+	EndReason       string    `json:"end_reason,omitempty"`
+	OpenTunnels     int       `json:"open_tunnels"`
+	Tunnels         int       `json:"tunnels"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastActivityAt  time.Time `json:"last_activity_at"`
+	EndedAt         time.Time `json:"ended_at,omitempty"`
+}
+
+// Recording is an asciicast recording of one tunnel into an HI session.
+type Recording struct {
+	SessionID   string    `json:"session_id"`
+	Name        string    `json:"name"`
+	SandboxNode string    `json:"sandbox_node"`
+	Path        string    `json:"path"`
+	SizeBytes   int64     `json:"size_bytes"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Events      int       `json:"events"`
+	Duration    float64   `json:"duration"`
+	StartedAt   time.Time `json:"started_at"`
+	StoredAt    time.Time `json:"stored_at"`
+}
+
+// Artifact is a file collected from a sandbox session, stored once per
+// content. Sessions refer to it through their file events.
+type Artifact struct {
+	artifact.Digests
+	FileType    string    `json:"file_type"`
+	SandboxNode string    `json:"sandbox_node"`
+	Path        string    `json:"path"`
+	StoredAt    time.Time `json:"stored_at"`
+}
+
+// SessionEvent is telemetry a sandbox node reported for an HI session.
+type SessionEvent struct {
+	ID          string `json:"id"`
+	SandboxNode string `json:"sandbox_node"`
+	nodeapi.Event
+}
+
 type Module struct {
 	ID          string            `json:"id"`
 	Name        string            `json:"name"`
@@ -107,10 +190,37 @@ type Module struct {
 	UpdatedAt   time.Time         `json:"updated_at"`
 }
 
+// SandboxImage is a signed OCI image archive that sandbox nodes install
+// and run HI sessions from. Listeners refer to it by Name; nodes get the
+// latest version.
+type SandboxImage struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	Description string    `json:"description"`
+	Digest      string    `json:"digest"`
+	Port        uint32    `json:"port"`
+	SizeBytes   int64     `json:"size_bytes"`
+	Path        string    `json:"path"`
+	Manifest    []byte    `json:"manifest"`
+	Signature   []byte    `json:"signature"`
+	SignedBy    string    `json:"signed_by"`
+	SignedAt    time.Time `json:"signed_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
 func ModuleKey(id, version string) string {
 	return fmt.Sprintf("%s:%s", id, version)
 }
 
+func RecordingKey(sessionID, name string) string {
+	return fmt.Sprintf("%s:%s", sessionID, name)
+}
+
+// SessionEventKey sorts a session's events by time.
+func SessionEventKey(sessionID string, t time.Time, id string) string {
+	return fmt.Sprintf("%s:%020d:%s", sessionID, t.UnixNano(), id)
+}
+
 type ImageMeta struct {
 	ModuleID  string    `json:"module_id"`
 	Version   string    `json:"version"`
@@ -144,6 +254,7 @@ type ListenerConfig struct {
 	Protocol        string `json:"protocol"`
 	Port            uint32 `json:"port"`
 	HighInteraction bool   `json:"high_interaction"`
+	SandboxImage    string `json:"sandbox_image,omitempty"`
 }
 
 type ResourceConfig struct {
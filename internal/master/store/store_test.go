@@ -1,9 +1,17 @@
 package store
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	gimpelv1 "gimpel/api/go/v1"
+	"gimpel/pkg/nodeapi"
+	"gimpel/pkg/signing"
 )
 
 func TestSatellites(t *testing.T) {
@@ -205,13 +213,188 @@ func TestStaleSatellites(t *testing.T) {
 	}
 }
 
+func TestRecordings(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+
+	cast := `{"version":2,"width":100,"height":30,"timestamp":1700000000}
+[0.5,"i","id\r"]
+[0.75,"o","uid=0(root)\r\n"]
+`
+	for _, name := range []string{"10", "2"} {
+		if _, err := s.StoreRecording("hi-1", name, "sandbox-a", strings.NewReader(cast), 1024); err != nil {
+			t.Fatalf("StoreRecording %s failed: %v", name, err)
+		}
+	}
+
+	recs, err := s.ListRecordings("hi-1")
+	if err != nil {
+		t.Fatalf("ListRecordings failed: %v", err)
+	}
+	if len(recs) != 2 || recs[0].Name != "2" || recs[1].Name != "10" {
+		t.Fatalf("ListRecordings returned %d, want [2 10]", len(recs))
+	}
+	if recs[0].Events != 2 || recs[0].Duration != 0.75 || recs[0].Width != 100 {
+		t.Errorf("recording = %d events over %gs at width %d, want 2 over 0.75s at 100", recs[0].Events, recs[0].Duration, recs[0].Width)
+	}
+
+	if _, err := s.StoreRecording("hi-1", "3", "sandbox-a", strings.NewReader(cast), 16); !errors.Is(err, ErrRecordingTooLarge) {
+		t.Errorf("oversized recording: err = %v, want ErrRecordingTooLarge", err)
+	}
+	if _, err := s.StoreRecording("hi-1", "4", "sandbox-a", strings.NewReader("not a cast"), 1024); !errors.Is(err, ErrInvalidRecording) {
+		t.Errorf("garbage recording: err = %v, want ErrInvalidRecording", err)
+	}
+	if _, err := s.StoreRecording("..", "1", "sandbox-a", strings.NewReader(cast), 1024); !errors.Is(err, ErrInvalidRecording) {
+		t.Errorf("path traversal: err = %v, want ErrInvalidRecording", err)
+	}
+	if rec, _ := s.GetRecording("hi-1", "3"); rec != nil {
+		t.Error("rejected recording was stored")
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+
+	start := time.Now()
+	events := []nodeapi.Event{
+		{SessionID: "hi-1", Type: nodeapi.EventDNSQuery, Time: start.Add(time.Second)},
+		{SessionID: "hi-1", Type: nodeapi.EventEgressBlocked, Time: start, DestIP: "203.0.113.9", DestPort: 6667},
+		{SessionID: "hi-10", Type: nodeapi.EventEgressBlocked, Time: start},
+	}
+	if err := s.PutSessionEvents("sandbox-a", events); err != nil {
+		t.Fatalf("PutSessionEvents failed: %v", err)
+	}
+
+	got, err := s.ListSessionEvents("hi-1", "", 0)
+	if err != nil {
+		t.Fatalf("ListSessionEvents failed: %v", err)
+	}
+	if len(got) != 2 || got[0].Type != nodeapi.EventEgressBlocked || got[1].Type != nodeapi.EventDNSQuery {
+		t.Fatalf("ListSessionEvents returned %d events, want blocked then dns", len(got))
+	}
+	if got[0].SandboxNode != "sandbox-a" || got[0].DestPort != 6667 {
+		t.Errorf("event = %+v", got[0])
+	}
+
+	got, _ = s.ListSessionEvents("hi-1", nodeapi.EventDNSQuery, 0)
+	if len(got) != 1 {
+		t.Errorf("filtered by type: %d events, want 1", len(got))
+	}
+	got, _ = s.ListSessionEvents("hi-1", "", 1)
+	if len(got) != 1 {
+		t.Errorf("limited: %d events, want 1", len(got))
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+
+	const elf = "\x7fELF\x02\x01\x01"
+	const sum = "ced1af6d51438341a0335cc00e1c2867fb718a537c1173cf210070a6b1cdf40a"
+
+	if _, err := s.StoreArtifact(strings.Repeat("0", 64), "sandbox-a", strings.NewReader(elf), 1024); !errors.Is(err, ErrInvalidArtifact) {
+		t.Errorf("mismatched content: err = %v, want ErrInvalidArtifact", err)
+	}
+	if _, err := s.StoreArtifact(sum, "sandbox-a", strings.NewReader(elf), 4); !errors.Is(err, ErrArtifactTooLarge) {
+		t.Errorf("oversized content: err = %v, want ErrArtifactTooLarge", err)
+	}
+
+	a, err := s.StoreArtifact(sum, "sandbox-a", strings.NewReader(elf), 1024)
+	if err != nil {
+		t.Fatalf("StoreArtifact failed: %v", err)
+	}
+	if a.FileType != "application/x-elf" || a.Size != int64(len(elf)) {
+		t.Errorf("artifact = %+v", a)
+	}
+	if again, err := s.StoreArtifact(sum, "sandbox-b", strings.NewReader(elf), 1024); err != nil || again.SandboxNode != "sandbox-a" {
+		t.Errorf("re-upload = %+v, %v; want the first copy", again, err)
+	}
+
+	f, _, err := s.OpenArtifact(sum)
+	if err != nil {
+		t.Fatalf("OpenArtifact failed: %v", err)
+	}
+	f.Close()
+}
+
+func TestSandboxImages(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+
+	kp, _ := signing.GenerateKeyPair()
+	signer, _ := signing.NewModuleSigner(kp)
+	upload := func(version, content string) error {
+		sum := sha256.Sum256([]byte(content))
+		signed := &gimpelv1.SandboxImage{
+			Name:    "ubuntu-web",
+			Version: version,
+			Digest:  "sha256:" + hex.EncodeToString(sum[:]),
+			Port:    2222,
+		}
+		signer.SignSandboxImage(signed)
+		img := &SandboxImage{
+			Name:      "ubuntu-web",
+			Version:   version,
+			Manifest:  signed.Manifest,
+			Signature: signed.Signature,
+			SignedBy:  signed.SignedBy,
+		}
+		return s.StoreSandboxImage(img, strings.NewReader(content))
+	}
+
+	if err := upload("1.0.0", "image v1"); err != nil {
+		t.Fatalf("StoreSandboxImage failed: %v", err)
+	}
+	if err := upload("1.1.0", "image v2"); err != nil {
+		t.Fatalf("StoreSandboxImage failed: %v", err)
+	}
+
+	img, err := s.GetSandboxImage("ubuntu-web", "1.0.0")
+	if err != nil || img == nil {
+		t.Fatalf("GetSandboxImage = %v, %v", img, err)
+	}
+	if img.Port != 2222 || img.SizeBytes != int64(len("image v1")) {
+		t.Errorf("image = %+v", img)
+	}
+
+	// The archive must be the one the manifest was signed for.
+	bad := &SandboxImage{Name: "ubuntu-web", Version: "1.2.0", Manifest: img.Manifest}
+	if err := s.StoreSandboxImage(bad, strings.NewReader("image v1")); !errors.Is(err, ErrInvalidSandboxImage) {
+		t.Errorf("manifest of another version: err = %v, want ErrInvalidSandboxImage", err)
+	}
+	bad.Version = "1.0.0"
+	if err := s.StoreSandboxImage(bad, strings.NewReader("tampered")); !errors.Is(err, ErrInvalidSandboxImage) {
+		t.Errorf("mismatched archive: err = %v, want ErrInvalidSandboxImage", err)
+	}
+
+	latest, err := s.LatestSandboxImages()
+	if err != nil {
+		t.Fatalf("LatestSandboxImages failed: %v", err)
+	}
+	if len(latest) != 1 || latest[0].Version != "1.1.0" {
+		t.Errorf("latest = %+v, want 1.1.0 only", latest)
+	}
+
+	if err := s.DeleteSandboxImage("ubuntu-web", "1.1.0"); err != nil {
+		t.Fatalf("DeleteSandboxImage failed: %v", err)
+	}
+	latest, _ = s.LatestSandboxImages()
+	if len(latest) != 1 || latest[0].Version != "1.0.0" {
+		t.Errorf("latest after delete = %+v, want 1.0.0", latest)
+	}
+}
+
 func testStore(t *testing.T) *Store {
 	t.Helper()
 	tmpDir := t.TempDir()
 
 	s, err := New(&Config{
-		DBPath:   filepath.Join(tmpDir, "test.db"),
-		ImageDir: filepath.Join(tmpDir, "images"),
+		DBPath:       filepath.Join(tmpDir, "test.db"),
+		ImageDir:     filepath.Join(tmpDir, "images"),
+		RecordingDir: filepath.Join(tmpDir, "recordings"),
+		ArtifactDir:  filepath.Join(tmpDir, "artifacts"),
 	})
 	if err != nil {
 		t.Fatalf("New store failed: %v", err)
@@ -2,7 +2,10 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -19,6 +22,130 @@ type SandboxConfig struct {
 	PublicIP      string    `mapstructure:"public_ip"`
 	TLS           TLSConfig `mapstructure:"tls"`
 	LogLevel      string    `mapstructure:"log_level"`
+	DataDir       string    `mapstructure:"data_dir"`
+
+	// Master enables registration with the master's node endpoint. Without
+	// it the node must be listed statically in the master's config.
+	Master MasterConfig `mapstructure:"master"`
+	// Catalog installs the sandbox images the master distributes.
+	Catalog CatalogConfig `mapstructure:"catalog"`
+
+	MaxSessions int               `mapstructure:"max_sessions"`
+	Labels      map[string]string `mapstructure:"labels"`
+
+	Recording RecordingConfig `mapstructure:"recording"`
+
+	Artifacts ArtifactConfig `mapstructure:"artifacts"`
+
+	// Egress is the network policy of images that do not set their own.
+	Egress EgressConfig `mapstructure:"egress"`
+
+	// BindAddress and the port range are where session endpoints listen;
+	// PublicIP is what agents are told to connect to.
+	BindAddress  string        `mapstructure:"bind_address"`
+	PortMin      int           `mapstructure:"port_min"`
+	PortMax      int           `mapstructure:"port_max"`
+	StartTimeout time.Duration `mapstructure:"start_timeout"`
+
+	Containerd    ContainerdConfig    `mapstructure:"containerd"`
+	UserNamespace UserNamespaceConfig `mapstructure:"user_namespace"`
+
+	// Images maps the image names sessions ask for to how they are run.
+	// Sessions can only ask for these and the images installed from the
+	// catalog. DefaultPort is the Port of images that do not set one.
+	Images       map[string]ImageConfig `mapstructure:"images"`
+	DefaultImage string                 `mapstructure:"default_image"`
+	DefaultPort  int                    `mapstructure:"default_port"`
+}
+
+type MasterConfig struct {
+	Address      string `mapstructure:"address"`
+	CAFile       string `mapstructure:"ca_file"`
+	PairingToken string `mapstructure:"pairing_token"`
+	// AdvertiseAddress is where the master reaches this node's gRPC
+	// server; it defaults to PublicIP and the port of ListenAddress.
+	AdvertiseAddress  string        `mapstructure:"advertise_address"`
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval"`
+}
+
+// CatalogConfig installs the master's sandbox images into containerd,
+// under the names they were uploaded with. Only images signed by one of
+// TrustedKeys, paths of public keys, are installed; without any the
+// catalog is ignored.
+type CatalogConfig struct {
+	TrustedKeys []string `mapstructure:"trusted_keys"`
+}
+
+// RecordingConfig records every terminal tunnel into a session as an
+// asciicast file under DataDir/recordings, which is shipped to the master
+// when the tunnel closes. Tunnels carrying the attacker's raw protocol, such
+// as encrypted SSH, are not recorded. MaxBytes caps each recording.
+type RecordingConfig struct {
+	Enabled  bool  `mapstructure:"enabled"`
+	MaxBytes int64 `mapstructure:"max_bytes"`
+}
+
+// ArtifactConfig collects the files a session added or modified into
+// DataDir/artifacts when it ends, named by SHA-256, and ships them to the
+// master. Files over MaxFileSize are reported but not kept, at most
+// MaxFiles are taken per session, and paths under Ignore are skipped.
+type ArtifactConfig struct {
+	Enabled     bool     `mapstructure:"enabled"`
+	MaxFileSize int64    `mapstructure:"max_file_size"`
+	MaxFiles    int      `mapstructure:"max_files"`
+	Ignore      []string `mapstructure:"ignore"`
+}
+
+// EgressConfig controls what a session environment reaches beyond
+// loopback. Egress is always denied. With Enabled set, every IPv4
+// destination is routed back into the environment, where a gateway
+// answers DNS with the Sinkhole address and reports every other attempt.
+// CaptureHTTP also takes HTTP and HTTPS on ports 80 and 443, records the
+// request or TLS server name, and forwards it only to AllowHosts, capped
+// at RateLimit bytes per second and MaxBytes per session.
+type EgressConfig struct {
+	Enabled     bool     `mapstructure:"enabled"`
+	Sinkhole    string   `mapstructure:"sinkhole"`
+	CaptureHTTP bool     `mapstructure:"capture_http"`
+	AllowHosts  []string `mapstructure:"allow_hosts"`
+	RateLimit   int      `mapstructure:"rate_limit"`
+	MaxBytes    int64    `mapstructure:"max_bytes"`
+}
+
+type ContainerdConfig struct {
+	Address   string `mapstructure:"address"`
+	Namespace string `mapstructure:"namespace"`
+}
+
+// UserNamespaceConfig is the host id range sessions run in. Both backends
+// run environments as root of a user namespace mapped onto UIDBase to
+// UIDBase+65535, uids and gids alike. Container images are remapped into
+// the range when first used; process backend root filesystems must be
+// owned by it, as for rootless containers.
+type UserNamespaceConfig struct {
+	UIDBase uint32 `mapstructure:"uid_base"`
+}
+
+// ImageConfig describes a session environment. Backend "containerd" runs
+// Ref; "process" runs Command in a copy-on-write overlay of Rootfs, as
+// root of its own user namespace. Either way the
+// environment gets its own network namespace and Port is the service the
+// session endpoint forwards to. PoolSize environments of the image are
+// kept started and paused, on top of MaxSessions, so sessions do not wait
+// for one to boot; they only get the image's Env.
+type ImageConfig struct {
+	Backend  string            `mapstructure:"backend"`
+	Ref      string            `mapstructure:"ref"`
+	Rootfs   string            `mapstructure:"rootfs"`
+	Command  []string          `mapstructure:"command"`
+	Port     int               `mapstructure:"port"`
+	Env      map[string]string `mapstructure:"env"`
+	Egress   *EgressConfig     `mapstructure:"egress"`
+	PoolSize int               `mapstructure:"pool_size"`
+
+	// Imported marks images installed from the signed catalog, which are
+	// never pulled from a registry.
+	Imported bool `mapstructure:"-"`
 }
 
 func (c *SandboxConfig) Validate() error {
@@ -31,6 +158,129 @@ func (c *SandboxConfig) Validate() error {
 	if c.PublicIP == "" {
 		c.PublicIP = "127.0.0.1"
 	}
+	if c.PortMin == 0 {
+		c.PortMin = 6000
+	}
+	if c.PortMax == 0 {
+		c.PortMax = c.PortMin + 999
+	}
+	if c.PortMin < 1 || c.PortMax > 65535 || c.PortMin > c.PortMax {
+		return fmt.Errorf("invalid port range %d-%d", c.PortMin, c.PortMax)
+	}
+	if c.MaxSessions == 0 {
+		c.MaxSessions = c.PortMax - c.PortMin + 1
+	}
+	if c.DataDir == "" {
+		c.DataDir = "/var/lib/gimpel-sandbox"
+	}
+	if c.Master.Address != "" {
+		if c.Master.CAFile == "" {
+			return fmt.Errorf("master.ca_file is required to register with the master")
+		}
+		if c.Master.AdvertiseAddress == "" {
+			_, port, err := net.SplitHostPort(c.ListenAddress)
+			if err != nil {
+				return fmt.Errorf("invalid listen_address: %w", err)
+			}
+			c.Master.AdvertiseAddress = net.JoinHostPort(c.PublicIP, port)
+		}
+		if c.Master.HeartbeatInterval == 0 {
+			c.Master.HeartbeatInterval = 10 * time.Second
+		}
+	}
+	if c.Recording.MaxBytes == 0 {
+		c.Recording.MaxBytes = 16 * 1024 * 1024
+	}
+	if c.Artifacts.MaxFileSize == 0 {
+		c.Artifacts.MaxFileSize = 32 * 1024 * 1024
+	}
+	if c.Artifacts.MaxFiles == 0 {
+		c.Artifacts.MaxFiles = 500
+	}
+	if c.Artifacts.Ignore == nil {
+		c.Artifacts.Ignore = []string{"/proc", "/sys", "/dev", "/run"}
+	}
+	if c.StartTimeout == 0 {
+		c.StartTimeout = time.Minute
+	}
+	if c.Containerd.Address == "" {
+		c.Containerd.Address = "/run/containerd/containerd.sock"
+	}
+	if c.Containerd.Namespace == "" {
+		c.Containerd.Namespace = "gimpel-sandbox"
+	}
+	if c.UserNamespace.UIDBase == 0 {
+		c.UserNamespace.UIDBase = 100000
+	}
+	if c.UserNamespace.UIDBase > math.MaxUint32-65535 {
+		return fmt.Errorf("user_namespace.uid_base %d leaves no room for 65536 ids", c.UserNamespace.UIDBase)
+	}
+	if c.DefaultPort == 0 {
+		c.DefaultPort = 22
+	}
+	if err := c.Egress.validate(); err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	for name, img := range c.Images {
+		switch img.Backend {
+		case "", "containerd":
+			if img.Ref == "" {
+				img.Ref = name
+			}
+		case "process":
+			if img.Rootfs == "" || len(img.Command) == 0 {
+				return fmt.Errorf("image %s: process backend requires rootfs and command", name)
+			}
+		default:
+			return fmt.Errorf("image %s: unknown backend %q", name, img.Backend)
+		}
+		if img.Port == 0 {
+			img.Port = c.DefaultPort
+		}
+		if img.PoolSize < 0 {
+			return fmt.Errorf("image %s: pool_size must not be negative", name)
+		}
+		if img.Egress == nil {
+			img.Egress = &c.Egress
+		} else if err := img.Egress.validate(); err != nil {
+			return fmt.Errorf("image %s: egress: %w", name, err)
+		}
+		if img.Egress.Reserves(img.Port) {
+			return fmt.Errorf("image %s: port %d is taken by the egress gateway", name, img.Port)
+		}
+		c.Images[name] = img
+	}
+	return nil
+}
+
+// Reserves tells whether port is taken by the egress gateway inside an
+// environment.
+func (e *EgressConfig) Reserves(port int) bool {
+	return e.Enabled && (port == 53 || e.CaptureHTTP && (port == 80 || port == 443))
+}
+
+func (e *EgressConfig) validate() error {
+	if e.Sinkhole == "" {
+		e.Sinkhole = "198.51.100.1"
+	}
+	if ip := net.ParseIP(e.Sinkhole); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("sinkhole %q is not an IPv4 address", e.Sinkhole)
+	}
+	if len(e.AllowHosts) > 0 && !e.CaptureHTTP {
+		return fmt.Errorf("allow_hosts requires capture_http")
+	}
+	if e.RateLimit < 0 {
+		return fmt.Errorf("rate_limit must not be negative")
+	}
+	if e.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes must not be negative")
+	}
+	if e.RateLimit == 0 {
+		e.RateLimit = 64 * 1024
+	}
+	if e.MaxBytes == 0 {
+		e.MaxBytes = 8 * 1024 * 1024
+	}
 	return nil
 }
 
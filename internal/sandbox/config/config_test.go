@@ -0,0 +1,47 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEgressLimits(t *testing.T) {
+	for _, tc := range []struct {
+		egress EgressConfig
+		err    string
+	}{
+		{EgressConfig{Enabled: true, RateLimit: -1}, "rate_limit"},
+		{EgressConfig{Enabled: true, MaxBytes: -1}, "max_bytes"},
+	} {
+		cfg := &SandboxConfig{ListenAddress: ":5000", Egress: tc.egress}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Validate(%+v) = %v, want a %s error", tc.egress, err, tc.err)
+		}
+	}
+
+	img := EgressConfig{Enabled: true, RateLimit: -5}
+	cfg := &SandboxConfig{
+		ListenAddress: ":5000",
+		Images:        map[string]ImageConfig{"router": {Ref: "router", Egress: &img}},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate accepted a negative image rate_limit")
+	}
+
+	cfg = &SandboxConfig{ListenAddress: ":5000"}
+	if err := cfg.Validate(); err != nil || cfg.Egress.RateLimit <= 0 || cfg.Egress.MaxBytes <= 0 {
+		t.Errorf("defaults: %v, %+v", err, cfg.Egress)
+	}
+}
+
+func TestUserNamespaceUIDBase(t *testing.T) {
+	cfg := &SandboxConfig{ListenAddress: ":5000"}
+	if err := cfg.Validate(); err != nil || cfg.UserNamespace.UIDBase == 0 {
+		t.Errorf("defaults: %v, uid_base %d; sessions must not map onto host root", err, cfg.UserNamespace.UIDBase)
+	}
+
+	cfg = &SandboxConfig{ListenAddress: ":5000", UserNamespace: UserNamespaceConfig{UIDBase: 1<<32 - 100}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "uid_base") {
+		t.Errorf("Validate accepted uid_base %d: %v", cfg.UserNamespace.UIDBase, err)
+	}
+}
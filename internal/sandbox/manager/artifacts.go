@@ -0,0 +1,185 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/pkg/artifact"
+	"gimpel/pkg/nodeapi"
+)
+
+const collectTimeout = 2 * time.Minute
+
+// ErrArtifactRejected is returned by sinks that will never accept an
+// artifact. It is kept on disk with a .rejected suffix instead of retried.
+var ErrArtifactRejected = errors.New("artifact rejected")
+
+// ArtifactSink takes collected files, typically by uploading them to the
+// master.
+type ArtifactSink interface {
+	StoreArtifact(ctx context.Context, sha256 string, r io.Reader) error
+}
+
+// SetArtifactSink sets where collected files go. Without one they stay in
+// the data directory.
+func (m *Manager) SetArtifactSink(sink ArtifactSink) {
+	m.mu.Lock()
+	m.artifactSink = sink
+	m.mu.Unlock()
+}
+
+func (m *Manager) artifactDir() string {
+	return filepath.Join(m.cfg.DataDir, "artifacts")
+}
+
+// collector returns what Stop calls for a session's file changes, or nil
+// if artifacts are not collected.
+func (m *Manager) collector(session *Session) ChangeFunc {
+	cfg := m.cfg.Artifacts
+	if !cfg.Enabled {
+		return nil
+	}
+	dir := m.artifactDir()
+	logger := log.WithField("session_id", session.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.WithError(err).Warn("failed to create artifact directory")
+		return nil
+	}
+
+	collected, skipped := 0, 0
+	return func(path, kind string, info os.FileInfo, open func() (io.ReadCloser, error)) error {
+		for _, prefix := range cfg.Ignore {
+			if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+				return nil
+			}
+		}
+		if collected >= cfg.MaxFiles {
+			if skipped++; skipped == 1 {
+				logger.WithField("max_files", cfg.MaxFiles).Warn("artifact limit reached, further files are skipped")
+			}
+			return nil
+		}
+		collected++
+
+		labels := map[string]string{
+			"path":   path,
+			"change": kind,
+			"size":   strconv.FormatInt(info.Size(), 10),
+			"mode":   fmt.Sprintf("%04o", info.Mode().Perm()),
+		}
+		if info.Size() > cfg.MaxFileSize {
+			labels["stored"] = "false"
+			m.emit(nodeapi.Event{SessionID: session.ID, Type: nodeapi.EventFileAccess, Labels: labels})
+			return nil
+		}
+
+		digests, fileType, err := storeArtifact(dir, open)
+		if err != nil {
+			logger.WithError(err).WithField("path", path).Warn("failed to collect artifact")
+			return nil
+		}
+		labels["sha256"] = digests.SHA256
+		labels["sha1"] = digests.SHA1
+		labels["md5"] = digests.MD5
+		labels["size"] = strconv.FormatInt(digests.Size, 10)
+		labels["file_type"] = fileType
+		labels["stored"] = "true"
+
+		typ := nodeapi.EventFileAccess
+		if artifact.Executable(fileType) {
+			typ = nodeapi.EventMalwareDetected
+		}
+		m.emit(nodeapi.Event{SessionID: session.ID, Type: typ, Labels: labels})
+		logger.WithFields(log.Fields{
+			"path":   path,
+			"sha256": digests.SHA256,
+			"type":   fileType,
+		}).Info("artifact collected")
+		return nil
+	}
+}
+
+// storeArtifact copies a file into dir under its SHA-256. A file already
+// there is kept.
+func storeArtifact(dir string, open func() (io.ReadCloser, error)) (artifact.Digests, string, error) {
+	src, err := open()
+	if err != nil {
+		return artifact.Digests{}, "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(dir, ".collect-*")
+	if err != nil {
+		return artifact.Digests{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	digests, fileType, err := artifact.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return artifact.Digests{}, "", err
+	}
+
+	path := filepath.Join(dir, digests.SHA256)
+	if _, err := os.Stat(path); err == nil {
+		return digests, fileType, nil
+	}
+	return digests, fileType, os.Rename(tmp.Name(), path)
+}
+
+// FlushArtifacts hands every collected file to the sink, deleting the ones
+// it accepts. Files it fails on are retried on the next flush; a call made
+// while another flush is running returns immediately.
+func (m *Manager) FlushArtifacts(ctx context.Context) {
+	m.mu.RLock()
+	sink := m.artifactSink
+	m.mu.RUnlock()
+	if sink == nil || !m.artifactFlushMu.TryLock() {
+		return
+	}
+	defer m.artifactFlushMu.Unlock()
+
+	entries, err := os.ReadDir(m.artifactDir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		sha256 := e.Name()
+		if !artifact.ValidSHA256(sha256) {
+			continue
+		}
+		path := filepath.Join(m.artifactDir(), sha256)
+		logger := log.WithField("sha256", sha256)
+		err := uploadArtifact(ctx, sink, sha256, path)
+		switch {
+		case errors.Is(err, ErrArtifactRejected):
+			logger.WithError(err).Warn("artifact rejected, keeping it on disk")
+			os.Rename(path, path+".rejected")
+		case err != nil:
+			logger.WithError(err).Warn("failed to upload artifact")
+			return
+		default:
+			os.Remove(path)
+		}
+	}
+}
+
+func uploadArtifact(ctx context.Context, sink ArtifactSink, sha256, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sink.StoreArtifact(ctx, sha256, f)
+}
@@ -0,0 +1,52 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+
+	"gimpel/internal/sandbox/config"
+)
+
+// Backend launches session environments.
+type Backend interface {
+	Name() string
+	Start(ctx context.Context, spec *EnvironmentSpec) (Environment, error)
+}
+
+// EnvironmentSpec is what a backend needs to launch one environment.
+type EnvironmentSpec struct {
+	ID    string
+	Image config.ImageConfig
+	Env   map[string]string
+}
+
+// Environment is a running, network-isolated session environment.
+type Environment interface {
+	// Dial connects to the environment's service port from inside its
+	// network namespace.
+	Dial(ctx context.Context) (net.Conn, error)
+	// Stop tears the environment down and releases what it holds. If
+	// collect is not nil it is called for the environment's file changes
+	// after it stopped running and before it is removed.
+	Stop(ctx context.Context, collect ChangeFunc) error
+	// Pause freezes every process of the environment until Resume.
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+	// Done is closed when the environment exits on its own or is stopped.
+	Done() <-chan struct{}
+	// Baseline marks what is on the environment's filesystem now as its
+	// starting state, so files written while it booted are not reported as
+	// changes. It is called when a session gets the environment.
+	Baseline()
+}
+
+const (
+	ChangeAdded    = "added"
+	ChangeModified = "modified"
+)
+
+// ChangeFunc is called for each regular file an environment added or
+// modified, at its path inside the environment. open reads its content.
+type ChangeFunc func(path, kind string, info os.FileInfo, open func() (io.ReadCloser, error)) error
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gimpel/internal/sandbox/config"
+)
+
+func newBackends(cfg *config.SandboxConfig) map[string]Backend {
+	return map[string]Backend{
+		"containerd": newContainerdBackend(cfg.Containerd, cfg.UserNamespace.UIDBase),
+		"process": &processBackend{
+			uidBase: cfg.UserNamespace.UIDBase,
+			dir:     filepath.Join(cfg.DataDir, "sessions"),
+		},
+	}
+}
+
+// nsEnvironment is an environment whose service is reached through the
+// network namespace of its init process.
+type nsEnvironment struct {
+	pid  int
+	port int
+	done chan struct{}
+
+	stopOnce sync.Once
+	stopErr  error
+	stop     func(ctx context.Context, collect ChangeFunc) error
+
+	pause, resume func(ctx context.Context) error
+
+	mu       sync.Mutex
+	baseline time.Time
+}
+
+func newNsEnvironment(pid, port int, stop func(ctx context.Context, collect ChangeFunc) error) *nsEnvironment {
+	return &nsEnvironment{
+		pid:  pid,
+		port: port,
+		done: make(chan struct{}),
+		stop: stop,
+
+		baseline: changeCutoff(),
+	}
+}
+
+func (e *nsEnvironment) Dial(ctx context.Context) (net.Conn, error) {
+	return dialNetns(ctx, e.pid, net.JoinHostPort("127.0.0.1", strconv.Itoa(e.port)))
+}
+
+func (e *nsEnvironment) Stop(ctx context.Context, collect ChangeFunc) error {
+	e.stopOnce.Do(func() {
+		e.stopErr = e.stop(ctx, collect)
+	})
+	return e.stopErr
+}
+
+func (e *nsEnvironment) Pause(ctx context.Context) error {
+	return e.pause(ctx)
+}
+
+func (e *nsEnvironment) Resume(ctx context.Context) error {
+	return e.resume(ctx)
+}
+
+func (e *nsEnvironment) Done() <-chan struct{} {
+	return e.done
+}
+
+func (e *nsEnvironment) Baseline() {
+	e.mu.Lock()
+	e.baseline = changeCutoff()
+	e.mu.Unlock()
+}
+
+// baselineTime returns the time after which inode changes are the
+// session's doing.
+func (e *nsEnvironment) baselineTime() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.baseline
+}
+
+// changeCutoff is the time after which inode changes count. Inode times
+// come from the kernel's coarse clock, which can trail time.Now by a tick.
+func changeCutoff() time.Time {
+	return time.Now().Add(-10 * time.Millisecond)
+}
+
+// changedBefore reports whether fi's inode last changed before t.
+func changedBefore(fi os.FileInfo, t time.Time) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && time.Unix(st.Ctim.Unix()).Before(t)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package manager
+
+import "gimpel/internal/sandbox/config"
+
+// Session environments need Linux namespaces.
+func newBackends(cfg *config.SandboxConfig) map[string]Backend {
+	return nil
+}
+
+func Main() {}
@@ -0,0 +1,276 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/contrib/seccomp"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/continuity/fs"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/sandbox/config"
+)
+
+const stopGracePeriod = 5 * time.Second
+
+// containerdBackend runs each session as a container with its own network
+// namespace, as root of a user namespace mapped onto uidBase and up, under
+// the default seccomp profile and without gaining privileges through
+// setuid binaries. Images are remapped into the range when first used.
+// The connection to containerd is made on first use so nodes that only run
+// process environments do not need it.
+type containerdBackend struct {
+	cfg     config.ContainerdConfig
+	uidBase uint32
+
+	mu     sync.Mutex
+	client *containerd.Client
+}
+
+func newContainerdBackend(cfg config.ContainerdConfig, uidBase uint32) *containerdBackend {
+	return &containerdBackend{cfg: cfg, uidBase: uidBase}
+}
+
+func (b *containerdBackend) Name() string {
+	return "containerd"
+}
+
+func (b *containerdBackend) connect() (*containerd.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.client != nil {
+		return b.client, nil
+	}
+	client, err := containerd.New(b.cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to containerd: %w", err)
+	}
+	b.client = client
+	return client, nil
+}
+
+func (b *containerdBackend) Start(ctx context.Context, spec *EnvironmentSpec) (Environment, error) {
+	client, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx = namespaces.WithNamespace(ctx, b.cfg.Namespace)
+
+	image, err := client.GetImage(ctx, spec.Image.Ref)
+	if err != nil && spec.Image.Imported {
+		return nil, fmt.Errorf("image %s is not installed: %w", spec.Image.Ref, err)
+	}
+	if err != nil {
+		log.WithField("image", spec.Image.Ref).Debug("image not found locally, pulling")
+		image, err = client.Pull(ctx, spec.Image.Ref, containerd.WithPullUnpack)
+		if err != nil {
+			return nil, fmt.Errorf("pulling image %s: %w", spec.Image.Ref, err)
+		}
+	}
+
+	id := "session-" + spec.ID
+	b.remove(ctx, client, id)
+
+	// The default spec gives the container a new network namespace with
+	// nothing but loopback.
+	ids := []specs.LinuxIDMapping{{ContainerID: 0, HostID: b.uidBase, Size: idRange}}
+	container, err := client.NewContainer(
+		ctx,
+		id,
+		containerd.WithImage(image),
+		containerd.WithRemappedSnapshot(id, image, b.uidBase, b.uidBase),
+		containerd.WithNewSpec(
+			oci.WithImageConfig(image),
+			oci.WithEnv(envList(spec.Env)),
+			oci.WithHostname(spec.ID[:min(len(spec.ID), 12)]),
+			oci.WithUserNamespace(ids, ids),
+			oci.WithNoNewPrivileges,
+			seccomp.WithDefaultProfile(),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating container: %w", err)
+	}
+
+	task, err := container.NewTask(ctx, cio.NullIO)
+	if err != nil {
+		container.Delete(ctx, containerd.WithSnapshotCleanup)
+		return nil, fmt.Errorf("creating task: %w", err)
+	}
+
+	cleanup := func(ctx context.Context) {
+		task.Delete(ctx, containerd.WithProcessKill)
+		container.Delete(ctx, containerd.WithSnapshotCleanup)
+	}
+
+	if err := loopbackUp(int(task.Pid())); err != nil {
+		cleanup(ctx)
+		return nil, err
+	}
+
+	waitCtx := namespaces.WithNamespace(context.Background(), b.cfg.Namespace)
+	exitCh, err := task.Wait(waitCtx)
+	if err != nil {
+		cleanup(ctx)
+		return nil, fmt.Errorf("waiting on task: %w", err)
+	}
+	if err := task.Start(ctx); err != nil {
+		cleanup(ctx)
+		return nil, fmt.Errorf("starting task: %w", err)
+	}
+
+	var env *nsEnvironment
+	env = newNsEnvironment(int(task.Pid()), spec.Image.Port, func(ctx context.Context, collect ChangeFunc) error {
+		ctx = namespaces.WithNamespace(ctx, b.cfg.Namespace)
+		task.Kill(ctx, syscall.SIGTERM)
+		select {
+		case <-env.done:
+		case <-time.After(stopGracePeriod):
+			task.Kill(ctx, syscall.SIGKILL)
+			<-env.done
+		}
+		if _, err := task.Delete(ctx); err != nil {
+			return fmt.Errorf("deleting task: %w", err)
+		}
+		if collect != nil {
+			if err := b.changes(ctx, client, container, env.baselineTime(), collect); err != nil {
+				log.WithError(err).WithField("session_id", spec.ID).Warn("failed to diff container filesystem")
+			}
+		}
+		return container.Delete(ctx, containerd.WithSnapshotCleanup)
+	})
+	env.pause = func(ctx context.Context) error {
+		return task.Pause(namespaces.WithNamespace(ctx, b.cfg.Namespace))
+	}
+	env.resume = func(ctx context.Context) error {
+		return task.Resume(namespaces.WithNamespace(ctx, b.cfg.Namespace))
+	}
+	go func() {
+		<-exitCh
+		close(env.done)
+	}()
+
+	return env, nil
+}
+
+// changes diffs a stopped container's snapshot against the image it was
+// created from, leaving out what the container wrote before since.
+func (b *containerdBackend) changes(ctx context.Context, client *containerd.Client, container containerd.Container, since time.Time, collect ChangeFunc) error {
+	info, err := container.Info(ctx)
+	if err != nil {
+		return err
+	}
+	sn := client.SnapshotService(info.Snapshotter)
+	st, err := sn.Stat(ctx, info.SnapshotKey)
+	if err != nil {
+		return err
+	}
+	upper, err := sn.Mounts(ctx, info.SnapshotKey)
+	if err != nil {
+		return err
+	}
+	baseKey := info.SnapshotKey + "-base"
+	lower, err := sn.View(ctx, baseKey, st.Parent)
+	if err != nil {
+		return fmt.Errorf("viewing image snapshot: %w", err)
+	}
+	defer sn.Remove(ctx, baseKey)
+
+	return mount.WithReadonlyTempMount(ctx, lower, func(lowerRoot string) error {
+		return mount.WithReadonlyTempMount(ctx, upper, func(upperRoot string) error {
+			return diffChanges(ctx, lowerRoot, upperRoot, since, collect)
+		})
+	})
+}
+
+// diffChanges reports the regular files upperRoot added or modified over
+// lowerRoot after since. Files the image's own boot wrote are the same for
+// every session and not worth collecting.
+func diffChanges(ctx context.Context, lowerRoot, upperRoot string, since time.Time, collect ChangeFunc) error {
+	return fs.Changes(ctx, lowerRoot, upperRoot, func(kind fs.ChangeKind, path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi == nil || !fi.Mode().IsRegular() || changedBefore(fi, since) {
+			return nil
+		}
+		var change string
+		switch kind {
+		case fs.ChangeKindAdd:
+			change = ChangeAdded
+		case fs.ChangeKindModify:
+			change = ChangeModified
+		default:
+			return nil
+		}
+		full := filepath.Join(upperRoot, path)
+		return collect(path, change, fi, func() (io.ReadCloser, error) {
+			return os.OpenFile(full, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		})
+	})
+}
+
+// Import loads an image archive, from docker save or an OCI layout, as ref
+// and unpacks it so sessions start without waiting for it.
+func (b *containerdBackend) Import(ctx context.Context, ref string, r io.Reader) error {
+	client, err := b.connect()
+	if err != nil {
+		return err
+	}
+	ctx = namespaces.WithNamespace(ctx, b.cfg.Namespace)
+
+	imgs, err := client.Import(ctx, r, containerd.WithIndexName(ref))
+	if err != nil {
+		return err
+	}
+	for _, img := range imgs {
+		if img.Name == ref {
+			return containerd.NewImage(client, img).Unpack(ctx, "")
+		}
+	}
+	return fmt.Errorf("archive has no image index")
+}
+
+// Delete removes an imported image. Containers created from it keep their
+// snapshots.
+func (b *containerdBackend) Delete(ctx context.Context, ref string) error {
+	client, err := b.connect()
+	if err != nil {
+		return err
+	}
+	ctx = namespaces.WithNamespace(ctx, b.cfg.Namespace)
+	return client.ImageService().Delete(ctx, ref)
+}
+
+func (b *containerdBackend) remove(ctx context.Context, client *containerd.Client, id string) {
+	container, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		return
+	}
+	log.WithField("container", id).Debug("removing stale session container")
+	if task, err := container.Task(ctx, nil); err == nil {
+		task.Delete(ctx, containerd.WithProcessKill)
+	}
+	container.Delete(ctx, containerd.WithSnapshotCleanup)
+}
+
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for k, v := range env {
+		list = append(list, k+"="+v)
+	}
+	return list
+}
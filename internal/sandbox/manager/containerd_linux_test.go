@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDiffChangesSkipsBootWrites(t *testing.T) {
+	lower, upper := t.TempDir(), t.TempDir()
+	for _, dir := range []string{lower, upper} {
+		if err := os.WriteFile(filepath.Join(dir, "passwd"), []byte("root:x:0:0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(upper, "boot.pid"), []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	since := changeCutoff()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(filepath.Join(upper, "passwd"), []byte("root:x:0:0\nevil:x:0:0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "dropper"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err := diffChanges(context.Background(), lower, upper, since, func(path, kind string, info os.FileInfo, open func() (io.ReadCloser, error)) error {
+		got = append(got, kind+" "+path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+
+	want := []string{"added /dropper", "modified /passwd"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("changes = %q, want %q", got, want)
+	}
+}
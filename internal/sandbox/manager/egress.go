@@ -0,0 +1,547 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/time/rate"
+
+	"gimpel/internal/sandbox/config"
+	"gimpel/pkg/nodeapi"
+)
+
+const (
+	blockedReportInterval = 10 * time.Second
+	// maxBlockedFlows bounds how many distinct destinations are tracked
+	// between reports; a scan beyond it is only counted.
+	maxBlockedFlows = 256
+	maxCapturedBody = 4096
+	sniffTimeout    = 10 * time.Second
+	upstreamTimeout = 10 * time.Second
+)
+
+var errHelloCaptured = errors.New("client hello captured")
+
+// egressGateway contains a session environment's network. The platform
+// side routes the environment's traffic to it; this side decides what to
+// answer, forward or report.
+type egressGateway struct {
+	sessionID string
+	policy    *config.EgressConfig
+	sinkhole  [4]byte
+	emit      func(nodeapi.Event)
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	limiter *rate.Limiter
+	budget  atomic.Int64
+
+	mu       sync.Mutex
+	blocked  map[flowKey]*flowCount
+	overflow int
+	closers  []io.Closer
+	done     chan struct{}
+	closed   bool
+}
+
+type flowKey struct {
+	proto string
+	dst   string
+	port  uint16
+}
+
+type flowCount struct {
+	attempts int
+	bytes    int
+}
+
+func newEgressGateway(sessionID string, policy *config.EgressConfig, emit func(nodeapi.Event)) *egressGateway {
+	g := &egressGateway{
+		sessionID: sessionID,
+		policy:    policy,
+		emit:      emit,
+		dial:      (&net.Dialer{Timeout: upstreamTimeout}).DialContext,
+		limiter:   rate.NewLimiter(rate.Limit(policy.RateLimit), policy.RateLimit),
+		blocked:   make(map[flowKey]*flowCount),
+		done:      make(chan struct{}),
+	}
+	copy(g.sinkhole[:], net.ParseIP(policy.Sinkhole).To4())
+	g.budget.Store(policy.MaxBytes)
+	go g.reportBlocked()
+	return g
+}
+
+func (g *egressGateway) event(ev nodeapi.Event) {
+	ev.SessionID = g.sessionID
+	g.emit(ev)
+}
+
+// track closes c with the gateway.
+func (g *egressGateway) track(c io.Closer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		c.Close()
+		return
+	}
+	g.closers = append(g.closers, c)
+}
+
+func (g *egressGateway) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	closers := g.closers
+	g.mu.Unlock()
+
+	for _, c := range closers {
+		c.Close()
+	}
+	close(g.done)
+	g.flushBlocked()
+	return nil
+}
+
+// handled reports whether the gateway serves proto/port itself, in which
+// case attempts on it are reported by the service rather than as blocked.
+func (g *egressGateway) handled(proto string, port uint16) bool {
+	switch {
+	case proto == "udp" && port == 53:
+		return true
+	case proto == "tcp" && (port == 80 || port == 443):
+		return g.policy.CaptureHTTP
+	}
+	return false
+}
+
+// observe inspects an IPv4 packet the environment sent and counts it if
+// it is a new attempt to reach something the gateway does not serve.
+func (g *egressGateway) observe(pkt []byte) {
+	p, ok := parseIPv4(pkt)
+	if !ok || p.dst.IsLoopback() {
+		return
+	}
+	switch p.proto {
+	case "tcp":
+		// Only connection attempts; replies and established flows are
+		// either ours or stay inside the environment.
+		if !p.syn || p.ack {
+			return
+		}
+	case "udp":
+		if p.srcPort == 53 {
+			return
+		}
+	default:
+		return
+	}
+	if g.handled(p.proto, p.dstPort) {
+		return
+	}
+	g.noteBlocked(p.proto, p.dst.String(), p.dstPort, p.length)
+}
+
+func (g *egressGateway) noteBlocked(proto, dst string, port uint16, size int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := flowKey{proto, dst, port}
+	c, ok := g.blocked[key]
+	if !ok {
+		if len(g.blocked) >= maxBlockedFlows {
+			g.overflow++
+			return
+		}
+		c = &flowCount{}
+		g.blocked[key] = c
+	}
+	c.attempts++
+	c.bytes += size
+}
+
+func (g *egressGateway) reportBlocked() {
+	ticker := time.NewTicker(blockedReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			g.flushBlocked()
+		}
+	}
+}
+
+func (g *egressGateway) flushBlocked() {
+	g.mu.Lock()
+	blocked, overflow := g.blocked, g.overflow
+	g.blocked, g.overflow = make(map[flowKey]*flowCount), 0
+	g.mu.Unlock()
+
+	for key, c := range blocked {
+		g.event(nodeapi.Event{
+			Type:     nodeapi.EventEgressBlocked,
+			DestIP:   key.dst,
+			DestPort: uint32(key.port),
+			Protocol: key.proto,
+			Labels: map[string]string{
+				"attempts": strconv.Itoa(c.attempts),
+				"bytes":    strconv.Itoa(c.bytes),
+			},
+		})
+	}
+	if overflow > 0 {
+		g.event(nodeapi.Event{
+			Type:   nodeapi.EventEgressBlocked,
+			Labels: map[string]string{"untracked_attempts": strconv.Itoa(overflow)},
+		})
+	}
+}
+
+// answerDNS answers every query as if it were authoritative: A records
+// resolve to the sinkhole and everything else to nothing.
+func (g *egressGateway) answerDNS(query []byte, resolver net.IP) ([]byte, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		ev := nodeapi.Event{
+			Type:     nodeapi.EventDNSQuery,
+			DestPort: 53,
+			Protocol: "udp",
+			Labels: map[string]string{
+				"name":  q.Name.String(),
+				"qtype": strings.TrimPrefix(q.Type.String(), "Type"),
+			},
+		}
+		if resolver != nil {
+			ev.DestIP = resolver.String()
+		}
+		g.event(ev)
+
+		if q.Type != dnsmessage.TypeA || q.Class != dnsmessage.ClassINET {
+			continue
+		}
+		err := b.AResource(dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		}, dnsmessage.AResource{A: g.sinkhole})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// serveHTTP records one plain HTTP request and forwards it if its host is
+// allowed; otherwise it answers 404.
+func (g *egressGateway) serveHTTP(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	body, _ := io.ReadAll(io.LimitReader(req.Body, maxCapturedBody))
+	req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+	conn.SetReadDeadline(time.Time{})
+
+	head, _ := httputil.DumpRequest(req, false)
+	dst, port := addrIPPort(conn.LocalAddr())
+	g.event(nodeapi.Event{
+		Type:     nodeapi.EventHTTPRequest,
+		DestIP:   dst,
+		DestPort: uint32(port),
+		Protocol: "tcp",
+		Labels: map[string]string{
+			"method":     req.Method,
+			"host":       req.Host,
+			"uri":        req.URL.RequestURI(),
+			"user_agent": req.UserAgent(),
+		},
+		Payload: append(head, body...),
+	})
+
+	host := hostOnly(req.Host)
+	if !g.allowed(host) {
+		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	upstream, err := g.dialUpstream(host, port)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+
+	// One request per connection so every request is seen.
+	req.Close = true
+	g.forward(host, port, conn, upstream, req.Write)
+}
+
+// serveTLS records the server name of a TLS client hello and forwards the
+// connection if the name is allowed. The TLS session itself is not
+// intercepted.
+func (g *egressGateway) serveTLS(conn net.Conn) {
+	defer conn.Close()
+
+	sniff := &sniffConn{Conn: conn}
+	var serverName string
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	tls.Server(sniff, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloCaptured
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	if sniff.read.Len() == 0 {
+		return
+	}
+
+	dst, port := addrIPPort(conn.LocalAddr())
+	g.event(nodeapi.Event{
+		Type:     nodeapi.EventTLSClientHello,
+		DestIP:   dst,
+		DestPort: uint32(port),
+		Protocol: "tcp",
+		Labels:   map[string]string{"server_name": serverName},
+	})
+
+	if serverName == "" || !g.allowed(serverName) {
+		return
+	}
+	upstream, err := g.dialUpstream(serverName, port)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	g.forward(serverName, port, conn, upstream, func(w io.Writer) error {
+		_, err := w.Write(sniff.read.Bytes())
+		return err
+	})
+}
+
+// sniffConn keeps what is read and swallows what is written, so a TLS
+// handshake can be started to parse the client hello without the client
+// seeing it.
+type sniffConn struct {
+	net.Conn
+	read bytes.Buffer
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Write(p[:n])
+	return n, err
+}
+
+func (c *sniffConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (g *egressGateway) allowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range g.policy.AllowHosts {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// dialUpstream connects to an allowed host from the node's own network.
+func (g *egressGateway) dialUpstream(host string, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	conn, err := g.dial(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"session_id": g.sessionID,
+			"host":       host,
+		}).Debug("failed to reach allowed egress host")
+		return nil, err
+	}
+	g.track(conn)
+	return conn, nil
+}
+
+// forward sends what first writes and then relays both ways within the
+// session's bandwidth caps.
+func (g *egressGateway) forward(host string, port uint16, conn, upstream net.Conn, first func(io.Writer) error) {
+	out := &limitedWriter{g: g, w: upstream}
+	in := &limitedWriter{g: g, w: conn}
+	defer func() {
+		g.event(nodeapi.Event{
+			Type:     nodeapi.EventEgressAllowed,
+			DestPort: uint32(port),
+			Protocol: "tcp",
+			Labels: map[string]string{
+				"host":           host,
+				"bytes_sent":     strconv.FormatInt(out.n, 10),
+				"bytes_received": strconv.FormatInt(in.n, 10),
+			},
+		})
+	}()
+
+	if err := first(out); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(out, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(in, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	// Unblock the other direction before reading the counters.
+	conn.Close()
+	upstream.Close()
+	<-done
+}
+
+var errEgressBudget = errors.New("egress byte budget exhausted")
+
+// limitedWriter charges what passes through against the session's rate
+// limit and byte budget.
+type limitedWriter struct {
+	g *egressGateway
+	w io.Writer
+	n int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), lw.g.limiter.Burst())]
+		if lw.g.budget.Add(-int64(len(chunk))) < 0 {
+			log.WithField("session_id", lw.g.sessionID).Warn("session egress byte budget exhausted")
+			return written, errEgressBudget
+		}
+		if err := lw.g.limiter.WaitN(context.Background(), len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := lw.w.Write(chunk)
+		written += n
+		lw.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+type ipv4Packet struct {
+	proto   string
+	src     net.IP
+	dst     net.IP
+	srcPort uint16
+	dstPort uint16
+	syn     bool
+	ack     bool
+	length  int
+}
+
+// parseIPv4 decodes the headers of a TCP or UDP packet as read from a raw
+// IPv4 socket.
+func parseIPv4(b []byte) (ipv4Packet, bool) {
+	var p ipv4Packet
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return p, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl+4 {
+		return p, false
+	}
+	p.length = int(binary.BigEndian.Uint16(b[2:4]))
+	p.src = net.IP(b[12:16])
+	p.dst = net.IP(b[16:20])
+	l4 := b[ihl:]
+	p.srcPort = binary.BigEndian.Uint16(l4[0:2])
+	p.dstPort = binary.BigEndian.Uint16(l4[2:4])
+	switch b[9] {
+	case 6:
+		if len(l4) < 14 {
+			return p, false
+		}
+		p.proto = "tcp"
+		p.syn = l4[13]&0x02 != 0
+		p.ack = l4[13]&0x10 != 0
+	case 17:
+		p.proto = "udp"
+	default:
+		return p, false
+	}
+	return p, true
+}
+
+func addrIPPort(addr net.Addr) (string, uint16) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String(), uint16(a.Port)
+	case *net.UDPAddr:
+		return a.IP.String(), uint16(a.Port)
+	}
+	return "", 0
+}
+
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
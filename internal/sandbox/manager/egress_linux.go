@@ -0,0 +1,195 @@
+package manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+
+	"gimpel/internal/sandbox/config"
+)
+
+// startEgress routes every IPv4 destination of the environment back into
+// its own namespace and serves the gateway there. IPv6 is left without a
+// route, so it fails without being reported.
+func (m *Manager) startEgress(sessionID string, env Environment, policy *config.EgressConfig) (*egressGateway, error) {
+	nsEnv, ok := env.(*nsEnvironment)
+	if !ok {
+		return nil, fmt.Errorf("environment has no network namespace")
+	}
+	pid := nsEnv.pid
+
+	if err := inNetns(pid, routeAllToLoopback); err != nil {
+		return nil, fmt.Errorf("routing egress to gateway: %w", err)
+	}
+
+	g := newEgressGateway(sessionID, policy, m.emit)
+	fail := func(err error) (*egressGateway, error) {
+		g.Close()
+		return nil, err
+	}
+
+	var dns net.PacketConn
+	err := inNetns(pid, func() error {
+		var err error
+		dns, err = net.ListenPacket("udp4", "0.0.0.0:53")
+		return err
+	})
+	if err != nil {
+		return fail(fmt.Errorf("listening for DNS: %w", err))
+	}
+	g.track(dns)
+	go g.serveDNS(dns)
+
+	if policy.CaptureHTTP {
+		for port, serve := range map[int]func(net.Conn){80: g.serveHTTP, 443: g.serveTLS} {
+			var ln net.Listener
+			err := inNetns(pid, func() error {
+				var err error
+				ln, err = net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", port))
+				return err
+			})
+			if err != nil {
+				return fail(fmt.Errorf("listening on port %d: %w", port, err))
+			}
+			g.track(ln)
+			go acceptLoop(ln, serve)
+		}
+	}
+
+	for _, proto := range []int{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+		var raw *os.File
+		err := inNetns(pid, func() error {
+			fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, proto)
+			if err != nil {
+				return err
+			}
+			raw = os.NewFile(uintptr(fd), "egress-raw")
+			return nil
+		})
+		if err != nil {
+			return fail(fmt.Errorf("opening raw socket: %w", err))
+		}
+		g.track(raw)
+		go g.watch(raw)
+	}
+
+	return g, nil
+}
+
+func acceptLoop(ln net.Listener, serve func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go serve(conn)
+	}
+}
+
+// serveDNS answers queries from the address they were sent to, which with
+// every destination local is whatever resolver the environment asked.
+func (g *egressGateway) serveDNS(conn net.PacketConn) {
+	pc := ipv4.NewPacketConn(conn)
+	if err := pc.SetControlMessage(ipv4.FlagDst, true); err != nil {
+		log.WithError(err).WithField("session_id", g.sessionID).Warn("DNS sinkhole cannot see query destinations")
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, cm, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var resolver net.IP
+		var reply *ipv4.ControlMessage
+		if cm != nil {
+			resolver = cm.Dst
+			reply = &ipv4.ControlMessage{Src: cm.Dst}
+		}
+		resp, err := g.answerDNS(buf[:n], resolver)
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(resp, reply, src)
+	}
+}
+
+// watch reads what the environment sends through a raw socket.
+func (g *egressGateway) watch(raw *os.File) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := raw.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.WithError(err).WithField("session_id", g.sessionID).Debug("egress watch stopped")
+			}
+			return
+		}
+		g.observe(buf[:n])
+	}
+}
+
+// routeAllToLoopback adds "local 0.0.0.0/0 dev lo" to the local table, so
+// every IPv4 address is treated as the namespace's own.
+func routeAllToLoopback() error {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return err
+	}
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	const size = unix.SizeofNlMsghdr + unix.SizeofRtMsg + unix.SizeofRtAttr + 4
+	msg := make([]byte, size)
+	ne := binary.NativeEndian
+	ne.PutUint32(msg[0:], size)
+	ne.PutUint16(msg[4:], unix.RTM_NEWROUTE)
+	ne.PutUint16(msg[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK|unix.NLM_F_CREATE|unix.NLM_F_EXCL)
+	ne.PutUint32(msg[8:], 1)
+
+	rt := msg[unix.SizeofNlMsghdr:]
+	rt[0] = unix.AF_INET
+	rt[4] = unix.RT_TABLE_LOCAL
+	rt[5] = unix.RTPROT_BOOT
+	rt[6] = unix.RT_SCOPE_HOST
+	rt[7] = unix.RTN_LOCAL
+
+	attr := rt[unix.SizeofRtMsg:]
+	ne.PutUint16(attr[0:], unix.SizeofRtAttr+4)
+	ne.PutUint16(attr[2:], unix.RTA_OIF)
+	ne.PutUint32(attr[4:], uint32(lo.Index))
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type == unix.NLMSG_ERROR && len(m.Data) >= 4 {
+			if errno := int32(ne.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no netlink acknowledgement")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package manager
+
+import (
+	"fmt"
+
+	"gimpel/internal/sandbox/config"
+)
+
+func (m *Manager) startEgress(sessionID string, env Environment, policy *config.EgressConfig) (*egressGateway, error) {
+	return nil, fmt.Errorf("egress control needs Linux")
+}
@@ -0,0 +1,161 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"gimpel/internal/sandbox/config"
+	"gimpel/pkg/nodeapi"
+)
+
+type eventLog struct {
+	mu     sync.Mutex
+	events []nodeapi.Event
+}
+
+func (l *eventLog) emit(ev nodeapi.Event) {
+	l.mu.Lock()
+	l.events = append(l.events, ev)
+	l.mu.Unlock()
+}
+
+func (l *eventLog) ofType(typ string) []nodeapi.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []nodeapi.Event
+	for _, ev := range l.events {
+		if ev.Type == typ {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func testGateway(t *testing.T, policy config.EgressConfig) (*egressGateway, *eventLog) {
+	t.Helper()
+	policy.Enabled = true
+	cfg := config.SandboxConfig{ListenAddress: ":5000", Egress: policy}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	events := &eventLog{}
+	g := newEgressGateway("hi-1", &cfg.Egress, events.emit)
+	t.Cleanup(func() { g.Close() })
+	return g, events
+}
+
+func TestEgressDNSSinkhole(t *testing.T) {
+	g, events := testGateway(t, config.EgressConfig{Sinkhole: "192.0.2.53"})
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("c2.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, _ := b.Finish()
+
+	resp, err := g.answerDNS(query, net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("answerDNS: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatalf("unpacking answer: %v", err)
+	}
+	if msg.ID != 7 || len(msg.Answers) != 1 {
+		t.Fatalf("answer id %d with %d records, want 7 with 1", msg.ID, len(msg.Answers))
+	}
+	if a := msg.Answers[0].Body.(*dnsmessage.AResource).A; net.IP(a[:]).String() != "192.0.2.53" {
+		t.Errorf("resolved to %v, want the sinkhole", a)
+	}
+
+	queries := events.ofType(nodeapi.EventDNSQuery)
+	if len(queries) != 1 || queries[0].Labels["name"] != "c2.example." || queries[0].DestIP != "8.8.8.8" {
+		t.Errorf("dns events = %+v", queries)
+	}
+}
+
+func TestEgressBlockedReport(t *testing.T) {
+	g, events := testGateway(t, config.EgressConfig{CaptureHTTP: true})
+
+	syn := func(dst [4]byte, port uint16, flags byte) []byte {
+		pkt := make([]byte, 40)
+		pkt[0], pkt[3], pkt[9] = 0x45, 40, 6
+		copy(pkt[12:], []byte{10, 0, 0, 1})
+		copy(pkt[16:], dst[:])
+		pkt[22], pkt[23] = byte(port>>8), byte(port)
+		pkt[33] = flags
+		return pkt
+	}
+	g.observe(syn([4]byte{192, 0, 2, 7}, 6667, 0x02))
+	g.observe(syn([4]byte{192, 0, 2, 7}, 6667, 0x02))
+	g.observe(syn([4]byte{192, 0, 2, 7}, 6667, 0x12)) // SYN-ACK
+	g.observe(syn([4]byte{192, 0, 2, 7}, 80, 0x02))   // captured
+	g.observe(syn([4]byte{127, 0, 0, 1}, 22, 0x02))   // inside
+	g.flushBlocked()
+
+	blocked := events.ofType(nodeapi.EventEgressBlocked)
+	if len(blocked) != 1 {
+		t.Fatalf("got %d blocked events, want 1: %+v", len(blocked), blocked)
+	}
+	ev := blocked[0]
+	if ev.DestIP != "192.0.2.7" || ev.DestPort != 6667 || ev.Protocol != "tcp" || ev.Labels["attempts"] != "2" || ev.Labels["bytes"] != "80" {
+		t.Errorf("blocked event = %+v", ev)
+	}
+}
+
+func TestEgressHTTPCapture(t *testing.T) {
+	g, events := testGateway(t, config.EgressConfig{CaptureHTTP: true, AllowHosts: []string{"*.ubuntu.com"}})
+
+	var dialed string
+	g.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			req, err := http.ReadRequest(bufio.NewReader(server))
+			if err != nil {
+				return
+			}
+			io.WriteString(server, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+			req.Body.Close()
+		}()
+		return client, nil
+	}
+
+	get := func(host string) string {
+		client, server := net.Pipe()
+		go g.serveHTTP(server)
+		defer client.Close()
+		io.WriteString(client, "GET /payload HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatalf("GET %s: %v", host, err)
+		}
+		return resp.Status
+	}
+
+	if status := get("evil.example"); !strings.HasPrefix(status, "404") {
+		t.Errorf("denied host answered %s, want 404", status)
+	}
+	if dialed != "" {
+		t.Errorf("denied host was dialed: %s", dialed)
+	}
+	if status := get("archive.ubuntu.com"); !strings.HasPrefix(status, "200") {
+		t.Errorf("allowed host answered %s, want 200", status)
+	}
+	if host, _, _ := net.SplitHostPort(dialed); host != "archive.ubuntu.com" {
+		t.Errorf("dialed %q, want archive.ubuntu.com", dialed)
+	}
+
+	reqs := events.ofType(nodeapi.EventHTTPRequest)
+	if len(reqs) != 2 || reqs[0].Labels["host"] != "evil.example" || reqs[0].Labels["uri"] != "/payload" {
+		t.Errorf("http events = %+v", reqs)
+	}
+}
@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/pkg/nodeapi"
+)
+
+const (
+	maxPendingEvents = 10000
+	eventBatchSize   = 500
+)
+
+// EventSink takes session telemetry, typically by sending it to the
+// master.
+type EventSink interface {
+	StoreEvents(ctx context.Context, events []nodeapi.Event) error
+}
+
+// SetEventSink sets where session telemetry goes. Without one it is only
+// logged.
+func (m *Manager) SetEventSink(sink EventSink) {
+	m.mu.Lock()
+	m.eventSink = sink
+	m.mu.Unlock()
+}
+
+// emit queues an event until the next flush. Once maxPendingEvents are
+// waiting the oldest are dropped.
+func (m *Manager) emit(ev nodeapi.Event) {
+	m.mu.RLock()
+	sink := m.eventSink
+	m.mu.RUnlock()
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	log.WithFields(log.Fields{
+		"session_id": ev.SessionID,
+		"type":       ev.Type,
+		"dest_ip":    ev.DestIP,
+		"dest_port":  ev.DestPort,
+	}).Debug("session event")
+	if sink == nil {
+		return
+	}
+
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	if len(m.events) >= maxPendingEvents {
+		m.events = m.events[1:]
+		m.droppedEvents++
+	}
+	m.events = append(m.events, ev)
+}
+
+// FlushEvents hands queued events to the sink in batches. Batches it fails
+// on are put back and retried on the next flush.
+func (m *Manager) FlushEvents(ctx context.Context) {
+	m.mu.RLock()
+	sink := m.eventSink
+	m.mu.RUnlock()
+	if sink == nil {
+		return
+	}
+
+	m.eventsMu.Lock()
+	events := m.events
+	m.events = nil
+	if m.droppedEvents > 0 {
+		log.WithField("dropped", m.droppedEvents).Warn("session event queue overflowed")
+		m.droppedEvents = 0
+	}
+	m.eventsMu.Unlock()
+
+	for len(events) > 0 {
+		n := min(len(events), eventBatchSize)
+		if err := sink.StoreEvents(ctx, events[:n]); err != nil {
+			log.WithError(err).Warn("failed to send session events")
+			m.eventsMu.Lock()
+			m.events = append(events, m.events...)
+			if over := len(m.events) - maxPendingEvents; over > 0 {
+				m.events = m.events[over:]
+				m.droppedEvents += over
+			}
+			m.eventsMu.Unlock()
+			return
+		}
+		events = events[n:]
+	}
+}
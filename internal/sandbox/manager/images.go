@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/sandbox/config"
+)
+
+// imageImporter is a backend that loads images from archives.
+type imageImporter interface {
+	Import(ctx context.Context, ref string, r io.Reader) error
+	Delete(ctx context.Context, ref string) error
+}
+
+func (m *Manager) importer() (imageImporter, error) {
+	importer, ok := m.backends["containerd"].(imageImporter)
+	if !ok {
+		return nil, fmt.Errorf("backend containerd is not available")
+	}
+	return importer, nil
+}
+
+// ImportImage loads an image archive into containerd as ref and offers it
+// to sessions as name, with its service on port. An image imported under
+// name before is deleted.
+func (m *Manager) ImportImage(ctx context.Context, name, ref string, port int, r io.Reader) error {
+	importer, err := m.importer()
+	if err != nil {
+		return err
+	}
+	if err := importer.Import(ctx, ref, r); err != nil {
+		return fmt.Errorf("importing image %s: %w", name, err)
+	}
+
+	m.mu.RLock()
+	prev, ok := m.catalog[name]
+	m.mu.RUnlock()
+	if err := m.AddImage(name, ref, port); err != nil {
+		importer.Delete(ctx, ref)
+		return err
+	}
+	if ok && prev.Ref != ref {
+		if err := importer.Delete(ctx, prev.Ref); err != nil {
+			log.WithError(err).WithField("ref", prev.Ref).Warn("failed to delete replaced image")
+		}
+	}
+	return nil
+}
+
+// AddImage offers an image already in containerd to sessions as name.
+// Images in the config take precedence, and imported images are not
+// pooled.
+func (m *Manager) AddImage(name, ref string, port int) error {
+	if m.cfg.Egress.Reserves(port) {
+		return fmt.Errorf("image %s: port %d is taken by the egress gateway", name, port)
+	}
+	m.mu.Lock()
+	m.catalog[name] = config.ImageConfig{
+		Backend:  "containerd",
+		Ref:      ref,
+		Port:     port,
+		Egress:   &m.cfg.Egress,
+		Imported: true,
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// RemoveImage withdraws an imported image and deletes it from containerd.
+// Sessions already running it are left alone.
+func (m *Manager) RemoveImage(ctx context.Context, name string) error {
+	m.mu.Lock()
+	img, ok := m.catalog[name]
+	delete(m.catalog, name)
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	importer, err := m.importer()
+	if err != nil {
+		return err
+	}
+	return importer.Delete(ctx, img.Ref)
+}
+
+// Images lists the images sessions can ask for by name.
+func (m *Manager) Images() []string {
+	m.mu.RLock()
+	images := make([]string, 0, len(m.cfg.Images)+len(m.catalog))
+	for name := range m.catalog {
+		if _, ok := m.cfg.Images[name]; !ok {
+			images = append(images, name)
+		}
+	}
+	m.mu.RUnlock()
+	for name := range m.cfg.Images {
+		images = append(images, name)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// imageConfig returns how image is run. Only configured and imported
+// images are run; anything else would be pulled without a signature check.
+func (m *Manager) imageConfig(image string) (config.ImageConfig, error) {
+	if img, ok := m.cfg.Images[image]; ok {
+		return img, nil
+	}
+	m.mu.RLock()
+	img, ok := m.catalog[image]
+	m.mu.RUnlock()
+	if !ok {
+		return config.ImageConfig{}, fmt.Errorf("image %s is neither configured nor installed", image)
+	}
+	return img, nil
+}
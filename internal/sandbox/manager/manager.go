@@ -1,14 +1,33 @@
 package manager
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"gimpel/internal/sandbox/config"
+	"gimpel/pkg/nodeapi"
+	"gimpel/pkg/tunnel"
+)
+
+const (
+	dialTimeout    = 5 * time.Second
+	stopTimeout    = 30 * time.Second
+	readyPollDelay = 200 * time.Millisecond
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrCapacity        = errors.New("session limit reached")
 )
 
 type Session struct {
@@ -18,67 +37,415 @@ type Session struct {
 	Port      int
 	TunnelKey []byte
 	CreatedAt time.Time
+	// Pooled is set if the session got a paused environment from its
+	// image's pool rather than one started for it.
+	Pooled bool
+
+	env      Environment
+	egress   *egressGateway
+	listener net.Listener
+	tunnels  atomic.Int32
 }
 
 type Manager struct {
-	cfg *config.SandboxConfig
+	cfg      *config.SandboxConfig
+	backends map[string]Backend
+	ports    *portPool
+
+	pools      map[string]*pool
+	poolCancel context.CancelFunc
+	poolWG     sync.WaitGroup
 
-	mu       sync.RWMutex
-	sessions map[string]*Session
-	nextPort int
+	mu           sync.RWMutex
+	sessions     map[string]*Session
+	catalog      map[string]config.ImageConfig
+	sink         RecordingSink
+	eventSink    EventSink
+	artifactSink ArtifactSink
+
+	flushMu         sync.Mutex
+	artifactFlushMu sync.Mutex
+
+	eventsMu      sync.Mutex
+	events        []nodeapi.Event
+	droppedEvents int
 }
 
 func New(cfg *config.SandboxConfig) *Manager {
 	return &Manager{
 		cfg:      cfg,
+		backends: newBackends(cfg),
+		ports:    newPortPool(cfg.PortMin, cfg.PortMax),
+		pools:    newPools(cfg),
 		sessions: make(map[string]*Session),
-		nextPort: 6000,
+		catalog:  make(map[string]config.ImageConfig),
 	}
 }
 
-func (m *Manager) CreateSession(sessionID, image string, env map[string]string) (*Session, error) {
+// CreateSession launches an environment from image and exposes its service
+// on a port from the configured range.
+func (m *Manager) CreateSession(ctx context.Context, sessionID, image string, env map[string]string) (*Session, error) {
+	m.mu.Lock()
+	if _, ok := m.sessions[sessionID]; ok {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("session %s already exists", sessionID)
+	}
+	if len(m.sessions) >= m.cfg.MaxSessions {
+		m.mu.Unlock()
+		return nil, ErrCapacity
+	}
+	// Reserve the ID while the environment starts.
+	m.sessions[sessionID] = nil
+	m.mu.Unlock()
+
+	session, err := m.createSession(ctx, sessionID, image, env)
+
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	if err != nil {
+		delete(m.sessions, sessionID)
+	} else {
+		m.sessions[sessionID] = session
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go m.serve(session)
+	go m.watch(session)
+
+	log.WithFields(log.Fields{
+		"session_id": sessionID,
+		"image":      session.Image,
+		"port":       session.Port,
+		"pooled":     session.Pooled,
+	}).Info("session created")
+
+	return session, nil
+}
 
-	port := m.nextPort
-	m.nextPort++
+func (m *Manager) createSession(ctx context.Context, sessionID, image string, env map[string]string) (*Session, error) {
+	if image == "" {
+		image = m.cfg.DefaultImage
+	}
+	if image == "" {
+		return nil, fmt.Errorf("no image requested and no default_image configured")
+	}
+	imgCfg, err := m.imageConfig(image)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := m.backend(imgCfg)
+	if err != nil {
+		return nil, err
+	}
 
 	tunnelKey := make([]byte, 32)
 	if _, err := rand.Read(tunnelKey); err != nil {
 		return nil, fmt.Errorf("generating tunnel key: %w", err)
 	}
 
-	session := &Session{
+	port, ln, err := m.bindPort()
+	if err != nil {
+		return nil, err
+	}
+
+	// Pooled environments were started with the image's env only.
+	var environment Environment
+	var egress *egressGateway
+	if envCovered(env, imgCfg.Env) {
+		environment, egress, err = m.warmEnvironment(ctx, sessionID, image, imgCfg)
+		if err != nil {
+			log.WithError(err).WithField("session_id", sessionID).Warn("pooled environment unusable, starting a new one")
+		}
+	}
+	pooled := environment != nil
+	if !pooled {
+		environment, egress, err = m.startEnvironment(ctx, sessionID, imgCfg, backend, env)
+		if err != nil {
+			ln.Close()
+			m.ports.release(port)
+			return nil, err
+		}
+	}
+
+	return &Session{
 		ID:        sessionID,
 		Image:     image,
 		Env:       env,
 		Port:      port,
 		TunnelKey: tunnelKey,
 		CreatedAt: time.Now(),
+		Pooled:    pooled,
+		env:       environment,
+		egress:    egress,
+		listener:  ln,
+	}, nil
+}
+
+// envCovered reports whether base already sets every variable in env to
+// the same value.
+func envCovered(env, base map[string]string) bool {
+	for k, v := range env {
+		if bv, ok := base[k]; !ok || bv != v {
+			return false
+		}
 	}
+	return true
+}
 
-	m.sessions[sessionID] = session
+func (m *Manager) backend(imgCfg config.ImageConfig) (Backend, error) {
+	name := imgCfg.Backend
+	if name == "" {
+		name = "containerd"
+	}
+	backend, ok := m.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("backend %s is not available", name)
+	}
+	return backend, nil
+}
 
-	log.WithFields(log.Fields{
-		"session_id": sessionID,
-		"image":      image,
-		"port":       port,
-	}).Info("session created")
+// startEnvironment starts an environment for a session and waits until
+// its service is up.
+func (m *Manager) startEnvironment(ctx context.Context, sessionID string, imgCfg config.ImageConfig, backend Backend, env map[string]string) (Environment, *egressGateway, error) {
+	envVars := make(map[string]string, len(imgCfg.Env)+len(env))
+	for k, v := range imgCfg.Env {
+		envVars[k] = v
+	}
+	for k, v := range env {
+		envVars[k] = v
+	}
 
-	return session, nil
+	startCtx, cancel := context.WithTimeout(ctx, m.cfg.StartTimeout)
+	defer cancel()
+
+	environment, err := backend.Start(startCtx, &EnvironmentSpec{ID: sessionID, Image: imgCfg, Env: envVars})
+	if err != nil {
+		return nil, nil, fmt.Errorf("starting %s environment: %w", backend.Name(), err)
+	}
+
+	var egress *egressGateway
+	if imgCfg.Egress != nil && imgCfg.Egress.Enabled {
+		egress, err = m.startEgress(sessionID, environment, imgCfg.Egress)
+		if err != nil {
+			stopEnvironment(environment)
+			return nil, nil, fmt.Errorf("starting egress gateway: %w", err)
+		}
+	}
+	if err := waitReady(startCtx, environment); err != nil {
+		if egress != nil {
+			egress.Close()
+		}
+		stopEnvironment(environment)
+		return nil, nil, fmt.Errorf("waiting for environment: %w", err)
+	}
+	environment.Baseline()
+	return environment, egress, nil
 }
 
-func (m *Manager) StopSession(sessionID string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// bindPort takes ports from the pool until one can be listened on.
+func (m *Manager) bindPort() (int, net.Listener, error) {
+	for attempts := m.ports.available(); attempts > 0; attempts-- {
+		port, err := m.ports.allocate()
+		if err != nil {
+			return 0, nil, err
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(m.cfg.BindAddress, strconv.Itoa(port)))
+		if err == nil {
+			return port, ln, nil
+		}
+		log.WithError(err).WithField("port", port).Warn("session port unavailable")
+		m.ports.release(port)
+	}
+	return 0, nil, ErrNoPorts
+}
+
+// waitReady polls the environment's service until it accepts connections.
+func waitReady(ctx context.Context, env Environment) error {
+	for {
+		conn, err := env.Dial(ctx)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-env.Done():
+			return fmt.Errorf("environment exited during startup")
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(readyPollDelay):
+		}
+	}
+}
+
+// serve forwards connections on the session's endpoint into the
+// environment.
+func (m *Manager) serve(session *Session) {
+	for {
+		conn, err := session.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+
+			// Only the agent holding the session's tunnel key gets through.
+			tc, err := tunnel.Server(conn, func(id string) ([]byte, bool) {
+				return session.TunnelKey, id == session.ID
+			})
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"session_id": session.ID,
+					"peer":       conn.RemoteAddr().String(),
+				}).Warn("rejected tunnel connection")
+				return
+			}
+			defer tc.Close()
+
+			meta := tc.Metadata()
+			log.WithFields(log.Fields{
+				"session_id": session.ID,
+				"source":     net.JoinHostPort(meta.SourceIP, strconv.Itoa(int(meta.SourcePort))),
+			}).Info("tunnel established")
+
+			if meta.Transcript {
+				m.recordTranscript(session, tc)
+				return
+			}
+
+			var in io.Reader = tc
+			var out io.Writer = tc
+			rec := m.startRecording(session, meta)
+			if rec != nil {
+				in = io.TeeReader(tc, rec.input())
+				out = io.MultiWriter(tc, rec.output())
+				defer m.finishRecording(rec)
+			}
+			tc.OnResize(func(size tunnel.WindowSize) {
+				log.WithFields(log.Fields{
+					"session_id": session.ID,
+					"cols":       size.Cols,
+					"rows":       size.Rows,
+				}).Debug("terminal resized")
+				if rec != nil {
+					rec.resize(size)
+				}
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			envConn, err := session.env.Dial(ctx)
+			cancel()
+			if err != nil {
+				log.WithError(err).WithField("session_id", session.ID).Warn("failed to reach session environment")
+				return
+			}
+			defer envConn.Close()
+
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(envConn, in)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(out, envConn)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+// watch stops a session whose environment exits on its own.
+func (m *Manager) watch(session *Session) {
+	<-session.env.Done()
 
-	if _, ok := m.sessions[sessionID]; !ok {
-		return fmt.Errorf("session not found")
+	m.mu.RLock()
+	current := m.sessions[session.ID]
+	m.mu.RUnlock()
+	if current != session {
+		return
 	}
 
+	log.WithField("session_id", session.ID).Warn("session environment exited")
+	m.StopSession(session.ID)
+}
+
+// Count returns the number of sessions, including those still starting.
+func (m *Manager) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
+
+// SessionIDs returns the IDs of the sessions that have started.
+func (m *Manager) SessionIDs() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.sessions))
+	for id, session := range m.sessions {
+		if session != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (m *Manager) StopSession(sessionID string) error {
+	m.mu.Lock()
+	session, ok := m.sessions[sessionID]
+	if !ok || session == nil {
+		m.mu.Unlock()
+		return ErrSessionNotFound
+	}
 	delete(m.sessions, sessionID)
+	m.mu.Unlock()
+
+	session.listener.Close()
 
+	// Files the session left behind are collected before the environment
+	// is removed.
+	collect := m.collector(session)
+	timeout := stopTimeout
+	if collect != nil {
+		timeout += collectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := session.env.Stop(ctx, collect)
+	if session.egress != nil {
+		session.egress.Close()
+	}
+	m.ports.release(session.Port)
+	if collect != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+			defer cancel()
+			m.FlushArtifacts(ctx)
+		}()
+	}
+
+	if err != nil {
+		log.WithError(err).WithField("session_id", sessionID).Warn("failed to clean up session environment")
+	}
 	log.WithField("session_id", sessionID).Info("session stopped")
 
-	return nil
+	return err
+}
+
+// Close stops every session and empties the pools.
+func (m *Manager) Close() {
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.sessions))
+	for id, session := range m.sessions {
+		if session != nil {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, id := range ids {
+		m.StopSession(id)
+	}
+	m.closePools()
 }
@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// inNetns runs fn on a thread switched into the network namespace of pid.
+// Sockets created by fn stay in that namespace.
+func inNetns(pid int, fn func() error) error {
+	target, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return fmt.Errorf("opening network namespace: %w", err)
+	}
+	defer target.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// If the thread cannot be switched back it stays locked and is
+		// discarded when this goroutine exits.
+		runtime.LockOSThread()
+
+		orig, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("opening current network namespace: %w", err)
+			return
+		}
+		defer orig.Close()
+
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("entering network namespace: %w", err)
+			return
+		}
+		err = fn()
+		if unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		errCh <- err
+	}()
+	return <-errCh
+}
+
+// dialNetns connects to addr from inside the network namespace of pid.
+func dialNetns(ctx context.Context, pid int, addr string) (net.Conn, error) {
+	var conn net.Conn
+	err := inNetns(pid, func() error {
+		var d net.Dialer
+		var err error
+		conn, err = d.DialContext(ctx, "tcp", addr)
+		return err
+	})
+	return conn, err
+}
+
+// loopbackUp brings up lo in the network namespace of pid; a fresh
+// namespace starts with it down.
+func loopbackUp(pid int) error {
+	return inNetns(pid, func() error {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+
+		ifr, err := unix.NewIfreq("lo")
+		if err != nil {
+			return err
+		}
+		if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+			return fmt.Errorf("reading lo flags: %w", err)
+		}
+		ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+		if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+			return fmt.Errorf("bringing up lo: %w", err)
+		}
+		return nil
+	})
+}
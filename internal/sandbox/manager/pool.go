@@ -0,0 +1,303 @@
+package manager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/sandbox/config"
+	"gimpel/pkg/nodeapi"
+)
+
+const maxPoolBackoff = time.Minute
+
+// pool keeps started, paused environments of one image for sessions to
+// take. It is refilled one environment at a time.
+type pool struct {
+	image string
+	cfg   config.ImageConfig
+	wake  chan struct{}
+
+	mu        sync.Mutex
+	ready     []*warmEnv
+	starting  bool
+	hits      uint64
+	misses    uint64
+	failures  uint64
+	startTime time.Duration
+}
+
+type warmEnv struct {
+	id  string
+	env Environment
+}
+
+func newPools(cfg *config.SandboxConfig) map[string]*pool {
+	pools := make(map[string]*pool)
+	for name, img := range cfg.Images {
+		if img.PoolSize > 0 {
+			pools[name] = &pool{image: name, cfg: img, wake: make(chan struct{}, 1)}
+		}
+	}
+	return pools
+}
+
+func (p *pool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take removes the oldest ready environment, or returns nil if there is
+// none.
+func (p *pool) take() *warmEnv {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.ready) == 0 {
+		p.misses++
+		return nil
+	}
+	w := p.ready[0]
+	p.ready = p.ready[1:]
+	p.hits++
+	p.signal()
+	return w
+}
+
+func (p *pool) remove(w *warmEnv) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, r := range p.ready {
+		if r == w {
+			p.ready = append(p.ready[:i], p.ready[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pool) needed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.ready) < p.cfg.PoolSize
+}
+
+func (p *pool) stats() nodeapi.PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	starting := 0
+	if p.starting {
+		starting = 1
+	}
+	return nodeapi.PoolStats{
+		Image:     p.image,
+		Size:      p.cfg.PoolSize,
+		Ready:     len(p.ready),
+		Starting:  starting,
+		Hits:      p.hits,
+		Misses:    p.misses,
+		Failures:  p.failures,
+		StartTime: p.startTime.Seconds(),
+	}
+}
+
+// StartPools begins filling the pools of images with a pool_size.
+func (m *Manager) StartPools() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.poolCancel = cancel
+	for _, p := range m.pools {
+		m.poolWG.Add(1)
+		go func() {
+			defer m.poolWG.Done()
+			m.fill(ctx, p)
+		}()
+	}
+}
+
+// PoolStats describes every pool, by image name.
+func (m *Manager) PoolStats() []nodeapi.PoolStats {
+	stats := make([]nodeapi.PoolStats, 0, len(m.pools))
+	for _, p := range m.pools {
+		stats = append(stats, p.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Image < stats[j].Image })
+	return stats
+}
+
+// fill keeps p topped up until ctx is done, backing off while the image
+// fails to start.
+func (m *Manager) fill(ctx context.Context, p *pool) {
+	logger := log.WithField("image", p.image)
+	failures := 0
+	for {
+		for !p.needed() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake:
+			}
+		}
+
+		p.mu.Lock()
+		p.starting = true
+		p.mu.Unlock()
+
+		start := time.Now()
+		w, err := m.startWarm(ctx, p)
+
+		p.mu.Lock()
+		p.starting = false
+		if err != nil {
+			p.failures++
+		} else {
+			p.ready = append(p.ready, w)
+			p.startTime = time.Since(start)
+		}
+		p.mu.Unlock()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			delay := min(time.Second<<min(failures, 6), maxPoolBackoff)
+			logger.WithError(err).WithField("retry_in", delay).Warn("failed to start pooled environment")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		failures = 0
+		logger.WithFields(log.Fields{
+			"env_id":   w.id,
+			"duration": time.Since(start),
+		}).Debug("pooled environment ready")
+		go m.watchWarm(p, w)
+	}
+}
+
+// startWarm starts an environment, waits for its service and pauses it.
+func (m *Manager) startWarm(ctx context.Context, p *pool) (*warmEnv, error) {
+	backend, err := m.backend(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	w := &warmEnv{id: hex.EncodeToString(id)}
+
+	startCtx, cancel := context.WithTimeout(ctx, m.cfg.StartTimeout)
+	defer cancel()
+	w.env, err = backend.Start(startCtx, &EnvironmentSpec{ID: w.id, Image: p.cfg, Env: p.cfg.Env})
+	if err != nil {
+		return nil, err
+	}
+	if err := waitReady(startCtx, w.env); err != nil {
+		stopEnvironment(w.env)
+		return nil, err
+	}
+	if err := w.env.Pause(startCtx); err != nil {
+		stopPaused(w.env)
+		return nil, err
+	}
+	return w, nil
+}
+
+// watchWarm drops a pooled environment that exits before it is taken.
+func (m *Manager) watchWarm(p *pool, w *warmEnv) {
+	<-w.env.Done()
+	if p.remove(w) {
+		log.WithFields(log.Fields{
+			"image":  p.image,
+			"env_id": w.id,
+		}).Warn("pooled environment exited")
+		stopEnvironment(w.env)
+		p.signal()
+	}
+}
+
+// warmEnvironment resumes a pooled environment of image for a session,
+// with egress contained before anything in it runs again. It returns nil
+// if the pool is empty or the image has none.
+func (m *Manager) warmEnvironment(ctx context.Context, sessionID, image string, imgCfg config.ImageConfig) (Environment, *egressGateway, error) {
+	p := m.pools[image]
+	if p == nil {
+		return nil, nil, nil
+	}
+	w := p.take()
+	if w == nil {
+		return nil, nil, nil
+	}
+
+	var egress *egressGateway
+	var err error
+	if imgCfg.Egress != nil && imgCfg.Egress.Enabled {
+		egress, err = m.startEgress(sessionID, w.env, imgCfg.Egress)
+	}
+	if err == nil {
+		err = w.env.Resume(ctx)
+		if err != nil && egress != nil {
+			egress.Close()
+		}
+	}
+	if err != nil {
+		stopPaused(w.env)
+		return nil, nil, err
+	}
+	w.env.Baseline()
+
+	log.WithFields(log.Fields{
+		"session_id": sessionID,
+		"env_id":     w.id,
+	}).Debug("session took pooled environment")
+	return w.env, egress, nil
+}
+
+// closePools stops filling the pools and removes what is in them.
+func (m *Manager) closePools() {
+	if m.poolCancel != nil {
+		m.poolCancel()
+	}
+	m.poolWG.Wait()
+
+	var wg sync.WaitGroup
+	for _, p := range m.pools {
+		p.mu.Lock()
+		ready := p.ready
+		p.ready = nil
+		p.mu.Unlock()
+		for _, w := range ready {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stopPaused(w.env)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// stopPaused lets a paused environment run again so it can shut down on
+// its own instead of being killed at the end of the grace period.
+func stopPaused(env Environment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	env.Resume(ctx)
+	return env.Stop(ctx, nil)
+}
+
+func stopEnvironment(env Environment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	return env.Stop(ctx, nil)
+}
@@ -0,0 +1,161 @@
+package manager
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gimpel/internal/sandbox/config"
+)
+
+type fakeBackend struct {
+	mu      sync.Mutex
+	started []*fakeEnv
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) envs() []*fakeEnv {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*fakeEnv(nil), b.started...)
+}
+
+func (b *fakeBackend) Start(ctx context.Context, spec *EnvironmentSpec) (Environment, error) {
+	env := &fakeEnv{id: spec.ID, done: make(chan struct{})}
+	b.mu.Lock()
+	b.started = append(b.started, env)
+	b.mu.Unlock()
+	return env, nil
+}
+
+type fakeEnv struct {
+	id     string
+	done   chan struct{}
+	mu     sync.Mutex
+	paused bool
+}
+
+func (e *fakeEnv) Dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func (e *fakeEnv) Stop(ctx context.Context, collect ChangeFunc) error {
+	select {
+	case <-e.done:
+	default:
+		close(e.done)
+	}
+	return nil
+}
+
+func (e *fakeEnv) Pause(ctx context.Context) error  { return e.setPaused(true) }
+func (e *fakeEnv) Resume(ctx context.Context) error { return e.setPaused(false) }
+func (e *fakeEnv) Baseline()                        {}
+
+func (e *fakeEnv) isPaused() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.paused
+}
+
+func (e *fakeEnv) setPaused(paused bool) error {
+	e.mu.Lock()
+	e.paused = paused
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *fakeEnv) Done() <-chan struct{} { return e.done }
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolHandsOutPausedEnvironments(t *testing.T) {
+	cfg := &config.SandboxConfig{
+		BindAddress:  "127.0.0.1",
+		PortMin:      20000,
+		PortMax:      20099,
+		MaxSessions:  10,
+		StartTimeout: time.Second,
+		Images: map[string]config.ImageConfig{
+			"router": {Backend: "fake", Port: 22, PoolSize: 2},
+		},
+	}
+	backend := &fakeBackend{}
+	m := New(cfg)
+	m.backends = map[string]Backend{"fake": backend}
+	m.StartPools()
+	defer m.Close()
+
+	waitFor(t, func() bool { return m.PoolStats()[0].Ready == 2 })
+	for _, env := range backend.envs() {
+		if !env.isPaused() {
+			t.Fatalf("pooled environment %s is running", env.id)
+		}
+	}
+
+	session, err := m.CreateSession(context.Background(), "hi-1", "router", nil)
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	env := session.env.(*fakeEnv)
+	if !session.Pooled || env.isPaused() || env.id == "hi-1" {
+		t.Errorf("session got env %s (pooled %v, paused %v), want a resumed pooled one", env.id, session.Pooled, env.isPaused())
+	}
+
+	// A session with its own env cannot use one.
+	session, err = m.CreateSession(context.Background(), "hi-2", "router", map[string]string{"TOKEN": "x"})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if session.Pooled {
+		t.Error("session with its own env got a pooled environment")
+	}
+
+	waitFor(t, func() bool { return m.PoolStats()[0].Ready == 2 })
+	if n := len(backend.envs()); n != 4 {
+		t.Errorf("started %d environments, want 4 after the refill", n)
+	}
+
+	// A pooled environment that dies is replaced.
+	backend.envs()[1].Stop(context.Background(), nil)
+	waitFor(t, func() bool { return len(backend.envs()) == 5 && m.PoolStats()[0].Ready == 2 })
+
+	if stats := m.PoolStats()[0]; stats.Hits != 1 || stats.Misses != 0 {
+		t.Errorf("stats = %+v, want 1 hit", stats)
+	}
+}
+
+func TestCreateSessionRejectsUnknownImage(t *testing.T) {
+	cfg := &config.SandboxConfig{
+		BindAddress:  "127.0.0.1",
+		PortMin:      20100,
+		PortMax:      20109,
+		MaxSessions:  10,
+		StartTimeout: time.Second,
+	}
+	backend := &fakeBackend{}
+	m := New(cfg)
+	m.backends = map[string]Backend{"containerd": backend}
+	defer m.Close()
+
+	if _, err := m.CreateSession(context.Background(), "hi-1", "docker.io/library/alpine", nil); err == nil {
+		t.Fatal("CreateSession ran an image that is neither configured nor installed")
+	}
+	if n := len(backend.envs()); n != 0 {
+		t.Errorf("started %d environments, want none", n)
+	}
+}
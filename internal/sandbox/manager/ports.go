@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrNoPorts = errors.New("no free session ports")
+
+// portPool hands out ports from a fixed range. Released ports go to the back
+// of the queue so a port is not reused while a stale client may still be
+// connecting to it.
+type portPool struct {
+	mu    sync.Mutex
+	free  []int
+	inUse map[int]bool
+}
+
+func newPortPool(min, max int) *portPool {
+	p := &portPool{
+		free:  make([]int, 0, max-min+1),
+		inUse: make(map[int]bool),
+	}
+	for port := min; port <= max; port++ {
+		p.free = append(p.free, port)
+	}
+	return p
+}
+
+func (p *portPool) allocate() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.free) == 0 {
+		return 0, ErrNoPorts
+	}
+	port := p.free[0]
+	p.free = p.free[1:]
+	p.inUse[port] = true
+	return port, nil
+}
+
+func (p *portPool) release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.inUse[port] {
+		return
+	}
+	delete(p.inUse, port)
+	p.free = append(p.free, port)
+}
+
+func (p *portPool) available() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.free)
+}
@@ -0,0 +1,31 @@
+package manager
+
+import "testing"
+
+func TestPortPool(t *testing.T) {
+	p := newPortPool(6000, 6002)
+
+	var got []int
+	for i := 0; i < 3; i++ {
+		port, err := p.allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, port)
+	}
+	if got[0] != 6000 || got[2] != 6002 {
+		t.Errorf("allocated %v, want 6000-6002", got)
+	}
+	if _, err := p.allocate(); err != ErrNoPorts {
+		t.Errorf("allocate() on exhausted pool = %v, want ErrNoPorts", err)
+	}
+
+	p.release(6001)
+	p.release(6001)
+	if port, err := p.allocate(); err != nil || port != 6001 {
+		t.Errorf("allocate() after release = %d, %v", port, err)
+	}
+	if p.available() != 0 {
+		t.Errorf("double release returned a port twice")
+	}
+}
@@ -0,0 +1,240 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// processBackend runs a command in new user, network, mount, PID, UTS and
+// IPC namespaces. The session is root of its user namespace, which maps
+// onto an unprivileged range of host ids, and its root is a copy-on-write
+// overlay of the image's root filesystem, set up under dir and removed
+// with the session. It needs root.
+type processBackend struct {
+	uidBase uint32
+	dir     string
+}
+
+// idRange is how many uids and gids a session's user namespace maps.
+const idRange = 65536
+
+// shimArg is the first argument of the sandbox binary when the process
+// backend starts it as a session's init shim.
+const shimArg = "__gimpel_session_init"
+
+func (b *processBackend) Name() string {
+	return "process"
+}
+
+func (b *processBackend) Start(ctx context.Context, spec *EnvironmentSpec) (Environment, error) {
+	rootfs := spec.Image.Rootfs
+	fi, err := os.Stat(rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	if uid := fi.Sys().(*syscall.Stat_t).Uid; uid < b.uidBase || uid-b.uidBase >= idRange {
+		return nil, fmt.Errorf("rootfs %s is owned by uid %d, outside the session range %d-%d", rootfs, uid, b.uidBase, b.uidBase+idRange-1)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("resolving sandbox executable: %w", err)
+	}
+
+	dir := filepath.Join(b.dir, spec.ID)
+	merged, err := mountOverlay(dir, rootfs, fi)
+	if err != nil {
+		removeOverlay(dir)
+		return nil, err
+	}
+
+	ids := []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(b.uidBase), Size: idRange}}
+	cmd := exec.Command(self, append([]string{shimArg, merged}, spec.Image.Command...)...)
+	cmd.Env = envList(spec.Env)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC,
+		UidMappings:                ids,
+		GidMappings:                ids,
+		GidMappingsEnableSetgroups: true,
+		// Host root is not mapped; without switching to the namespace's
+		// root the shim would run as the overflow uid, without capabilities.
+		Credential: &syscall.Credential{Uid: 0, Gid: 0},
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		removeOverlay(dir)
+		return nil, fmt.Errorf("starting %s: %w", spec.Image.Command[0], err)
+	}
+
+	var env *nsEnvironment
+	env = newNsEnvironment(cmd.Process.Pid, spec.Image.Port, func(ctx context.Context, collect ChangeFunc) error {
+		// The command is init of its PID namespace; everything else in the
+		// environment dies with it.
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-env.done:
+		case <-time.After(stopGracePeriod):
+			cmd.Process.Kill()
+			<-env.done
+		}
+		if collect != nil {
+			if err := diffChanges(ctx, rootfs, merged, env.baselineTime(), collect); err != nil {
+				log.WithError(err).WithField("session_id", spec.ID).Warn("failed to diff session overlay")
+			}
+		}
+		if err := removeOverlay(dir); err != nil {
+			return fmt.Errorf("removing session overlay: %w", err)
+		}
+		return nil
+	})
+	env.pause = func(context.Context) error {
+		return signalNamespace(cmd.Process.Pid, syscall.SIGSTOP)
+	}
+	env.resume = func(context.Context) error {
+		return signalNamespace(cmd.Process.Pid, syscall.SIGCONT)
+	}
+	go func() {
+		err := cmd.Wait()
+		log.WithError(err).WithField("session_id", spec.ID).Debug("session process exited")
+		close(env.done)
+	}()
+
+	if err := loopbackUp(cmd.Process.Pid); err != nil {
+		env.Stop(ctx, nil)
+		return nil, err
+	}
+	return env, nil
+}
+
+// mountOverlay mounts a writable overlay of lower at dir/rootfs, with its
+// upper and work directories next to it, and returns the mount point. The
+// overlay's root takes the owner and mode of the upper directory, so they
+// are copied from lower.
+func mountOverlay(dir, lower string, fi os.FileInfo) (string, error) {
+	if err := removeOverlay(dir); err != nil {
+		return "", fmt.Errorf("removing stale session overlay: %w", err)
+	}
+	upper, work, merged := filepath.Join(dir, "upper"), filepath.Join(dir, "work"), filepath.Join(dir, "rootfs")
+	for _, d := range []string{upper, work, merged} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return "", err
+		}
+	}
+	// The shim walks to the overlay as the session's root user, an
+	// unprivileged user on the host, so it needs search permission on the
+	// way there, as with Docker's user namespace remapping.
+	for _, d := range []string{filepath.Dir(filepath.Dir(dir)), filepath.Dir(dir), dir} {
+		if err := searchable(d); err != nil {
+			return "", err
+		}
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if err := os.Chown(upper, int(st.Uid), int(st.Gid)); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(upper, fi.Mode().Perm()); err != nil {
+		return "", err
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if err := unix.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		return "", fmt.Errorf("mounting session overlay: %w", err)
+	}
+	return merged, nil
+}
+
+func searchable(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&0001 != 0 {
+		return nil
+	}
+	return os.Chmod(dir, fi.Mode().Perm()|0001)
+}
+
+func removeOverlay(dir string) error {
+	if err := unix.Unmount(filepath.Join(dir, "rootfs"), unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Main runs a session's init shim when the sandbox binary was started as
+// one by the process backend and never returns in that case. It is a no-op
+// otherwise.
+func Main() {
+	if len(os.Args) < 4 || os.Args[1] != shimArg {
+		return
+	}
+
+	if err := runShim(os.Args[2], os.Args[3:]); err != nil {
+		fmt.Fprintf(os.Stderr, "gimpel session init: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+// runShim pivots into the overlay mounted at root and execs args. Mounts
+// copied from the host are locked in the session's user namespace and
+// cannot be pivoted to, so the overlay is bind-mounted onto itself first.
+func runShim(root string, args []string) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	if err := unix.Mount(root, root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("binding root: %w", err)
+	}
+	if err := unix.Chdir(root); err != nil {
+		return fmt.Errorf("entering root: %w", err)
+	}
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivoting root: %w", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching host root: %w", err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return err
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	return unix.Exec(path, args, os.Environ())
+}
+
+// signalNamespace sends sig to every process in the PID namespace pid is
+// in. Stopping them this way rather than with the cgroup freezer keeps the
+// backend free of cgroup setup.
+func signalNamespace(pid int, sig syscall.Signal) error {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if link, err := os.Readlink("/proc/" + e.Name() + "/ns/pid"); err == nil && link == ns {
+			syscall.Kill(p, sig)
+		}
+	}
+	return nil
+}
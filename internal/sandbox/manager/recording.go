@@ -0,0 +1,256 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/pkg/asciicast"
+	"gimpel/pkg/tunnel"
+)
+
+const uploadTimeout = 2 * time.Minute
+
+// ErrRecordingRejected is returned by sinks that will never accept a
+// recording. It is kept on disk as .cast.rejected instead of retried.
+var ErrRecordingRejected = errors.New("recording rejected")
+
+// RecordingSink takes finished recordings, typically by uploading them to
+// the master.
+type RecordingSink interface {
+	StoreRecording(ctx context.Context, sessionID, name string, r io.Reader) error
+}
+
+// SetRecordingSink sets where finished recordings go. Without one they
+// stay in the data directory.
+func (m *Manager) SetRecordingSink(sink RecordingSink) {
+	m.mu.Lock()
+	m.sink = sink
+	m.mu.Unlock()
+}
+
+// recording captures one tunnel as an asciicast file. It is written to a
+// .part file that is renamed once the tunnel closes.
+type recording struct {
+	sessionID string
+	path      string
+	limit     int64
+
+	mu      sync.Mutex
+	file    *os.File
+	cast    *asciicast.Writer
+	size    int64
+	stopped bool
+}
+
+func (m *Manager) startRecording(session *Session, meta *tunnel.Metadata) *recording {
+	if !m.cfg.Recording.Enabled {
+		return nil
+	}
+
+	logger := log.WithField("session_id", session.ID)
+	if !meta.Terminal && !meta.Transcript {
+		logger.WithField("protocol", meta.Protocol).Info("tunnel is not a terminal stream, not recording it")
+		return nil
+	}
+
+	dir := filepath.Join(m.cfg.DataDir, "recordings", session.ID)
+	path := filepath.Join(dir, strconv.Itoa(int(session.tunnels.Add(1)))+".cast")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.WithError(err).Warn("failed to create recording directory")
+		return nil
+	}
+	file, err := os.OpenFile(path+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		logger.WithError(err).Warn("failed to create recording")
+		return nil
+	}
+
+	title := session.ID
+	if meta.SourceIP != "" {
+		title = fmt.Sprintf("%s from %s", session.ID, net.JoinHostPort(meta.SourceIP, strconv.Itoa(int(meta.SourcePort))))
+	}
+	rec := &recording{
+		sessionID: session.ID,
+		path:      path,
+		limit:     m.cfg.Recording.MaxBytes,
+		file:      file,
+	}
+	rec.cast = asciicast.NewWriter(rec, asciicast.Header{Title: title}, time.Now())
+	return rec
+}
+
+// Write counts what the asciicast writer produces against the limit.
+func (r *recording) Write(p []byte) (int, error) {
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *recording) event(typ string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	if r.size+int64(len(data)) > r.limit {
+		r.stopped = true
+		log.WithField("session_id", r.sessionID).Warn("recording size limit reached, recording stopped")
+		return
+	}
+	if err := r.cast.Write(time.Now(), typ, data); err != nil {
+		r.stopped = true
+		log.WithError(err).WithField("session_id", r.sessionID).Warn("failed to write recording")
+	}
+}
+
+func (r *recording) resize(size tunnel.WindowSize) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stopped {
+		r.cast.Resize(time.Now(), int(size.Cols), int(size.Rows))
+	}
+}
+
+// input and output record what passes through them without ever failing
+// the forwarded stream.
+func (r *recording) input() io.Writer  { return recordStream{r, asciicast.EventInput} }
+func (r *recording) output() io.Writer { return recordStream{r, asciicast.EventOutput} }
+
+type recordStream struct {
+	r   *recording
+	typ string
+}
+
+func (s recordStream) Write(p []byte) (int, error) {
+	s.r.event(s.typ, p)
+	return len(p), nil
+}
+
+// recordTranscript records a transcript tunnel until the module closes it.
+func (m *Manager) recordTranscript(session *Session, tc *tunnel.Conn) {
+	rec := m.startRecording(session, tc.Metadata())
+	if rec == nil {
+		io.Copy(io.Discard, tc)
+		return
+	}
+	defer m.finishRecording(rec)
+
+	tc.OnResize(rec.resize)
+	for {
+		kind, data, err := tunnel.ReadTranscript(tc)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.WithError(err).WithField("session_id", session.ID).Warn("transcript tunnel failed")
+			}
+			return
+		}
+		if kind == tunnel.TranscriptInput {
+			rec.event(asciicast.EventInput, data)
+		} else {
+			rec.event(asciicast.EventOutput, data)
+		}
+	}
+}
+
+// finishRecording closes rec and uploads it in the background.
+func (m *Manager) finishRecording(rec *recording) {
+	if err := rec.close(); err != nil {
+		log.WithError(err).WithField("session_id", rec.sessionID).Warn("failed to finish recording")
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+		defer cancel()
+		m.FlushRecordings(ctx)
+	}()
+}
+
+func (r *recording) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The other direction may still be draining; drop what it sends.
+	r.stopped = true
+	err := r.cast.Close(time.Now())
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(r.path+".part", r.path)
+}
+
+// FlushRecordings hands every finished recording to the sink, deleting the
+// ones it accepts. Recordings it fails on are retried on the next flush; a
+// call made while another flush is running returns immediately.
+func (m *Manager) FlushRecordings(ctx context.Context) {
+	m.mu.RLock()
+	sink := m.sink
+	m.mu.RUnlock()
+	if sink == nil || !m.flushMu.TryLock() {
+		return
+	}
+	defer m.flushMu.Unlock()
+
+	root := filepath.Join(m.cfg.DataDir, "recordings")
+	sessions, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, dir := range sessions {
+		if !dir.IsDir() {
+			continue
+		}
+		sessionID := dir.Name()
+		files, _ := os.ReadDir(filepath.Join(root, sessionID))
+		for _, f := range files {
+			name, ok := strings.CutSuffix(f.Name(), ".cast")
+			if !ok {
+				continue
+			}
+			path := filepath.Join(root, sessionID, f.Name())
+			logger := log.WithFields(log.Fields{
+				"session_id": sessionID,
+				"recording":  name,
+			})
+			err := storeRecording(ctx, sink, sessionID, name, path)
+			switch {
+			case errors.Is(err, ErrRecordingRejected):
+				logger.WithError(err).Warn("recording rejected, keeping it on disk")
+				os.Rename(path, path+".rejected")
+			case err != nil:
+				logger.WithError(err).Warn("failed to upload recording")
+				return
+			default:
+				os.Remove(path)
+			}
+		}
+		m.mu.RLock()
+		_, active := m.sessions[sessionID]
+		m.mu.RUnlock()
+		if !active {
+			// Only succeeds once the session has no recordings left.
+			os.Remove(filepath.Join(root, sessionID))
+		}
+	}
+}
+
+func storeRecording(ctx context.Context, sink RecordingSink, sessionID, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sink.StoreRecording(ctx, sessionID, name, f)
+}
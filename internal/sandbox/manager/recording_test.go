@@ -0,0 +1,88 @@
+package manager
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gimpel/internal/sandbox/config"
+	"gimpel/pkg/asciicast"
+	"gimpel/pkg/tunnel"
+)
+
+func TestRecordingOnlyTerminalStreams(t *testing.T) {
+	cfg := &config.SandboxConfig{DataDir: t.TempDir()}
+	cfg.Recording.Enabled = true
+	cfg.Recording.MaxBytes = 1 << 20
+	m := &Manager{cfg: cfg}
+	session := &Session{ID: "s1"}
+
+	if rec := m.startRecording(session, &tunnel.Metadata{SessionID: "s1", Protocol: "tcp"}); rec != nil {
+		rec.close()
+		t.Fatal("recorded a raw protocol stream")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "recordings", "s1")); !os.IsNotExist(err) {
+		t.Errorf("recording directory created for a raw stream: %v", err)
+	}
+
+	rec := m.startRecording(session, &tunnel.Metadata{SessionID: "s1", Terminal: true})
+	if rec == nil {
+		t.Fatal("terminal stream not recorded")
+	}
+	rec.output().Write([]byte("$ "))
+	if err := rec.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "recordings", "s1", "1.cast")); err != nil {
+		t.Errorf("finished recording: %v", err)
+	}
+}
+
+func TestRecordTranscript(t *testing.T) {
+	cfg := &config.SandboxConfig{DataDir: t.TempDir()}
+	cfg.Recording.Enabled = true
+	cfg.Recording.MaxBytes = 1 << 20
+	m := &Manager{cfg: cfg}
+	session := &Session{ID: "s1"}
+
+	key := bytes.Repeat([]byte{7}, 32)
+	a, b := net.Pipe()
+	go func() {
+		tc, err := tunnel.Client(a, "s1", key, &tunnel.Metadata{SessionID: "s1", Transcript: true})
+		if err != nil {
+			a.Close()
+			return
+		}
+		tunnel.WriteTranscript(tc, tunnel.TranscriptOutput, []byte("$ "))
+		tunnel.WriteTranscript(tc, tunnel.TranscriptInput, []byte("id\r"))
+		tc.Close()
+	}()
+	tc, err := tunnel.Server(b, func(string) ([]byte, bool) { return key, true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.recordTranscript(session, tc)
+
+	f, err := os.Open(filepath.Join(cfg.DataDir, "recordings", "s1", "1.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := asciicast.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		ev, err := r.Next()
+		if err != nil {
+			break
+		}
+		got = append(got, ev.Type+":"+ev.Data)
+	}
+	if len(got) != 2 || got[0] != "o:$ " || got[1] != "i:id\r" {
+		t.Errorf("events %q", got)
+	}
+}
@@ -0,0 +1,239 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	gimpelv1 "gimpel/api/go/v1"
+	"gimpel/pkg/nodeapi"
+	"gimpel/pkg/signing"
+)
+
+// installedImage is a catalog image imported into containerd.
+type installedImage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Digest  string `json:"digest"`
+	Ref     string `json:"ref"`
+	Port    int    `json:"port"`
+}
+
+func (c *Client) imagesDir() string {
+	return filepath.Join(c.cfg.DataDir, "images")
+}
+
+// LoadImages loads the trusted keys of the image catalog and offers the
+// images installed from it before. Without trusted keys the catalog is
+// not synced.
+func (c *Client) LoadImages() error {
+	if len(c.cfg.Catalog.TrustedKeys) == 0 {
+		return nil
+	}
+	var keys []*signing.KeyPair
+	for _, path := range c.cfg.Catalog.TrustedKeys {
+		kp, err := signing.LoadPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("loading trusted key %s: %w", path, err)
+		}
+		keys = append(keys, kp)
+	}
+	c.verifier = signing.NewModuleVerifier(keys...)
+
+	data, err := os.ReadFile(filepath.Join(c.imagesDir(), "installed.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading installed images: %w", err)
+	}
+	var installed map[string]installedImage
+	if err := json.Unmarshal(data, &installed); err != nil {
+		return fmt.Errorf("parsing installed images: %w", err)
+	}
+	for name, img := range installed {
+		if err := c.mgr.AddImage(name, img.Ref, img.Port); err != nil {
+			log.WithError(err).WithField("image", name).Warn("dropping installed image")
+			continue
+		}
+		c.installed[name] = img
+	}
+	return nil
+}
+
+// syncImages installs what the master's image catalog lists and removes
+// what it no longer does. An image whose signature is not trusted is
+// skipped until the catalog changes; one that fails to download or import
+// is tried again with the next heartbeat. Either way the version installed
+// before is kept.
+func (c *Client) syncImages(ctx context.Context, version string) {
+	if !c.syncMu.TryLock() {
+		return
+	}
+	defer c.syncMu.Unlock()
+	if version == c.catalogVersion {
+		return
+	}
+
+	var catalog nodeapi.ImageCatalog
+	if err := c.get(ctx, nodeapi.ImagesURL(c.id), &catalog); err != nil {
+		log.WithError(err).Warn("failed to fetch sandbox image catalog")
+		return
+	}
+
+	complete := true
+	listed := make(map[string]bool)
+	for _, img := range catalog.Images {
+		listed[img.Name] = true
+		if c.installed[img.Name].Digest == img.Digest {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"image":   img.Name,
+			"version": img.Version,
+		})
+		if err := c.verifyImage(img); err != nil {
+			logger.WithError(err).Warn("rejecting sandbox image")
+			continue
+		}
+		if err := c.installImage(ctx, img); err != nil {
+			logger.WithError(err).Warn("failed to install sandbox image")
+			complete = false
+			continue
+		}
+		logger.WithField("digest", img.Digest).Info("sandbox image installed")
+	}
+
+	for name := range c.installed {
+		if listed[name] {
+			continue
+		}
+		if err := c.mgr.RemoveImage(ctx, name); err != nil {
+			log.WithError(err).WithField("image", name).Warn("failed to delete sandbox image")
+		}
+		delete(c.installed, name)
+		log.WithField("image", name).Info("sandbox image removed")
+	}
+
+	if err := c.saveInstalled(); err != nil {
+		log.WithError(err).Warn("failed to save installed images")
+	}
+	if complete {
+		c.catalogVersion = catalog.Version
+	}
+}
+
+func (c *Client) verifyImage(img nodeapi.Image) error {
+	if err := c.verifier.VerifySandboxImage(&gimpelv1.SandboxImage{
+		Name:      img.Name,
+		Version:   img.Version,
+		Digest:    img.Digest,
+		Port:      img.Port,
+		Manifest:  img.Manifest,
+		Signature: img.Signature,
+		SignedBy:  img.SignedBy,
+		SignedAt:  img.SignedAt,
+	}); err != nil {
+		return err
+	}
+	if img.Port == 0 || img.Port > 65535 {
+		return fmt.Errorf("invalid port %d", img.Port)
+	}
+	return nil
+}
+
+// installImage downloads a verified image, checks it is what was signed
+// and imports it.
+func (c *Client) installImage(ctx context.Context, img nodeapi.Image) error {
+	if err := os.MkdirAll(c.imagesDir(), 0700); err != nil {
+		return fmt.Errorf("creating images dir: %w", err)
+	}
+	path := filepath.Join(c.imagesDir(), img.Name+".tar")
+	if err := c.download(ctx, nodeapi.ImageURL(c.id, img.Name, img.Version), path, img.Digest); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ref := fmt.Sprintf("gimpel-sandbox/%s:%s", img.Name, img.Version)
+	if err := c.mgr.ImportImage(ctx, img.Name, ref, int(img.Port), f); err != nil {
+		return err
+	}
+	c.installed[img.Name] = installedImage{
+		Name:    img.Name,
+		Version: img.Version,
+		Digest:  img.Digest,
+		Ref:     ref,
+		Port:    int(img.Port),
+	}
+	return nil
+}
+
+// download writes the body of path to dst if its SHA-256 matches digest.
+func (c *Client) download(ctx context.Context, path, dst, digest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+c.cfg.Master.Address+path, nil)
+	if err != nil {
+		return err
+	}
+	// Images can be large; ctx bounds the download instead of the
+	// client's request timeout.
+	client := &http.Client{Transport: c.client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+			err = fmt.Errorf("downloaded image is %s, signed digest is %s", got, digest)
+		}
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) saveInstalled() error {
+	data, err := json.MarshalIndent(c.installed, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.imagesDir(), "installed.json")
+	if err := os.MkdirAll(c.imagesDir(), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,315 @@
+// Package node registers a sandbox with the master, keeps it informed of
+// the node's capacity so sessions can be scheduled onto it and installs
+// the sandbox images it distributes.
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gimpel/internal/sandbox/config"
+	"gimpel/internal/sandbox/manager"
+	"gimpel/pkg/nodeapi"
+	"gimpel/pkg/signing"
+)
+
+const requestTimeout = 10 * time.Second
+
+type Client struct {
+	cfg *config.SandboxConfig
+	mgr *manager.Manager
+
+	id     string
+	client *http.Client
+
+	// verifier is set when the image catalog is synced. syncMu guards
+	// installed and catalogVersion, the last catalog fully installed.
+	verifier       *signing.ModuleVerifier
+	syncMu         sync.Mutex
+	installed      map[string]installedImage
+	catalogVersion string
+}
+
+func New(cfg *config.SandboxConfig, mgr *manager.Manager) *Client {
+	return &Client{cfg: cfg, mgr: mgr, installed: make(map[string]installedImage)}
+}
+
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Enroll loads the node's credentials, registering with the pairing token
+// first if there are none, and points the sandbox's TLS config at them so
+// its gRPC server only accepts the master.
+func (c *Client) Enroll(ctx context.Context) error {
+	idPath := filepath.Join(c.cfg.DataDir, "node_id")
+	certPath := filepath.Join(c.cfg.DataDir, "cert.pem")
+	keyPath := filepath.Join(c.cfg.DataDir, "key.pem")
+	caPath := filepath.Join(c.cfg.DataDir, "ca.pem")
+
+	masterCA, err := os.ReadFile(c.cfg.Master.CAFile)
+	if err != nil {
+		return fmt.Errorf("reading master CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(masterCA) {
+		return fmt.Errorf("failed to parse master CA")
+	}
+
+	id, err := os.ReadFile(idPath)
+	if err == nil {
+		c.id = strings.TrimSpace(string(id))
+	} else {
+		if c.cfg.Master.PairingToken == "" {
+			return fmt.Errorf("node is not registered and no pairing token is configured")
+		}
+		c.client = &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+		if err := c.register(ctx, idPath, certPath, keyPath, caPath); err != nil {
+			return err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("loading node certificate: %w", err)
+	}
+	c.client = &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      roots,
+		}},
+	}
+
+	c.cfg.TLS.CertFile = certPath
+	c.cfg.TLS.KeyFile = keyPath
+	c.cfg.TLS.CAFile = caPath
+
+	log.WithField("node_id", c.id).Info("sandbox node enrolled")
+	return nil
+}
+
+func (c *Client) register(ctx context.Context, idPath, certPath, keyPath, caPath string) error {
+	hostname, _ := os.Hostname()
+	req := &nodeapi.RegisterRequest{
+		Token:    c.cfg.Master.PairingToken,
+		Hostname: hostname,
+		Address:  c.cfg.Master.AdvertiseAddress,
+		Labels:   c.cfg.Labels,
+		Images:   c.mgr.Images(),
+		Capacity: c.capacity(),
+	}
+
+	var resp nodeapi.RegisterResponse
+	if err := c.post(ctx, nodeapi.RegisterPath, req, &resp); err != nil {
+		return fmt.Errorf("registering with master: %w", err)
+	}
+
+	if err := os.MkdirAll(c.cfg.DataDir, 0700); err != nil {
+		return fmt.Errorf("creating data dir: %w", err)
+	}
+	if err := os.WriteFile(certPath, resp.Certificate, 0600); err != nil {
+		return fmt.Errorf("writing cert: %w", err)
+	}
+	if err := os.WriteFile(keyPath, resp.PrivateKey, 0600); err != nil {
+		return fmt.Errorf("writing key: %w", err)
+	}
+	if err := os.WriteFile(caPath, resp.CACertificate, 0644); err != nil {
+		return fmt.Errorf("writing CA: %w", err)
+	}
+	// The ID goes last: its presence means registration completed.
+	if err := os.WriteFile(idPath, []byte(resp.NodeID), 0600); err != nil {
+		return fmt.Errorf("writing node ID: %w", err)
+	}
+
+	c.id = resp.NodeID
+	log.WithField("node_id", c.id).Info("registered with master")
+	return nil
+}
+
+// Run sends heartbeats until ctx is done.
+func (c *Client) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.cfg.Master.HeartbeatInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		err := c.heartbeat(ctx)
+		switch {
+		case err != nil && failures == 0:
+			log.WithError(err).Warn("heartbeat failed, master unreachable")
+			failures++
+		case err != nil:
+			log.WithError(err).WithField("failures", failures).Debug("heartbeat failed")
+			failures++
+		case failures > 0:
+			log.WithField("failures", failures).Info("master reachable again")
+			failures = 0
+		}
+		if err == nil {
+			// Retries recordings that failed to upload earlier.
+			go c.mgr.FlushRecordings(ctx)
+			go c.mgr.FlushEvents(ctx)
+			go c.mgr.FlushArtifacts(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) heartbeat(ctx context.Context) error {
+	hb := &nodeapi.Heartbeat{
+		Address:  c.cfg.Master.AdvertiseAddress,
+		Labels:   c.cfg.Labels,
+		Images:   c.mgr.Images(),
+		Capacity: c.capacity(),
+		Pools:    c.mgr.PoolStats(),
+		Sessions: c.mgr.SessionIDs(),
+	}
+	var resp nodeapi.HeartbeatResponse
+	if err := c.post(ctx, nodeapi.HeartbeatURL(c.id), hb, &resp); err != nil {
+		return err
+	}
+	if c.verifier != nil && resp.ImageCatalog != "" {
+		go c.syncImages(ctx, resp.ImageCatalog)
+	}
+	return nil
+}
+
+// StoreRecording uploads a session recording. It implements
+// manager.RecordingSink.
+func (c *Client) StoreRecording(ctx context.Context, sessionID, name string, r io.Reader) error {
+	url := "https://" + c.cfg.Master.Address + nodeapi.RecordingURL(c.id, sessionID, name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-asciicast")
+
+	// Recordings can be large; ctx bounds the upload instead of the
+	// client's request timeout.
+	client := &http.Client{Transport: c.client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusRequestEntityTooLarge:
+			return fmt.Errorf("%w: %v", manager.ErrRecordingRejected, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// StoreArtifact uploads a file collected from a session. It implements
+// manager.ArtifactSink.
+func (c *Client) StoreArtifact(ctx context.Context, sha256 string, r io.Reader) error {
+	url := "https://" + c.cfg.Master.Address + nodeapi.ArtifactURL(c.id, sha256)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	client := &http.Client{Transport: c.client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusRequestEntityTooLarge:
+			return fmt.Errorf("%w: %v", manager.ErrArtifactRejected, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// StoreEvents sends session telemetry. It implements manager.EventSink.
+func (c *Client) StoreEvents(ctx context.Context, events []nodeapi.Event) error {
+	var resp nodeapi.EventsResponse
+	return c.post(ctx, nodeapi.EventsURL(c.id), &nodeapi.EventBatch{Events: events}, &resp)
+}
+
+func (c *Client) post(ctx context.Context, path string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+c.cfg.Master.Address+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+c.cfg.Master.Address+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) capacity() nodeapi.Capacity {
+	capacity := nodeapi.Capacity{
+		MaxSessions:    c.cfg.MaxSessions,
+		ActiveSessions: c.mgr.Count(),
+	}
+	capacity.CPUs, capacity.CPUUsage, capacity.MemoryBytes, capacity.MemUsage = systemStats()
+	return capacity
+}
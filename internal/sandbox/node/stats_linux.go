@@ -0,0 +1,52 @@
+package node
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// systemStats reports the CPU count, the one-minute load as a percentage of
+// the CPUs, total memory and the percentage of it in use.
+func systemStats() (cpus int, cpuUsage float64, memTotal uint64, memUsage float64) {
+	cpus = runtime.NumCPU()
+
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			if load, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				cpuUsage = load / float64(cpus) * 100
+			}
+		}
+	}
+
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return cpus, cpuUsage, 0, 0
+	}
+	defer f.Close()
+
+	var available uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			memTotal = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	if memTotal > 0 {
+		memUsage = float64(memTotal-available) / float64(memTotal) * 100
+	}
+	return cpus, cpuUsage, memTotal, memUsage
+}
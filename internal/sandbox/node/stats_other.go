@@ -0,0 +1,9 @@
+//go:build !linux
+
+package node
+
+import "runtime"
+
+func systemStats() (cpus int, cpuUsage float64, memTotal uint64, memUsage float64) {
+	return runtime.NumCPU(), 0, 0, 0
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	gimpelv1 "gimpel/api/go/v1"
 	"gimpel/internal/sandbox/config"
@@ -109,8 +112,13 @@ type Handler struct {
 func (h *Handler) CreateSession(ctx context.Context, req *gimpelv1.CreateSessionRequest) (*gimpelv1.CreateSessionResponse, error) {
 	log.WithField("session_id", req.SessionId).Info("received create session request")
 
-	session, err := h.mgr.CreateSession(req.SessionId, req.Image, req.Env)
+	session, err := h.mgr.CreateSession(ctx, req.SessionId, req.Image, req.Env)
 	if err != nil {
+		// Tell the master to place the session elsewhere without treating
+		// this node as failed.
+		if errors.Is(err, manager.ErrCapacity) || errors.Is(err, manager.ErrNoPorts) {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
 		return nil, err
 	}
 
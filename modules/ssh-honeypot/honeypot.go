@@ -22,6 +22,7 @@ type SSHHoneypot struct {
 	config   *ssh.ServerConfig
 	hostKey  ssh.Signer
 	sessions sync.Map
+	sandbox  sandboxConfig
 }
 
 func NewSSHHoneypot() *SSHHoneypot {
@@ -54,6 +55,7 @@ func (h *SSHHoneypot) Init(ctx *gimpelsdk.ModuleContext) error {
 		ServerVersion:     "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.1",
 	}
 	h.config.AddHostKey(h.hostKey)
+	h.sandbox = loadSandboxConfig()
 
 	go h.processEvents()
 
@@ -87,6 +89,14 @@ func (h *SSHHoneypot) HandleConnection(ctx context.Context, conn net.Conn, info
 
 	h.sessions.Store(sessionID, sshConn)
 
+	if h.sandbox.enabled {
+		err := h.relayToSandbox(ctx, sessionID, sshConn, chans, reqs, info)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Escalation failed for %s, using fake shell: %v", sessionID, err)
+	}
+
 	go ssh.DiscardRequests(reqs)
 
 	for newChan := range chans {
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	gimpelsdk "github.com/NoHaxxJustLags/gimpel/sdk/go"
+)
+
+const (
+	sandboxModeSSH      = "ssh"
+	sandboxModeTerminal = "terminal"
+)
+
+// sandboxConfig controls handing authenticated attackers over to a real
+// shell in an HI sandbox. The honeypot stays in the middle: it terminates
+// the attacker's SSH connection and either opens its own to an sshd in the
+// sandbox, so every channel and request can be observed on the way through,
+// or in terminal mode relays the attacker's shell in the clear to a sandbox
+// image that serves a shell on a pty, which the sandbox records.
+type sandboxConfig struct {
+	enabled  bool
+	mode     string
+	user     string
+	password string
+}
+
+func loadSandboxConfig() sandboxConfig {
+	cfg := sandboxConfig{
+		enabled:  os.Getenv("SSH_ESCALATE") == "true",
+		mode:     os.Getenv("SSH_SANDBOX_MODE"),
+		user:     os.Getenv("SSH_SANDBOX_USER"),
+		password: os.Getenv("SSH_SANDBOX_PASSWORD"),
+	}
+	if cfg.mode == "" {
+		cfg.mode = sandboxModeSSH
+	}
+	if cfg.user == "" {
+		cfg.user = "root"
+	}
+	return cfg
+}
+
+type ptyRequest struct {
+	Term     string
+	Cols     uint32
+	Rows     uint32
+	WidthPx  uint32
+	HeightPx uint32
+	Modes    string
+}
+
+type windowChange struct {
+	Cols     uint32
+	Rows     uint32
+	WidthPx  uint32
+	HeightPx uint32
+}
+
+type execRequest struct {
+	Command string
+}
+
+// relayToSandbox logs into the sandbox and bridges the attacker's channels
+// and global requests to it until either side disconnects. It returns an
+// error without touching chans or reqs if the sandbox cannot be reached, so
+// the caller can fall back to the fake shell.
+func (h *SSHHoneypot) relayToSandbox(ctx context.Context, sessionID string, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, info *gimpelsdk.ConnectionInfo) error {
+	if h.sandbox.mode == sandboxModeTerminal {
+		return h.relayTerminal(ctx, sessionID, conn, chans, reqs, info)
+	}
+
+	sandbox, err := gimpelsdk.OpenSandbox(ctx, info)
+	if err != nil {
+		return err
+	}
+
+	client, upChans, upReqs, err := ssh.NewClientConn(sandbox, sandbox.RemoteAddr().String(), &ssh.ClientConfig{
+		User:            h.sandbox.user,
+		Auth:            []ssh.AuthMethod{ssh.Password(h.sandbox.password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   string(conn.ClientVersion()),
+	})
+	if err != nil {
+		sandbox.Close()
+		return fmt.Errorf("logging into sandbox: %w", err)
+	}
+	defer client.Close()
+
+	h.escalated(sessionID, sandbox, conn)
+
+	// The sandbox only sees SSH, so the first session channel is recorded
+	// from the decrypted side.
+	transcript, err := gimpelsdk.OpenTranscript(ctx, info)
+	if err != nil {
+		log.Printf("Session %s will not be recorded: %v", sessionID, err)
+	}
+	defer func() {
+		if transcript != nil {
+			transcript.Close()
+		}
+	}()
+
+	// The sandbox has no business opening channels towards the attacker.
+	go func() {
+		for ch := range upChans {
+			ch.Reject(ssh.Prohibited, "not allowed")
+		}
+	}()
+	go ssh.DiscardRequests(upReqs)
+	go func() {
+		client.Wait()
+		conn.Close()
+	}()
+
+	go func() {
+		for req := range reqs {
+			ok, payload, err := client.SendRequest(req.Type, req.WantReply, req.Payload)
+			if err != nil {
+				ok, payload = false, nil
+			}
+			req.Reply(ok, payload)
+		}
+	}()
+
+	for newChan := range chans {
+		upstream, upRequests, err := client.OpenChannel(newChan.ChannelType(), newChan.ExtraData())
+		if err != nil {
+			if openErr, ok := err.(*ssh.OpenChannelError); ok {
+				newChan.Reject(openErr.Reason, openErr.Message)
+			} else {
+				newChan.Reject(ssh.ConnectionFailed, "connection failed")
+			}
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			upstream.Close()
+			continue
+		}
+		var recorded *gimpelsdk.Transcript
+		if newChan.ChannelType() == "session" {
+			recorded, transcript = transcript, nil
+		}
+		go h.bridgeChannel(sessionID, sandbox, channel, requests, upstream, upRequests, recorded)
+	}
+	return nil
+}
+
+func (h *SSHHoneypot) escalated(sessionID string, sandbox *gimpelsdk.SandboxConn, conn *ssh.ServerConn) {
+	log.Printf("Session %s escalated to HI session %s", sessionID, sandbox.SessionID)
+	h.emitter.Emit(&gimpelsdk.Event{
+		SessionID: sessionID,
+		Type:      gimpelsdk.EventTypeCustom,
+		Labels: map[string]string{
+			"event":         "escalated",
+			"hi_session_id": sandbox.SessionID,
+			"user":          conn.User(),
+			"mode":          h.sandbox.mode,
+		},
+	})
+}
+
+// relayTerminal gives the attacker's first session channel the sandbox's
+// shell. Other channels are refused, since the stream carries exactly one
+// terminal.
+func (h *SSHHoneypot) relayTerminal(ctx context.Context, sessionID string, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, info *gimpelsdk.ConnectionInfo) error {
+	sandbox, err := gimpelsdk.OpenTerminal(ctx, info)
+	if err != nil {
+		return err
+	}
+	defer sandbox.Close()
+
+	h.escalated(sessionID, sandbox, conn)
+	go ssh.DiscardRequests(reqs)
+
+	relaying := false
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" || relaying {
+			newChan.Reject(ssh.Prohibited, "not allowed")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		relaying = true
+		go func() {
+			h.bridgeTerminal(sessionID, sandbox, channel, requests)
+			conn.Close()
+		}()
+	}
+	return nil
+}
+
+// bridgeTerminal relays channel to the sandbox's shell once the attacker
+// asks for a shell or a command. A command is typed into the shell.
+func (h *SSHHoneypot) bridgeTerminal(sessionID string, sandbox *gimpelsdk.SandboxConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	start := make(chan string, 1)
+	go func() {
+		defer close(start)
+		started := false
+		for req := range requests {
+			switch req.Type {
+			case "pty-req", "window-change":
+				h.inspectRequest(sessionID, sandbox, req)
+				req.Reply(true, nil)
+			case "env":
+				req.Reply(true, nil)
+			case "shell", "exec":
+				if started {
+					req.Reply(false, nil)
+					continue
+				}
+				started = true
+				h.inspectRequest(sessionID, sandbox, req)
+				var exec execRequest
+				if req.Type == "exec" && ssh.Unmarshal(req.Payload, &exec) == nil {
+					start <- exec.Command + "; exit\n"
+				} else {
+					start <- ""
+				}
+				req.Reply(true, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	command, ok := <-start
+	if !ok {
+		return
+	}
+	if command != "" {
+		sandbox.Write([]byte(command))
+	}
+
+	go func() {
+		io.Copy(sandbox, channel)
+		sandbox.Close()
+	}()
+	io.Copy(channel, sandbox)
+	channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+}
+
+// bridgeChannel relays channel to upstream, copying what passes through
+// into transcript if it is not nil.
+func (h *SSHHoneypot) bridgeChannel(sessionID string, sandbox *gimpelsdk.SandboxConn, channel ssh.Channel, requests <-chan *ssh.Request, upstream ssh.Channel, upRequests <-chan *ssh.Request, transcript *gimpelsdk.Transcript) {
+	defer channel.Close()
+	defer upstream.Close()
+
+	var in io.Reader = channel
+	var out, errOut io.Writer = channel, channel.Stderr()
+	if transcript != nil {
+		defer transcript.Close()
+		in = io.TeeReader(channel, transcript.Input())
+		out = io.MultiWriter(channel, transcript.Output())
+		errOut = io.MultiWriter(channel.Stderr(), transcript.Output())
+	}
+
+	go func() {
+		for req := range requests {
+			h.inspectRequest(sessionID, sandbox, req)
+			ok, err := upstream.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				req.Reply(ok && err == nil, nil)
+			}
+		}
+		upstream.Close()
+	}()
+
+	go func() {
+		io.Copy(upstream, in)
+		upstream.CloseWrite()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(out, upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(errOut, upstream.Stderr())
+	}()
+
+	// exit-status and friends arrive before the sandbox closes the channel.
+	for req := range upRequests {
+		ok, err := channel.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+	wg.Wait()
+}
+
+func (h *SSHHoneypot) inspectRequest(sessionID string, sandbox *gimpelsdk.SandboxConn, req *ssh.Request) {
+	switch req.Type {
+	case "pty-req":
+		var pty ptyRequest
+		if ssh.Unmarshal(req.Payload, &pty) == nil {
+			sandbox.Resize(uint16(pty.Cols), uint16(pty.Rows))
+		}
+	case "window-change":
+		var wc windowChange
+		if ssh.Unmarshal(req.Payload, &wc) == nil {
+			sandbox.Resize(uint16(wc.Cols), uint16(wc.Rows))
+		}
+	case "exec":
+		var exec execRequest
+		if ssh.Unmarshal(req.Payload, &exec) == nil {
+			log.Printf("Exec command (sandbox): %s", exec.Command)
+			h.emitter.EmitCommand(sessionID, []byte(exec.Command))
+		}
+	}
+}
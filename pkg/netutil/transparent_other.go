@@ -0,0 +1,16 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"context"
+	"net"
+)
+
+func ListenTransparent(ctx context.Context, network, addr string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,26 @@
+package netutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	got, err := ParsePortRanges("22, 80-90,8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PortRange{{22, 22}, {80, 90}, {8080, 8080}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParsePortRanges() = %v, want %v", got, want)
+	}
+	if !got[1].Contains(85) || got[1].Contains(91) {
+		t.Error("Contains() does not treat the range as inclusive")
+	}
+
+	for _, bad := range []string{"", "0", "90-80", "70000", "ssh", "1-"} {
+		if _, err := ParsePortRanges(bad); err == nil {
+			t.Errorf("ParsePortRanges(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenSmallWindow listens on a TCP address whose accepted connections
+// advertise the smallest receive window the kernel allows. A client that is
+// never read from stalls once that window fills.
+func ListenSmallWindow(ctx context.Context, network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				// The kernel rounds both up to its minimum.
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, 1)
+				if sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_WINDOW_CLAMP, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("shrinking receive window: %w", sockErr)
+			}
+			return nil
+		},
+	}
+	return lc.Listen(ctx, network, addr)
+}
+
+// PeerClosed reports whether the peer has closed or reset a TCP connection,
+// without reading what it sent.
+func PeerClosed(conn net.Conn) (bool, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false, fmt.Errorf("connection %T has no file descriptor", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return false, err
+	}
+	if sockErr != nil {
+		return false, fmt.Errorf("reading TCP_INFO: %w", sockErr)
+	}
+	return info.State != unix.BPF_TCP_ESTABLISHED, nil
+}
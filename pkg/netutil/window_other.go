@@ -0,0 +1,16 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"context"
+	"net"
+)
+
+func ListenSmallWindow(ctx context.Context, network, addr string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+func PeerClosed(conn net.Conn) (bool, error) {
+	return false, ErrUnsupported
+}
@@ -0,0 +1,171 @@
+// Package nodeapi defines the messages sandbox nodes exchange with the
+// master's node endpoint. Nodes register once with a pairing token and
+// then heartbeat over mutual TLS with the certificate they were issued.
+package nodeapi
+
+import (
+	"net/url"
+	"time"
+)
+
+const (
+	RegisterPath  = "/v1/nodes/register"
+	HeartbeatPath = "/v1/nodes/{id}/heartbeat"
+	// RecordingPath takes an asciicast recording of one tunnel into a
+	// session as the PUT body.
+	RecordingPath = "/v1/nodes/{id}/sessions/{session}/recordings/{name}"
+	// EventsPath takes an EventBatch of session telemetry.
+	EventsPath = "/v1/nodes/{id}/events"
+	// ArtifactPath takes a file collected from a session as the PUT body,
+	// named by its SHA-256.
+	ArtifactPath = "/v1/nodes/{id}/artifacts/{sha256}"
+	// ImagesPath returns the ImageCatalog and ImagePath streams one image
+	// archive from it.
+	ImagesPath = "/v1/nodes/{id}/images"
+	ImagePath  = "/v1/nodes/{id}/images/{name}/{version}"
+)
+
+// Event types nodes report for their sessions.
+const (
+	EventEgressBlocked  = "egress_blocked"
+	EventEgressAllowed  = "egress_allowed"
+	EventDNSQuery       = "dns_query"
+	EventHTTPRequest    = "http_request"
+	EventTLSClientHello = "tls_client_hello"
+	// EventFileAccess and EventMalwareDetected carry a file collected at
+	// the end of a session; the latter when it is an executable.
+	EventFileAccess      = "file_access"
+	EventMalwareDetected = "malware_detected"
+)
+
+// HeartbeatURL returns the heartbeat path of a node.
+func HeartbeatURL(nodeID string) string {
+	return "/v1/nodes/" + nodeID + "/heartbeat"
+}
+
+// EventsURL returns the path a node posts session telemetry to.
+func EventsURL(nodeID string) string {
+	return "/v1/nodes/" + nodeID + "/events"
+}
+
+// ArtifactURL returns the path a node uploads an artifact to.
+func ArtifactURL(nodeID, sha256 string) string {
+	return "/v1/nodes/" + nodeID + "/artifacts/" + sha256
+}
+
+// ImagesURL returns the path of the sandbox image catalog.
+func ImagesURL(nodeID string) string {
+	return "/v1/nodes/" + nodeID + "/images"
+}
+
+// ImageURL returns the path a node downloads an image archive from.
+func ImageURL(nodeID, name, version string) string {
+	return "/v1/nodes/" + nodeID + "/images/" + url.PathEscape(name) + "/" + url.PathEscape(version)
+}
+
+// RecordingURL returns the path a node uploads a session recording to.
+func RecordingURL(nodeID, sessionID, name string) string {
+	return "/v1/nodes/" + nodeID + "/sessions/" + url.PathEscape(sessionID) + "/recordings/" + url.PathEscape(name)
+}
+
+// Capacity is what a node can take and how busy it is.
+type Capacity struct {
+	MaxSessions    int     `json:"max_sessions"`
+	ActiveSessions int     `json:"active_sessions"`
+	CPUs           int     `json:"cpus"`
+	CPUUsage       float64 `json:"cpu_usage"`
+	MemoryBytes    uint64  `json:"memory_bytes"`
+	MemUsage       float64 `json:"mem_usage"`
+}
+
+type RegisterRequest struct {
+	Token    string            `json:"token"`
+	Hostname string            `json:"hostname"`
+	Address  string            `json:"address"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Images   []string          `json:"images,omitempty"`
+	Capacity Capacity          `json:"capacity"`
+}
+
+type RegisterResponse struct {
+	NodeID        string `json:"node_id"`
+	Certificate   []byte `json:"certificate"`
+	PrivateKey    []byte `json:"private_key"`
+	CACertificate []byte `json:"ca_certificate"`
+}
+
+// PoolStats describes a node's pool of started, paused environments of one
+// image. Hits and Misses count sessions that did and did not find one
+// ready; Failures counts environments that failed to start for the pool.
+type PoolStats struct {
+	Image     string  `json:"image"`
+	Size      int     `json:"size"`
+	Ready     int     `json:"ready"`
+	Starting  int     `json:"starting"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Failures  uint64  `json:"failures"`
+	StartTime float64 `json:"start_time_seconds"`
+}
+
+// Heartbeat carries everything that may have changed since registration.
+type Heartbeat struct {
+	Address  string            `json:"address"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Images   []string          `json:"images,omitempty"`
+	Capacity Capacity          `json:"capacity"`
+	Pools    []PoolStats       `json:"pools,omitempty"`
+	// Sessions are the IDs of the sessions running on the node. The master
+	// stops those it no longer tracks, such as sessions it ended while the
+	// node was unreachable.
+	Sessions []string `json:"sessions,omitempty"`
+}
+
+type HeartbeatResponse struct {
+	OK bool `json:"ok"`
+	// ImageCatalog changes whenever the image catalog does, so nodes only
+	// fetch it then.
+	ImageCatalog string `json:"image_catalog,omitempty"`
+}
+
+// Image is a sandbox image in the catalog. Manifest is a serialized
+// SandboxImageManifest signed by Signature, which nodes verify before
+// installing the archive.
+type Image struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+	Digest      string `json:"digest"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Port        uint32 `json:"port"`
+	Manifest    []byte `json:"manifest"`
+	Signature   []byte `json:"signature"`
+	SignedBy    string `json:"signed_by"`
+	SignedAt    int64  `json:"signed_at"`
+}
+
+// ImageCatalog lists the latest version of every sandbox image.
+type ImageCatalog struct {
+	Version string  `json:"version"`
+	Images  []Image `json:"images"`
+}
+
+// Event is something that happened inside a session environment.
+type Event struct {
+	SessionID string            `json:"session_id"`
+	Type      string            `json:"type"`
+	Time      time.Time         `json:"time"`
+	DestIP    string            `json:"dest_ip,omitempty"`
+	DestPort  uint32            `json:"dest_port,omitempty"`
+	Protocol  string            `json:"protocol,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Payload   []byte            `json:"payload,omitempty"`
+}
+
+type EventBatch struct {
+	Events []Event `json:"events"`
+}
+
+type EventsResponse struct {
+	Accepted int `json:"accepted"`
+}
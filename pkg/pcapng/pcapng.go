@@ -0,0 +1,94 @@
+// Package pcapng writes packet captures in the pcapng format and can
+// synthesize TCP packets around relayed byte streams.
+package pcapng
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// LinkTypeRaw marks packets that start with an IPv4 or IPv6 header.
+const LinkTypeRaw = 101
+
+const (
+	blockSectionHeader    = 0x0a0d0d0a
+	blockInterfaceDesc    = 0x00000001
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1a2b3c4d
+	optEndOfOpt           = 0
+	optIfTsresol          = 9
+	tsresolNanoseconds    = 9
+	defaultSnapLength     = 0
+	blockTrailerLength    = 4
+	enhancedPacketHdrSize = 20
+)
+
+// Writer writes one section with a single interface.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the section header and an interface description for
+// linkType with nanosecond timestamps.
+func NewWriter(w io.Writer, linkType uint16) (*Writer, error) {
+	pw := &Writer{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	// Section length unknown.
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	if err := pw.writeBlock(blockSectionHeader, shb); err != nil {
+		return nil, fmt.Errorf("writing section header: %w", err)
+	}
+
+	idb := make([]byte, 8, 20)
+	binary.LittleEndian.PutUint16(idb[0:], linkType)
+	binary.LittleEndian.PutUint32(idb[4:], defaultSnapLength)
+	idb = appendOption(idb, optIfTsresol, []byte{tsresolNanoseconds})
+	idb = appendOption(idb, optEndOfOpt, nil)
+	if err := pw.writeBlock(blockInterfaceDesc, idb); err != nil {
+		return nil, fmt.Errorf("writing interface description: %w", err)
+	}
+
+	return pw, nil
+}
+
+// WritePacket writes data as an enhanced packet block captured at ts.
+func (pw *Writer) WritePacket(ts time.Time, data []byte) error {
+	body := make([]byte, enhancedPacketHdrSize, enhancedPacketHdrSize+pad4(len(data)))
+	nanos := uint64(ts.UnixNano())
+	binary.LittleEndian.PutUint32(body[0:], 0)
+	binary.LittleEndian.PutUint32(body[4:], uint32(nanos>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(nanos))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+	body = append(body, data...)
+	body = append(body, make([]byte, pad4(len(data))-len(data))...)
+	return pw.writeBlock(blockEnhancedPacket, body)
+}
+
+func (pw *Writer) writeBlock(typ uint32, body []byte) error {
+	total := uint32(8 + len(body) + blockTrailerLength)
+	buf := make([]byte, 0, total)
+	buf = binary.LittleEndian.AppendUint32(buf, typ)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	_, err := pw.w.Write(buf)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value))-len(value))...)
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,64 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTCPStream(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewTCPStream(w, netip.MustParseAddrPort("198.51.100.7:40000"), netip.MustParseAddrPort("192.0.2.1:22"))
+	ts := time.Unix(1700000000, 123456789)
+	s.Handshake(ts)
+	s.Write(ts, true, []byte("SSH-2.0-client\r\n"))
+	s.Write(ts, false, bytes.Repeat([]byte{'x'}, maxSegment+1))
+	s.Close(ts)
+
+	var packets [][]byte
+	data := buf.Bytes()
+	for len(data) > 0 {
+		typ := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatalf("malformed block of type %#x", typ)
+		}
+		if typ == blockEnhancedPacket {
+			captured := binary.LittleEndian.Uint32(data[20:])
+			packets = append(packets, data[28:28+captured])
+			if ns := uint64(binary.LittleEndian.Uint32(data[12:]))<<32 | uint64(binary.LittleEndian.Uint32(data[16:])); ns != uint64(ts.UnixNano()) {
+				t.Errorf("timestamp %d, want %d", ns, ts.UnixNano())
+			}
+		}
+		data = data[length:]
+	}
+
+	// 3 handshake, 1 client data, 2 server data, 3 teardown.
+	if len(packets) != 9 {
+		t.Fatalf("%d packets, want 9", len(packets))
+	}
+	for i, pkt := range packets {
+		if checksum(0, pkt[:ipv4HeaderLength]) != 0 {
+			t.Errorf("packet %d: bad IPv4 checksum", i)
+		}
+		src, _ := netip.AddrFromSlice(pkt[12:16])
+		dst, _ := netip.AddrFromSlice(pkt[16:20])
+		if tcpChecksum(src, dst, pkt[ipv4HeaderLength:]) != 0 {
+			t.Errorf("packet %d: bad TCP checksum", i)
+		}
+	}
+
+	serverData := packets[5][ipv4HeaderLength:]
+	if seq := binary.BigEndian.Uint32(serverData[4:]); seq != 1+maxSegment {
+		t.Errorf("second server segment seq %d, want %d", seq, 1+maxSegment)
+	}
+	if ack := binary.BigEndian.Uint32(serverData[8:]); ack != 1+16 {
+		t.Errorf("server ack %d, want %d", ack, 1+16)
+	}
+}
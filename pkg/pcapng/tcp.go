@@ -0,0 +1,177 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	tcpHeaderLength  = 20
+	ipv4HeaderLength = 20
+	ipv6HeaderLength = 40
+	protocolTCP      = 6
+
+	// maxSegment keeps synthesized packets well inside the IPv4 length.
+	maxSegment = 16384
+)
+
+// TCPStream writes the two directions of one TCP connection as packets with
+// synthesized IP and TCP headers, so a relayed byte stream can be followed
+// in packet tools. Initial sequence numbers are zero.
+type TCPStream struct {
+	w      *Writer
+	client netip.AddrPort
+	server netip.AddrPort
+	ipv6   bool
+
+	clientSeq uint32
+	serverSeq uint32
+}
+
+// NewTCPStream returns a stream between client and server. Mixed address
+// families are written as IPv6 with IPv4-mapped addresses.
+func NewTCPStream(w *Writer, client, server netip.AddrPort) *TCPStream {
+	c, s := client.Addr().Unmap(), server.Addr().Unmap()
+	ipv6 := c.Is6() || s.Is6()
+	if ipv6 {
+		c, s = netip.AddrFrom16(c.As16()), netip.AddrFrom16(s.As16())
+	}
+	return &TCPStream{
+		w:      w,
+		client: netip.AddrPortFrom(c, client.Port()),
+		server: netip.AddrPortFrom(s, server.Port()),
+		ipv6:   ipv6,
+	}
+}
+
+// Handshake writes the three-way handshake that opens the stream.
+func (s *TCPStream) Handshake(ts time.Time) error {
+	if err := s.segment(ts, true, tcpSYN, nil); err != nil {
+		return err
+	}
+	s.clientSeq++
+	if err := s.segment(ts, false, tcpSYN|tcpACK, nil); err != nil {
+		return err
+	}
+	s.serverSeq++
+	return s.segment(ts, true, tcpACK, nil)
+}
+
+// Write writes payload sent by the client (fromClient) or the server.
+func (s *TCPStream) Write(ts time.Time, fromClient bool, payload []byte) error {
+	for len(payload) > 0 {
+		n := min(len(payload), maxSegment)
+		if err := s.segment(ts, fromClient, tcpPSH|tcpACK, payload[:n]); err != nil {
+			return err
+		}
+		if fromClient {
+			s.clientSeq += uint32(n)
+		} else {
+			s.serverSeq += uint32(n)
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// Close writes a FIN from each side.
+func (s *TCPStream) Close(ts time.Time) error {
+	if err := s.segment(ts, true, tcpFIN|tcpACK, nil); err != nil {
+		return err
+	}
+	s.clientSeq++
+	if err := s.segment(ts, false, tcpFIN|tcpACK, nil); err != nil {
+		return err
+	}
+	s.serverSeq++
+	return s.segment(ts, true, tcpACK, nil)
+}
+
+func (s *TCPStream) segment(ts time.Time, fromClient bool, flags byte, payload []byte) error {
+	src, dst := s.client, s.server
+	seq, ack := s.clientSeq, s.serverSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, tcpHeaderLength, tcpHeaderLength+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = tcpHeaderLength / 4 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	tcp = append(tcp, payload...)
+	binary.BigEndian.PutUint16(tcp[16:], tcpChecksum(src.Addr(), dst.Addr(), tcp))
+
+	var pkt []byte
+	if s.ipv6 {
+		pkt = make([]byte, ipv6HeaderLength, ipv6HeaderLength+len(tcp))
+		pkt[0] = 6 << 4
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(tcp)))
+		pkt[6] = protocolTCP
+		pkt[7] = 64
+		srcIP, dstIP := src.Addr().As16(), dst.Addr().As16()
+		copy(pkt[8:], srcIP[:])
+		copy(pkt[24:], dstIP[:])
+	} else {
+		pkt = make([]byte, ipv4HeaderLength, ipv4HeaderLength+len(tcp))
+		pkt[0] = 4<<4 | ipv4HeaderLength/4
+		binary.BigEndian.PutUint16(pkt[2:], uint16(ipv4HeaderLength+len(tcp)))
+		pkt[6] = 0x40 // don't fragment
+		pkt[8] = 64
+		pkt[9] = protocolTCP
+		srcIP, dstIP := src.Addr().As4(), dst.Addr().As4()
+		copy(pkt[12:], srcIP[:])
+		copy(pkt[16:], dstIP[:])
+		binary.BigEndian.PutUint16(pkt[10:], checksum(0, pkt))
+	}
+	pkt = append(pkt, tcp...)
+
+	return s.w.WritePacket(ts, pkt)
+}
+
+func tcpChecksum(src, dst netip.Addr, segment []byte) uint16 {
+	var pseudo []byte
+	if src.Is4() {
+		pseudo = append(src.AsSlice(), dst.AsSlice()...)
+		pseudo = append(pseudo, 0, protocolTCP)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		pseudo = append(src.AsSlice(), dst.AsSlice()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, protocolTCP)
+	}
+	return checksum(sum(0, pseudo), segment)
+}
+
+// checksum folds the one's complement sum of data onto initial.
+func checksum(initial uint32, data []byte) uint16 {
+	s := sum(initial, data)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+func sum(s uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		s += uint32(data[0]) << 8
+	}
+	return s
+}
@@ -11,6 +11,10 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// ModuleKind marks a module manifest. Manifests signed before it was
+// introduced have no kind.
+const ModuleKind = "module"
+
 type ModuleSigner struct {
 	keyPair *KeyPair
 }
@@ -28,6 +32,7 @@ func (s *ModuleSigner) SignModule(module *gimpelv1.ModuleImage) error {
 		Version:       module.Version,
 		PayloadSha256: module.Digest,
 		Timestamp:     time.Now().Unix(),
+		Kind:          ModuleKind,
 	}
 
 	manifestBytes, err := proto.Marshal(manifest)
@@ -114,6 +119,10 @@ func (v *ModuleVerifier) VerifyModule(module *gimpelv1.ModuleImage) error {
 		return fmt.Errorf("unmarshaling manifest: %w", err)
 	}
 
+	if manifest.Kind != "" && manifest.Kind != ModuleKind {
+		return fmt.Errorf("manifest is not for a module")
+	}
+
 	if manifest.ModuleId != module.Id {
 		return fmt.Errorf("manifest module ID mismatch: expected %s, got %s", module.Id, manifest.ModuleId)
 	}
@@ -0,0 +1,99 @@
+package signing
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	gimpelv1 "gimpel/api/go/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const SandboxImageKind = "sandbox_image"
+
+// sandboxImageDomain prefixes the signed digest of a sandbox image
+// manifest so its signature is never valid for anything else.
+const sandboxImageDomain = "gimpel-sandbox-image\x00"
+
+func sandboxImageDigest(manifest []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(sandboxImageDomain), manifest...))
+}
+
+func (s *ModuleSigner) SignSandboxImage(image *gimpelv1.SandboxImage) error {
+	manifest := &gimpelv1.SandboxImageManifest{
+		Name:          image.Name,
+		Version:       image.Version,
+		PayloadSha256: image.Digest,
+		Timestamp:     time.Now().Unix(),
+		Port:          image.Port,
+		Kind:          SandboxImageKind,
+	}
+
+	manifestBytes, err := proto.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("marshaling manifest: %w", err)
+	}
+
+	hash := sandboxImageDigest(manifestBytes)
+
+	image.Manifest = manifestBytes
+	image.Signature = s.keyPair.Sign(hash[:])
+	image.SignedBy = s.keyPair.KeyID
+	image.SignedAt = manifest.Timestamp
+
+	return nil
+}
+
+// VerifySandboxImage checks an image's signature and that its manifest
+// covers the name, version, digest and port it is offered with.
+func (v *ModuleVerifier) VerifySandboxImage(image *gimpelv1.SandboxImage) error {
+	if image.Signature == nil {
+		return fmt.Errorf("sandbox image is not signed")
+	}
+
+	if image.Manifest == nil {
+		return fmt.Errorf("sandbox image manifest is missing")
+	}
+
+	if image.SignedBy == "" {
+		return fmt.Errorf("sandbox image has no signer key ID")
+	}
+
+	manifest, err := ParseSandboxImageManifest(image.Manifest)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Name != image.Name || manifest.Version != image.Version {
+		return fmt.Errorf("manifest image mismatch: expected %s:%s, got %s:%s", image.Name, image.Version, manifest.Name, manifest.Version)
+	}
+
+	if manifest.PayloadSha256 != image.Digest {
+		return fmt.Errorf("manifest payload hash mismatch: expected %s, got %s", image.Digest, manifest.PayloadSha256)
+	}
+
+	if manifest.Port != image.Port {
+		return fmt.Errorf("manifest port mismatch: expected %d, got %d", image.Port, manifest.Port)
+	}
+
+	hash := sandboxImageDigest(image.Manifest)
+
+	if err := v.verifier.Verify(hash[:], image.Signature, image.SignedBy); err != nil {
+		return fmt.Errorf("sandbox image signature verification failed: %w", err)
+	}
+
+	return nil
+}
+
+// ParseSandboxImageManifest decodes a manifest without verifying it.
+func ParseSandboxImageManifest(data []byte) (*gimpelv1.SandboxImageManifest, error) {
+	var manifest gimpelv1.SandboxImageManifest
+	if err := proto.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("unmarshaling manifest: %w", err)
+	}
+	if manifest.Kind != SandboxImageKind {
+		return nil, fmt.Errorf("manifest is not for a sandbox image")
+	}
+	return &manifest, nil
+}
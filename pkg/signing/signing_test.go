@@ -1,6 +1,7 @@
 package signing
 
 import (
+	"crypto/sha256"
 	"os"
 	"path/filepath"
 	"testing"
@@ -183,6 +184,74 @@ func TestModuleSigning(t *testing.T) {
 	}
 }
 
+func TestSandboxImageSigning(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	signer, _ := NewModuleSigner(kp)
+	verifier := NewModuleVerifier(kp)
+
+	image := &gimpelv1.SandboxImage{
+		Name:    "ubuntu-22-web",
+		Version: "1.0.0",
+		Digest:  "sha256:abc123",
+		Port:    22,
+	}
+	if err := signer.SignSandboxImage(image); err != nil {
+		t.Fatalf("SignSandboxImage failed: %v", err)
+	}
+	if err := verifier.VerifySandboxImage(image); err != nil {
+		t.Errorf("VerifySandboxImage failed: %v", err)
+	}
+
+	image.Port = 2222
+	if err := verifier.VerifySandboxImage(image); err == nil {
+		t.Error("VerifySandboxImage should fail for a changed port")
+	}
+
+	// A signed module is not a signed sandbox image.
+	module := &gimpelv1.ModuleImage{Id: "ubuntu-22-web", Version: "1.0.0", Digest: "sha256:abc123"}
+	signer.SignModule(module)
+	image = &gimpelv1.SandboxImage{
+		Name:      module.Id,
+		Version:   module.Version,
+		Digest:    module.Digest,
+		Manifest:  module.Manifest,
+		Signature: module.Signature,
+		SignedBy:  module.SignedBy,
+	}
+	if err := verifier.VerifySandboxImage(image); err == nil {
+		t.Error("VerifySandboxImage should fail for a module manifest")
+	}
+}
+
+func TestSandboxImageSignatureIsNotModuleSignature(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	signer, _ := NewModuleSigner(kp)
+	verifier := NewModuleVerifier(kp)
+
+	image := &gimpelv1.SandboxImage{Name: "ssh", Version: "1.0.0", Digest: "sha256:abc123", Port: 22}
+	if err := signer.SignSandboxImage(image); err != nil {
+		t.Fatalf("SignSandboxImage failed: %v", err)
+	}
+
+	module := &gimpelv1.ModuleImage{
+		Id:        image.Name,
+		Version:   image.Version,
+		Digest:    image.Digest,
+		Manifest:  image.Manifest,
+		Signature: image.Signature,
+		SignedBy:  image.SignedBy,
+	}
+	if err := verifier.VerifyModule(module); err == nil {
+		t.Error("VerifyModule accepted a sandbox image signature")
+	}
+
+	// The signature does not cover the bare manifest either.
+	hash := sha256.Sum256(image.Manifest)
+	if kp.Verify(hash[:], image.Signature) {
+		t.Error("sandbox image signature is valid without its domain prefix")
+	}
+}
+
 func TestCatalogSigning(t *testing.T) {
 	kp, _ := GenerateKeyPair()
 	signer, _ := NewModuleSigner(kp)
@@ -0,0 +1,259 @@
+// Package tlsfp parses TLS ClientHello messages and computes JA3 and JA4
+// client fingerprints.
+package tlsfp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	recordTypeHandshake   = 0x16
+	handshakeClientHello  = 0x01
+	recordHeaderLength    = 5
+	maxClientHelloRecords = 4
+)
+
+// Extension types used by the fingerprints.
+const (
+	extServerName          uint16 = 0x0000
+	extSupportedGroups     uint16 = 0x000a
+	extECPointFormats      uint16 = 0x000b
+	extSignatureAlgorithms uint16 = 0x000d
+	extALPN                uint16 = 0x0010
+	extSupportedVersions   uint16 = 0x002b
+)
+
+var ErrNotClientHello = errors.New("not a TLS ClientHello")
+
+// ClientHello holds the fields of a ClientHello that fingerprints use, in
+// the order the client sent them.
+type ClientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ALPN                []string
+	ServerName          string
+}
+
+// RecordLength reports how many bytes of data make up the TLS records
+// holding the ClientHello. more is true while data is too short to tell.
+func RecordLength(data []byte) (n int, more bool, err error) {
+	for records := 0; records < maxClientHelloRecords; records++ {
+		if len(data) < n+recordHeaderLength {
+			return 0, true, nil
+		}
+		hdr := data[n:]
+		if hdr[0] != recordTypeHandshake {
+			return 0, false, ErrNotClientHello
+		}
+		n += recordHeaderLength + int(binary.BigEndian.Uint16(hdr[3:5]))
+		if len(data) < n {
+			return 0, true, nil
+		}
+
+		msg, err := handshakeMessage(data[:n])
+		if err != nil {
+			return 0, false, err
+		}
+		if len(msg) >= 4 && len(msg) >= 4+uint24(msg[1:4]) {
+			return n, false, nil
+		}
+	}
+	return 0, false, fmt.Errorf("ClientHello spans more than %d records", maxClientHelloRecords)
+}
+
+// handshakeMessage joins the fragments of consecutive handshake records.
+func handshakeMessage(data []byte) ([]byte, error) {
+	var msg []byte
+	for len(data) > 0 {
+		if len(data) < recordHeaderLength || data[0] != recordTypeHandshake {
+			return nil, ErrNotClientHello
+		}
+		l := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < recordHeaderLength+l {
+			return nil, ErrNotClientHello
+		}
+		msg = append(msg, data[recordHeaderLength:recordHeaderLength+l]...)
+		data = data[recordHeaderLength+l:]
+	}
+	return msg, nil
+}
+
+// ParseClientHello parses the TLS records of a ClientHello as read from the
+// wire.
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	msg, err := handshakeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < 4 || msg[0] != handshakeClientHello {
+		return nil, ErrNotClientHello
+	}
+	body := msg[4:]
+	if len(body) < uint24(msg[1:4]) {
+		return nil, fmt.Errorf("truncated ClientHello")
+	}
+	body = body[:uint24(msg[1:4])]
+
+	r := reader(body)
+	ch := &ClientHello{}
+
+	var ok bool
+	if ch.Version, ok = r.uint16(); !ok {
+		return nil, fmt.Errorf("truncated ClientHello")
+	}
+	if !r.skip(32) {
+		return nil, fmt.Errorf("truncated ClientHello")
+	}
+	if _, ok = r.vector8(); !ok {
+		return nil, fmt.Errorf("truncated session id")
+	}
+
+	suites, ok := r.vector16()
+	if !ok {
+		return nil, fmt.Errorf("truncated cipher suites")
+	}
+	ch.CipherSuites = suites.uint16s()
+
+	if _, ok = r.vector8(); !ok {
+		return nil, fmt.Errorf("truncated compression methods")
+	}
+	if len(r) == 0 {
+		return ch, nil
+	}
+
+	exts, ok := r.vector16()
+	if !ok {
+		return nil, fmt.Errorf("truncated extensions")
+	}
+	for len(exts) > 0 {
+		typ, ok := exts.uint16()
+		if !ok {
+			return nil, fmt.Errorf("truncated extension")
+		}
+		ext, ok := exts.vector16()
+		if !ok {
+			return nil, fmt.Errorf("truncated extension %#04x", typ)
+		}
+		ch.Extensions = append(ch.Extensions, typ)
+		ch.parseExtension(typ, ext)
+	}
+
+	return ch, nil
+}
+
+// parseExtension records the contents of extensions fingerprints look at.
+// Malformed contents are ignored; the extension type is still counted.
+func (ch *ClientHello) parseExtension(typ uint16, ext reader) {
+	switch typ {
+	case extServerName:
+		list, _ := ext.vector16()
+		for len(list) > 0 {
+			nameType, ok := list.uint8()
+			if !ok {
+				return
+			}
+			name, ok := list.vector16()
+			if !ok {
+				return
+			}
+			if nameType == 0 {
+				ch.ServerName = string(name)
+				return
+			}
+		}
+	case extSupportedGroups:
+		groups, _ := ext.vector16()
+		ch.SupportedGroups = groups.uint16s()
+	case extECPointFormats:
+		formats, _ := ext.vector8()
+		ch.ECPointFormats = append([]uint8(nil), formats...)
+	case extSignatureAlgorithms:
+		algs, _ := ext.vector16()
+		ch.SignatureAlgorithms = algs.uint16s()
+	case extSupportedVersions:
+		versions, _ := ext.vector8()
+		ch.SupportedVersions = versions.uint16s()
+	case extALPN:
+		list, _ := ext.vector16()
+		for len(list) > 0 {
+			proto, ok := list.vector8()
+			if !ok {
+				return
+			}
+			ch.ALPN = append(ch.ALPN, string(proto))
+		}
+	}
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func uint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *reader) vector8() (reader, bool) {
+	n, ok := r.uint8()
+	if !ok || len(*r) < int(n) {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *reader) vector16() (reader, bool) {
+	n, ok := r.uint16()
+	if !ok || len(*r) < int(n) {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r reader) uint16s() []uint16 {
+	vals := make([]uint16, 0, len(r)/2)
+	for len(r) >= 2 {
+		vals = append(vals, binary.BigEndian.Uint16(r))
+		r = r[2:]
+	}
+	return vals
+}
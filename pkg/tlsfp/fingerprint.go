@@ -0,0 +1,142 @@
+package tlsfp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// JA3 returns the JA3 string and its MD5 hash. GREASE values are dropped.
+func (ch *ClientHello) JA3() (string, string) {
+	fields := []string{
+		strconv.Itoa(int(ch.Version)),
+		joinDecimal(ch.CipherSuites),
+		joinDecimal(ch.Extensions),
+		joinDecimal(ch.SupportedGroups),
+		joinDecimal(widen(ch.ECPointFormats)),
+	}
+	s := strings.Join(fields, ",")
+	sum := md5.Sum([]byte(s))
+	return s, hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello received over TCP.
+func (ch *ClientHello) JA4() string {
+	ciphers := withoutGREASE(ch.CipherSuites)
+	exts := withoutGREASE(ch.Extensions)
+
+	sni := "i"
+	if ch.ServerName != "" {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ch.ja4Version(), sni, min(len(ciphers), 99), min(len(exts), 99), ch.ja4ALPN())
+
+	slices.Sort(ciphers)
+	b := truncatedHash(joinHex(ciphers))
+
+	// The server name and ALPN extensions are left out of the hash since
+	// they vary by destination rather than by client.
+	var hashed []uint16
+	for _, e := range exts {
+		if e != extServerName && e != extALPN {
+			hashed = append(hashed, e)
+		}
+	}
+	slices.Sort(hashed)
+	c := joinHex(hashed)
+	if algs := joinHex(withoutGREASE(ch.SignatureAlgorithms)); algs != "" {
+		c += "_" + algs
+	}
+	if len(hashed) == 0 {
+		c = ""
+	}
+
+	return a + "_" + b + "_" + truncatedHash(c)
+}
+
+func (ch *ClientHello) ja4Version() string {
+	// supported_versions, when present, supersedes the legacy field.
+	version := ch.Version
+	if versions := withoutGREASE(ch.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+func (ch *ClientHello) ja4ALPN() string {
+	if len(ch.ALPN) == 0 || ch.ALPN[0] == "" {
+		return "00"
+	}
+	proto := ch.ALPN[0]
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(proto))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func withoutGREASE(vals []uint16) []uint16 {
+	out := make([]uint16, 0, len(vals))
+	for _, v := range vals {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func widen(vals []uint8) []uint16 {
+	out := make([]uint16, len(vals))
+	for i, v := range vals {
+		out[i] = uint16(v)
+	}
+	return out
+}
+
+func joinDecimal(vals []uint16) string {
+	parts := make([]string, 0, len(vals))
+	for _, v := range withoutGREASE(vals) {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(vals []uint16) string {
+	parts := make([]string, len(vals))
+	for i, v := range vals {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,111 @@
+package tlsfp
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// captureClientHello returns the records of the ClientHello sent by a
+// crypto/tls client.
+func captureClientHello(t *testing.T, cfg *tls.Config) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+
+	var data []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := server.Read(buf)
+		data = append(data, buf[:n]...)
+		if length, more, lenErr := RecordLength(data); lenErr != nil {
+			t.Fatal(lenErr)
+		} else if !more {
+			return data[:length]
+		}
+		if err == io.EOF {
+			t.Fatal("client closed before sending a ClientHello")
+		}
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	data := captureClientHello(t, &tls.Config{
+		ServerName: "www.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+
+	hello, err := ParseClientHello(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "www.example.com" {
+		t.Errorf("ServerName = %q", hello.ServerName)
+	}
+	if len(hello.ALPN) != 2 || hello.ALPN[0] != "h2" {
+		t.Errorf("ALPN = %q", hello.ALPN)
+	}
+	if len(hello.CipherSuites) == 0 || len(hello.SupportedGroups) == 0 || len(hello.SignatureAlgorithms) == 0 {
+		t.Errorf("missing fields: %+v", hello)
+	}
+
+	ja4 := hello.JA4()
+	if !regexp.MustCompile(`^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`).MatchString(ja4) {
+		t.Errorf("JA4 = %q", ja4)
+	}
+
+	ja3, hash := hello.JA3()
+	if fields := strings.Split(ja3, ","); len(fields) != 5 || fields[0] != "771" {
+		t.Errorf("JA3 = %q", ja3)
+	}
+	if len(hash) != 32 {
+		t.Errorf("JA3 hash = %q", hash)
+	}
+}
+
+func TestFingerprintsIgnoreGREASE(t *testing.T) {
+	base := &ClientHello{
+		Version:           0x0303,
+		CipherSuites:      []uint16{0x1301, 0x1302},
+		Extensions:        []uint16{0x0000, 0x000a, 0x002b},
+		SupportedGroups:   []uint16{0x001d},
+		SupportedVersions: []uint16{0x0304, 0x0303},
+		ServerName:        "a",
+	}
+	greased := *base
+	greased.CipherSuites = []uint16{0x1a1a, 0x1301, 0x1302}
+	greased.Extensions = []uint16{0x2a2a, 0x0000, 0x000a, 0x002b}
+	greased.SupportedGroups = []uint16{0xfafa, 0x001d}
+	greased.SupportedVersions = []uint16{0x3a3a, 0x0304, 0x0303}
+
+	ja3, _ := base.JA3()
+	if got, _ := greased.JA3(); got != ja3 {
+		t.Errorf("JA3 with GREASE = %q, want %q", got, ja3)
+	}
+	if ja3 != "771,4865-4866,0-10-43,29," {
+		t.Errorf("JA3 = %q", ja3)
+	}
+	if got, want := greased.JA4(), base.JA4(); got != want {
+		t.Errorf("JA4 with GREASE = %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(base.JA4(), "t13d020300_") {
+		t.Errorf("JA4 = %q", base.JA4())
+	}
+}
+
+func TestRecordLengthRejectsPlaintext(t *testing.T) {
+	if _, _, err := RecordLength([]byte("GET / HTTP/1.1\r\n")); err != ErrNotClientHello {
+		t.Errorf("RecordLength(http) error = %v", err)
+	}
+	if _, more, err := RecordLength([]byte{0x16, 0x03, 0x01}); !more || err != nil {
+		t.Errorf("RecordLength(partial) = %v, %v", more, err)
+	}
+}
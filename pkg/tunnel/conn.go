@@ -0,0 +1,231 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	frameData     byte = 0
+	frameMetadata byte = 1
+	frameResize   byte = 2
+	frameClose    byte = 3
+
+	maxFramePayload = 64 * 1024
+	frameHeaderSize = 4
+	closeTimeout    = time.Second
+)
+
+// Metadata describes the attacker connection carried by a tunnel.
+type Metadata struct {
+	SessionID  string            `json:"session_id"`
+	ListenerID string            `json:"listener_id,omitempty"`
+	SourceIP   string            `json:"source_ip"`
+	SourcePort uint32            `json:"source_port"`
+	DestIP     string            `json:"dest_ip,omitempty"`
+	DestPort   uint32            `json:"dest_port,omitempty"`
+	Protocol   string            `json:"protocol,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// Terminal is set when the stream is a terminal session in the clear,
+	// relayed by a module that terminated the attacker's protocol, rather
+	// than the attacker's raw bytes.
+	Terminal bool `json:"terminal,omitempty"`
+	// Transcript is set when the stream is a copy of a terminal session
+	// relayed to the sandbox some other way, encoded with WriteTranscript.
+	// The sandbox records it and does not pass it to the environment.
+	Transcript bool `json:"transcript,omitempty"`
+}
+
+// WindowSize is a terminal size carried by a resize message.
+type WindowSize struct {
+	Cols uint16
+	Rows uint16
+}
+
+// Conn is an established tunnel. Reads and writes carry the attacker's
+// byte stream; resize and close travel as control messages alongside it.
+type Conn struct {
+	net.Conn
+
+	send, recv       cipher.AEAD
+	sendSeq, recvSeq uint64
+
+	writeMu sync.Mutex
+
+	readMu   sync.Mutex
+	pending  []byte
+	readErr  error
+	onResize func(WindowSize)
+
+	meta      *Metadata
+	closeOnce sync.Once
+}
+
+func newConn(raw net.Conn, key, clientNonce, serverNonce []byte, isClient bool) (*Conn, error) {
+	c2s, s2c, err := directionKeys(key, clientNonce, serverNonce)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{Conn: raw, send: c2s, recv: s2c}
+	if !isClient {
+		c.send, c.recv = s2c, c2s
+	}
+	return c, nil
+}
+
+// Metadata returns what the agent sent about the connection.
+func (c *Conn) Metadata() *Metadata {
+	return c.meta
+}
+
+// OnResize sets the function called, from Read, for each resize message.
+func (c *Conn) OnResize(fn func(WindowSize)) {
+	c.readMu.Lock()
+	c.onResize = fn
+	c.readMu.Unlock()
+}
+
+// Resize tells the peer the terminal size changed.
+func (c *Conn) Resize(size WindowSize) error {
+	var body [4]byte
+	binary.BigEndian.PutUint16(body[0:], size.Cols)
+	binary.BigEndian.PutUint16(body[2:], size.Rows)
+	return c.writeFrame(frameResize, body[:])
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		typ, body, err := c.readFrame()
+		if err != nil {
+			c.readErr = err
+			continue
+		}
+		switch typ {
+		case frameData:
+			c.pending = body
+		case frameResize:
+			if len(body) == 4 && c.onResize != nil {
+				c.onResize(WindowSize{
+					Cols: binary.BigEndian.Uint16(body[0:]),
+					Rows: binary.BigEndian.Uint16(body[2:]),
+				})
+			}
+		case frameClose:
+			c.readErr = io.EOF
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), maxFramePayload)
+		if err := c.writeFrame(frameData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close sends a close message and closes the underlying connection.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.writeFrame(frameClose, nil)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *Conn) writeMetadata(meta *Metadata) error {
+	if meta == nil {
+		meta = &Metadata{}
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshaling metadata: %w", err)
+	}
+	return c.writeFrame(frameMetadata, data)
+}
+
+func (c *Conn) readMetadata() (*Metadata, error) {
+	typ, body, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if typ != frameMetadata {
+		return nil, fmt.Errorf("%w: expected metadata", ErrBadHandshake)
+	}
+	var meta Metadata
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return nil, fmt.Errorf("parsing metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// Frames are a 4-byte length followed by the sealed type byte and body.
+// The length is authenticated as additional data.
+func (c *Conn) writeFrame(typ byte, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	plain := make([]byte, 0, 1+len(body))
+	plain = append(plain, typ)
+	plain = append(plain, body...)
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(plain)+c.send.Overhead())
+	binary.BigEndian.PutUint32(frame, uint32(len(plain)+c.send.Overhead()))
+	frame = c.send.Seal(frame, sequenceNonce(c.send, c.sendSeq), plain, frame[:frameHeaderSize])
+	c.sendSeq++
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *Conn) readFrame() (byte, []byte, error) {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < uint32(1+c.recv.Overhead()) || n > uint32(1+maxFramePayload+c.recv.Overhead()) {
+		return 0, nil, fmt.Errorf("invalid tunnel frame length %d", n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return 0, nil, err
+	}
+	plain, err := c.recv.Open(sealed[:0], sequenceNonce(c.recv, c.recvSeq), sealed, hdr[:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("decrypting tunnel frame: %w", err)
+	}
+	c.recvSeq++
+	return plain[0], plain[1:], nil
+}
+
+// sequenceNonce makes the nonce for the seq-th frame in one direction;
+// each direction has its own key, so counters never collide.
+func sequenceNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
@@ -0,0 +1,178 @@
+// Package tunnel carries a relayed connection between an agent and a
+// sandbox over a mutually authenticated, encrypted channel keyed by the
+// per-session tunnel key.
+//
+// The agent opens with its session ID, a random nonce and an HMAC of both
+// under the session key; the sandbox answers with its own nonce and an HMAC
+// over both nonces. Each direction is then encrypted with AES-256-GCM under
+// a key derived with HKDF from the session key and the two nonces, so every
+// connection has fresh keys and a captured handshake cannot be replayed.
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	protocolVersion  = 1
+	nonceSize        = 32
+	keySize          = 32
+	maxSessionIDSize = 255
+	handshakeTimeout = 10 * time.Second
+)
+
+var magic = []byte("GTUN")
+
+var (
+	ErrBadKey       = errors.New("tunnel authentication failed")
+	ErrUnknownPeer  = errors.New("unknown tunnel session")
+	ErrBadHandshake = errors.New("malformed tunnel handshake")
+)
+
+// KeyLookup returns the tunnel key of a session.
+type KeyLookup func(sessionID string) ([]byte, bool)
+
+// Client runs the agent side of the handshake over conn and sends meta as
+// the first message.
+func Client(conn net.Conn, sessionID string, key []byte, meta *Metadata) (*Conn, error) {
+	if len(sessionID) > maxSessionIDSize {
+		return nil, fmt.Errorf("session ID longer than %d bytes", maxSessionIDSize)
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	clientNonce := make([]byte, nonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	hello := make([]byte, 0, len(magic)+2+len(sessionID)+nonceSize+sha256.Size)
+	hello = append(hello, magic...)
+	hello = append(hello, protocolVersion, byte(len(sessionID)))
+	hello = append(hello, sessionID...)
+	hello = append(hello, clientNonce...)
+	hello = append(hello, mac(key, "client", []byte(sessionID), clientNonce)...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, fmt.Errorf("sending hello: %w", err)
+	}
+
+	reply := make([]byte, nonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		// The sandbox hangs up on a wrong key.
+		return nil, fmt.Errorf("%w: %v", ErrBadKey, err)
+	}
+	serverNonce, proof := reply[:nonceSize], reply[nonceSize:]
+	if !hmac.Equal(proof, mac(key, "server", []byte(sessionID), clientNonce, serverNonce)) {
+		return nil, ErrBadKey
+	}
+
+	c, err := newConn(conn, key, clientNonce, serverNonce, true)
+	if err != nil {
+		return nil, err
+	}
+	c.meta = meta
+	if err := c.writeMetadata(meta); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Server runs the sandbox side of the handshake, rejecting clients that do
+// not prove knowledge of the session key, and reads the client's metadata.
+func Server(conn net.Conn, lookup KeyLookup) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hdr := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, fmt.Errorf("reading hello: %w", err)
+	}
+	if string(hdr[:len(magic)]) != string(magic) || hdr[len(magic)] != protocolVersion {
+		return nil, ErrBadHandshake
+	}
+
+	rest := make([]byte, int(hdr[len(magic)+1])+nonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return nil, fmt.Errorf("reading hello: %w", err)
+	}
+	idLen := int(hdr[len(magic)+1])
+	sessionID := rest[:idLen]
+	clientNonce := rest[idLen : idLen+nonceSize]
+	proof := rest[idLen+nonceSize:]
+
+	key, ok := lookup(string(sessionID))
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+	if !hmac.Equal(proof, mac(key, "client", sessionID, clientNonce)) {
+		return nil, ErrBadKey
+	}
+
+	serverNonce := make([]byte, nonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	reply := append(serverNonce, mac(key, "server", sessionID, clientNonce, serverNonce)...)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, fmt.Errorf("sending reply: %w", err)
+	}
+
+	c, err := newConn(conn, key, clientNonce, serverNonce, false)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := c.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	meta.SessionID = string(sessionID)
+	c.meta = meta
+	return c, nil
+}
+
+func mac(key []byte, label string, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	for _, p := range parts {
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(p)))
+		h.Write(l[:])
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// directionKeys derives the client-to-server and server-to-client AEADs.
+func directionKeys(key, clientNonce, serverNonce []byte) (c2s, s2c cipher.AEAD, err error) {
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	if c2s, err = deriveAEAD(key, salt, "gimpel tunnel c2s"); err != nil {
+		return nil, nil, err
+	}
+	if s2c, err = deriveAEAD(key, salt, "gimpel tunnel s2c"); err != nil {
+		return nil, nil, err
+	}
+	return c2s, s2c, nil
+}
+
+func deriveAEAD(key, salt []byte, info string) (cipher.AEAD, error) {
+	k, err := hkdf.Key(sha256.New, key, salt, info, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key: %w", err)
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
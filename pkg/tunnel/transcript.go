@@ -0,0 +1,53 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Transcript record kinds.
+const (
+	TranscriptInput  byte = 'i'
+	TranscriptOutput byte = 'o'
+)
+
+const maxTranscriptRecord = 1 << 20
+
+// WriteTranscript writes one transcript record: the kind, a 4-byte length
+// and data.
+func WriteTranscript(w io.Writer, kind byte, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), maxTranscriptRecord)
+		rec := make([]byte, 5, 5+n)
+		rec[0] = kind
+		binary.BigEndian.PutUint32(rec[1:], uint32(n))
+		if _, err := w.Write(append(rec, data[:n]...)); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// ReadTranscript reads a record written by WriteTranscript.
+func ReadTranscript(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	switch hdr[0] {
+	case TranscriptInput, TranscriptOutput:
+	default:
+		return 0, nil, fmt.Errorf("unknown transcript record kind %q", hdr[0])
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxTranscriptRecord {
+		return 0, nil, fmt.Errorf("transcript record of %d bytes is too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], data, nil
+}
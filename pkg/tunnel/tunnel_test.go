@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func pair(t *testing.T, clientKey, serverKey []byte) (*Conn, *Conn, error, error) {
+	t.Helper()
+	a, b := net.Pipe()
+	lookup := func(id string) ([]byte, bool) { return serverKey, id == "hi-1" }
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	srv := make(chan result, 1)
+	go func() {
+		c, err := Server(b, lookup)
+		if err != nil {
+			b.Close()
+		}
+		srv <- result{c, err}
+	}()
+
+	client, clientErr := Client(a, "hi-1", clientKey, &Metadata{SourceIP: "198.51.100.7", SourcePort: 40000})
+	if clientErr != nil {
+		a.Close()
+	}
+	r := <-srv
+	return client, r.conn, clientErr, r.err
+}
+
+func TestTunnel(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	client, server, err1, err2 := pair(t, key, key)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("handshake: client %v, server %v", err1, err2)
+	}
+	if m := server.Metadata(); m.SessionID != "hi-1" || m.SourceIP != "198.51.100.7" || m.SourcePort != 40000 {
+		t.Errorf("metadata %+v", m)
+	}
+
+	var sizes []WindowSize
+	server.OnResize(func(s WindowSize) { sizes = append(sizes, s) })
+
+	payload := bytes.Repeat([]byte("x"), maxFramePayload+10)
+	go func() {
+		client.Resize(WindowSize{Cols: 120, Rows: 40})
+		client.Write(payload)
+		client.Close()
+	}()
+
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("read %d bytes, want %d", len(got), len(payload))
+	}
+	if len(sizes) != 1 || sizes[0] != (WindowSize{Cols: 120, Rows: 40}) {
+		t.Errorf("resizes %v", sizes)
+	}
+}
+
+func TestTunnelRejectsWrongKey(t *testing.T) {
+	_, _, clientErr, serverErr := pair(t, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32))
+	if !errors.Is(serverErr, ErrBadKey) {
+		t.Errorf("server error %v, want ErrBadKey", serverErr)
+	}
+	if !errors.Is(clientErr, ErrBadKey) {
+		t.Errorf("client error %v, want ErrBadKey", clientErr)
+	}
+}
@@ -0,0 +1,204 @@
+package gimpelsdk
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gimpel/pkg/tunnel"
+)
+
+// ErrEscalationUnavailable is returned when the agent did not give the
+// module an agent socket, e.g. in standalone mode.
+var ErrEscalationUnavailable = errors.New("escalation unavailable")
+
+type agentRequest struct {
+	Op           string `json:"op"`
+	ConnectionID string `json:"connection_id"`
+	Cols         uint16 `json:"cols,omitempty"`
+	Rows         uint16 `json:"rows,omitempty"`
+	Terminal     bool   `json:"terminal,omitempty"`
+}
+
+type agentResponse struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// SandboxConn is a byte stream into the HI session a connection was
+// escalated to.
+type SandboxConn struct {
+	net.Conn
+	SessionID string
+
+	connID string
+}
+
+// OpenSandbox asks the agent to escalate the connection described by info
+// to a high-interaction session. The listener must have escalation enabled.
+// The module stays in charge of the attacker's connection and relays what
+// it wants into the returned stream.
+func OpenSandbox(ctx context.Context, info *ConnectionInfo) (*SandboxConn, error) {
+	return openSandbox(ctx, info, false)
+}
+
+// OpenTerminal is OpenSandbox for modules that terminate the attacker's
+// protocol and relay the decrypted terminal session, such as a shell on a
+// pty, into the stream. Only such streams are recorded by the sandbox.
+func OpenTerminal(ctx context.Context, info *ConnectionInfo) (*SandboxConn, error) {
+	return openSandbox(ctx, info, true)
+}
+
+func openSandbox(ctx context.Context, info *ConnectionInfo, terminal bool) (*SandboxConn, error) {
+	conn, resp, err := agentCall(ctx, &agentRequest{Op: "escalate", ConnectionID: info.ConnectionID, Terminal: terminal})
+	if err != nil {
+		return nil, err
+	}
+	return &SandboxConn{Conn: conn, SessionID: resp.SessionID, connID: info.ConnectionID}, nil
+}
+
+// Transcript is a copy of a terminal session a module relays to the
+// sandbox in a form the sandbox cannot read, such as SSH it forwards to the
+// sandbox's sshd. The sandbox records it like a terminal stream.
+type Transcript struct {
+	conn net.Conn
+
+	mu  sync.Mutex
+	err error
+}
+
+// OpenTranscript opens a transcript for a connection already escalated with
+// OpenSandbox. Terminal size changes sent with SandboxConn.Resize are
+// recorded in it too.
+func OpenTranscript(ctx context.Context, info *ConnectionInfo) (*Transcript, error) {
+	conn, _, err := agentCall(ctx, &agentRequest{Op: "record", ConnectionID: info.ConnectionID})
+	if err != nil {
+		return nil, err
+	}
+	return &Transcript{conn: conn}, nil
+}
+
+// Input and Output return writers for what the attacker typed and what the
+// session printed. Their writes never fail, so they can be teed into the
+// relayed streams; a transcript that breaks stops recording.
+func (t *Transcript) Input() io.Writer  { return transcriptStream{t, tunnel.TranscriptInput} }
+func (t *Transcript) Output() io.Writer { return transcriptStream{t, tunnel.TranscriptOutput} }
+
+type transcriptStream struct {
+	t    *Transcript
+	kind byte
+}
+
+func (s transcriptStream) Write(p []byte) (int, error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	if s.t.err == nil {
+		s.t.err = tunnel.WriteTranscript(s.t.conn, s.kind, p)
+	}
+	return len(p), nil
+}
+
+// Close ends the recording.
+func (t *Transcript) Close() error {
+	return t.conn.Close()
+}
+
+// Resize tells the sandbox the attacker's terminal size changed.
+func (c *SandboxConn) Resize(cols, rows uint16) error {
+	conn, _, err := agentCall(context.Background(), &agentRequest{
+		Op:           "resize",
+		ConnectionID: c.connID,
+		Cols:         cols,
+		Rows:         rows,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Escalate hands conn over to a high-interaction session and relays it
+// unchanged until either side closes. It is for modules that have not yet
+// spoken on conn or whose protocol the sandbox continues as is.
+func Escalate(ctx context.Context, conn net.Conn, info *ConnectionInfo) error {
+	sandbox, err := OpenSandbox(ctx, info)
+	if err != nil {
+		return err
+	}
+	defer sandbox.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(sandbox, conn)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, sandbox)
+		errCh <- err
+	}()
+
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+func agentCall(ctx context.Context, req *agentRequest) (net.Conn, *agentResponse, error) {
+	path := os.Getenv("GIMPEL_AGENT_SOCKET")
+	if path == "" {
+		return nil, nil, ErrEscalationUnavailable
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to agent socket: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+	if _, err := conn.Write(append(frame, data...)); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("sending agent request: %w", err)
+	}
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("reading agent response: %w", err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("reading agent response: %w", err)
+	}
+	var resp agentResponse
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("decoding agent response: %w", err)
+	}
+	if !resp.OK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("agent refused %s: %s", req.Op, resp.Error)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, &resp, nil
+}
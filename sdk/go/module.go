@@ -21,6 +21,10 @@ type ConnectionInfo struct {
 	DestPort     uint32
 	Protocol     string
 	Timestamp    int64
+
+	// Metadata carries agent annotations such as "detected_protocol" from
+	// protocol sniffing.
+	Metadata map[string]string
 }
 
 type ModuleContext struct {
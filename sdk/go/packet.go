@@ -0,0 +1,79 @@
+package gimpelsdk
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+const maxDatagramSize = 65535
+
+// PacketModule is implemented by modules that serve datagram (UDP)
+// listeners. The agent groups datagrams by 5-tuple into flows and closes a
+// flow after it has been idle; each flow is handed to HandlePacketFlow.
+type PacketModule interface {
+	Module
+	HandlePacketFlow(ctx context.Context, flow *PacketFlow, info *ConnectionInfo) error
+}
+
+// PacketFlow exchanges the datagrams of one flow with the agent. Message
+// boundaries are preserved: ReadPacket returns exactly one datagram sent by
+// the peer and WritePacket sends exactly one datagram back.
+type PacketFlow struct {
+	conn net.Conn
+
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+	buf     []byte
+}
+
+func newPacketFlow(conn net.Conn) *PacketFlow {
+	return &PacketFlow{conn: conn, buf: make([]byte, maxDatagramSize)}
+}
+
+// ReadPacket returns the next datagram from the peer. The returned slice is
+// only valid until the next call. It returns io.EOF once the agent has
+// closed the flow.
+func (f *PacketFlow) ReadPacket() ([]byte, error) {
+	f.readMu.Lock()
+	defer f.readMu.Unlock()
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(f.conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(f.conn, f.buf[:n]); err != nil {
+		return nil, err
+	}
+	return f.buf[:n], nil
+}
+
+// WritePacket sends one datagram to the peer.
+func (f *PacketFlow) WritePacket(data []byte) error {
+	if len(data) > maxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes exceeds %d", len(data), maxDatagramSize)
+	}
+
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	_, err := f.conn.Write(buf)
+	return err
+}
+
+// Close ends the flow. Later datagrams from the same peer start a new flow.
+func (f *PacketFlow) Close() error {
+	return f.conn.Close()
+}
+
+func isPacketProtocol(protocol string) bool {
+	return strings.HasPrefix(protocol, "udp")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -159,13 +160,13 @@ func (s *Server) handleDataConnection(conn net.Conn) {
 	defer conn.Close()
 
 	lenBuf := make([]byte, 2)
-	if _, err := conn.Read(lenBuf); err != nil {
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
 		return
 	}
 	handshakeLen := int(lenBuf[0])<<8 | int(lenBuf[1])
 
 	handshakeData := make([]byte, handshakeLen)
-	if _, err := conn.Read(handshakeData); err != nil {
+	if _, err := io.ReadFull(conn, handshakeData); err != nil {
 		return
 	}
 
@@ -192,6 +193,17 @@ func (s *Server) handleDataConnection(conn net.Conn) {
 		DestPort:     handshake.DestPort,
 		Protocol:     handshake.Protocol,
 		Timestamp:    handshake.Timestamp,
+		Metadata:     handshake.Metadata,
+	}
+
+	if isPacketProtocol(info.Protocol) {
+		pm, ok := s.module.(PacketModule)
+		if !ok {
+			log.Printf("module does not handle datagram flows, dropping %s", info.ConnectionID)
+			return
+		}
+		pm.HandlePacketFlow(context.Background(), newPacketFlow(conn), info)
+		return
 	}
 
 	s.module.HandleConnection(context.Background(), conn, info)
@@ -212,13 +224,13 @@ func (s *Server) handleFDPassConnection(conn *net.UnixConn) {
 	defer conn.Close()
 
 	lenBuf := make([]byte, 2)
-	if _, err := conn.Read(lenBuf); err != nil {
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
 		return
 	}
 	handshakeLen := int(lenBuf[0])<<8 | int(lenBuf[1])
 
 	handshakeData := make([]byte, handshakeLen)
-	if _, err := conn.Read(handshakeData); err != nil {
+	if _, err := io.ReadFull(conn, handshakeData); err != nil {
 		return
 	}
 
@@ -258,6 +270,7 @@ func (s *Server) handleFDPassConnection(conn *net.UnixConn) {
 		DestPort:     handshake.DestPort,
 		Protocol:     handshake.Protocol,
 		Timestamp:    handshake.Timestamp,
+		Metadata:     handshake.Metadata,
 	}
 
 	go func() {
@@ -0,0 +1,120 @@
+//go:build wasip1
+
+package gimpelwasm
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"unsafe"
+)
+
+//go:wasmimport gimpel conn_read
+func connRead(ptr unsafe.Pointer, size uint32) int32
+
+//go:wasmimport gimpel conn_write
+func connWrite(ptr unsafe.Pointer, size uint32) int32
+
+//go:wasmimport gimpel conn_close
+func connClose()
+
+//go:wasmimport gimpel conn_info
+func connInfo(ptr unsafe.Pointer, size uint32) int32
+
+//go:wasmimport gimpel emit_event
+func emitEvent(eventType uint32, labelsPtr unsafe.Pointer, labelsLen uint32, payloadPtr unsafe.Pointer, payloadLen uint32) int32
+
+//go:wasmimport gimpel log
+func hostLog(level uint32, ptr unsafe.Pointer, size uint32)
+
+var ErrConnection = errors.New("connection error")
+
+// Conn is the connection this module instance was started for.
+type Conn struct{}
+
+func Connection() *Conn {
+	return &Conn{}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n := connRead(unsafe.Pointer(&p[0]), uint32(len(p)))
+	switch {
+	case n > 0:
+		return int(n), nil
+	case n == 0:
+		return 0, io.EOF
+	default:
+		return 0, ErrConnection
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		n := connWrite(unsafe.Pointer(&chunk[0]), uint32(len(chunk)))
+		if n < 0 {
+			return written, ErrConnection
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+func (c *Conn) Close() error {
+	connClose()
+	return nil
+}
+
+func (c *Conn) Info() (*ConnectionInfo, error) {
+	buf := make([]byte, 512)
+	for {
+		n := connInfo(unsafe.Pointer(&buf[0]), uint32(len(buf)))
+		if n < 0 {
+			return nil, ErrConnection
+		}
+		if int(n) <= len(buf) {
+			var info ConnectionInfo
+			if err := json.Unmarshal(buf[:n], &info); err != nil {
+				return nil, err
+			}
+			return &info, nil
+		}
+		buf = make([]byte, n)
+	}
+}
+
+func Emit(eventType EventType, labels map[string]string, payload []byte) error {
+	var labelsJSON []byte
+	if len(labels) > 0 {
+		var err error
+		if labelsJSON, err = json.Marshal(labels); err != nil {
+			return err
+		}
+	}
+
+	if emitEvent(uint32(eventType), bytesPtr(labelsJSON), uint32(len(labelsJSON)), bytesPtr(payload), uint32(len(payload))) < 0 {
+		return errors.New("emitting event failed")
+	}
+	return nil
+}
+
+func Debug(msg string) { logMessage(0, msg) }
+func Info(msg string)  { logMessage(1, msg) }
+func Warn(msg string)  { logMessage(2, msg) }
+func Error(msg string) { logMessage(3, msg) }
+
+func logMessage(level uint32, msg string) {
+	b := []byte(msg)
+	hostLog(level, bytesPtr(b), uint32(len(b)))
+}
+
+func bytesPtr(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&b[0])
+}
@@ -0,0 +1,30 @@
+// Package gimpelwasm is the guest side of the agent's wasm execution mode.
+// Build modules with GOOS=wasip1 GOARCH=wasm; each instance handles exactly
+// one connection, obtained with Connection, and returns from main when done.
+package gimpelwasm
+
+type EventType uint32
+
+// Event types match gimpel.v1.EventType.
+const (
+	EventTypeConnectionOpen  EventType = 1
+	EventTypeConnectionClose EventType = 2
+	EventTypeDataReceived    EventType = 3
+	EventTypeDataSent        EventType = 4
+	EventTypeAuthAttempt     EventType = 5
+	EventTypeCommand         EventType = 6
+	EventTypeFileAccess      EventType = 7
+	EventTypeMalwareDetected EventType = 8
+	EventTypeCustom          EventType = 100
+)
+
+type ConnectionInfo struct {
+	ConnectionID string            `json:"connection_id"`
+	ListenerID   string            `json:"listener_id"`
+	SourceIP     string            `json:"source_ip"`
+	SourcePort   uint32            `json:"source_port"`
+	DestIP       string            `json:"dest_ip"`
+	DestPort     uint32            `json:"dest_port"`
+	Protocol     string            `json:"protocol"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}